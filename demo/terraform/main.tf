@@ -111,10 +111,26 @@ resource "kubernetes_manifest" "audispd-plugins" {
   depends_on = [ azurerm_kubernetes_cluster.this ]
 }
 
+# Deploy the aks-auditd ServiceAccount and its read-only access to the ConfigMaps above
+resource "kubernetes_manifest" "aks-auditd-serviceaccount" {
+  manifest = yamldecode(file("../../kubernetes/rbac/serviceaccount.yaml"))
+  depends_on = [ azurerm_kubernetes_cluster.this ]
+}
+
+resource "kubernetes_manifest" "aks-auditd-role" {
+  manifest = yamldecode(file("../../kubernetes/rbac/role.yaml"))
+  depends_on = [ azurerm_kubernetes_cluster.this ]
+}
+
+resource "kubernetes_manifest" "aks-auditd-rolebinding" {
+  manifest = yamldecode(file("../../kubernetes/rbac/rolebinding.yaml"))
+  depends_on = [ kubernetes_manifest.aks-auditd-role, kubernetes_manifest.aks-auditd-serviceaccount ]
+}
+
 # Deploy the DaemonSet to the AKS cluster
 resource "kubernetes_manifest" "aks-auditd-daemonset" {
   manifest = yamldecode(file("../../kubernetes/daemonset.yaml"))
-  depends_on = [ azurerm_kubernetes_cluster.this ]
+  depends_on = [ azurerm_kubernetes_cluster.this, kubernetes_manifest.aks-auditd-serviceaccount ]
 }
 
 # Deploy the Container Insights ConfigMap to gather kube-system:aks-auditd logs from the AKS cluster
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// The init container runs privileged and writes into the host file system. A symlink planted on the node, such as
+// /etc/audit/plugins.d -> /root/.ssh, must not redirect those writes. Every host write resolves its path beneath a root
+// directory with openat2 and RESOLVE_BENEATH|RESOLVE_NO_SYMLINKS, or with an O_NOFOLLOW walk where openat2 is missing
+// or blocked, and refuses any path that leaves the root or passes through a symlink.
+
+// openat2 is the openat2 system call. Tests replace it to exercise the fallback for when it is missing or blocked.
+var openat2 = unix.Openat2
+
+// errEscape is returned when a path leaves its root directory or passes through a symlink.
+var errEscape = errors.New("path escapes the root directory")
+
+// reportEscape logs a refused file operation as a security event.
+func reportEscape(operation, path string, reason error) {
+	log.WithFields(log.Fields{
+		"securityEvent": "pathEscape",
+		"operation":     operation,
+		"path":          path,
+	}).Errorf("Refused a host file operation that escapes %s. Check the node for a planted symlink. Error: %v", chrootMount, reason)
+}
+
+// openBeneath opens path, which must be in root, with the given flags without leaving root or following a symlink.
+func openBeneath(root, operation, path string, flags int, mode uint32) (*os.File, error) {
+	rel, err := filepath.Rel(root, filepath.Clean(path))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		reportEscape(operation, path, fmt.Errorf("not in %s", root))
+		return nil, fmt.Errorf("%s %s: %w", operation, path, errEscape)
+	}
+
+	rootFd, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: operation, Path: root, Err: err}
+	}
+	defer unix.Close(rootFd)
+
+	fd, err := openat2(rootFd, rel, &unix.OpenHow{
+		Flags:   uint64(flags | unix.O_CLOEXEC),
+		Mode:    uint64(mode),
+		Resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_SYMLINKS | unix.RESOLVE_NO_MAGICLINKS,
+	})
+	// Kernels before 5.6 lack openat2, and container runtimes with an older seccomp profile block it with EPERM
+	if errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EPERM) {
+		fd, err = walkBeneath(rootFd, rel, flags, mode)
+	}
+	if errors.Is(err, unix.EXDEV) || errors.Is(err, unix.ELOOP) {
+		reportEscape(operation, path, err)
+		return nil, fmt.Errorf("%s %s: %w", operation, path, errEscape)
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: operation, Path: path, Err: err}
+	}
+
+	return os.NewFile(uintptr(fd), path), nil
+}
+
+// walkBeneath opens rel beneath the directory rootFd one component at a time with O_NOFOLLOW, for when openat2 is
+// missing or blocked. rel is clean and relative, so it has no .. components.
+func walkBeneath(rootFd int, rel string, flags int, mode uint32) (int, error) {
+	fd, err := unix.Dup(rootFd)
+	if err != nil {
+		return -1, err
+	}
+	if rel == "." {
+		defer unix.Close(fd)
+		return unix.Openat(fd, ".", flags|unix.O_CLOEXEC, mode)
+	}
+
+	components := strings.Split(rel, "/")
+	for _, component := range components[:len(components)-1] {
+		next, err := unix.Openat(fd, component, unix.O_PATH|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		unix.Close(fd)
+		if errors.Is(err, unix.ENOTDIR) {
+			err = unix.ELOOP // A symlink opened with O_NOFOLLOW|O_DIRECTORY fails with ENOTDIR
+		}
+		if err != nil {
+			return -1, err
+		}
+		fd = next
+	}
+	defer unix.Close(fd)
+
+	last := components[len(components)-1]
+	file, err := unix.Openat(fd, last, flags|unix.O_NOFOLLOW|unix.O_CLOEXEC, mode)
+	if errors.Is(err, unix.ENOTDIR) && flags&unix.O_DIRECTORY != 0 {
+		// A symlink opened with O_NOFOLLOW|O_DIRECTORY fails with ENOTDIR, like a regular file
+		var stat unix.Stat_t
+		if unix.Fstatat(fd, last, &stat, unix.AT_SYMLINK_NOFOLLOW) == nil && stat.Mode&unix.S_IFMT == unix.S_IFLNK {
+			err = unix.ELOOP
+		}
+	}
+	return file, err
+}
+
+// writeFileBeneath atomically replaces path in root with the content of sourcePath, with the given permissions and
+// owner. The file is written to a hidden temporary file next to path, and its permissions and owner are set on the
+// open file before it is renamed over path. A symlink at path is replaced, not followed.
+func writeFileBeneath(root, sourcePath, path string, mode os.FileMode, uid, gid int) error {
+	srcFile, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	dir, err := openBeneath(root, "write", filepath.Dir(path), unix.O_PATH|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	dirFd := int(dir.Fd())
+
+	name := filepath.Base(path)
+	tmpName := "." + name + "." + strconv.FormatUint(uint64(rand.Uint32()), 10) + ".tmp"
+	fd, err := unix.Openat(dirFd, tmpName, unix.O_WRONLY|unix.O_CREAT|unix.O_EXCL|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0600)
+	if err != nil {
+		return &os.PathError{Op: "create", Path: filepath.Join(filepath.Dir(path), tmpName), Err: err}
+	}
+	tmpFile := os.NewFile(uintptr(fd), filepath.Join(filepath.Dir(path), tmpName))
+	defer unix.Unlinkat(dirFd, tmpName, 0) // No-op once the file has been renamed
+	defer tmpFile.Close()
+
+	if _, err := tmpFile.ReadFrom(srcFile); err != nil {
+		return err
+	}
+	if err := tmpFile.Chown(uid, gid); err != nil {
+		return err
+	}
+	if err := tmpFile.Chmod(mode); err != nil { // After Chown, which clears the setuid and setgid bits
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		return err
+	}
+
+	if err := unix.Renameat(dirFd, tmpName, dirFd, name); err != nil {
+		return &os.LinkError{Op: "rename", Old: tmpFile.Name(), New: path, Err: err}
+	}
+	return nil
+}
+
+// chmodDirectory sets the permissions of the directory at path in root to the result of mode applied to its current
+// permissions, and its group to gid unless gid is -1. The permissions are set on the open directory, so a symlink at
+// path is refused rather than followed.
+func chmodDirectory(root, path string, gid int, mode func(current os.FileMode) os.FileMode) error {
+	dir, err := openBeneath(root, "chmod", path, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	info, err := dir.Stat()
+	if err != nil {
+		return err
+	}
+	if gid != -1 {
+		if err := dir.Chown(-1, gid); err != nil {
+			return err
+		}
+	}
+	return dir.Chmod(mode(info.Mode()))
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// testWriteFileBeneath checks that writeFileBeneath writes in root and refuses a path through a symlink, with openat2
+// or with the fallback walk.
+func testWriteFileBeneath(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	source := filepath.Join(t.TempDir(), "auditd.conf")
+	if err := os.WriteFile(source, []byte("log_format = ENRICHED\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "audit"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "plugins.d")); err != nil {
+		t.Fatal(err)
+	}
+
+	uid, gid := os.Getuid(), os.Getgid()
+	path := filepath.Join(root, "audit", "auditd.conf")
+	if err := writeFileBeneath(root, source, path, 0640, uid, gid); err != nil {
+		t.Fatalf("writing a file in root: %v", err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "log_format = ENRICHED\n" {
+		t.Errorf("the written file holds %q, %v", data, err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("the written file has mode %v, %v, want 0640", info.Mode().Perm(), err)
+	}
+
+	err := writeFileBeneath(root, source, filepath.Join(root, "plugins.d", "af_unix.conf"), 0640, uid, gid)
+	if !errors.Is(err, errEscape) {
+		t.Errorf("writing through a symlinked directory returned %v, want %v", err, errEscape)
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+		t.Errorf("the directory outside of root holds %d entries, want 0", len(entries))
+	}
+}
+
+func TestWriteFileBeneath(t *testing.T) {
+	testWriteFileBeneath(t)
+}
+
+func TestWriteFileBeneathWithoutOpenat2(t *testing.T) {
+	for _, errno := range []unix.Errno{unix.ENOSYS, unix.EPERM} {
+		t.Run(errno.Error(), func(t *testing.T) {
+			previous := openat2
+			openat2 = func(int, string, *unix.OpenHow) (int, error) { return -1, errno }
+			t.Cleanup(func() { openat2 = previous })
+			testWriteFileBeneath(t)
+		})
+	}
+}
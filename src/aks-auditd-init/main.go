@@ -1,10 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"io"
 	"os"
 	"os/exec"
+	"os/signal"
 	"strconv"
 	"strings"
 	"syscall"
@@ -44,7 +45,14 @@ const aksAuditdMonitorServicePath = "/etc/systemd/system/aks-auditd-monitor.serv
 const hostRulesDirectory = "/etc/audit/rules.d"     // rules directory on the host file system. No trailing slash.
 const hostPluginsDirectory = "/etc/audit/plugins.d" // plugins directory on the host file system. No trailing slash.
 
+// Cancelled when the container receives SIGTERM or SIGINT. runCommand and copyFile check it before every step, so a
+// step that has already started always completes and the init container exits between steps.
+var shutdown = context.Background()
+
 func main() {
+	stop := notifyShutdown()
+	defer stop()
+
 	// Set default config values
 	viper.SetDefault("logLevel", "info")
 
@@ -107,20 +115,33 @@ func main() {
 	// Set /etc/audit to 751 permissions so the aks-audit group members can traverse to subdirectories, such as /etc/audit/rules.d
 	// and /etc/audit/plugins.d, but not modify any other /etc/audit files.
 	log.Info("Setting permissions on /etc/audit.")
-	err = syscall.Chmod("/etc/audit", 0751)
+	err = chmodDirectory("/", "/etc/audit", -1, func(os.FileMode) os.FileMode { return 0751 })
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	// Change ownership on the rules directory and all subfiles
 	log.Info("Changing rules.d directory permissions.")
+	// chgrp -R and chmod -R do not follow symlinks in the directory
 	runCommand("chgrp", "-R", "audit-admins", hostRulesDirectory) // Change the group to audit-admins
 	runCommand("chmod", "-R", "g+rw", hostRulesDirectory)         // Give the group read/write/execute permissions TODO: I might not need execute permissions.
-	runCommand("chmod", "g+s", hostRulesDirectory)                // Set the setgid bit so that new files inherit the group
-	runCommand("rm", "-f", hostRulesDirectory+"/*")               // Clear out the rules directory
+	// Set the setgid bit so that new files inherit the group
+	if err := chmodDirectory("/", hostRulesDirectory, -1, func(mode os.FileMode) os.FileMode { return mode | os.ModeSetgid }); err != nil {
+		log.Error(fmt.Sprintf("Failed to set permissions on %s, error: %v", hostRulesDirectory, err))
+	}
+	runCommand("rm", "-f", hostRulesDirectory+"/*") // Clear out the rules directory
 
 	runCommand("rm", "-f", hostPluginsDirectory+"/*") // Clear out the plugins directory. Only use those supplied by the container.
 
+	// Change ownership on the plugins directory so the aks-auditd container can keep it in sync with the audispd-plugins
+	// ConfigMap. The plugin files themselves stay owned by root. aks-auditd-monitor resets the owner after every change.
+	log.Info("Changing plugins.d directory permissions.")
+	// Change the group to audit-admins, give the group permissions to create and remove files, and set the setgid bit so
+	// that new files inherit the group
+	if err := chmodDirectory("/", hostPluginsDirectory, auditadminsGID, func(mode os.FileMode) os.FileMode { return mode | 0070 | os.ModeSetgid }); err != nil {
+		log.Error(fmt.Sprintf("Failed to set permissions on %s, error: %v", hostPluginsDirectory, err))
+	}
+
 	// Check if the aks-auditd-monitor service is running. If we get an "active" response back, we want to stop the service so our binaries can be updated in later steps.
 	aksMonitorServiceStatus := exec.Command("systemctl", "is-active", "aks-auditd-monitor")
 	output, err := aksMonitorServiceStatus.CombinedOutput()
@@ -143,40 +164,23 @@ func main() {
 	// Copy over the aks-audit-monitor binary to the host file system
 	aksMonitorBinaryContainerPath := chrootMount + aksAuditdMonitorBinaryPath
 	log.Info("Copying aks-auditd-monitor binary and service file to the host file system.")
-	if err := copyFile("/app/aks-auditd-monitor", aksMonitorBinaryContainerPath); err != nil {
+	if err := copyFile("/app/aks-auditd-monitor", aksMonitorBinaryContainerPath, 0755, 0, 0); err != nil {
 		log.Error(fmt.Sprintf("Failed to copy file: %s to %s, error: %v", "/app/aks-auditd-monitor", aksMonitorBinaryContainerPath, err))
 	}
-	if err := os.Chmod(aksMonitorBinaryContainerPath, 0755); err != nil {
-		log.Error(fmt.Sprintf("Failed to set permissions on file: %s, error: %v", aksMonitorBinaryContainerPath, err))
-	}
-	if err := os.Chown(aksMonitorBinaryContainerPath, 0, 0); err != nil {
-		log.Error(fmt.Sprintf("Failed to set ownership on file: %s, error: %v", aksMonitorBinaryContainerPath, err))
-	}
 
 	// Copy over the aks-auditd-monitor service file to the host file system
 	aksMonitorServiceContainerPath := chrootMount + aksAuditdMonitorServicePath
-	if err := copyFile("/app/aks-auditd-monitor.service", aksMonitorServiceContainerPath); err != nil {
+	if err := copyFile("/app/aks-auditd-monitor.service", aksMonitorServiceContainerPath, 0644, 0, 0); err != nil {
 		log.Error(fmt.Sprintf("Failed to copy file: %s to %s, error: %v", "/app/aks-auditd-monitor.service", aksMonitorServiceContainerPath, err))
 	}
-	if err := os.Chmod(aksMonitorServiceContainerPath, 0644); err != nil {
-		log.Error(fmt.Sprintf("Failed to set permissions on file: %s, error: %v", aksMonitorServiceContainerPath, err))
-	}
-	if err := os.Chown(aksMonitorServiceContainerPath, 0, 0); err != nil {
-		log.Error(fmt.Sprintf("Failed to set ownership on file: %s, error: %v", aksMonitorServiceContainerPath, err))
-	}
 
 	// Copy over the syslog.conf file to the host file system and set the appropriate permissions.
-	// auditd is sensitive about the permissions and ownership on this file.
-	pluginsContainerPath := chrootMount + hostPluginsDirectory
-	syslogConfPath := pluginsContainerPath + "/syslog.conf"
-	if err := copyFile(syslogConfPath, pluginsContainerPath); err != nil {
-		log.Error(fmt.Sprintf("Failed to copy file: %s to %s, error: %v", syslogConfPath, aksMonitorServiceContainerPath, err))
-	}
-	if err := os.Chmod(syslogConfPath, 0600); err != nil {
-		log.Error(fmt.Sprintf("Failed to set permissions on file: %s, error: %v", aksMonitorServiceContainerPath, err))
-	}
-	if err := os.Chown(syslogConfPath, 0, 0); err != nil {
-		log.Error(fmt.Sprintf("Failed to set ownership on file: %s, error: %v", aksMonitorServiceContainerPath, err))
+	// auditd is sensitive about the permissions and ownership on this file. The group matches what aks-auditd-monitor
+	// enforces, so the aks-auditd container sees the file as in sync with the ConfigMap.
+	syslogConfSourcePath := audispdPluginsMount + "/syslog.conf"
+	syslogConfPath := chrootMount + hostPluginsDirectory + "/syslog.conf"
+	if err := copyFile(syslogConfSourcePath, syslogConfPath, 0640, 0, auditadminsGID); err != nil {
+		log.Error(fmt.Sprintf("Failed to copy file: %s to %s, error: %v", syslogConfSourcePath, syslogConfPath, err))
 	}
 
 	// Chroot to the host file system to configure the aks-auditd-monitor service and start it
@@ -221,6 +225,8 @@ func Chroot(path string) (func() error, error) {
 // runCommand runs a command and logs the output
 func runCommand(cmd string, args ...string) {
 
+	exitOnShutdown(cmd + " " + strings.Join(args, " "))
+
 	// Create the command
 	command := exec.Command(cmd, args...)
 
@@ -236,20 +242,29 @@ func runCommand(cmd string, args ...string) {
 	log.Debugf("Command Output: %s", string(output))
 }
 
-// copyFile copies a file from src to dst
-func copyFile(sourcePath, targetPath string) error {
-	srcFile, err := os.Open(sourcePath)
-	if err != nil {
-		return err
-	}
-	defer srcFile.Close()
+// copyFile copies a file from the container to targetPath on the host file system mounted at chrootMount, with the
+// given permissions and owner. The file is written to a temporary file next to targetPath and renamed over targetPath
+// once it is complete, so an interrupted copy never leaves a partially written file on the host. A path that leaves
+// the host file system or passes through a symlink is refused.
+func copyFile(sourcePath, targetPath string, mode os.FileMode, uid, gid int) error {
+	exitOnShutdown("copy " + sourcePath + " to " + targetPath)
 
-	targetFile, err := os.Create(targetPath)
-	if err != nil {
-		return err
-	}
-	defer targetFile.Close()
+	return writeFileBeneath(chrootMount, sourcePath, targetPath, mode, uid, gid)
+}
 
-	_, err = io.Copy(targetFile, srcFile)
-	return err
+// notifyShutdown cancels shutdown when the container receives SIGTERM or SIGINT, and ignores SIGHUP, as there is
+// nothing to reload in a container that runs once. stop releases SIGTERM and SIGINT.
+func notifyShutdown() context.CancelFunc {
+	var stop context.CancelFunc
+	shutdown, stop = signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	signal.Ignore(syscall.SIGHUP)
+	return stop
+}
+
+// exitOnShutdown exits the init container before the next step when a shutdown signal has been received. The pod
+// restarts the init container, which repeats all steps.
+func exitOnShutdown(step string) {
+	if shutdown.Err() != nil {
+		log.Fatalf("Received a shutdown signal. Exiting before: %s", step)
+	}
 }
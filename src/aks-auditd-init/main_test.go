@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestShutdownSignals runs itself in a child process, as exitOnShutdown exits the process. The child ignores SIGHUP,
+// completes the step it is in, and exits before the next step after SIGTERM.
+func TestShutdownSignals(t *testing.T) {
+	if dir := os.Getenv("AKS_AUDITD_INIT_SHUTDOWN_DIR"); dir != "" {
+		stop := notifyShutdown()
+		defer stop()
+
+		syscall.Kill(os.Getpid(), syscall.SIGHUP)
+		runCommand("touch", filepath.Join(dir, "before"))
+
+		syscall.Kill(os.Getpid(), syscall.SIGTERM)
+		for deadline := time.Now().Add(5 * time.Second); shutdown.Err() == nil && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+		}
+		runCommand("touch", filepath.Join(dir, "after"))
+		return
+	}
+
+	dir := t.TempDir()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestShutdownSignals$")
+	cmd.Env = append(os.Environ(), "AKS_AUDITD_INIT_SHUTDOWN_DIR="+dir)
+	output, err := cmd.CombinedOutput()
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+		t.Fatalf("the init container did not exit with status 1 after SIGTERM: %v\n%s", err, output)
+	}
+	if !strings.Contains(string(output), "Exiting before: touch "+filepath.Join(dir, "after")) {
+		t.Errorf("the exit does not name the step it skipped:\n%s", output)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "before")); err != nil {
+		t.Errorf("SIGHUP stopped the init container: %v\n%s", err, output)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "after")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the step after SIGTERM ran: %v", err)
+	}
+}
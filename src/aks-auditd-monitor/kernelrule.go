@@ -0,0 +1,578 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Sizes of struct audit_rule_data from linux/audit.h. The struct is followed by the values of the string fields.
+const (
+	auditBitmaskSize = 64
+	auditMaxFields   = 64
+	ruleDataSize     = 4*3 + 4*auditBitmaskSize + 3*4*auditMaxFields + 4
+)
+
+// Filter lists and actions of a rule. A rule added with -A has auditFilterPrepend set in its flags.
+const (
+	auditFilterUser    = 0
+	auditFilterTask    = 1
+	auditFilterExit    = 4
+	auditFilterExclude = 5
+	auditFilterFS      = 6
+	auditFilterPrepend = 0x10
+
+	auditNever  = 0
+	auditAlways = 2
+)
+
+// Field types the encoder handles on their own
+const (
+	auditWatch        = 105
+	auditPerm         = 106
+	auditDir          = 107
+	auditFieldCompare = 111
+	auditFilterKey    = 210
+	auditSuccess      = 104
+	auditArch         = 11
+)
+
+// Field types of the -F names, from the field table of libaudit
+var fieldTypes = map[string]uint32{
+	"pid": 0, "uid": 1, "euid": 2, "suid": 3, "fsuid": 4, "gid": 5, "egid": 6, "sgid": 7, "fsgid": 8, "auid": 9,
+	"loginuid": 9, "pers": 10, "arch": auditArch, "msgtype": 12, "subj_user": 13, "subj_role": 14, "subj_type": 15,
+	"subj_sen": 16, "subj_clr": 17, "ppid": 18, "obj_user": 19, "obj_role": 20, "obj_type": 21, "obj_lev_low": 22,
+	"obj_lev_high": 23, "loginuid_set": 24, "sessionid": 25, "fstype": 26, "devmajor": 100, "devminor": 101,
+	"inode": 102, "exit": 103, "success": auditSuccess, "path": auditWatch, "perm": auditPerm, "dir": auditDir,
+	"filetype": 108, "obj_uid": 109, "obj_gid": 110, "exe": 112, "saddr_fam": 113, "a0": 200, "a1": 201, "a2": 202,
+	"a3": 203,
+}
+
+// Field types whose value is a string. The kernel takes and lists their length as the value.
+var stringFieldTypes = map[uint32]bool{
+	13: true, 14: true, 15: true, 16: true, 17: true, 19: true, 20: true, 21: true, 22: true, 23: true,
+	auditWatch: true, auditDir: true, 112: true, auditFilterKey: true,
+}
+
+// Operators of the fields
+var fieldOps = map[string]uint32{
+	"=": 0x40000000, "!=": 0x30000000, "<": 0x10000000, ">": 0x20000000, "<=": 0x50000000, ">=": 0x60000000,
+	"&": 0x08000000, "&=": 0x48000000,
+}
+
+// Fields that hold a user or group ID
+var (
+	uidFields = map[string]bool{"uid": true, "euid": true, "suid": true, "fsuid": true, "auid": true, "loginuid": true, "obj_uid": true}
+	gidFields = map[string]bool{"gid": true, "egid": true, "sgid": true, "fsgid": true, "obj_gid": true}
+)
+
+// Values of AUDIT_FIELD_COMPARE for the pairs of fields -C compares. The order of the pair does not matter.
+var fieldComparisons = map[[2]string]uint32{
+	{"uid", "obj_uid"}: 1, {"gid", "obj_gid"}: 2, {"euid", "obj_uid"}: 3, {"egid", "obj_gid"}: 4,
+	{"auid", "obj_uid"}: 5, {"suid", "obj_uid"}: 6, {"sgid", "obj_gid"}: 7, {"fsuid", "obj_uid"}: 8,
+	{"fsgid", "obj_gid"}: 9, {"uid", "auid"}: 10, {"uid", "euid"}: 11, {"uid", "fsuid"}: 12, {"uid", "suid"}: 13,
+	{"auid", "fsuid"}: 14, {"auid", "suid"}: 15, {"auid", "euid"}: 16, {"euid", "suid"}: 17, {"euid", "fsuid"}: 18,
+	{"suid", "fsuid"}: 19, {"gid", "egid"}: 20, {"gid", "fsgid"}: 21, {"gid", "sgid"}: 22, {"egid", "fsgid"}: 23,
+	{"egid", "sgid"}: 24, {"sgid", "fsgid"}: 25,
+}
+
+// AUDIT_ARCH values and the syscall tables of ausyscall for the machine names the arch field accepts on the nodes
+var archValues = map[string]struct {
+	value uint32
+	abi   string
+}{
+	"x86_64": {0xc000003e, "x86_64"}, "i386": {0x40000003, "i386"}, "i486": {0x40000003, "i386"},
+	"i586": {0x40000003, "i386"}, "i686": {0x40000003, "i386"}, "aarch64": {0xc00000b7, "aarch64"},
+	"armv7l": {0x40000028, "arm"},
+}
+
+// nodeMachine is the machine of the node in Go naming. The monitor is built for each arch and aks-auditd-init copies
+// the one of its image, which is the arch of the node.
+var nodeMachine = runtime.GOARCH
+
+// Machine names of b64 and b32 on every machine the monitor runs on, in Go naming
+var machineArches = map[string]map[string]string{
+	"amd64": {"b64": "x86_64", "b32": "i386"},
+	"arm64": {"b64": "aarch64", "b32": "armv7l"},
+}
+
+// Permission bits of watches and the perm field
+var permBits = map[rune]uint32{'x': 1, 'w': 2, 'r': 4, 'a': 8}
+
+// File types of the filetype field
+var fileTypeValues = map[string]uint32{
+	"file": 0100000, "dir": 0040000, "socket": 0140000, "link": 0120000, "character": 0020000,
+	"block": 0060000, "fifo": 0010000,
+}
+
+// File system types of the fstype field
+var fsTypeValues = map[string]uint32{"debugfs": 0x64626720, "tracefs": 0x74726163}
+
+// Errno names rules use with the exit field
+var errnoValues = map[string]int32{
+	"EPERM": 1, "ENOENT": 2, "ESRCH": 3, "EINTR": 4, "EIO": 5, "ENXIO": 6, "E2BIG": 7, "ENOEXEC": 8, "EBADF": 9,
+	"ECHILD": 10, "EAGAIN": 11, "ENOMEM": 12, "EACCES": 13, "EFAULT": 14, "EBUSY": 16, "EEXIST": 17, "EXDEV": 18,
+	"ENODEV": 19, "ENOTDIR": 20, "EISDIR": 21, "EINVAL": 22, "ENFILE": 23, "EMFILE": 24, "ETXTBSY": 26,
+	"EFBIG": 27, "ENOSPC": 28, "ESPIPE": 29, "EROFS": 30, "EMLINK": 31, "EPIPE": 32, "ENAMETOOLONG": 36,
+	"ENOSYS": 38, "ENOTEMPTY": 39, "ELOOP": 40, "ENOTSUP": 95, "EOPNOTSUPP": 95,
+}
+
+// Message type names rules use with the msgtype field
+var msgTypeValues = map[string]uint32{
+	"USER_AUTH": 1100, "USER_ACCT": 1101, "USER_MGMT": 1102, "CRED_ACQ": 1103, "CRED_DISP": 1104,
+	"USER_START": 1105, "USER_END": 1106, "USER_AVC": 1107, "USER_CHAUTHTOK": 1108, "USER_ERR": 1109,
+	"CRED_REFR": 1110, "USYS_CONFIG": 1111, "USER_LOGIN": 1112, "USER_LOGOUT": 1113, "ADD_USER": 1114,
+	"DEL_USER": 1115, "ADD_GROUP": 1116, "DEL_GROUP": 1117, "USER_CMD": 1123, "USER_TTY": 1124,
+	"SERVICE_START": 1130, "SERVICE_STOP": 1131, "SYSCALL": 1300, "PATH": 1302, "IPC": 1303, "SOCKETCALL": 1304,
+	"CONFIG_CHANGE": 1305, "SOCKADDR": 1306, "CWD": 1307, "EXECVE": 1309, "MMAP": 1323, "NETFILTER_CFG": 1325,
+	"SECCOMP": 1326, "PROCTITLE": 1327, "BPRM_FCAPS": 1321, "CAPSET": 1322, "EOE": 1320, "BPF": 1334, "AVC": 1400,
+}
+
+// kernelRule is struct audit_rule_data, a rule as the kernel takes and lists it.
+type kernelRule struct {
+	Flags  uint32 // Filter list, and auditFilterPrepend for a rule added with -A
+	Action uint32
+	Mask   [auditBitmaskSize]uint32 // Bit n is set when the rule matches syscall n
+	Fields []kernelField
+}
+
+// kernelField is a field of a kernel rule. The value of a string field is in Str and Value is its length.
+type kernelField struct {
+	Type  uint32
+	Op    uint32
+	Value uint32
+	Str   string
+}
+
+// marshal encodes the rule as struct audit_rule_data.
+func (r kernelRule) marshal() []byte {
+	var strs strings.Builder
+	data := make([]byte, ruleDataSize)
+	binary.NativeEndian.PutUint32(data[0:], r.Flags)
+	binary.NativeEndian.PutUint32(data[4:], r.Action)
+	binary.NativeEndian.PutUint32(data[8:], uint32(len(r.Fields)))
+	for i, word := range r.Mask {
+		binary.NativeEndian.PutUint32(data[12+4*i:], word)
+	}
+	fields := 12 + 4*auditBitmaskSize
+	for i, field := range r.Fields {
+		value := field.Value
+		if stringFieldTypes[field.Type] {
+			value = uint32(len(field.Str))
+			strs.WriteString(field.Str)
+		}
+		binary.NativeEndian.PutUint32(data[fields+4*i:], field.Type)
+		binary.NativeEndian.PutUint32(data[fields+4*auditMaxFields+4*i:], value)
+		binary.NativeEndian.PutUint32(data[fields+8*auditMaxFields+4*i:], field.Op)
+	}
+	binary.NativeEndian.PutUint32(data[ruleDataSize-4:], uint32(strs.Len()))
+	return append(data, strs.String()...)
+}
+
+// unmarshalRule decodes a struct audit_rule_data the kernel listed.
+func unmarshalRule(data []byte) (kernelRule, error) {
+	var r kernelRule
+	if len(data) < ruleDataSize {
+		return r, fmt.Errorf("rule of %d bytes is shorter than struct audit_rule_data", len(data))
+	}
+	r.Flags = binary.NativeEndian.Uint32(data[0:])
+	r.Action = binary.NativeEndian.Uint32(data[4:])
+	count := binary.NativeEndian.Uint32(data[8:])
+	if count > auditMaxFields {
+		return r, fmt.Errorf("rule has %d fields", count)
+	}
+	for i := range r.Mask {
+		r.Mask[i] = binary.NativeEndian.Uint32(data[12+4*i:])
+	}
+
+	fields := 12 + 4*auditBitmaskSize
+	strs := data[ruleDataSize:]
+	for i := 0; i < int(count); i++ {
+		field := kernelField{
+			Type:  binary.NativeEndian.Uint32(data[fields+4*i:]),
+			Value: binary.NativeEndian.Uint32(data[fields+4*auditMaxFields+4*i:]),
+			Op:    binary.NativeEndian.Uint32(data[fields+8*auditMaxFields+4*i:]),
+		}
+		if stringFieldTypes[field.Type] {
+			if int(field.Value) > len(strs) {
+				return r, fmt.Errorf("string field %d is longer than the rule", field.Type)
+			}
+			field.Str, strs = string(strs[:field.Value]), strs[field.Value:]
+		}
+		r.Fields = append(r.Fields, field)
+	}
+	return r, nil
+}
+
+// list returns the filter list of the rule.
+func (r kernelRule) list() uint32 {
+	return r.Flags &^ auditFilterPrepend
+}
+
+// key returns a string that is the same for two rules the kernel treats as the same rule. The kernel replaces the
+// syscall class bits at the top of the mask with the syscalls of the classes, so those bits are left out. The mask
+// only matters on the exit list.
+func (r kernelRule) key() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d,%d", r.Flags, r.Action)
+	if r.list() == auditFilterExit {
+		mask := r.Mask
+		mask[auditBitmaskSize-1] &= 0x0000ffff
+		fmt.Fprintf(&b, " %x", mask)
+	}
+	for _, field := range r.Fields {
+		value := field.Value
+		// The kernel may keep a success field as AUDITSC_FAILURE, which is 2, rather than 0
+		if field.Type == auditSuccess && value == 2 {
+			value = 0
+		}
+		if stringFieldTypes[field.Type] {
+			fmt.Fprintf(&b, " %d:%x:%q", field.Type, field.Op, field.Str)
+		} else {
+			fmt.Fprintf(&b, " %d:%x:%d", field.Type, field.Op, value)
+		}
+	}
+	return b.String()
+}
+
+// String formats the rule for logging with its list, action, and fields. The syscalls are left out.
+func (r kernelRule) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "list=%d action=%d", r.list(), r.Action)
+	for _, field := range r.Fields {
+		if stringFieldTypes[field.Type] {
+			fmt.Fprintf(&b, " %d=%s", field.Type, strings.ReplaceAll(field.Str, "\x01", ","))
+		} else {
+			fmt.Fprintf(&b, " %d=%d", field.Type, int32(field.Value))
+		}
+	}
+	return b.String()
+}
+
+// CompiledControl is a control option of the effective ruleset aks-auditd compiles, such as -b 8192.
+type CompiledControl struct {
+	Option string `json:"option"`
+	Value  string `json:"value"`
+	Key    string `json:"key"`
+}
+
+// CompiledWatch is a watch of the compiled ruleset, such as -w /etc/passwd -p wa -k identity.
+type CompiledWatch struct {
+	Remove bool     `json:"remove"`
+	Path   string   `json:"path"`
+	Perms  string   `json:"perms"`
+	Keys   []string `json:"keys"`
+}
+
+// CompiledRule is a rule of the compiled ruleset. SyscallIndex is the number of fields that come before the syscalls.
+type CompiledRule struct {
+	Op           string          `json:"op"`
+	Action       string          `json:"action"`
+	List         string          `json:"list"`
+	Syscalls     []string        `json:"syscalls"`
+	Fields       []CompiledField `json:"fields"`
+	Keys         []string        `json:"keys"`
+	SyscallIndex int             `json:"syscallIndex"`
+}
+
+// CompiledField is a -F field, or a -C comparison when Compare is set, of a compiled rule.
+type CompiledField struct {
+	Name    string `json:"name"`
+	Op      string `json:"op"`
+	Value   string `json:"value"`
+	Compare bool   `json:"compare"`
+}
+
+// ruleEncoder turns the watches and rules of the compiled ruleset into kernel rules the way auditctl does. Syscall
+// names are resolved with the tables of ausyscall on the node, and user and group names with the node's databases.
+type ruleEncoder struct {
+	syscalls map[string]map[string]int // ABI to syscall name to number
+}
+
+// encodeWatch encodes a watch such as -w /etc/passwd -p wa -k identity. A watch on a directory watches the whole
+// tree below it.
+func (e *ruleEncoder) encodeWatch(w CompiledWatch) (kernelRule, error) {
+	rule := kernelRule{Flags: auditFilterExit, Action: auditAlways}
+	if w.Remove {
+		return rule, fmt.Errorf("-W %s deletes a watch", w.Path)
+	}
+	allSyscalls(&rule)
+
+	path := w.Path
+	if len(path) > 1 {
+		path = strings.TrimRight(path, "/")
+	}
+	watchType := uint32(auditWatch)
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		watchType = auditDir
+	}
+	perms := w.Perms
+	if perms == "" {
+		perms = "rwxa"
+	}
+
+	rule.Fields = append(rule.Fields,
+		kernelField{Type: watchType, Op: fieldOps["="], Str: path},
+		kernelField{Type: auditPerm, Op: fieldOps["="], Value: permValue(perms)},
+	)
+	addKeys(&rule, w.Keys)
+	return rule, nil
+}
+
+// encodeRule encodes a rule added with -a, such as -a always,exit -F arch=b64 -S openat -F exit=-EACCES -k access.
+func (e *ruleEncoder) encodeRule(r CompiledRule) (kernelRule, error) {
+	var rule kernelRule
+	if r.Op != "-a" {
+		return rule, fmt.Errorf("%s rules are not supported", r.Op)
+	}
+	lists := map[string]uint32{"user": auditFilterUser, "task": auditFilterTask, "exit": auditFilterExit, "exclude": auditFilterExclude, "filesystem": auditFilterFS}
+	list, supported := lists[r.List]
+	if !supported {
+		return rule, fmt.Errorf("rules on the %s list are not supported", r.List)
+	}
+	rule.Flags = list
+	rule.Action = auditNever
+	if r.Action == "always" {
+		rule.Action = auditAlways
+	}
+
+	// auditctl resolves syscall names in the table of the arch given before them
+	abi := machineArches[nodeMachine]["b64"]
+	for i, field := range r.Fields {
+		if field.Name == "arch" && !field.Compare && len(r.Syscalls) > 0 {
+			if i >= r.SyscallIndex {
+				return rule, fmt.Errorf("the arch field comes after the syscalls")
+			}
+			if field.Op != "=" {
+				return rule, fmt.Errorf("syscalls after arch%s%s are not supported", field.Op, field.Value)
+			}
+			abi = resolveArch(field.Value)
+		}
+	}
+
+	for _, field := range r.Fields {
+		encoded, err := encodeField(field)
+		if err != nil {
+			return rule, err
+		}
+		rule.Fields = append(rule.Fields, encoded)
+	}
+
+	if list == auditFilterExit && len(r.Syscalls) == 0 {
+		allSyscalls(&rule)
+	}
+	for _, name := range r.Syscalls {
+		if name == "all" {
+			allSyscalls(&rule)
+			continue
+		}
+		number, err := e.syscallNumber(abi, name)
+		if err != nil {
+			return rule, err
+		}
+		rule.Mask[number/32] |= 1 << (number % 32)
+	}
+
+	if list == auditFilterExclude && len(r.Keys) > 0 {
+		return rule, fmt.Errorf("keys on the exclude list are not supported")
+	}
+	addKeys(&rule, r.Keys)
+	return rule, nil
+}
+
+// encodeField encodes a -F field or a -C comparison.
+func encodeField(field CompiledField) (kernelField, error) {
+	op, known := fieldOps[field.Op]
+	if !known {
+		return kernelField{}, fmt.Errorf("unknown operator %s", field.Op)
+	}
+	if field.Compare {
+		value, known := fieldComparisons[[2]string{canonicalField(field.Name), canonicalField(field.Value)}]
+		if !known {
+			value, known = fieldComparisons[[2]string{canonicalField(field.Value), canonicalField(field.Name)}]
+		}
+		if !known {
+			return kernelField{}, fmt.Errorf("-C %s%s%s is not supported", field.Name, field.Op, field.Value)
+		}
+		return kernelField{Type: auditFieldCompare, Op: op, Value: value}, nil
+	}
+
+	fieldType, known := fieldTypes[field.Name]
+	if !known {
+		return kernelField{}, fmt.Errorf("field %s is not supported", field.Name)
+	}
+	encoded := kernelField{Type: fieldType, Op: op}
+	if stringFieldTypes[fieldType] {
+		encoded.Str = field.Value
+		return encoded, nil
+	}
+
+	value, err := fieldValue(field)
+	if err != nil {
+		return kernelField{}, err
+	}
+	encoded.Value = value
+	return encoded, nil
+}
+
+// fieldValue resolves the value of a numeric field the way libaudit does.
+func fieldValue(field CompiledField) (uint32, error) {
+	name, v := field.Name, field.Value
+	if number, err := parseNumber(v); err == nil && name != "arch" {
+		return number, nil
+	}
+
+	switch {
+	case uidFields[name]:
+		if v == "unset" {
+			return 0xffffffff, nil
+		}
+		u, err := user.Lookup(v)
+		if err != nil {
+			return 0, fmt.Errorf("field %s: %w", name, err)
+		}
+		return parseNumber(u.Uid)
+	case gidFields[name]:
+		if v == "unset" {
+			return 0xffffffff, nil
+		}
+		g, err := user.LookupGroup(v)
+		if err != nil {
+			return 0, fmt.Errorf("field %s: %w", name, err)
+		}
+		return parseNumber(g.Gid)
+	case name == "arch":
+		arch, known := archValues[resolveMachine(v)]
+		if !known {
+			return 0, fmt.Errorf("arch %s is not supported", v)
+		}
+		return arch.value, nil
+	case name == "exit":
+		errno, known := errnoValues[strings.TrimPrefix(v, "-")]
+		if !known {
+			return 0, fmt.Errorf("errno %s is not supported", v)
+		}
+		if strings.HasPrefix(v, "-") {
+			errno = -errno
+		}
+		return uint32(errno), nil
+	case name == "perm":
+		return permValue(v), nil
+	case name == "filetype":
+		if value, known := fileTypeValues[v]; known {
+			return value, nil
+		}
+	case name == "fstype":
+		if value, known := fsTypeValues[v]; known {
+			return value, nil
+		}
+	case name == "msgtype":
+		if value, known := msgTypeValues[strings.ToUpper(v)]; known {
+			return value, nil
+		}
+	}
+	return 0, fmt.Errorf("value %s of field %s is not supported", v, name)
+}
+
+// parseNumber parses a decimal or hexadecimal number. A negative number is stored as its 32-bit two's complement, so
+// -1 is the unset ID 4294967295.
+func parseNumber(s string) (uint32, error) {
+	if strings.HasPrefix(s, "-") {
+		n, err := strconv.ParseInt(s, 0, 32)
+		return uint32(n), err
+	}
+	n, err := strconv.ParseUint(s, 0, 32)
+	return uint32(n), err
+}
+
+// canonicalField returns the name libaudit uses for a field with two names.
+func canonicalField(name string) string {
+	if name == "loginuid" {
+		return "auid"
+	}
+	return name
+}
+
+// resolveMachine returns the machine name of b64 and b32 on this machine, and any other arch value as it is.
+func resolveMachine(arch string) string {
+	if machine, exists := machineArches[nodeMachine][arch]; exists {
+		return machine
+	}
+	return arch
+}
+
+// resolveArch returns the ausyscall table of an arch value, or an empty string for an arch that is not supported.
+func resolveArch(arch string) string {
+	return archValues[resolveMachine(arch)].abi
+}
+
+// permValue returns the permission bits of a combination of r, w, x, and a.
+func permValue(perms string) uint32 {
+	var value uint32
+	for _, perm := range perms {
+		value |= permBits[perm]
+	}
+	return value
+}
+
+// allSyscalls makes the rule match every syscall the way auditctl does for -S all, which leaves the syscall class
+// bits in the last word of the mask unset.
+func allSyscalls(rule *kernelRule) {
+	for i := 0; i < auditBitmaskSize-1; i++ {
+		rule.Mask[i] = 0xffffffff
+	}
+}
+
+// addKeys adds the keys as the last field, separated by \x01 like auditctl does.
+func addKeys(rule *kernelRule, keys []string) {
+	if len(keys) > 0 {
+		rule.Fields = append(rule.Fields, kernelField{Type: auditFilterKey, Op: fieldOps["="], Str: strings.Join(keys, "\x01")})
+	}
+}
+
+// syscallNumber returns the number of a syscall in the table of abi. The tables are read with ausyscall --dump, so
+// they match the ones auditctl uses on the node.
+func (e *ruleEncoder) syscallNumber(abi, name string) (int, error) {
+	if number, err := strconv.Atoi(name); err == nil {
+		if number < 0 || number >= 32*auditBitmaskSize {
+			return 0, fmt.Errorf("syscall number %d is out of range", number)
+		}
+		return number, nil
+	}
+	if abi == "" {
+		return 0, fmt.Errorf("syscall %s: the arch is not supported", name)
+	}
+
+	if e.syscalls == nil {
+		e.syscalls = make(map[string]map[string]int)
+	}
+	table, loaded := e.syscalls[abi]
+	if !loaded {
+		output, err := exec.Command("ausyscall", abi, "--dump").Output()
+		if err != nil {
+			return 0, fmt.Errorf("ausyscall %s --dump: %w", abi, err)
+		}
+		table = make(map[string]int)
+		for _, line := range strings.Split(string(output), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) != 2 {
+				continue
+			}
+			if number, err := strconv.Atoi(fields[0]); err == nil && number < 32*auditBitmaskSize {
+				table[fields[1]] = number
+			}
+		}
+		e.syscalls[abi] = table
+	}
+
+	number, exists := table[name]
+	if !exists {
+		return 0, fmt.Errorf("syscall %s is not in the %s table", name, abi)
+	}
+	return number, nil
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Operators and field types from linux/audit.h, written out so the tests do not share the tables of the encoder
+const (
+	opEqual        = 0x40000000 // AUDIT_EQUAL
+	opNotEqual     = 0x30000000 // AUDIT_NOT_EQUAL
+	opLessThan     = 0x10000000 // AUDIT_LESS_THAN
+	opGreaterThan  = 0x20000000 // AUDIT_GREATER_THAN
+	opLessEqual    = 0x50000000 // AUDIT_LESS_THAN_OR_EQUAL
+	opGreaterEqual = 0x60000000 // AUDIT_GREATER_THAN_OR_EQUAL
+	opBitMask      = 0x08000000 // AUDIT_BIT_MASK
+	opBitTest      = 0x48000000 // AUDIT_BIT_TEST
+)
+
+// testEncoder returns an encoder with a few syscalls of the x86_64, i386, aarch64, and arm tables, so tests do not
+// run ausyscall.
+func testEncoder() *ruleEncoder {
+	return &ruleEncoder{syscalls: map[string]map[string]int{
+		"x86_64":  {"open": 2, "execve": 59, "openat": 257},
+		"i386":    {"open": 5, "execve": 11, "openat": 295},
+		"aarch64": {"execve": 221, "openat": 56},
+		"arm":     {"execve": 11, "openat": 322},
+	}}
+}
+
+// maskOf returns the syscall mask of a rule on the given syscall numbers.
+func maskOf(numbers ...int) [auditBitmaskSize]uint32 {
+	var mask [auditBitmaskSize]uint32
+	for _, number := range numbers {
+		mask[number/32] |= 1 << (number % 32)
+	}
+	return mask
+}
+
+// maskAll returns the syscall mask of -S all.
+func maskAll() [auditBitmaskSize]uint32 {
+	var mask [auditBitmaskSize]uint32
+	for i := 0; i < auditBitmaskSize-1; i++ {
+		mask[i] = 0xffffffff
+	}
+	return mask
+}
+
+func TestEncodeFieldOperators(t *testing.T) {
+	for op, want := range map[string]uint32{
+		"=": opEqual, "!=": opNotEqual, "<": opLessThan, ">": opGreaterThan, "<=": opLessEqual, ">=": opGreaterEqual,
+		"&": opBitMask, "&=": opBitTest,
+	} {
+		got, err := encodeField(CompiledField{Name: "a0", Op: op, Value: "4"})
+		if err != nil || got != (kernelField{Type: 200, Op: want, Value: 4}) {
+			t.Errorf("a0%s4 = %+v, %v, want op %#x", op, got, err, want)
+		}
+	}
+	if _, err := encodeField(CompiledField{Name: "a0", Op: "=~", Value: "4"}); err == nil {
+		t.Error("an unknown operator was encoded")
+	}
+}
+
+func TestEncodeField(t *testing.T) {
+	for _, test := range []struct {
+		field CompiledField
+		want  kernelField
+	}{
+		// Numeric fields, with the types of linux/audit.h
+		{CompiledField{Name: "pid", Op: "=", Value: "1"}, kernelField{Type: 0, Op: opEqual, Value: 1}},
+		{CompiledField{Name: "uid", Op: ">=", Value: "1000"}, kernelField{Type: 1, Op: opGreaterEqual, Value: 1000}},
+		{CompiledField{Name: "euid", Op: "=", Value: "0"}, kernelField{Type: 2, Op: opEqual, Value: 0}},
+		{CompiledField{Name: "suid", Op: "!=", Value: "0"}, kernelField{Type: 3, Op: opNotEqual, Value: 0}},
+		{CompiledField{Name: "fsuid", Op: "=", Value: "0"}, kernelField{Type: 4, Op: opEqual, Value: 0}},
+		{CompiledField{Name: "gid", Op: "=", Value: "0"}, kernelField{Type: 5, Op: opEqual, Value: 0}},
+		{CompiledField{Name: "egid", Op: "=", Value: "0"}, kernelField{Type: 6, Op: opEqual, Value: 0}},
+		{CompiledField{Name: "sgid", Op: "=", Value: "0"}, kernelField{Type: 7, Op: opEqual, Value: 0}},
+		{CompiledField{Name: "fsgid", Op: "=", Value: "0"}, kernelField{Type: 8, Op: opEqual, Value: 0}},
+		{CompiledField{Name: "auid", Op: ">=", Value: "1000"}, kernelField{Type: 9, Op: opGreaterEqual, Value: 1000}},
+		{CompiledField{Name: "loginuid", Op: "<", Value: "500"}, kernelField{Type: 9, Op: opLessThan, Value: 500}},
+		{CompiledField{Name: "pers", Op: "=", Value: "0x0008"}, kernelField{Type: 10, Op: opEqual, Value: 8}},
+		{CompiledField{Name: "ppid", Op: "=", Value: "1"}, kernelField{Type: 18, Op: opEqual, Value: 1}},
+		{CompiledField{Name: "sessionid", Op: "!=", Value: "4294967295"}, kernelField{Type: 25, Op: opNotEqual, Value: 0xffffffff}},
+		{CompiledField{Name: "devmajor", Op: "=", Value: "8"}, kernelField{Type: 100, Op: opEqual, Value: 8}},
+		{CompiledField{Name: "devminor", Op: "=", Value: "1"}, kernelField{Type: 101, Op: opEqual, Value: 1}},
+		{CompiledField{Name: "inode", Op: "=", Value: "1234"}, kernelField{Type: 102, Op: opEqual, Value: 1234}},
+		{CompiledField{Name: "exit", Op: "=", Value: "-13"}, kernelField{Type: 103, Op: opEqual, Value: 0xfffffff3}},
+		{CompiledField{Name: "success", Op: "=", Value: "1"}, kernelField{Type: 104, Op: opEqual, Value: 1}},
+		{CompiledField{Name: "obj_uid", Op: "=", Value: "0"}, kernelField{Type: 109, Op: opEqual, Value: 0}},
+		{CompiledField{Name: "obj_gid", Op: "=", Value: "0"}, kernelField{Type: 110, Op: opEqual, Value: 0}},
+		{CompiledField{Name: "saddr_fam", Op: "=", Value: "2"}, kernelField{Type: 113, Op: opEqual, Value: 2}},
+		{CompiledField{Name: "a0", Op: "&", Value: "0x10"}, kernelField{Type: 200, Op: opBitMask, Value: 16}},
+		{CompiledField{Name: "a1", Op: "=", Value: "-1"}, kernelField{Type: 201, Op: opEqual, Value: 0xffffffff}},
+		{CompiledField{Name: "a2", Op: "&=", Value: "3"}, kernelField{Type: 202, Op: opBitTest, Value: 3}},
+		{CompiledField{Name: "a3", Op: ">", Value: "0"}, kernelField{Type: 203, Op: opGreaterThan, Value: 0}},
+
+		// Names libaudit resolves to numbers
+		{CompiledField{Name: "uid", Op: "=", Value: "root"}, kernelField{Type: 1, Op: opEqual, Value: 0}},
+		{CompiledField{Name: "gid", Op: "=", Value: "root"}, kernelField{Type: 5, Op: opEqual, Value: 0}},
+		{CompiledField{Name: "auid", Op: "!=", Value: "unset"}, kernelField{Type: 9, Op: opNotEqual, Value: 0xffffffff}},
+		{CompiledField{Name: "auid", Op: "!=", Value: "-1"}, kernelField{Type: 9, Op: opNotEqual, Value: 0xffffffff}},
+		{CompiledField{Name: "egid", Op: "=", Value: "unset"}, kernelField{Type: 6, Op: opEqual, Value: 0xffffffff}},
+		{CompiledField{Name: "arch", Op: "=", Value: "x86_64"}, kernelField{Type: 11, Op: opEqual, Value: 0xc000003e}},
+		{CompiledField{Name: "arch", Op: "!=", Value: "i686"}, kernelField{Type: 11, Op: opNotEqual, Value: 0x40000003}},
+		{CompiledField{Name: "arch", Op: "=", Value: "aarch64"}, kernelField{Type: 11, Op: opEqual, Value: 0xc00000b7}},
+		{CompiledField{Name: "arch", Op: "=", Value: "armv7l"}, kernelField{Type: 11, Op: opEqual, Value: 0x40000028}},
+		{CompiledField{Name: "exit", Op: "=", Value: "-EACCES"}, kernelField{Type: 103, Op: opEqual, Value: 0xfffffff3}},
+		{CompiledField{Name: "exit", Op: "=", Value: "EPERM"}, kernelField{Type: 103, Op: opEqual, Value: 1}},
+		{CompiledField{Name: "perm", Op: "=", Value: "wa"}, kernelField{Type: 106, Op: opEqual, Value: 10}},
+		{CompiledField{Name: "perm", Op: "=", Value: "rwxa"}, kernelField{Type: 106, Op: opEqual, Value: 15}},
+		{CompiledField{Name: "filetype", Op: "=", Value: "file"}, kernelField{Type: 108, Op: opEqual, Value: 0100000}},
+		{CompiledField{Name: "filetype", Op: "!=", Value: "dir"}, kernelField{Type: 108, Op: opNotEqual, Value: 0040000}},
+		{CompiledField{Name: "fstype", Op: "=", Value: "debugfs"}, kernelField{Type: 26, Op: opEqual, Value: 0x64626720}},
+		{CompiledField{Name: "fstype", Op: "!=", Value: "tracefs"}, kernelField{Type: 26, Op: opNotEqual, Value: 0x74726163}},
+		{CompiledField{Name: "msgtype", Op: "=", Value: "EXECVE"}, kernelField{Type: 12, Op: opEqual, Value: 1309}},
+		{CompiledField{Name: "msgtype", Op: "=", Value: "cwd"}, kernelField{Type: 12, Op: opEqual, Value: 1307}},
+		{CompiledField{Name: "msgtype", Op: "=", Value: "1300"}, kernelField{Type: 12, Op: opEqual, Value: 1300}},
+
+		// String fields, whose length the kernel takes as the value
+		{CompiledField{Name: "path", Op: "=", Value: "/etc/passwd"}, kernelField{Type: 105, Op: opEqual, Str: "/etc/passwd"}},
+		{CompiledField{Name: "dir", Op: "=", Value: "/etc/ssh"}, kernelField{Type: 107, Op: opEqual, Str: "/etc/ssh"}},
+		{CompiledField{Name: "exe", Op: "!=", Value: "/usr/bin/containerd"}, kernelField{Type: 112, Op: opNotEqual, Str: "/usr/bin/containerd"}},
+		{CompiledField{Name: "subj_user", Op: "=", Value: "system_u"}, kernelField{Type: 13, Op: opEqual, Str: "system_u"}},
+		{CompiledField{Name: "subj_role", Op: "=", Value: "r"}, kernelField{Type: 14, Op: opEqual, Str: "r"}},
+		{CompiledField{Name: "subj_type", Op: "=", Value: "t"}, kernelField{Type: 15, Op: opEqual, Str: "t"}},
+		{CompiledField{Name: "subj_sen", Op: "=", Value: "s0"}, kernelField{Type: 16, Op: opEqual, Str: "s0"}},
+		{CompiledField{Name: "subj_clr", Op: "=", Value: "s0"}, kernelField{Type: 17, Op: opEqual, Str: "s0"}},
+		{CompiledField{Name: "obj_user", Op: "=", Value: "u"}, kernelField{Type: 19, Op: opEqual, Str: "u"}},
+		{CompiledField{Name: "obj_role", Op: "=", Value: "r"}, kernelField{Type: 20, Op: opEqual, Str: "r"}},
+		{CompiledField{Name: "obj_type", Op: "!=", Value: "t"}, kernelField{Type: 21, Op: opNotEqual, Str: "t"}},
+		{CompiledField{Name: "obj_lev_low", Op: "=", Value: "s0"}, kernelField{Type: 22, Op: opEqual, Str: "s0"}},
+		{CompiledField{Name: "obj_lev_high", Op: "=", Value: "s0"}, kernelField{Type: 23, Op: opEqual, Str: "s0"}},
+
+		// -C comparisons, with the AUDIT_COMPARE values of linux/audit.h in either order of the pair
+		{CompiledField{Name: "uid", Op: "!=", Value: "euid", Compare: true}, kernelField{Type: 111, Op: opNotEqual, Value: 11}},
+		{CompiledField{Name: "euid", Op: "!=", Value: "uid", Compare: true}, kernelField{Type: 111, Op: opNotEqual, Value: 11}},
+		{CompiledField{Name: "auid", Op: "=", Value: "obj_uid", Compare: true}, kernelField{Type: 111, Op: opEqual, Value: 5}},
+		{CompiledField{Name: "loginuid", Op: "!=", Value: "uid", Compare: true}, kernelField{Type: 111, Op: opNotEqual, Value: 10}},
+		{CompiledField{Name: "sgid", Op: "=", Value: "fsgid", Compare: true}, kernelField{Type: 111, Op: opEqual, Value: 25}},
+		{CompiledField{Name: "gid", Op: "=", Value: "obj_gid", Compare: true}, kernelField{Type: 111, Op: opEqual, Value: 2}},
+	} {
+		got, err := encodeField(test.field)
+		if err != nil || got != test.want {
+			t.Errorf("%s%s%s = %+v, %v, want %+v", test.field.Name, test.field.Op, test.field.Value, got, err, test.want)
+		}
+	}
+}
+
+func TestEncodeFieldUnsupported(t *testing.T) {
+	for _, field := range []CompiledField{
+		{Name: "color", Op: "=", Value: "red"},
+		{Name: "uid", Op: "=", Value: "no-such-user-aks"},
+		{Name: "gid", Op: "=", Value: "no-such-group-aks"},
+		{Name: "arch", Op: "=", Value: "ppc64le"},
+		{Name: "arch", Op: "=", Value: "0xc000003e"},
+		{Name: "exit", Op: "=", Value: "-ENOTCONN"},
+		{Name: "filetype", Op: "=", Value: "door"},
+		{Name: "fstype", Op: "=", Value: "ext4"},
+		{Name: "msgtype", Op: "=", Value: "USER_SELINUX_ERR"},
+		{Name: "uid", Op: "=", Value: "path", Compare: true},
+		{Name: "uid", Op: "=", Value: "gid", Compare: true},
+	} {
+		if got, err := encodeField(field); err == nil {
+			t.Errorf("%+v was encoded as %+v, want an error", field, got)
+		}
+	}
+}
+
+func TestEncodeRule(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		rule CompiledRule
+		want kernelRule
+	}{
+		{
+			name: "syscalls of b64",
+			rule: CompiledRule{
+				Op: "-a", Action: "always", List: "exit", Syscalls: []string{"openat", "open"}, SyscallIndex: 1,
+				Fields: []CompiledField{{Name: "arch", Op: "=", Value: "x86_64"}, {Name: "exit", Op: "=", Value: "-EACCES"}},
+				Keys:   []string{"access"},
+			},
+			want: kernelRule{Flags: 4, Action: 2, Mask: maskOf(257, 2), Fields: []kernelField{
+				{Type: 11, Op: opEqual, Value: 0xc000003e},
+				{Type: 103, Op: opEqual, Value: 0xfffffff3},
+				{Type: 210, Op: opEqual, Str: "access"},
+			}},
+		},
+		{
+			name: "syscalls of b32",
+			rule: CompiledRule{
+				Op: "-a", Action: "always", List: "exit", Syscalls: []string{"execve", "11"}, SyscallIndex: 1,
+				Fields: []CompiledField{{Name: "arch", Op: "=", Value: "i386"}},
+			},
+			want: kernelRule{Flags: 4, Action: 2, Mask: maskOf(11), Fields: []kernelField{{Type: 11, Op: opEqual, Value: 0x40000003}}},
+		},
+		{
+			name: "syscalls of aarch64",
+			rule: CompiledRule{
+				Op: "-a", Action: "always", List: "exit", Syscalls: []string{"execve"}, SyscallIndex: 1,
+				Fields: []CompiledField{{Name: "arch", Op: "=", Value: "aarch64"}},
+			},
+			want: kernelRule{Flags: 4, Action: 2, Mask: maskOf(221), Fields: []kernelField{{Type: 11, Op: opEqual, Value: 0xc00000b7}}},
+		},
+		{
+			name: "keys joined",
+			rule: CompiledRule{
+				Op: "-a", Action: "always", List: "exit", Syscalls: []string{"all"},
+				Fields: []CompiledField{{Name: "uid", Op: "!=", Value: "euid", Compare: true}, {Name: "euid", Op: "=", Value: "0"}},
+				Keys:   []string{"setuid", "priv"},
+			},
+			want: kernelRule{Flags: 4, Action: 2, Mask: maskAll(), Fields: []kernelField{
+				{Type: 111, Op: opNotEqual, Value: 11},
+				{Type: 2, Op: opEqual, Value: 0},
+				{Type: 210, Op: opEqual, Str: "setuid\x01priv"},
+			}},
+		},
+		{
+			name: "exit without syscalls",
+			rule: CompiledRule{Op: "-a", Action: "never", List: "exit", Fields: []CompiledField{{Name: "exe", Op: "=", Value: "/usr/bin/containerd"}}},
+			want: kernelRule{Flags: 4, Action: 0, Mask: maskAll(), Fields: []kernelField{{Type: 112, Op: opEqual, Str: "/usr/bin/containerd"}}},
+		},
+		{
+			name: "task",
+			rule: CompiledRule{Op: "-a", Action: "never", List: "task", Fields: []CompiledField{{Name: "uid", Op: "=", Value: "0"}}},
+			want: kernelRule{Flags: 1, Action: 0, Fields: []kernelField{{Type: 1, Op: opEqual, Value: 0}}},
+		},
+		{
+			name: "user",
+			rule: CompiledRule{Op: "-a", Action: "always", List: "user", Fields: []CompiledField{{Name: "auid", Op: ">=", Value: "1000"}}, Keys: []string{"u"}},
+			want: kernelRule{Flags: 0, Action: 2, Fields: []kernelField{{Type: 9, Op: opGreaterEqual, Value: 1000}, {Type: 210, Op: opEqual, Str: "u"}}},
+		},
+		{
+			name: "exclude",
+			rule: CompiledRule{Op: "-a", Action: "never", List: "exclude", Fields: []CompiledField{{Name: "msgtype", Op: "=", Value: "CWD"}}},
+			want: kernelRule{Flags: 5, Action: 0, Fields: []kernelField{{Type: 12, Op: opEqual, Value: 1307}}},
+		},
+		{
+			name: "filesystem",
+			rule: CompiledRule{Op: "-a", Action: "never", List: "filesystem", Fields: []CompiledField{{Name: "fstype", Op: "=", Value: "tracefs"}}},
+			want: kernelRule{Flags: 6, Action: 0, Fields: []kernelField{{Type: 26, Op: opEqual, Value: 0x74726163}}},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := testEncoder().encodeRule(test.rule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("encodeRule() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEncodeRuleArchOfNode(t *testing.T) {
+	previous := nodeMachine
+	t.Cleanup(func() { nodeMachine = previous })
+
+	for _, test := range []struct {
+		machine string
+		arches  map[string]kernelRule
+		execve  int
+	}{
+		{"amd64", map[string]kernelRule{
+			"b64": {Flags: 4, Action: 2, Mask: maskOf(59), Fields: []kernelField{{Type: 11, Op: opEqual, Value: 0xc000003e}}},
+			"b32": {Flags: 4, Action: 2, Mask: maskOf(11), Fields: []kernelField{{Type: 11, Op: opEqual, Value: 0x40000003}}},
+		}, 59},
+		{"arm64", map[string]kernelRule{
+			"b64": {Flags: 4, Action: 2, Mask: maskOf(221), Fields: []kernelField{{Type: 11, Op: opEqual, Value: 0xc00000b7}}},
+			"b32": {Flags: 4, Action: 2, Mask: maskOf(11), Fields: []kernelField{{Type: 11, Op: opEqual, Value: 0x40000028}}},
+		}, 221},
+	} {
+		nodeMachine = test.machine
+		for arch, want := range test.arches {
+			rule := CompiledRule{Op: "-a", Action: "always", List: "exit", Syscalls: []string{"execve"}, SyscallIndex: 1,
+				Fields: []CompiledField{{Name: "arch", Op: "=", Value: arch}}}
+			if got, err := testEncoder().encodeRule(rule); err != nil || !reflect.DeepEqual(got, want) {
+				t.Errorf("%s arch=%s: encodeRule() = %+v, %v, want %+v", test.machine, arch, got, err, want)
+			}
+		}
+
+		// Without an arch field, syscall names are resolved for the node
+		rule := CompiledRule{Op: "-a", Action: "always", List: "exit", Syscalls: []string{"execve"}}
+		if got, err := testEncoder().encodeRule(rule); err != nil || got.Mask != maskOf(test.execve) {
+			t.Errorf("%s: encodeRule() = %+v, %v, want execve of the node", test.machine, got, err)
+		}
+	}
+}
+
+// Rules the encoder cannot encode exactly like auditctl fail, so the monitor restarts auditd instead.
+func TestEncodeRuleUnsupported(t *testing.T) {
+	arch := func(op, value string) []CompiledField {
+		return []CompiledField{{Name: "arch", Op: op, Value: value}}
+	}
+	for name, rule := range map[string]CompiledRule{
+		"prepend":               {Op: "-A", Action: "always", List: "exit", Syscalls: []string{"execve"}, Fields: arch("=", "x86_64"), SyscallIndex: 1},
+		"delete":                {Op: "-d", Action: "always", List: "exit", Syscalls: []string{"execve"}, Fields: arch("=", "x86_64"), SyscallIndex: 1},
+		"io_uring":              {Op: "-a", Action: "always", List: "io_uring", Syscalls: []string{"openat"}},
+		"arch after syscalls":   {Op: "-a", Action: "always", List: "exit", Syscalls: []string{"execve"}, Fields: arch("=", "x86_64")},
+		"syscalls after arch!=": {Op: "-a", Action: "always", List: "exit", Syscalls: []string{"execve"}, Fields: arch("!=", "i386"), SyscallIndex: 1},
+		"unknown arch":          {Op: "-a", Action: "always", List: "exit", Syscalls: []string{"execve"}, Fields: arch("=", "ppc64le"), SyscallIndex: 1},
+		"unknown syscall":       {Op: "-a", Action: "always", List: "exit", Syscalls: []string{"socketcall"}, Fields: arch("=", "x86_64"), SyscallIndex: 1},
+		"syscall out of range":  {Op: "-a", Action: "always", List: "exit", Syscalls: []string{"2048"}, Fields: arch("=", "x86_64"), SyscallIndex: 1},
+		"exclude with key":      {Op: "-a", Action: "never", List: "exclude", Fields: []CompiledField{{Name: "msgtype", Op: "=", Value: "CWD"}}, Keys: []string{"k"}},
+		"unsupported field":     {Op: "-a", Action: "always", List: "exit", Fields: []CompiledField{{Name: "exit", Op: "=", Value: "-ENOTCONN"}}},
+	} {
+		if got, err := testEncoder().encodeRule(rule); err == nil {
+			t.Errorf("%s: encodeRule() = %+v, want an error", name, got)
+		}
+	}
+}
+
+func TestEncodeWatch(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "passwd")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		watch CompiledWatch
+		want  []kernelField
+	}{
+		{CompiledWatch{Path: file, Perms: "wa", Keys: []string{"identity"}}, []kernelField{
+			{Type: 105, Op: opEqual, Str: file}, {Type: 106, Op: opEqual, Value: 10}, {Type: 210, Op: opEqual, Str: "identity"},
+		}},
+		{CompiledWatch{Path: file}, []kernelField{{Type: 105, Op: opEqual, Str: file}, {Type: 106, Op: opEqual, Value: 15}}},
+		{CompiledWatch{Path: dir + "/", Perms: "r", Keys: []string{"a", "b"}}, []kernelField{
+			{Type: 107, Op: opEqual, Str: dir}, {Type: 106, Op: opEqual, Value: 4}, {Type: 210, Op: opEqual, Str: "a\x01b"},
+		}},
+		{CompiledWatch{Path: filepath.Join(dir, "missing"), Perms: "x"}, []kernelField{
+			{Type: 105, Op: opEqual, Str: filepath.Join(dir, "missing")}, {Type: 106, Op: opEqual, Value: 1},
+		}},
+	} {
+		got, err := testEncoder().encodeWatch(test.watch)
+		want := kernelRule{Flags: 4, Action: 2, Mask: maskAll(), Fields: test.want}
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("encodeWatch(%+v) = %+v, %v, want %+v", test.watch, got, err, want)
+		}
+	}
+
+	if _, err := testEncoder().encodeWatch(CompiledWatch{Remove: true, Path: file}); err == nil {
+		t.Error("-W was encoded")
+	}
+}
+
+// marshal writes struct audit_rule_data: flags, action, field_count, mask[64], fields[64], values[64],
+// fieldflags[64], buflen, and buf.
+func TestMarshal(t *testing.T) {
+	rule := kernelRule{Flags: 4, Action: 2, Mask: maskOf(59), Fields: []kernelField{
+		{Type: 11, Op: opEqual, Value: 0xc000003e},
+		{Type: 112, Op: opNotEqual, Str: "/usr/bin/runc"},
+		{Type: 210, Op: opEqual, Str: "exec"},
+	}}
+	data := rule.marshal()
+
+	u32 := func(offset int) uint32 { return binary.NativeEndian.Uint32(data[offset:]) }
+	const fields, values, fieldflags, buflen = 268, 524, 780, 1036
+	if len(data) != 1040+len("/usr/bin/runcexec") {
+		t.Fatalf("marshal() returned %d bytes", len(data))
+	}
+	for _, check := range []struct {
+		name      string
+		got, want uint32
+	}{
+		{"flags", u32(0), 4},
+		{"action", u32(4), 2},
+		{"field_count", u32(8), 3},
+		{"mask[1]", u32(12 + 4), 1 << 27},
+		{"fields[0]", u32(fields), 11},
+		{"fields[1]", u32(fields + 4), 112},
+		{"fields[2]", u32(fields + 8), 210},
+		{"values[0]", u32(values), 0xc000003e},
+		{"values[1]", u32(values + 4), uint32(len("/usr/bin/runc"))},
+		{"values[2]", u32(values + 8), uint32(len("exec"))},
+		{"fieldflags[0]", u32(fieldflags), opEqual},
+		{"fieldflags[1]", u32(fieldflags + 4), opNotEqual},
+		{"buflen", u32(buflen), uint32(len("/usr/bin/runcexec"))},
+	} {
+		if check.got != check.want {
+			t.Errorf("%s = %#x, want %#x", check.name, check.got, check.want)
+		}
+	}
+	if got := string(data[1040:]); got != "/usr/bin/runcexec" {
+		t.Errorf("buf = %q", got)
+	}
+
+	// The kernel lists the length of a string field as its value
+	decoded, err := unmarshalRule(data)
+	rule.Fields[1].Value, rule.Fields[2].Value = uint32(len("/usr/bin/runc")), uint32(len("exec"))
+	if err != nil || !reflect.DeepEqual(decoded, rule) {
+		t.Errorf("unmarshalRule() = %+v, %v, want %+v", decoded, err, rule)
+	}
+	if _, err := unmarshalRule(data[:100]); err == nil {
+		t.Error("a short rule was decoded")
+	}
+	if _, err := unmarshalRule(data[:1040+4]); err == nil {
+		t.Error("a rule with a truncated string was decoded")
+	}
+}
+
+func TestRuleKey(t *testing.T) {
+	watch := kernelRule{Flags: 4, Action: 2, Mask: maskAll(), Fields: []kernelField{{Type: 105, Op: opEqual, Str: "/etc/passwd"}}}
+
+	// The kernel sets the syscall class bits in the last word of the mask
+	listed := watch
+	listed.Mask[auditBitmaskSize-1] = 0xffff0000
+	if listed.key() != watch.key() {
+		t.Error("the syscall class bits changed the key")
+	}
+
+	success := kernelRule{Flags: 4, Action: 2, Fields: []kernelField{{Type: 104, Op: opEqual, Value: 0}}}
+	failure := success
+	failure.Fields = []kernelField{{Type: 104, Op: opEqual, Value: 2}}
+	if success.key() != failure.key() {
+		t.Error("success=0 as listed by the kernel changed the key")
+	}
+
+	other := watch
+	other.Fields = []kernelField{{Type: 105, Op: opEqual, Str: "/etc/shadow"}}
+	if other.key() == watch.key() || strings.Contains(other.key(), "passwd") {
+		t.Error("rules on different paths have the same key")
+	}
+}
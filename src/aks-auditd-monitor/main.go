@@ -1,9 +1,18 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
@@ -22,7 +31,39 @@ const restartDelay = 30 * time.Second
 // auditd rules directory
 const rulesDirectory = "/etc/audit/rules.d"
 
+// auditd plugins directory
+const pluginsDirectory = "/etc/audit/plugins.d"
+
+// auditd configuration file. auditd only reads it when it starts, so a change requires a restart.
+const auditdConfFile = "/etc/audit/auditd.conf"
+
+// File written to the history directory aks-auditd keeps in the rules directory when auditd fails to load the rules.
+// aks-auditd then rolls the node back to the previous ruleset.
+const loadFailureFileName = "load-failed.json"
+
+// File the monitor writes to the rules directory when the kernel audit configuration is immutable and a rules change
+// cannot be applied until the node reboots. aks-auditd reads it to expose the state on the node. The prefix keeps
+// aks-auditd and augenrules from treating it as a rules file.
+const rebootRequiredFileName = ".aks-auditd-reboot-required.json"
+
+// Manifest aks-auditd keeps in the rules directory. It lists the files of the ruleset aks-auditd applied, and the
+// digest of the ruleset.
+const manifestFileName = ".aks-auditd-manifest.json"
+
+// Journal aks-auditd keeps in a rules or plugins directory while it switches a new set of files in. Until aks-auditd
+// removes it, the directory holds a mix of old and new files, so nothing is loaded from it.
+const journalFileName = ".aks-auditd-journal.json"
+
+// Value of enabled in the kernel audit status when -e 2 locked the audit configuration until the next reboot
+const auditImmutable = 2
+
+// GID of the audit admins group created by aks-auditd-init. Plugin files keep this group so aks-auditd can read them.
+const auditadminsGID = 808
+
 func main() {
+	ctx, stop, reload := notifySignals()
+	defer stop()
+
 	// Initialize the watcher
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
@@ -31,10 +72,14 @@ func main() {
 	defer watcher.Close()
 
 	// Start listening for events.
-	go watchLoop(watcher)
+	done := make(chan struct{})
+	go func() {
+		watchLoop(ctx, watcher, reload)
+		close(done)
+	}()
 
 	// Add the directories to the list of watches.
-	for _, p := range []string{rulesDirectory} {
+	for _, p := range []string{rulesDirectory, pluginsDirectory, filepath.Dir(auditdConfFile)} {
 		err = watcher.Add(p)
 		if err != nil {
 			log.Fatalf("%q: %s", p, err)
@@ -42,22 +87,83 @@ func main() {
 		log.Debug("Watching: ", p)
 	}
 
+	clearRebootRequired(rulesDirectory)
+
 	log.Info("Starting aks-auditd-monitor. Control-C to exit.")
-	<-make(chan struct{}) // Block forever
+	<-done // Block until the watch loop exits
+	log.Info("Stopped aks-auditd-monitor.")
+}
+
+// notifySignals returns a context that is cancelled by SIGTERM or SIGINT, and a channel that receives SIGHUP. SIGTERM
+// and SIGINT stop the monitor once a restart in progress completes. SIGHUP restarts auditd right away. stop releases
+// both.
+func notifySignals() (context.Context, context.CancelFunc, chan os.Signal) {
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	return ctx, func() {
+		signal.Stop(reload)
+		cancel()
+	}, reload
 }
 
 // watchLoop
 // Watch loop watches for any changes in the directories we are monitoring. If a change is detected, it queues up the event for a
-// set amount of time before restarting the auditd service. This code restarts the auditd service by relying on an event timeout
-// of 10 seconds. If something continuously writes to any of the monitored directories, the auditd service will never restart.
-// Because the rules files are not expected to change frequenty, this should not be an issue.
-func watchLoop(w *fsnotify.Watcher) {
+// set amount of time before acting on it. Changes to rules files are loaded into the kernel without restarting auditd where
+// possible. Changes to auditd.conf restart the auditd service. Changes to plugin files only reload the auditd dispatcher.
+// This code relies on an event timeout of 10 seconds. If something continuously writes to any of the monitored
+// directories, the queued action will never run. Because the rules and plugin files are not expected to change
+// frequenty, this should not be an issue.
+//
+// While aks-auditd switches a new set of files into a directory, a queued load, restart, or reload of that directory
+// waits until the switch is complete, so auditd only ever loads the old set or the new set. The removal of the journal
+// of the switch queues the change like any other event.
+//
+// When ctx is cancelled, any queued restart or reload runs before the loop returns, so a rules change that arrived just
+// before the monitor was stopped is not lost. A value on reload restarts auditd immediately, or once a switch in
+// progress is complete.
+func watchLoop(ctx context.Context, w *fsnotify.Watcher, reload <-chan os.Signal) {
 
 	watcherTimeout := 10 * time.Second // Timeout we use to check if no events have occurred, but auditd needs to be restarted.
-	var pauseStartTime time.Time       // Time when the first event occurs.
+	var pauseStartTime time.Time       // Time when the first rules or auditd.conf event occurs.
+	var reloadStartTime time.Time      // Time when the first plugins event occurs.
+	restartRequired := false           // Set when a queued change requires a full auditd restart.
 
 	for {
 		select {
+		case <-ctx.Done():
+			// A switch still in progress queues the change again when its journal is removed, once the monitor runs again
+			if !pauseStartTime.IsZero() && !waitForSwitch(rulesDirectory, watcherTimeout) {
+				pauseStartTime = time.Time{}
+			}
+			if !reloadStartTime.IsZero() && !waitForSwitch(pluginsDirectory, watcherTimeout) {
+				reloadStartTime = time.Time{}
+			}
+			if !pauseStartTime.IsZero() {
+				log.Info("Shutting down with a queued rules change. Loading the rules.")
+				enforcePluginPermissions()
+				loadRules(restartRequired)
+			}
+			// A restart also reloads the dispatcher
+			if !reloadStartTime.IsZero() && (pauseStartTime.IsZero() || !restartRequired) {
+				log.Info("Shutting down with a queued reload. Reloading the auditd dispatcher.")
+				enforcePluginPermissions()
+				reloadDispatcher()
+			}
+			return
+		case <-reload:
+			if switchInProgress(rulesDirectory) || switchInProgress(pluginsDirectory) {
+				log.Info("Received SIGHUP. Restarting auditd once aks-auditd completes the switch of files in progress.")
+				restartRequired = true
+				pauseStartTime = time.Now().Add(-restartDelay)
+				continue
+			}
+			log.Info("Received SIGHUP. Restarting auditd.")
+			enforcePluginPermissions()
+			restartAuditd()
+			pauseStartTime = time.Time{} // Reset the "pause" timers.
+			reloadStartTime = time.Time{}
+			restartRequired = false
 		// Read from Errors.
 		case err, ok := <-w.Errors:
 			if !ok {
@@ -69,28 +175,82 @@ func watchLoop(w *fsnotify.Watcher) {
 				return
 			}
 
-			// If a change is detected on a rules or a config file, handle the file and queue up an auditd restart.
-			// It is possible for a file ending in .conf in the rules file and vise versa to trigger an auditd restart
-			// with the logic below, but it will not cause any issues.
-			if event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Remove) != 0 &&
-				(isRulesFile(event.Name)) {
+			if event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Remove) == 0 {
+				continue
+			}
+
+			// If a change is detected on a rules file, queue up loading the rules. A change of auditd.conf queues up an
+			// auditd restart, which also loads the rules. If a change is detected on a plugin file, queue up a
+			// dispatcher reload.
+			switch dir := filepath.Dir(event.Name); {
+			case dir == rulesDirectory && (isRulesFile(event.Name) || isSwitchComplete(event)), event.Name == auditdConfFile:
 				log.Infof("Change detected: %s - %s", event.Op, event.Name)
+				restartRequired = restartRequired || event.Name == auditdConfFile
 				if pauseStartTime.IsZero() {
 					pauseStartTime = time.Now() // Start the "pause" timer.
-					log.Infof("Queuing up events for %v seconds before an auditd restart.", restartDelay)
+					log.Infof("Queuing up events for %v seconds before loading the changes.", restartDelay)
+				}
+			case dir == pluginsDirectory && (isPluginFile(event.Name) || isSwitchComplete(event)):
+				log.Infof("Change detected: %s - %s", event.Op, event.Name)
+				// Take ownership of the file right away, so it is never left owned by aks-auditd while the reload is queued
+				if event.Op&fsnotify.Remove == 0 && isPluginFile(event.Name) {
+					enforcePluginFile(event.Name)
+				}
+				if reloadStartTime.IsZero() {
+					reloadStartTime = time.Now() // Start the "pause" timer.
+					log.Infof("Queuing up events for %v seconds before an auditd dispatcher reload.", restartDelay)
 				}
 			}
 
 			// Timeout case
 		case <-time.After(watcherTimeout):
 			log.Debugf("No events received for %v seconds. Executing another process...", watcherTimeout)
-			if !pauseStartTime.IsZero() && time.Since(pauseStartTime) > restartDelay {
-				log.Info("Pause for events timer expired. Restarting auditd.")
-				restartAuditd()              // Block until auditd is restarted
+			if !pauseStartTime.IsZero() && time.Since(pauseStartTime) > restartDelay && switchInProgress(rulesDirectory) {
+				log.Info("aks-auditd is switching in a new set of rules files. Loading the changes once the switch is complete.")
+			} else if !pauseStartTime.IsZero() && time.Since(pauseStartTime) > restartDelay {
+				log.Info("Pause for events timer expired. Loading the changes.")
+				enforcePluginPermissions()   // A restart also loads the plugins
+				loadRules(restartRequired)   // Block until the rules are loaded
 				pauseStartTime = time.Time{} // Reset the "pause" timer.
+				if restartRequired {
+					reloadStartTime = time.Time{}
+				}
+				restartRequired = false
 			}
+			if !reloadStartTime.IsZero() && time.Since(reloadStartTime) > restartDelay && switchInProgress(pluginsDirectory) {
+				log.Info("aks-auditd is switching in a new set of plugin files. Reloading once the switch is complete.")
+			} else if !reloadStartTime.IsZero() && time.Since(reloadStartTime) > restartDelay {
+				log.Info("Pause for events timer expired. Reloading the auditd dispatcher.")
+				enforcePluginPermissions()
+				reloadDispatcher()
+				reloadStartTime = time.Time{} // Reset the "pause" timer.
+			}
+		}
+	}
+}
+
+// switchInProgress returns true while aks-auditd is switching a new set of files into dir.
+func switchInProgress(dir string) bool {
+	_, err := os.Lstat(filepath.Join(dir, journalFileName))
+	return err == nil
+}
+
+// isSwitchComplete returns true if the event is the removal of the journal of a switch, after which the directory
+// holds the complete new set of files.
+func isSwitchComplete(event fsnotify.Event) bool {
+	return filepath.Base(event.Name) == journalFileName && event.Op&fsnotify.Remove != 0
+}
+
+// waitForSwitch waits up to timeout for a switch of files into dir to complete. It returns false when the switch is
+// still in progress.
+func waitForSwitch(dir string, timeout time.Duration) bool {
+	for deadline := time.Now().Add(timeout); switchInProgress(dir); time.Sleep(100 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			log.Warnf("aks-auditd is still switching in a new set of files in %s. Not loading them.", dir)
+			return false
 		}
 	}
+	return true
 }
 
 // restartAuditd restarts the auditd service
@@ -104,10 +264,17 @@ func restartAuditd() {
 	restarting = true
 	mu.Unlock()
 
-	log.Info("Restarting auditd service.")
-	cmd := exec.Command("systemctl", "restart", "auditd")
-	if err := cmd.Run(); err != nil {
+	// With an immutable audit configuration, a restart neither removes nor adds a rule, and augenrules fails, which
+	// would roll back a ruleset that is fine. Only a reboot applies the rules.
+	if isImmutable() {
+		markRebootRequired(rulesDirectory)
+	} else if output, err := restartService(); err != nil {
 		log.Errorf("Failed to restart auditd: %v", err)
+		reportLoadFailure(rulesDirectory, fmt.Sprintf("systemctl restart auditd: %v: %s", err, strings.TrimSpace(string(output))))
+	} else if output, err := exec.Command("augenrules", "--load").CombinedOutput(); err != nil {
+		// The auditd unit ignores augenrules errors on start, so load the rules again to find out if they are valid.
+		log.Errorf("Failed to load the auditd rules: %v Output: %s", err, string(output))
+		reportLoadFailure(rulesDirectory, fmt.Sprintf("augenrules --load: %v: %s", err, strings.TrimSpace(string(output))))
 	}
 
 	// Delay to avoid rapid restarts and reset the flag
@@ -117,8 +284,270 @@ func restartAuditd() {
 	mu.Unlock()
 }
 
+// reportLoadFailure tells aks-auditd that auditd could not load the current rules in rulesDir, so it rolls the node
+// back to the previous ruleset. Nothing is reported when aks-auditd keeps no history of the rules on this node.
+func reportLoadFailure(rulesDir, reason string) {
+	reported, err := writeLoadFailure(rulesDir, reason)
+	switch {
+	case err != nil:
+		log.Errorf("Failed to report the load failure: %v", err)
+	case !reported:
+		log.Debug("No ruleset history on this node. Not reporting the load failure.")
+	default:
+		log.Warn("Reported the load failure to aks-auditd. The node is rolled back to the previous ruleset.")
+	}
+}
+
+// writeLoadFailure writes the load failure to the history directory of the rules in rulesDir. It returns false when
+// aks-auditd keeps no history of them.
+func writeLoadFailure(rulesDir, reason string) (bool, error) {
+	historyDir, err := historyDirectory(rulesDir)
+	if err != nil || historyDir == "" {
+		return false, err
+	}
+
+	data, err := json.Marshal(struct {
+		Timestamp time.Time `json:"timestamp"`
+		Error     string    `json:"error"`
+	}{time.Now().UTC(), reason})
+	if err != nil {
+		return false, err
+	}
+
+	loadFailureFile := filepath.Join(historyDir, loadFailureFileName)
+	tmpFile := loadFailureFile + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmpFile, loadFailureFile)
+}
+
+// historyDirectory returns the directory in rulesDir where aks-auditd keeps the history of the rulesets it applied, as
+// named in the compiled ruleset aks-auditd writes next to the rules. It returns an empty string when aks-auditd keeps
+// no history, or has not compiled the rules yet.
+func historyDirectory(rulesDir string) (string, error) {
+	var compiled CompiledRuleset
+	data, err := os.ReadFile(filepath.Join(rulesDir, compiledFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal(data, &compiled); err != nil {
+		return "", fmt.Errorf("invalid compiled ruleset in %s: %w", rulesDir, err)
+	}
+
+	if compiled.History == "" {
+		return "", nil
+	}
+	if !filepath.IsLocal(compiled.History) {
+		return "", fmt.Errorf("the history directory %q is not in %s", compiled.History, rulesDir)
+	}
+	historyDir := filepath.Join(rulesDir, compiled.History)
+	if _, err := os.Stat(historyDir); err != nil {
+		return "", err
+	}
+	return historyDir, nil
+}
+
+// restartService restarts the auditd system service and returns the output of systemctl.
+func restartService() ([]byte, error) {
+	log.Info("Restarting auditd service.")
+	return exec.Command("systemctl", "restart", "auditd").CombinedOutput()
+}
+
+// isImmutable returns true when -e 2 locked the kernel audit configuration. When the status cannot be read, the
+// configuration is assumed to be mutable, so the restart is tried as before.
+func isImmutable() bool {
+	enabled, err := auditEnabled()
+	if err != nil {
+		log.Warnf("Unable to read the kernel audit status: %v", err)
+		return false
+	}
+	return enabled == auditImmutable
+}
+
+// auditEnabled returns the enabled value of the kernel audit status: 0 when auditing is disabled, 1 when it is enabled,
+// and 2 when the audit configuration is immutable.
+func auditEnabled() (int, error) {
+	output, err := exec.Command("auditctl", "-s").CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("auditctl -s: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "enabled" {
+			return strconv.Atoi(fields[1])
+		}
+	}
+	return 0, fmt.Errorf("auditctl -s: no enabled value in %q", strings.TrimSpace(string(output)))
+}
+
+// RebootRequired records that the ruleset with the given digest was not applied because the audit configuration is
+// immutable. BootID ties the state to the current boot, as the rules on the node are loaded on the next one.
+type RebootRequired struct {
+	Timestamp time.Time `json:"timestamp"`
+	Digest    string    `json:"digest"`
+	BootID    string    `json:"bootID"`
+}
+
+// markRebootRequired records that the rules in rulesDir wait for a reboot. The digest is the one aks-auditd records
+// for the ruleset in its history, so the state names the ruleset that is not applied.
+func markRebootRequired(rulesDir string) {
+	digest, err := rulesetDigest(rulesDir)
+	if err != nil {
+		log.Errorf("Failed to read the digest of the ruleset: %v", err)
+	}
+	log.Warnf("The audit configuration is immutable (-e 2). Not restarting auditd. Reboot the node to apply ruleset %s.", digest)
+
+	data, err := json.Marshal(RebootRequired{Timestamp: time.Now().UTC(), Digest: digest, BootID: bootID()})
+	if err != nil {
+		log.Errorf("Failed to encode the reboot required state: %v", err)
+		return
+	}
+	rebootRequiredFile := filepath.Join(rulesDir, rebootRequiredFileName)
+	tmpFile := rebootRequiredFile + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		log.Errorf("Failed to record the reboot required state: %v", err)
+		return
+	}
+	if err := os.Rename(tmpFile, rebootRequiredFile); err != nil {
+		log.Errorf("Failed to record the reboot required state: %v", err)
+	}
+}
+
+// clearRebootRequired removes the reboot required state recorded in rulesDir during an earlier boot. The rules on the
+// node were loaded when the node booted, so they are applied.
+func clearRebootRequired(rulesDir string) {
+	var state RebootRequired
+	rebootRequiredFile := filepath.Join(rulesDir, rebootRequiredFileName)
+	data, err := os.ReadFile(rebootRequiredFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &state)
+	}
+	if err == nil && state.BootID == bootID() {
+		log.Warnf("The node still requires a reboot to apply ruleset %s.", state.Digest)
+		return
+	}
+
+	if err := os.Remove(rebootRequiredFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Errorf("Failed to clear the reboot required state: %v", err)
+		return
+	}
+	log.Info("The node rebooted. Cleared the reboot required state.")
+}
+
+// bootID returns the random ID the kernel generates on every boot.
+func bootID() string {
+	id, err := os.ReadFile("/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		log.Warnf("Unable to read the boot ID: %v", err)
+		return ""
+	}
+	return strings.TrimSpace(string(id))
+}
+
+// rulesetDigest returns the digest aks-auditd recorded in the manifest of rulesDir for the ruleset it applied there,
+// which is the digest the ruleset has in the history.
+func rulesetDigest(rulesDir string) (string, error) {
+	var manifest struct {
+		Digest string `json:"digest"`
+	}
+	data, err := os.ReadFile(filepath.Join(rulesDir, manifestFileName))
+	if err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return "", err
+	}
+	if manifest.Digest == "" {
+		return "", errors.New("the manifest has no ruleset digest yet")
+	}
+	return manifest.Digest, nil
+}
+
+// reloadDispatcher sends SIGHUP to auditd, which rereads its configuration and restarts the dispatcher with the current
+// plugin configuration. Unlike a restart, the kernel audit rules remain loaded.
+func reloadDispatcher() {
+	mu.Lock()
+	if restarting {
+		log.Info("Restart already in progress, skipping dispatcher reload...")
+		mu.Unlock()
+		return
+	}
+	restarting = true
+	mu.Unlock()
+
+	log.Info("Reloading auditd dispatcher.")
+	cmd := exec.Command("systemctl", "kill", "--kill-who=main", "--signal=SIGHUP", "auditd")
+	if err := cmd.Run(); err != nil {
+		log.Errorf("Failed to reload auditd dispatcher: %v", err)
+	}
+
+	// Delay to avoid rapid reloads and reset the flag
+	time.Sleep(1 * time.Second)
+	mu.Lock()
+	restarting = false
+	mu.Unlock()
+}
+
+// enforcePluginPermissions sets the ownership and permissions auditd requires on the plugin configuration files.
+// auditd skips any plugin file that is not owned by root or has permissions other than 0600 or 0640. aks-auditd writes
+// these files as its own user, so the owner is reset to root here. The audit-admins group is kept so aks-auditd can
+// still read the files to compare them with the ConfigMap.
+func enforcePluginPermissions() {
+	files, err := os.ReadDir(pluginsDirectory)
+	if err != nil {
+		log.Errorf("Failed to read plugins directory %s: %v", pluginsDirectory, err)
+		return
+	}
+
+	for _, file := range files {
+		path := filepath.Join(pluginsDirectory, file.Name())
+		if file.Type().IsRegular() && isPluginFile(path) {
+			enforcePluginFile(path)
+		}
+	}
+}
+
+// enforcePluginFile sets root ownership and the audit-admins group on a plugin file, and permissions of 0640 unless
+// they are 0600 or 0640 already. A path that is not a regular file, such as a symlink, is left alone.
+func enforcePluginFile(path string) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("Failed to stat plugin file %s: %v", path, err)
+		}
+		return
+	}
+	if !info.Mode().IsRegular() {
+		return
+	}
+
+	if err := os.Lchown(path, 0, auditadminsGID); err != nil {
+		log.Errorf("Failed to set ownership on plugin file %s: %v", path, err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 && perm != 0640 {
+		log.Infof("Changing permissions on plugin file %s from %#o to 0640.", path, perm)
+		if err := os.Chmod(path, 0640); err != nil {
+			log.Errorf("Failed to set permissions on plugin file %s: %v", path, err)
+		}
+	}
+}
+
 // isRulesFile returns true if the file ends in .rules, which is a requirement
 // of auditd rules when run through augenrules.
 func isRulesFile(path string) bool {
 	return strings.HasSuffix(path, ".rules")
 }
+
+// isPluginFile returns true if the file ends in .conf, which is a requirement
+// of auditd plugin configuration files.
+func isPluginFile(path string) bool {
+	return strings.HasSuffix(path, ".conf")
+}
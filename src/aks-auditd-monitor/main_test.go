@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestEnforcePluginFile(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing the owner of a file requires root")
+	}
+	dir := t.TempDir()
+
+	for _, test := range []struct {
+		name string
+		mode os.FileMode
+		want os.FileMode
+	}{
+		{"af_unix.conf", 0644, 0640},
+		{"syslog.conf", 0600, 0600},
+		{"au-remote.conf", 0640, 0640},
+		{"world.conf", 0666, 0640},
+	} {
+		path := filepath.Join(dir, test.name)
+		if err := os.WriteFile(path, []byte("active = yes\n"), test.mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(path, test.mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Lchown(path, 1000, 1000); err != nil {
+			t.Fatal(err)
+		}
+
+		enforcePluginFile(path)
+
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stat := info.Sys().(*syscall.Stat_t)
+		if info.Mode().Perm() != test.want || stat.Uid != 0 || stat.Gid != auditadminsGID {
+			t.Errorf("%s: mode %#o owner %d:%d, want mode %#o owner 0:%d", test.name, info.Mode().Perm(), stat.Uid, stat.Gid, test.want, auditadminsGID)
+		}
+	}
+
+	// A symlink is not followed
+	target := filepath.Join(dir, "target")
+	if err := os.WriteFile(target, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link.conf")
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+	enforcePluginFile(link)
+	if info, err := os.Stat(target); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("target of a symlinked plugin file was changed: %v, %v", info.Mode(), err)
+	}
+
+	// A file removed before the event is handled is ignored
+	enforcePluginFile(filepath.Join(dir, "removed.conf"))
+}
+
+func TestSwitchInProgress(t *testing.T) {
+	dir := t.TempDir()
+	if switchInProgress(dir) {
+		t.Error("a directory without a journal is being switched")
+	}
+	if !waitForSwitch(dir, time.Second) {
+		t.Error("waitForSwitch waited for a directory without a journal")
+	}
+
+	journal := filepath.Join(dir, journalFileName)
+	if err := os.WriteFile(journal, []byte("{}"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if !switchInProgress(dir) {
+		t.Error("a directory with a journal is not being switched")
+	}
+	if waitForSwitch(dir, 200*time.Millisecond) {
+		t.Error("waitForSwitch returned while the journal exists")
+	}
+
+	// The switch completes while the monitor waits
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		os.Remove(journal)
+	}()
+	if !waitForSwitch(dir, 5*time.Second) {
+		t.Error("waitForSwitch did not return once the journal was removed")
+	}
+
+	for _, test := range []struct {
+		event fsnotify.Event
+		want  bool
+	}{
+		{fsnotify.Event{Name: journal, Op: fsnotify.Remove}, true},
+		{fsnotify.Event{Name: journal, Op: fsnotify.Create}, false},
+		{fsnotify.Event{Name: journal, Op: fsnotify.Write}, false},
+		{fsnotify.Event{Name: filepath.Join(dir, "10-audit.rules"), Op: fsnotify.Remove}, false},
+	} {
+		if got := isSwitchComplete(test.event); got != test.want {
+			t.Errorf("isSwitchComplete(%v) = %v, want %v", test.event, got, test.want)
+		}
+	}
+}
+
+func TestWriteLoadFailure(t *testing.T) {
+	rulesDir := t.TempDir()
+	writeCompiled := func(history string) {
+		t.Helper()
+		data, err := json.Marshal(map[string]any{"digest": "abc", "files": map[string]string{}, "history": history})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(rulesDir, compiledFileName), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Nothing is reported before aks-auditd compiled the rules
+	if reported, err := writeLoadFailure(rulesDir, "augenrules --load: exit status 1"); reported || err != nil {
+		t.Errorf("writeLoadFailure without a compiled ruleset returned %v, %v", reported, err)
+	}
+
+	// Nor when aks-auditd keeps no history of the rules
+	writeCompiled("")
+	if reported, err := writeLoadFailure(rulesDir, "augenrules --load: exit status 1"); reported || err != nil {
+		t.Errorf("writeLoadFailure without a history returned %v, %v", reported, err)
+	}
+
+	// The failure is written to the history directory the compiled ruleset names
+	historyDir := filepath.Join(rulesDir, ".custom-history")
+	if err := os.Mkdir(historyDir, 0750); err != nil {
+		t.Fatal(err)
+	}
+	writeCompiled(".custom-history")
+	if reported, err := writeLoadFailure(rulesDir, "augenrules --load: exit status 1"); !reported || err != nil {
+		t.Fatalf("writeLoadFailure returned %v, %v", reported, err)
+	}
+	var failure struct {
+		Timestamp time.Time `json:"timestamp"`
+		Error     string    `json:"error"`
+	}
+	data, err := os.ReadFile(filepath.Join(historyDir, loadFailureFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &failure); err != nil || failure.Error != "augenrules --load: exit status 1" || failure.Timestamp.IsZero() {
+		t.Errorf("load failure is %s, %v", data, err)
+	}
+
+	// A history directory outside the rules directory is refused
+	writeCompiled("../elsewhere")
+	if reported, err := writeLoadFailure(rulesDir, "augenrules --load: exit status 1"); reported || err == nil {
+		t.Errorf("writeLoadFailure outside the rules directory returned %v, %v", reported, err)
+	}
+}
+
+// fakeCommands puts shell scripts, keyed by command name, first on PATH. Every script appends its name and arguments
+// to the returned log file before it runs.
+func fakeCommands(t *testing.T, scripts map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "commands.log")
+	for name, script := range scripts {
+		content := "#!/bin/sh\necho \"" + name + " $*\" >> " + logFile + "\n" + script + "\n"
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return logFile
+}
+
+// waitForLog returns the content of the log file once it contains want, or after timeout.
+func waitForLog(logFile, want string, timeout time.Duration) string {
+	deadline := time.Now().Add(timeout)
+	for {
+		data, _ := os.ReadFile(logFile)
+		if strings.Contains(string(data), want) || time.Now().After(deadline) {
+			return string(data)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWatchLoopSignals(t *testing.T) {
+	logFile := fakeCommands(t, map[string]string{
+		"auditctl":   "echo enabled 1",
+		"systemctl":  "exit 0",
+		"augenrules": "exit 0",
+	})
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+
+	ctx, stop, reload := notifySignals()
+	defer stop()
+	done := make(chan struct{})
+	go func() {
+		watchLoop(ctx, watcher, reload)
+		close(done)
+	}()
+
+	// SIGHUP restarts auditd right away
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	if log := waitForLog(logFile, "augenrules --load", 5*time.Second); !strings.Contains(log, "systemctl restart auditd") {
+		t.Fatalf("SIGHUP did not restart auditd, commands run:\n%s", log)
+	}
+
+	// SIGTERM stops the loop once the restart completes, without running anything when nothing is queued
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("SIGTERM did not stop the watch loop")
+	}
+	if log := waitForLog(logFile, "", 0); strings.Count(log, "systemctl") != 1 {
+		t.Errorf("SIGTERM ran commands with nothing queued:\n%s", log)
+	}
+}
+
+func TestAuditEnabled(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		script        string
+		want          int
+		wantErr       bool
+		wantImmutable bool
+	}{
+		{"enabled", "echo 'enabled 1'\necho 'failure 1'", 1, false, false},
+		{"disabled", "echo 'enabled 0'", 0, false, false},
+		{"immutable", "echo 'enabled 2'\necho 'failure 1'\necho 'pid 1234'", 2, false, true},
+		{"failed", "echo 'permission denied'\nexit 1", 0, true, false},
+		{"no enabled value", "echo 'failure 1'", 0, true, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			fakeCommands(t, map[string]string{"auditctl": test.script})
+
+			got, err := auditEnabled()
+			if (err != nil) != test.wantErr {
+				t.Fatalf("auditEnabled() error = %v, want error %v", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("auditEnabled() = %d, want %d", got, test.want)
+			}
+			// The configuration is assumed to be mutable when the status cannot be read
+			if isImmutable() != test.wantImmutable {
+				t.Errorf("isImmutable() = %v, want %v", !test.wantImmutable, test.wantImmutable)
+			}
+		})
+	}
+}
+
+func TestRebootRequired(t *testing.T) {
+	dir := t.TempDir()
+	manifest := `{"files":{"10-base.rules":"5e0f"},"digest":"9a1c"}`
+	if err := os.WriteFile(filepath.Join(dir, manifestFileName), []byte(manifest), 0640); err != nil {
+		t.Fatal(err)
+	}
+	readState := func() (RebootRequired, bool) {
+		var state RebootRequired
+		data, err := os.ReadFile(filepath.Join(dir, rebootRequiredFileName))
+		if os.IsNotExist(err) {
+			return state, false
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(data, &state); err != nil {
+			t.Fatal(err)
+		}
+		return state, true
+	}
+
+	// The state names the ruleset by the digest aks-auditd recorded, and the boot it was recorded in
+	markRebootRequired(dir)
+	state, exists := readState()
+	if !exists || state.Digest != "9a1c" || state.BootID != bootID() || state.Timestamp.IsZero() {
+		t.Fatalf("reboot required state = %+v, %v, want digest 9a1c in this boot", state, exists)
+	}
+
+	// The node has not rebooted yet
+	clearRebootRequired(dir)
+	if _, exists := readState(); !exists {
+		t.Fatal("the state was cleared before the node rebooted")
+	}
+
+	// The node rebooted
+	state.BootID = "a-previous-boot"
+	data, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, rebootRequiredFileName), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	clearRebootRequired(dir)
+	if _, exists := readState(); exists {
+		t.Error("the state of an earlier boot was not cleared")
+	}
+
+	// A manifest written by an earlier version of aks-auditd has no digest
+	if err := os.WriteFile(filepath.Join(dir, manifestFileName), []byte(`{"files":{}}`), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rulesetDigest(dir); err == nil {
+		t.Error("rulesetDigest() of a manifest without a digest did not fail")
+	}
+}
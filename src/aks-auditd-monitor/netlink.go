@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"syscall"
+)
+
+// Audit netlink message types from linux/audit.h
+const (
+	auditGet        = 1000
+	auditSet        = 1001
+	auditAddRule    = 1011
+	auditDelRule    = 1012
+	auditListRules  = 1013
+	auditSetFeature = 1018
+)
+
+// Bits of the mask of an AUDIT_SET request that select the status values to change
+const (
+	auditStatusEnabled         = 0x01
+	auditStatusFailure         = 0x02
+	auditStatusRateLimit       = 0x08
+	auditStatusBacklogLimit    = 0x10
+	auditStatusBacklogWaitTime = 0x20
+	auditStatusLost            = 0x40
+)
+
+// Version of struct audit_features and the bit of the feature that keeps a set loginuid from being changed
+const (
+	auditFeatureVersion           = 1
+	auditFeatureLoginuidImmutable = 1 << 1
+)
+
+// Time to wait for a reply of the kernel before the request fails
+const netlinkTimeout = 5
+
+// auditStatus is struct audit_status, the kernel audit configuration AUDIT_GET returns and AUDIT_SET changes. Mask
+// selects the values AUDIT_SET changes.
+type auditStatus struct {
+	Mask            uint32
+	Enabled         uint32
+	Failure         uint32
+	PID             uint32
+	RateLimit       uint32
+	BacklogLimit    uint32
+	Lost            uint32
+	Backlog         uint32
+	FeatureBitmap   uint32
+	BacklogWaitTime uint32
+}
+
+// auditConn is a netlink socket to the kernel audit system. Changing the rules requires CAP_AUDIT_CONTROL.
+type auditConn struct {
+	fd  int
+	seq uint32
+}
+
+// dialAudit opens a netlink socket to the kernel audit system.
+func dialAudit() (*auditConn, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_AUDIT)
+	if err != nil {
+		return nil, fmt.Errorf("audit netlink socket: %w", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("audit netlink bind: %w", err)
+	}
+	// A reply that never comes must not block the watch loop
+	timeout := syscall.Timeval{Sec: netlinkTimeout}
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &timeout); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("audit netlink timeout: %w", err)
+	}
+	return &auditConn{fd: fd}, nil
+}
+
+// Close closes the socket.
+func (c *auditConn) Close() error {
+	return syscall.Close(c.fd)
+}
+
+// request sends a message to the kernel and returns the payloads of its replies. With ack, the request returns once
+// the kernel acknowledged it. Without, it returns after the first reply, or after the last one of a multipart reply.
+func (c *auditConn) request(msgType uint16, payload []byte, ack bool) ([][]byte, error) {
+	c.seq++
+	flags := uint16(syscall.NLM_F_REQUEST)
+	if ack {
+		flags |= syscall.NLM_F_ACK
+	}
+
+	msg := make([]byte, syscall.NLMSG_HDRLEN+len(payload))
+	binary.NativeEndian.PutUint32(msg[0:4], uint32(len(msg)))
+	binary.NativeEndian.PutUint16(msg[4:6], msgType)
+	binary.NativeEndian.PutUint16(msg[6:8], flags)
+	binary.NativeEndian.PutUint32(msg[8:12], c.seq)
+	copy(msg[syscall.NLMSG_HDRLEN:], payload)
+	if err := syscall.Sendto(c.fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, fmt.Errorf("audit netlink send: %w", err)
+	}
+
+	var replies [][]byte
+	buf := make([]byte, 1<<16)
+	for {
+		n, _, err := syscall.Recvfrom(c.fd, buf, 0)
+		if err != nil {
+			return nil, fmt.Errorf("audit netlink receive: %w", err)
+		}
+		messages, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, fmt.Errorf("audit netlink receive: %w", err)
+		}
+
+		for _, m := range messages {
+			if m.Header.Seq != c.seq {
+				continue // A late reply to an earlier request
+			}
+			switch m.Header.Type {
+			case syscall.NLMSG_DONE:
+				return replies, nil
+			case syscall.NLMSG_ERROR:
+				if len(m.Data) < 4 {
+					return nil, fmt.Errorf("audit netlink receive: short error message")
+				}
+				// A negative value is an error. AUDIT_SET that resets the lost counter acks with the count.
+				if errno := int32(binary.NativeEndian.Uint32(m.Data[0:4])); errno < 0 {
+					return nil, syscall.Errno(-errno)
+				}
+				return replies, nil
+			default:
+				replies = append(replies, append([]byte(nil), m.Data...))
+				if !ack && m.Header.Flags&syscall.NLM_F_MULTI == 0 {
+					return replies, nil
+				}
+			}
+		}
+	}
+}
+
+// listRules returns the rules the kernel has, with AUDIT_LIST_RULES. The rules of every filter list are in the order
+// the kernel matches them.
+func (c *auditConn) listRules() ([]kernelRule, error) {
+	replies, err := c.request(auditListRules, nil, false)
+	if err != nil {
+		return nil, fmt.Errorf("AUDIT_LIST_RULES: %w", err)
+	}
+
+	rules := make([]kernelRule, 0, len(replies))
+	for _, reply := range replies {
+		rule, err := unmarshalRule(reply)
+		if err != nil {
+			return nil, fmt.Errorf("AUDIT_LIST_RULES: %w", err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// addRule appends the rule to its filter list with AUDIT_ADD_RULE.
+func (c *auditConn) addRule(rule kernelRule) error {
+	if _, err := c.request(auditAddRule, rule.marshal(), true); err != nil {
+		return fmt.Errorf("AUDIT_ADD_RULE %s: %w", rule, err)
+	}
+	return nil
+}
+
+// deleteRule deletes the rule with AUDIT_DEL_RULE. The rule is sent as the kernel listed it.
+func (c *auditConn) deleteRule(rule kernelRule) error {
+	if _, err := c.request(auditDelRule, rule.marshal(), true); err != nil {
+		return fmt.Errorf("AUDIT_DEL_RULE %s: %w", rule, err)
+	}
+	return nil
+}
+
+// status returns the kernel audit configuration with AUDIT_GET.
+func (c *auditConn) status() (auditStatus, error) {
+	var status auditStatus
+	replies, err := c.request(auditGet, nil, false)
+	if err != nil {
+		return status, fmt.Errorf("AUDIT_GET: %w", err)
+	}
+	if len(replies) == 0 {
+		return status, fmt.Errorf("AUDIT_GET: no reply")
+	}
+
+	// Older kernels reply with a shorter struct. The missing values stay 0.
+	values := make([]uint32, 10)
+	for i := range values {
+		if len(replies[0]) >= 4*(i+1) {
+			values[i] = binary.NativeEndian.Uint32(replies[0][4*i:])
+		}
+	}
+	return auditStatus{
+		Mask: values[0], Enabled: values[1], Failure: values[2], PID: values[3], RateLimit: values[4],
+		BacklogLimit: values[5], Lost: values[6], Backlog: values[7], FeatureBitmap: values[8],
+		BacklogWaitTime: values[9],
+	}, nil
+}
+
+// setStatus changes the values of the kernel audit configuration that status.Mask selects with AUDIT_SET.
+func (c *auditConn) setStatus(status auditStatus) error {
+	payload := make([]byte, 0, 40)
+	for _, value := range []uint32{
+		status.Mask, status.Enabled, status.Failure, status.PID, status.RateLimit, status.BacklogLimit, status.Lost,
+		status.Backlog, status.FeatureBitmap, status.BacklogWaitTime,
+	} {
+		payload = binary.NativeEndian.AppendUint32(payload, value)
+	}
+	if _, err := c.request(auditSet, payload, true); err != nil {
+		return fmt.Errorf("AUDIT_SET: %w", err)
+	}
+	return nil
+}
+
+// setFeature turns on and locks the features in mask with AUDIT_SET_FEATURE. Setting a feature that is already on and
+// locked succeeds.
+func (c *auditConn) setFeature(mask uint32) error {
+	payload := make([]byte, 0, 16)
+	for _, value := range []uint32{auditFeatureVersion, mask, mask, mask} {
+		payload = binary.NativeEndian.AppendUint32(payload, value)
+	}
+	if _, err := c.request(auditSetFeature, payload, true); err != nil {
+		return fmt.Errorf("AUDIT_SET_FEATURE: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Effective ruleset aks-auditd compiles from the rules files in the rules directory
+const compiledFileName = ".aks-auditd-compiled.json"
+const compiledFile = rulesDirectory + "/" + compiledFileName
+
+// CompiledRuleset is the effective ruleset aks-auditd writes next to the rules: the lines of the audit.rules augenrules
+// generates, and the digests of the rules files they were compiled from. History names the directory next to the
+// rules where aks-auditd keeps the history of the rulesets it applied, and is empty when it keeps none.
+type CompiledRuleset struct {
+	Digest  string            `json:"digest"`
+	Files   map[string]string `json:"files"`
+	History string            `json:"history"`
+	Lines   []struct {
+		Control *CompiledControl `json:"control"`
+		Watch   *CompiledWatch   `json:"watch"`
+		Rule    *CompiledRule    `json:"rule"`
+	} `json:"lines"`
+}
+
+// desiredState is what the kernel audit configuration looks like once the compiled ruleset is loaded.
+type desiredState struct {
+	rules             []kernelRule
+	status            auditStatus // Values to set, selected by Mask
+	enabled           *uint32     // Value of the last -e, set after the rules
+	loginuidImmutable bool
+}
+
+// loadRules applies a change of the rules files. Unless a full restart is required, the rules are reconciled with the
+// kernel over netlink, so auditd keeps running and no events are dropped during the change. When the change cannot be
+// made live, auditd is restarted as before.
+func loadRules(restart bool) {
+	if !restart && !isImmutable() {
+		err := reconcileRules()
+		if err == nil {
+			return
+		}
+		reconcileFailed(rulesDirectory, err)
+	}
+	restartAuditd()
+}
+
+// loadError is a change of the kernel audit configuration that failed. The rules and status values the kernel had
+// before were restored.
+type loadError struct {
+	err error
+}
+
+func (e *loadError) Error() string {
+	return e.err.Error()
+}
+
+func (e *loadError) Unwrap() error {
+	return e.err
+}
+
+// reconcileFailed logs why the rules in rulesDir could not be reconciled live. When the kernel did not load them, the
+// failure is reported to aks-auditd like a failure of augenrules --load, so it rolls the node back. A ruleset that was
+// not tried, for example because the encoder does not support it, is left to the restart.
+func reconcileFailed(rulesDir string, err error) {
+	log.Warnf("Unable to reconcile the audit rules live: %v. Restarting auditd instead.", err)
+	var failed *loadError
+	if errors.As(err, &failed) {
+		reportLoadFailure(rulesDir, fmt.Sprintf("netlink: %v", err))
+	}
+}
+
+// reconcileRules reads the rules the kernel has, diffs them against the compiled ruleset, and adds and deletes only
+// the rules that changed. Afterwards, the kernel rules are read again and must match the compiled ruleset exactly.
+// Only then are the status values of the control options changed. When a request fails or the kernel rules do not
+// match, the rules and status values the kernel had before are restored, so they stay loaded until auditd is
+// restarted with the new ones, and the error is a *loadError.
+//
+// Nothing is changed when the compiled ruleset is missing or out of date, or uses something the encoder does not
+// support.
+func reconcileRules() error {
+	compiled, err := readCompiled()
+	if err != nil {
+		return err
+	}
+	desired, err := encodeCompiled(compiled)
+	if err != nil {
+		return err
+	}
+
+	conn, err := dialAudit()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := applyRuleset(conn, desired, compiled.Digest); err != nil {
+		return err
+	}
+
+	// Regenerate /etc/audit/audit.rules without loading it, so it matches the rules in the kernel
+	if output, err := exec.Command("augenrules").CombinedOutput(); err != nil {
+		log.Warnf("Failed to regenerate audit.rules: %v Output: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// applyRuleset changes the kernel rules and status to the desired state of the ruleset with the digest.
+func applyRuleset(conn kernelConn, desired desiredState, digest string) error {
+	current, err := conn.listRules()
+	if err != nil {
+		return err
+	}
+	previous, err := conn.status()
+	if err != nil {
+		return err
+	}
+	deletes, adds, err := planRules(current, desired.rules)
+	if err != nil {
+		return err
+	}
+
+	err = applyPlan(conn, deletes, adds)
+	if err == nil {
+		var loaded []kernelRule
+		loaded, err = conn.listRules()
+		if err == nil && !sameRules(loaded, desired.rules) {
+			err = fmt.Errorf("the kernel rules do not match ruleset %s after the change", digest)
+		}
+	}
+	if err == nil {
+		err = applyStatus(conn, desired, previous)
+	}
+	// -e 2 locks the configuration, so it comes last
+	if err == nil && desired.enabled != nil && *desired.enabled != previous.Enabled {
+		err = conn.setStatus(auditStatus{Mask: auditStatusEnabled, Enabled: *desired.enabled})
+	}
+	if err != nil {
+		restoreRules(conn, current)
+		restoreStatus(conn, previous)
+		return &loadError{err}
+	}
+
+	log.WithFields(log.Fields{
+		"deleted":   len(deletes),
+		"added":     len(adds),
+		"unchanged": len(desired.rules) - len(adds),
+	}).Infof("Reconciled the kernel audit rules with ruleset %s without restarting auditd.", digest)
+	return nil
+}
+
+// readCompiled reads the compiled ruleset. It must have been compiled from the rules files that are in the rules
+// directory now.
+func readCompiled() (CompiledRuleset, error) {
+	var compiled CompiledRuleset
+	data, err := os.ReadFile(compiledFile)
+	if err != nil {
+		return compiled, fmt.Errorf("no compiled ruleset: %w", err)
+	}
+	if err := json.Unmarshal(data, &compiled); err != nil {
+		return compiled, fmt.Errorf("invalid compiled ruleset %s: %w", compiledFile, err)
+	}
+
+	files := make(map[string]string)
+	entries, err := os.ReadDir(rulesDirectory)
+	if err != nil {
+		return compiled, err
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !isRulesFile(entry.Name()) || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(rulesDirectory, entry.Name()))
+		if err != nil {
+			return compiled, err
+		}
+		files[entry.Name()] = fmt.Sprintf("%x", sha256.Sum256(data))
+	}
+	if !reflect.DeepEqual(files, compiled.Files) {
+		return compiled, fmt.Errorf("the compiled ruleset %s does not match the rules files", compiled.Digest)
+	}
+	return compiled, nil
+}
+
+// encodeCompiled turns the compiled ruleset into the kernel rules and status values it loads. The ruleset must start
+// with -D, so the rules it loads are the only ones left in the kernel.
+func encodeCompiled(compiled CompiledRuleset) (desiredState, error) {
+	var desired desiredState
+	var encoder ruleEncoder
+	deletesAll := false
+	seen := make(map[string]bool)
+
+	for _, line := range compiled.Lines {
+		var rule kernelRule
+		var err error
+		switch {
+		case line.Control != nil:
+			deletesAll = deletesAll || (line.Control.Option == "-D" && line.Control.Key == "")
+			if err := desired.setControl(*line.Control); err != nil {
+				return desired, err
+			}
+			continue
+		case line.Watch != nil:
+			rule, err = encoder.encodeWatch(*line.Watch)
+		case line.Rule != nil:
+			rule, err = encoder.encodeRule(*line.Rule)
+		default:
+			continue
+		}
+		if err != nil {
+			return desired, err
+		}
+
+		// auditctl fails on a rule the kernel already has
+		if seen[rule.key()] {
+			return desired, fmt.Errorf("the ruleset has the rule %s twice", rule)
+		}
+		seen[rule.key()] = true
+		desired.rules = append(desired.rules, rule)
+	}
+
+	if !deletesAll {
+		return desired, fmt.Errorf("the ruleset does not start with -D")
+	}
+	return desired, nil
+}
+
+// setControl records the status value a control option sets.
+func (d *desiredState) setControl(control CompiledControl) error {
+	value, _ := strconv.ParseUint(control.Value, 10, 32)
+	switch control.Option {
+	case "-D":
+		if control.Key != "" {
+			return fmt.Errorf("-D -k %s only deletes some of the rules", control.Key)
+		}
+	case "-b":
+		d.status.Mask |= auditStatusBacklogLimit
+		d.status.BacklogLimit = uint32(value)
+	case "-f":
+		d.status.Mask |= auditStatusFailure
+		d.status.Failure = uint32(value)
+	case "-r":
+		d.status.Mask |= auditStatusRateLimit
+		d.status.RateLimit = uint32(value)
+	case "--backlog_wait_time":
+		d.status.Mask |= auditStatusBacklogWaitTime
+		d.status.BacklogWaitTime = uint32(value)
+	case "--reset-lost":
+		d.status.Mask |= auditStatusLost
+	case "--loginuid-immutable":
+		d.loginuidImmutable = true
+	case "-e":
+		enabled := uint32(value)
+		d.enabled = &enabled
+	case "-c", "-i":
+		// Only change how auditctl handles errors
+	default:
+		return fmt.Errorf("control option %s is not supported", control.Option)
+	}
+	return nil
+}
+
+// planRules returns the kernel rules to delete and the rules to add, in order, so the kernel ends up with the desired
+// rules. The kernel appends an added rule to the end of its list, so a rule the kernel already has only stays when
+// every desired rule before it on its list stays as well. On every list, the longest run of desired rules from the
+// start that the kernel has in the same order, possibly with other rules between them, stays. Every other kernel rule
+// is deleted, and the desired rules after the run are added.
+func planRules(current, desired []kernelRule) (deletes, adds []kernelRule, err error) {
+	byList := make(map[uint32][]kernelRule)
+	for _, rule := range desired {
+		if rule.Flags&auditFilterPrepend != 0 {
+			return nil, nil, fmt.Errorf("-A rules are not supported")
+		}
+		byList[rule.list()] = append(byList[rule.list()], rule)
+	}
+
+	kept := make(map[uint32]int)
+	for _, rule := range current {
+		list := rule.list()
+		if i := kept[list]; i < len(byList[list]) && byList[list][i].key() == rule.key() {
+			kept[list]++
+			continue
+		}
+		deletes = append(deletes, rule)
+	}
+
+	position := make(map[uint32]int)
+	for _, rule := range desired {
+		list := rule.list()
+		position[list]++
+		if position[list] > kept[list] {
+			adds = append(adds, rule)
+		}
+	}
+	return deletes, adds, nil
+}
+
+// ruleConn is the part of the audit netlink connection that lists and changes the kernel rules.
+type ruleConn interface {
+	listRules() ([]kernelRule, error)
+	addRule(rule kernelRule) error
+	deleteRule(rule kernelRule) error
+}
+
+// kernelConn is the part of the audit netlink connection that changes the kernel rules and status.
+type kernelConn interface {
+	ruleConn
+	status() (auditStatus, error)
+	setStatus(status auditStatus) error
+	setFeature(mask uint32) error
+}
+
+// applyPlan adds and deletes the rules planRules returned. The kernel appends an added rule to the end of its list,
+// after the rules that are deleted, so the rules are added before the old ones are deleted and a changed rule never
+// leaves a gap. Only a rule that stays the same but moves, because a rule before it changed, is briefly missing: the
+// kernel rejects a rule it already has, so the old copy is deleted right before the rule is added again.
+func applyPlan(conn ruleConn, deletes, adds []kernelRule) error {
+	pending := make(map[string]kernelRule)
+	for _, rule := range deletes {
+		pending[rule.key()] = rule
+	}
+
+	for _, rule := range adds {
+		if old, exists := pending[rule.key()]; exists {
+			if err := conn.deleteRule(old); err != nil {
+				return err
+			}
+			delete(pending, rule.key())
+		}
+		if err := conn.addRule(rule); err != nil {
+			return err
+		}
+	}
+	for _, rule := range deletes {
+		if _, exists := pending[rule.key()]; !exists {
+			continue
+		}
+		if err := conn.deleteRule(rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreRules loads the rules the kernel had before a change that failed, so they stay in effect until auditd is
+// restarted.
+func restoreRules(conn ruleConn, previous []kernelRule) {
+	current, err := conn.listRules()
+	if err == nil {
+		var deletes, adds []kernelRule
+		if deletes, adds, err = planRules(current, previous); err == nil {
+			err = applyPlan(conn, deletes, adds)
+		}
+	}
+	if err != nil {
+		log.Errorf("Failed to restore the previous kernel audit rules: %v", err)
+		return
+	}
+	log.Info("Restored the previous kernel audit rules.")
+}
+
+// sameRules returns true if the kernel has the desired rules in the desired order on every list.
+func sameRules(current, desired []kernelRule) bool {
+	byList := func(rules []kernelRule) map[uint32][]string {
+		lists := make(map[uint32][]string)
+		for _, rule := range rules {
+			lists[rule.list()] = append(lists[rule.list()], rule.key())
+		}
+		return lists
+	}
+	return reflect.DeepEqual(byList(current), byList(desired))
+}
+
+// applyStatus sets the status values of the control options that differ from the current ones, and locks the loginuid
+// when the ruleset asks for it.
+func applyStatus(conn kernelConn, desired desiredState, current auditStatus) error {
+	if status := changedStatus(current, desired.status); status.Mask != 0 {
+		if err := conn.setStatus(status); err != nil {
+			return err
+		}
+	}
+
+	if desired.loginuidImmutable {
+		return conn.setFeature(auditFeatureLoginuidImmutable)
+	}
+	return nil
+}
+
+// restoreStatus sets the status values back to the ones the kernel had before a change that failed. A loginuid that
+// was locked stays locked, as the kernel does not unlock it.
+func restoreStatus(conn kernelConn, previous auditStatus) {
+	current, err := conn.status()
+	if err == nil {
+		previous.Mask = auditStatusEnabled | auditStatusFailure | auditStatusRateLimit | auditStatusBacklogLimit |
+			auditStatusBacklogWaitTime
+		if status := changedStatus(current, previous); status.Mask != 0 {
+			err = conn.setStatus(status)
+		}
+	}
+	if err != nil {
+		log.Errorf("Failed to restore the previous kernel audit status: %v", err)
+	}
+}
+
+// changedStatus returns the values of status that differ from the current ones, selected by Mask.
+func changedStatus(current, status auditStatus) auditStatus {
+	for _, value := range []struct {
+		bit              uint32
+		current, desired uint32
+	}{
+		{auditStatusEnabled, current.Enabled, status.Enabled},
+		{auditStatusBacklogLimit, current.BacklogLimit, status.BacklogLimit},
+		{auditStatusFailure, current.Failure, status.Failure},
+		{auditStatusRateLimit, current.RateLimit, status.RateLimit},
+		{auditStatusBacklogWaitTime, current.BacklogWaitTime, status.BacklogWaitTime},
+	} {
+		if value.current == value.desired {
+			status.Mask &^= value.bit
+		}
+	}
+	return status
+}
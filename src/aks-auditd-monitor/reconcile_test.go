@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeKernel keeps the rules and status of the kernel like the audit subsystem does, and records every change.
+type fakeKernel struct {
+	rules      []kernelRule
+	state      auditStatus
+	features   uint32
+	changes    []string
+	failAdd    string // Name of a rule the kernel rejects
+	failStatus uint32 // Status value bits the kernel rejects
+}
+
+func (k *fakeKernel) listRules() ([]kernelRule, error) {
+	return append([]kernelRule(nil), k.rules...), nil
+}
+
+func (k *fakeKernel) addRule(rule kernelRule) error {
+	if ruleName(rule) == k.failAdd {
+		return errors.New("AUDIT_ADD_RULE: invalid argument")
+	}
+	for _, existing := range k.rules {
+		if existing.key() == rule.key() {
+			return errors.New("AUDIT_ADD_RULE: file exists")
+		}
+	}
+	k.rules = append(k.rules, rule)
+	k.changes = append(k.changes, "add "+ruleName(rule))
+	return nil
+}
+
+func (k *fakeKernel) deleteRule(rule kernelRule) error {
+	for i, existing := range k.rules {
+		if existing.key() == rule.key() {
+			k.rules = append(k.rules[:i:i], k.rules[i+1:]...)
+			k.changes = append(k.changes, "delete "+ruleName(rule))
+			return nil
+		}
+	}
+	return errors.New("AUDIT_DEL_RULE: no such file or directory")
+}
+
+func (k *fakeKernel) status() (auditStatus, error) {
+	return k.state, nil
+}
+
+func (k *fakeKernel) setStatus(status auditStatus) error {
+	if status.Mask&k.failStatus != 0 {
+		return errors.New("AUDIT_SET: invalid argument")
+	}
+	for _, value := range []struct {
+		bit           uint32
+		current, next *uint32
+	}{
+		{auditStatusEnabled, &k.state.Enabled, &status.Enabled},
+		{auditStatusFailure, &k.state.Failure, &status.Failure},
+		{auditStatusRateLimit, &k.state.RateLimit, &status.RateLimit},
+		{auditStatusBacklogLimit, &k.state.BacklogLimit, &status.BacklogLimit},
+		{auditStatusBacklogWaitTime, &k.state.BacklogWaitTime, &status.BacklogWaitTime},
+	} {
+		if status.Mask&value.bit != 0 {
+			*value.current = *value.next
+			k.changes = append(k.changes, fmt.Sprintf("set %#x=%d", value.bit, *value.next))
+		}
+	}
+	return nil
+}
+
+func (k *fakeKernel) setFeature(mask uint32) error {
+	k.features |= mask
+	k.changes = append(k.changes, fmt.Sprintf("feature %#x", mask))
+	return nil
+}
+
+// testRules returns a rule on the exit list for every name, such as A, or on the task list for a name such as task:A.
+func testRules(names ...string) []kernelRule {
+	var rules []kernelRule
+	for _, name := range names {
+		list := uint32(auditFilterExit)
+		if task, found := strings.CutPrefix(name, "task:"); found {
+			list, name = auditFilterTask, task
+		}
+		rules = append(rules, kernelRule{Flags: list, Action: auditAlways, Fields: []kernelField{{Type: auditFilterKey, Op: fieldOps["="], Str: name}}})
+	}
+	return rules
+}
+
+// ruleName returns the name testRules gave the rule.
+func ruleName(rule kernelRule) string {
+	return rule.Fields[0].Str
+}
+
+func ruleNames(rules []kernelRule) []string {
+	names := []string{}
+	for _, rule := range rules {
+		names = append(names, ruleName(rule))
+	}
+	return names
+}
+
+func TestPlanRules(t *testing.T) {
+	for _, test := range []struct {
+		name                   string
+		current, desired       []string
+		wantDeletes, wantAdded []string
+	}{
+		{"unchanged", []string{"A", "B"}, []string{"A", "B"}, []string{}, []string{}},
+		{"appended", []string{"A"}, []string{"A", "B"}, []string{}, []string{"B"}},
+		{"removed last", []string{"A", "B"}, []string{"A"}, []string{"B"}, []string{}},
+		{"changed", []string{"A", "B", "C"}, []string{"A", "X", "C"}, []string{"B", "C"}, []string{"X", "C"}},
+		{"removed first", []string{"A", "B"}, []string{"B"}, []string{"A"}, []string{}},
+		{"moved", []string{"A", "B"}, []string{"B", "A"}, []string{"A"}, []string{"A"}},
+		{"per list", []string{"A", "task:T", "B"}, []string{"A", "task:U", "B"}, []string{"T"}, []string{"U"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			deletes, adds, err := planRules(testRules(test.current...), testRules(test.desired...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := ruleNames(deletes); !reflect.DeepEqual(got, test.wantDeletes) {
+				t.Errorf("deletes %v, want %v", got, test.wantDeletes)
+			}
+			if got := ruleNames(adds); !reflect.DeepEqual(got, test.wantAdded) {
+				t.Errorf("adds %v, want %v", got, test.wantAdded)
+			}
+		})
+	}
+
+	prepend := testRules("A")
+	prepend[0].Flags |= auditFilterPrepend
+	if _, _, err := planRules(nil, prepend); err == nil {
+		t.Error("planRules accepted a -A rule")
+	}
+}
+
+func TestApplyPlan(t *testing.T) {
+	for _, test := range []struct {
+		name             string
+		current, desired []string
+		wantChanges      []string
+	}{
+		// A changed rule is added before the rule it replaces is deleted. C stays the same but moves, so it is deleted
+		// right before it is added again.
+		{"changed", []string{"A", "B", "C"}, []string{"A", "X", "C"}, []string{"add X", "delete C", "add C", "delete B"}},
+		{"appended", []string{"A"}, []string{"A", "B"}, []string{"add B"}},
+		{"removed", []string{"A", "B", "C"}, []string{"A", "C"}, []string{"delete B"}},
+		{"moved", []string{"A", "B", "C"}, []string{"B", "A", "C"}, []string{"delete A", "add A", "delete C", "add C"}},
+		{"replaced", []string{"A", "B"}, []string{"X", "Y"}, []string{"add X", "add Y", "delete A", "delete B"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			kernel := &fakeKernel{rules: testRules(test.current...)}
+			desired := testRules(test.desired...)
+			deletes, adds, err := planRules(kernel.rules, desired)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := applyPlan(kernel, deletes, adds); err != nil {
+				t.Fatal(err)
+			}
+			if !sameRules(kernel.rules, desired) {
+				t.Errorf("the kernel has %v, want %v", ruleNames(kernel.rules), test.desired)
+			}
+			if !reflect.DeepEqual(kernel.changes, test.wantChanges) {
+				t.Errorf("changes %v, want %v", kernel.changes, test.wantChanges)
+			}
+		})
+	}
+}
+
+func TestRestoreRules(t *testing.T) {
+	previous := testRules("A", "B", "C", "task:T")
+	kernel := &fakeKernel{rules: append([]kernelRule(nil), previous...), failAdd: "Z"}
+
+	deletes, adds, err := planRules(kernel.rules, testRules("A", "X", "Y", "Z", "task:U"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := applyPlan(kernel, deletes, adds); err == nil {
+		t.Fatal("applyPlan returned no error for a rule the kernel rejects")
+	}
+
+	restoreRules(kernel, previous)
+	if !sameRules(kernel.rules, previous) {
+		t.Errorf("the kernel has %v after the restore, want %v", ruleNames(kernel.rules), ruleNames(previous))
+	}
+}
+
+func TestSameRules(t *testing.T) {
+	if !sameRules(testRules("A", "task:T", "B"), testRules("task:T", "A", "B")) {
+		t.Error("the order of the lists changed the result")
+	}
+	if sameRules(testRules("A", "B"), testRules("B", "A")) {
+		t.Error("the order of the rules on a list did not change the result")
+	}
+	if sameRules(testRules("A"), testRules("A", "B")) {
+		t.Error("a missing rule did not change the result")
+	}
+}
+
+func TestEncodeCompiled(t *testing.T) {
+	var compiled CompiledRuleset
+	if err := json.Unmarshal([]byte(`{"lines": [
+		{"control": {"option": "-D"}},
+		{"control": {"option": "-b", "value": "8192"}},
+		{"control": {"option": "--backlog_wait_time", "value": "60000"}},
+		{"control": {"option": "-f", "value": "1"}},
+		{"control": {"option": "--loginuid-immutable"}},
+		{"rule": {"op": "-a", "action": "never", "list": "exclude", "fields": [{"name": "msgtype", "op": "=", "value": "CWD"}]}},
+		{"rule": {"op": "-a", "action": "always", "list": "task", "fields": [{"name": "uid", "op": "=", "value": "0"}]}},
+		{"control": {"option": "-e", "value": "1"}}
+	]}`), &compiled); err != nil {
+		t.Fatal(err)
+	}
+
+	desired, err := encodeCompiled(compiled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantStatus := auditStatus{
+		Mask:            auditStatusBacklogLimit | auditStatusBacklogWaitTime | auditStatusFailure,
+		BacklogLimit:    8192,
+		BacklogWaitTime: 60000,
+		Failure:         1,
+	}
+	if desired.status != wantStatus || !desired.loginuidImmutable || desired.enabled == nil || *desired.enabled != 1 {
+		t.Errorf("status %+v, loginuid immutable %v, enabled %v", desired.status, desired.loginuidImmutable, desired.enabled)
+	}
+	if len(desired.rules) != 2 || desired.rules[0].list() != auditFilterExclude || desired.rules[1].list() != auditFilterTask {
+		t.Errorf("rules %v", desired.rules)
+	}
+}
+
+// A ruleset the encoder cannot load exactly fails, so the monitor restarts auditd instead.
+func TestEncodeCompiledUnsupported(t *testing.T) {
+	for name, lines := range map[string]string{
+		"without -D":     `{"control": {"option": "-b", "value": "8192"}}`,
+		"-D with a key":  `{"control": {"option": "-D", "key": "identity"}}`,
+		"unknown option": `{"control": {"option": "-D"}}, {"control": {"option": "--signal", "value": "1"}}`,
+		"rule twice": `{"control": {"option": "-D"}},
+			{"rule": {"op": "-a", "action": "always", "list": "task", "fields": [{"name": "uid", "op": "=", "value": "0"}]}},
+			{"rule": {"op": "-a", "action": "always", "list": "task", "fields": [{"name": "uid", "op": "=", "value": "root"}]}}`,
+		"unsupported rule": `{"control": {"option": "-D"}},
+			{"rule": {"op": "-a", "action": "always", "list": "io_uring", "syscalls": ["openat"]}}`,
+		"watch removal": `{"control": {"option": "-D"}}, {"watch": {"remove": true, "path": "/etc/passwd"}}`,
+	} {
+		var compiled CompiledRuleset
+		if err := json.Unmarshal([]byte(`{"lines": [`+lines+`]}`), &compiled); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, err := encodeCompiled(compiled); err == nil {
+			t.Errorf("%s: encodeCompiled returned no error", name)
+		}
+	}
+}
+
+func TestApplyRuleset(t *testing.T) {
+	enabled := uint32(1)
+	desired := desiredState{
+		rules:             testRules("A", "X", "task:T"),
+		status:            auditStatus{Mask: auditStatusBacklogLimit | auditStatusFailure, BacklogLimit: 8192, Failure: 1},
+		enabled:           &enabled,
+		loginuidImmutable: true,
+	}
+	previous := auditStatus{Enabled: 1, Failure: 1, BacklogLimit: 320}
+
+	// The status changes only once the rules are loaded, and -e comes last
+	kernel := &fakeKernel{rules: testRules("A", "B"), state: previous}
+	if err := applyRuleset(kernel, desired, "abc"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"add X", "add T", "delete B", "set 0x10=8192", "feature 0x2"}
+	if !reflect.DeepEqual(kernel.changes, want) {
+		t.Errorf("changes %v, want %v", kernel.changes, want)
+	}
+
+	for _, test := range []struct {
+		name       string
+		failAdd    string
+		failStatus uint32
+	}{
+		{"rule rejected", "X", 0},
+		{"status rejected", "", auditStatusBacklogLimit},
+		{"enabled rejected", "", auditStatusEnabled},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			enabled := uint32(0)
+			desired := desired
+			desired.enabled = &enabled
+			desired.loginuidImmutable = false
+			if test.failStatus == auditStatusEnabled {
+				desired.status = auditStatus{Mask: auditStatusFailure, Failure: 2}
+			}
+			kernel := &fakeKernel{rules: testRules("A", "B"), state: previous, failAdd: test.failAdd, failStatus: test.failStatus}
+
+			// The kernel is left with the rules and status it had, and the failure is a load failure
+			err := applyRuleset(kernel, desired, "abc")
+			var failed *loadError
+			if !errors.As(err, &failed) {
+				t.Fatalf("applyRuleset() error = %v, want a load failure", err)
+			}
+			if !sameRules(kernel.rules, testRules("A", "B")) {
+				t.Errorf("the kernel has %v, want the previous rules", ruleNames(kernel.rules))
+			}
+			if kernel.state != previous {
+				t.Errorf("the kernel status is %+v, want %+v", kernel.state, previous)
+			}
+		})
+	}
+
+	// A ruleset the kernel is not asked to load is not a load failure
+	prepend := desired
+	prepend.rules = testRules("A")
+	prepend.rules[0].Flags |= auditFilterPrepend
+	kernel = &fakeKernel{rules: testRules("A", "B"), state: previous}
+	var failed *loadError
+	if err := applyRuleset(kernel, prepend, "abc"); err == nil || errors.As(err, &failed) || len(kernel.changes) > 0 {
+		t.Errorf("applyRuleset() error = %v with changes %v, want an error before any change", err, kernel.changes)
+	}
+}
+
+func TestReconcileFailed(t *testing.T) {
+	rulesDir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(rulesDir, ".aks-auditd-history"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(rulesDir, compiledFileName), []byte(`{"history": ".aks-auditd-history"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	loadFailureFile := filepath.Join(rulesDir, ".aks-auditd-history", loadFailureFileName)
+
+	// A ruleset that was not tried live is left to the restart
+	reconcileFailed(rulesDir, errors.New("rules on the io_uring list are not supported"))
+	if _, err := os.Stat(loadFailureFile); !os.IsNotExist(err) {
+		t.Errorf("a load failure was reported for a ruleset the kernel was not asked to load: %v", err)
+	}
+
+	// A ruleset the kernel rejected is reported, so aks-auditd rolls the node back
+	reconcileFailed(rulesDir, &loadError{errors.New("AUDIT_ADD_RULE: invalid argument")})
+	data, err := os.ReadFile(loadFailureFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "netlink: AUDIT_ADD_RULE: invalid argument") {
+		t.Errorf("load failure is %s, want the netlink error", data)
+	}
+}
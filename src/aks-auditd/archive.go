@@ -0,0 +1,176 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	log "github.com/sirupsen/logrus"
+)
+
+// Name of the directory in a target directory that holds the expanded content of the archives in the sources. The
+// leading dot keeps augenrules and aks-auditd-monitor from reading it. Each archive is expanded into a subdirectory
+// named after its digest, so an archive is only expanded again when it changes.
+const archiveCacheDirectoryName = stagingPrefix + "archives"
+
+// Limits on the content of an archive. They keep a compressed archive that expands to a huge size from filling the
+// node disk. A ConfigMap holds at most 1 MiB, so real rulesets stay far below these limits.
+const (
+	maxArchiveEntrySize = 16 << 20
+	maxArchiveSize      = 64 << 20
+	maxArchiveEntries   = 1000
+)
+
+// File name suffixes of the archives that are expanded instead of written to the node as they are
+var archiveSuffixes = []string{".tar.gz", ".tgz", ".tar.zst", ".tar.zstd"}
+
+// isArchive returns true if the source file is an archive of rules files.
+func isArchive(fileName string) bool {
+	for _, suffix := range archiveSuffixes {
+		if strings.HasSuffix(fileName, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// archiveCacheDir returns the directory in targetDir that holds the expanded archives.
+func archiveCacheDir(targetDir string) string {
+	return filepath.Join(targetDir, archiveCacheDirectoryName)
+}
+
+// expandArchive expands the archive at archivePath into the archive cache of targetDir and returns the directory with
+// its files. The archive is expanded into a hidden directory first and renamed into place, so a rejected archive
+// never leaves a partial expansion behind.
+func expandArchive(targetDir, archivePath string, hash [32]byte) (string, error) {
+	expandedDir := filepath.Join(archiveCacheDir(targetDir), digest(hash))
+	if info, err := hostLstat(targetDir, expandedDir); err == nil && info.IsDir() {
+		return expandedDir, nil
+	}
+
+	if err := hostMkdirAll(targetDir, archiveCacheDir(targetDir), 0750); err != nil {
+		return "", err
+	}
+	tmpDir, err := hostMkdirTemp(targetDir, archiveCacheDir(targetDir), ".tmp-")
+	if err != nil {
+		return "", err
+	}
+	defer hostRemoveAll(targetDir, tmpDir)
+
+	file, err := hostOpen(targetDir, archivePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	var content io.Reader
+	switch {
+	case strings.HasSuffix(archivePath, ".gz") || strings.HasSuffix(archivePath, ".tgz"):
+		gzipReader, err := gzip.NewReader(file)
+		if err != nil {
+			return "", err
+		}
+		defer gzipReader.Close()
+		content = gzipReader
+	default:
+		zstdReader, err := zstd.NewReader(file, zstd.WithDecoderMaxMemory(maxArchiveSize))
+		if err != nil {
+			return "", err
+		}
+		defer zstdReader.Close()
+		content = zstdReader
+	}
+
+	if err := extractTar(content, targetDir, tmpDir); err != nil {
+		return "", err
+	}
+	if err := hostRename(targetDir, tmpDir, expandedDir); err != nil {
+		return "", err
+	}
+	log.Infof("Expanded archive %s into %s", archivePath, expandedDir)
+
+	return expandedDir, nil
+}
+
+// pruneCache removes the entries of a cache directory in root, such as the expanded archives, that are not in keep.
+func pruneCache(root, cacheDir string, keep map[string]bool) {
+	entries, err := hostReadDir(root, cacheDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !keep[entry.Name()] && !strings.HasPrefix(entry.Name(), ".") {
+			if err := hostRemoveAll(root, filepath.Join(cacheDir, entry.Name())); err != nil {
+				log.Warnf("Failed to remove %s from the cache: %v", entry.Name(), err)
+			}
+		}
+	}
+}
+
+// extractTar writes the regular files of the tar archive in r to dir in root. Archives are flat. Links, devices, entries
+// outside of dir, oversized entries, and archives that expand beyond maxArchiveSize are rejected.
+func extractTar(r io.Reader, root, dir string) error {
+	archive := tar.NewReader(r)
+
+	var total int64
+	for entries := 0; ; entries++ {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if entries >= maxArchiveEntries {
+			return fmt.Errorf("the archive has more than %d entries", maxArchiveEntries)
+		}
+		if header.Typeflag == tar.TypeDir && header.Name == "./" {
+			continue
+		}
+		if header.Typeflag != tar.TypeReg {
+			return fmt.Errorf("%s: only regular files are allowed in a rules archive", header.Name)
+		}
+		if header.Size > maxArchiveEntrySize {
+			return fmt.Errorf("%s: file is larger than %d bytes", header.Name, maxArchiveEntrySize)
+		}
+		if total += header.Size; total > maxArchiveSize {
+			return fmt.Errorf("the archive expands to more than %d bytes", maxArchiveSize)
+		}
+		name, err := archiveEntryName(header.Name)
+		if err != nil {
+			return err
+		}
+
+		file, err := hostOpenFile(root, filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(file, io.LimitReader(archive, header.Size))
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// archiveEntryName returns the file name an archive entry is written under. Archives are flat, so names with a
+// directory, such as ../../etc/passwd, are rejected, as are hidden names that aks-auditd would skip. The signature
+// file is the only hidden name allowed.
+func archiveEntryName(name string) (string, error) {
+	clean := path.Clean(strings.TrimPrefix(name, "./"))
+	if clean == signatureFileName {
+		return clean, nil
+	}
+	if clean == "" || clean == "." || strings.Contains(clean, "/") || strings.HasPrefix(clean, ".") {
+		return "", fmt.Errorf("invalid file name %q in rules archive: must be a plain file name", name)
+	}
+	return clean, nil
+}
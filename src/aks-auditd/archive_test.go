@@ -0,0 +1,169 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tarEntry is an entry of a test archive. The content is written as is, so a header can claim a size the content
+// does not have.
+type tarEntry struct {
+	header  tar.Header
+	content string
+}
+
+// file returns a regular file entry.
+func file(name, content string) tarEntry {
+	return tarEntry{tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}, content}
+}
+
+// buildTar returns a tar archive of the entries. The archive is not closed, so it may end after a header.
+func buildTar(t *testing.T, entries ...tarEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		header := entry.header
+		if err := w.WriteHeader(&header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, entry.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Flush()
+	return buf.Bytes()
+}
+
+func TestExtractTar(t *testing.T) {
+	manyFiles := make([]tarEntry, maxArchiveEntries+1)
+	for i := range manyFiles {
+		manyFiles[i] = file(fmt.Sprintf("%04d.rules", i), "")
+	}
+
+	for _, test := range []struct {
+		name    string
+		archive []byte
+		want    []string
+		wantErr string
+	}{
+		{name: "flat", archive: buildTar(t, file("10-base.rules", "-D\n"), file("./20-exec.rules", "-a always,exit -S execve\n")), want: []string{"10-base.rules", "20-exec.rules"}},
+		{name: "root directory entry", archive: buildTar(t, tarEntry{header: tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0755}}, file("10-base.rules", "-D\n")), want: []string{"10-base.rules"}},
+		{name: "signature", archive: buildTar(t, file("10-base.rules", "-D\n"), file(signatureFileName, "c2ln\n")), want: []string{signatureFileName, "10-base.rules"}},
+		{name: "directory", archive: buildTar(t, tarEntry{header: tar.Header{Name: "rules/", Typeflag: tar.TypeDir, Mode: 0755}}), wantErr: "only regular files"},
+		{name: "file in a directory", archive: buildTar(t, file("rules/10-base.rules", "-D\n")), wantErr: "must be a plain file name"},
+		{name: "parent directory", archive: buildTar(t, file("../../etc/passwd", "root::0:0\n")), wantErr: "must be a plain file name"},
+		{name: "absolute path", archive: buildTar(t, file("/etc/passwd", "root::0:0\n")), wantErr: "must be a plain file name"},
+		{name: "hidden file", archive: buildTar(t, file(".aks-auditd-manifest.json", "{}")), wantErr: "must be a plain file name"},
+		{name: "symlink", archive: buildTar(t, tarEntry{header: tar.Header{Name: "10-base.rules", Typeflag: tar.TypeSymlink, Linkname: "/etc/shadow"}}), wantErr: "only regular files"},
+		{name: "hard link", archive: buildTar(t, tarEntry{header: tar.Header{Name: "10-base.rules", Typeflag: tar.TypeLink, Linkname: "/etc/shadow"}}), wantErr: "only regular files"},
+		{name: "device", archive: buildTar(t, tarEntry{header: tar.Header{Name: "null", Typeflag: tar.TypeChar, Devmajor: 1, Devminor: 3}}), wantErr: "only regular files"},
+		{name: "duplicate name", archive: buildTar(t, file("10-base.rules", "-D\n"), file("./10-base.rules", "-e 0\n")), wantErr: "exists"},
+		{name: "oversized file", archive: buildTar(t, tarEntry{header: tar.Header{Name: "big.rules", Typeflag: tar.TypeReg, Mode: 0644, Size: maxArchiveEntrySize + 1}}), wantErr: "larger than"},
+		{name: "too many entries", archive: buildTar(t, manyFiles...), wantErr: fmt.Sprintf("more than %d entries", maxArchiveEntries)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := testPair(t).TargetDirectory
+			err := extractTar(bytes.NewReader(test.archive), dir, dir)
+			switch {
+			case test.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case test.wantErr != "":
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, test.wantErr)
+				}
+				return
+			}
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, entry := range entries {
+				got = append(got, entry.Name())
+			}
+			if strings.Join(got, ",") != strings.Join(test.want, ",") {
+				t.Errorf("extracted %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestExtractTarTotalSize(t *testing.T) {
+	// Files at the size limit that together expand beyond the archive limit, streamed so the test does not hold them
+	r, w := io.Pipe()
+	go func() {
+		archive := tar.NewWriter(w)
+		zeros := make([]byte, maxArchiveEntrySize)
+		for i := 0; i <= maxArchiveSize/maxArchiveEntrySize; i++ {
+			header := tar.Header{Name: fmt.Sprintf("%d.rules", i), Typeflag: tar.TypeReg, Mode: 0644, Size: maxArchiveEntrySize}
+			if archive.WriteHeader(&header) != nil {
+				break
+			}
+			if _, err := archive.Write(zeros); err != nil {
+				break
+			}
+		}
+		w.CloseWithError(archive.Close())
+	}()
+	defer r.Close()
+
+	dir := testPair(t).TargetDirectory
+	err := extractTar(r, dir, dir)
+	if err == nil || !strings.Contains(err.Error(), "expands to more than") {
+		t.Fatalf("got error %v, want the archive to be rejected for its total size", err)
+	}
+}
+
+func TestExpandArchive(t *testing.T) {
+	pair := testPair(t)
+
+	// writeArchive writes the entries as a tar+gzip archive to the source directory and returns its path and hash.
+	writeArchive := func(name string, entries ...tarEntry) (string, [32]byte) {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(buildTar(t, entries...))
+		gz.Close()
+		path := filepath.Join(pair.SourceDirectory, name)
+		if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path, sha256.Sum256(buf.Bytes())
+	}
+
+	path, hash := writeArchive("rules.tar.gz", file("10-base.rules", "-D\n"))
+	dir, err := expandArchive(pair.TargetDirectory, path, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readFiles(t, dir); got["10-base.rules"] != "-D\n" || len(got) != 1 {
+		t.Errorf("expanded %v", got)
+	}
+	if again, err := expandArchive(pair.TargetDirectory, path, hash); err != nil || again != dir {
+		t.Errorf("second expansion returned %s, %v, want the cached %s", again, err, dir)
+	}
+
+	// A rejected archive leaves nothing behind in the cache
+	path, hash = writeArchive("bad.tgz", file("10-base.rules", "-D\n"), file("../escape.rules", "-e 0\n"))
+	if _, err := expandArchive(pair.TargetDirectory, path, hash); err == nil {
+		t.Fatal("archive with a parent directory entry was expanded")
+	}
+	entries, err := os.ReadDir(archiveCacheDir(pair.TargetDirectory))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != filepath.Base(dir) {
+		t.Errorf("archive cache holds %d entries after a rejected archive, want only %s", len(entries), filepath.Base(dir))
+	}
+	if _, err := os.Stat(filepath.Join(pair.TargetDirectory, "escape.rules")); !os.IsNotExist(err) {
+		t.Errorf("rejected archive wrote outside the cache: %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package auditrules
+
+// Header augenrules writes as the first line of audit.rules
+const compiledHeader = "## This file is automatically generated from /etc/audit/rules.d"
+
+// Control options augenrules moves to the top of audit.rules, in the order it writes them. Only the last of each is
+// kept, except for -D, where the first one is.
+var hoistedOptions = []string{"-D", "-b", "--backlog_wait_time", "-f", "-r", "--loginuid-immutable"}
+
+// Compile merges the files of a ruleset, in the order augenrules loads them, into the audit.rules augenrules
+// generates from them. Comments and blank lines are left out. The first -D and the last -b, --backlog_wait_time, -f,
+// -r, and --loginuid-immutable are moved to the top in that order, the last -e is moved to the end, and every other
+// rule keeps its order. Every line is formatted with single spaces and keeps the order and grouping of its options as
+// augenrules copies it, so the same rules always compile to the same audit.rules.
+func Compile(files []*File) *File {
+	hoisted := make(map[string]Line)
+	var enable *Line
+	var rules []Line
+
+	for _, file := range files {
+		for _, line := range file.Lines {
+			if line.IsBlank() || line.IsComment() {
+				continue
+			}
+			if control := line.Control; control != nil {
+				if control.Option == "-e" {
+					enable = &line
+					continue
+				}
+				if isHoisted(control.Option) {
+					if _, exists := hoisted[control.Option]; !exists || control.Option != "-D" {
+						hoisted[control.Option] = line
+					}
+					continue
+				}
+			}
+			rules = append(rules, line)
+		}
+	}
+
+	compiled := &File{Name: "audit.rules", Lines: []Line{{Comment: compiledHeader}}}
+	for _, option := range hoistedOptions {
+		if line, exists := hoisted[option]; exists {
+			compiled.Lines = append(compiled.Lines, line)
+		}
+	}
+	compiled.Lines = append(compiled.Lines, rules...)
+	if enable != nil {
+		compiled.Lines = append(compiled.Lines, *enable)
+	}
+
+	for i := range compiled.Lines {
+		compiled.Lines[i].Pos = Position{Line: i + 1, Column: 1}
+	}
+	return compiled
+}
+
+// isHoisted returns true for the control options augenrules moves to the top.
+func isHoisted(option string) bool {
+	for _, hoistedOption := range hoistedOptions {
+		if option == hoistedOption {
+			return true
+		}
+	}
+	return false
+}
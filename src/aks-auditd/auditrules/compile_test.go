@@ -0,0 +1,25 @@
+package auditrules
+
+import "testing"
+
+func TestCompile(t *testing.T) {
+	base, err := ParseString("10-base.rules", "-D\n-b 8192\n-w /etc/passwd -k identity -p wa\n-e 1\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app, err := ParseString("50-app.rules", "# App\n-b 16384\n-a always,exit -k exec -F arch=b64 -S execve -S execveat\n-D\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rules keep the order and grouping of their options, as augenrules copies them
+	want := compiledHeader + "\n" +
+		"-D\n" +
+		"-b 16384\n" +
+		"-w /etc/passwd -k identity -p wa\n" +
+		"-a always,exit -k exec -F arch=b64 -S execve -S execveat\n" +
+		"-e 1\n"
+	if got := Compile([]*File{base, app}).String(); got != want {
+		t.Errorf("Compile() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,145 @@
+package auditrules
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Expansion describes a rule ExpandArch rewrote.
+type Expansion struct {
+	Line    int
+	Rules   []string // The rules the line was rewritten into
+	Dropped []string // The arch values the rule was left out for, because none of its syscalls exist there
+}
+
+// ExpandArch rewrites the syscall rules of a rules file for the machine, in Go naming such as amd64 or arm64. A rule
+// on the exit list with -S and without -F arch becomes a pair of rules with arch=b64 and arch=b32, leaving out the ones
+// the file already has. The syscall names of every rule with arch=b64 or arch=b32 are mapped to the ABI the arch
+// selects on the machine, such as open to openat on arm64. A rule whose syscalls do not exist in an ABI at all is left
+// out for that arch and replaced by a comment.
+//
+// Lines that are not rewritten are kept byte for byte. The file must parse without errors. ExpandArch returns the
+// rewritten file and the expansions, which are empty when nothing changed.
+func ExpandArch(name, text, machine string) (string, []Expansion, error) {
+	abis, supported := machineABIs[machine]
+	if !supported {
+		return text, nil, fmt.Errorf("syscall rules cannot be expanded for %s", machine)
+	}
+	file, err := ParseString(name, text)
+	if err != nil {
+		return text, nil, err
+	}
+
+	// Rules already in the file, so an expanded rule that the file also has explicitly is not added twice
+	existing := make(map[string]bool)
+	for _, line := range file.Lines {
+		if line.Rule != nil {
+			existing[line.Rule.Canonical()] = true
+		}
+	}
+
+	lines := strings.Split(text, "\n")
+	var expansions []Expansion
+	for _, line := range file.Lines {
+		rule := line.Rule
+		if rule == nil || rule.List != "exit" || len(rule.Syscalls) == 0 {
+			continue
+		}
+
+		var arches []string
+		arch, hasArch := rule.Field("arch")
+		switch {
+		case !hasArch && !archIndependent(rule):
+			arches = []string{"b64", "b32"}
+		case abis[arch] != "" && archFieldIsEqual(rule):
+			arches = []string{arch}
+		default:
+			continue // A machine name such as x86_64, or arch!=b32, already selects the syscall table
+		}
+
+		expansion := Expansion{Line: line.Pos.Line}
+		changed := !hasArch
+		for _, arch := range arches {
+			expanded := expandRule(rule, arch, abis[arch], hasArch)
+			if expanded == nil {
+				expansion.Dropped = append(expansion.Dropped, arch)
+				changed = true
+				continue
+			}
+			if strings.Join(expanded.Syscalls, ",") != strings.Join(rule.Syscalls, ",") {
+				changed = true
+			}
+			if !hasArch && existing[expanded.String()] {
+				continue
+			}
+			expansion.Rules = append(expansion.Rules, expanded.String())
+		}
+		if !changed {
+			continue
+		}
+
+		rewritten := append([]string(nil), expansion.Rules...)
+		for _, arch := range expansion.Dropped {
+			rewritten = append(rewritten, fmt.Sprintf("# Left out for arch=%s. %s has none of the syscalls of: %s", arch, abis[arch], strings.TrimSpace(lines[line.Pos.Line-1])))
+		}
+		lines[line.Pos.Line-1] = strings.Join(rewritten, "\n")
+		expansions = append(expansions, expansion)
+	}
+
+	if len(expansions) == 0 {
+		return text, nil, nil
+	}
+	return strings.Join(lines, "\n"), expansions, nil
+}
+
+// archIndependent returns true for a rule on -S all only, which matches every arch as it is, and for a rule with a
+// syscall number, which names a different syscall in every ABI. Neither is expanded.
+func archIndependent(rule *Rule) bool {
+	all := true
+	for _, name := range rule.Syscalls {
+		if numberPattern.MatchString(name) {
+			return true
+		}
+		all = all && name == "all"
+	}
+	return all
+}
+
+// archFieldIsEqual returns true if the arch field of the rule compares with =.
+func archFieldIsEqual(rule *Rule) bool {
+	for _, field := range rule.Fields {
+		if field.Name == "arch" && !field.Compare {
+			return field.Op == "="
+		}
+	}
+	return false
+}
+
+// expandRule returns a copy of rule for arch with its syscall names mapped to abi, or nil when none of them exist in
+// abi. Without hasArch, the arch field is added before every other field, so auditctl resolves the syscall names in
+// the table of abi.
+func expandRule(rule *Rule, arch, abi string, hasArch bool) *Rule {
+	expanded := *rule
+	expanded.Syscalls = nil
+	expanded.Options = nil
+	seen := make(map[string]bool)
+	for _, name := range rule.Syscalls {
+		resolved, exists := name, true
+		if name != "all" && !numberPattern.MatchString(name) {
+			resolved, exists = resolveSyscall(abi, name)
+		}
+		if exists && !seen[resolved] {
+			seen[resolved] = true
+			expanded.Syscalls = append(expanded.Syscalls, resolved)
+		}
+	}
+	if len(expanded.Syscalls) == 0 {
+		return nil
+	}
+
+	if !hasArch {
+		expanded.Fields = append([]Field{{Name: "arch", Op: "=", Value: arch}}, rule.Fields...)
+		expanded.SyscallIndex = rule.SyscallIndex + 1
+	}
+	return &expanded
+}
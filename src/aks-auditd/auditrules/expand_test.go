@@ -0,0 +1,126 @@
+package auditrules
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExpandArch(t *testing.T) {
+	for _, test := range []struct {
+		name, machine, text, want string
+		lines                     []int // Lines of the expansions
+	}{
+		{
+			name:    "pair",
+			machine: "amd64",
+			text:    "-a always,exit -S execve -F auid>=1000 -k exec\n",
+			want: "-a always,exit -F arch=b64 -S execve -F auid>=1000 -k exec\n" +
+				"-a always,exit -F arch=b32 -S execve -F auid>=1000 -k exec\n",
+			lines: []int{1},
+		},
+		{
+			name:    "legacy 32-bit names",
+			machine: "amd64",
+			text:    "-a always,exit -S chown,lchown32,fchown32 -k perm\n",
+			want: "-a always,exit -F arch=b64 -S chown,lchown,fchown -k perm\n" +
+				"-a always,exit -F arch=b32 -S chown,lchown32,fchown32 -k perm\n",
+			lines: []int{1},
+		},
+		{
+			name:    "arm64 names",
+			machine: "arm64",
+			text:    "-a always,exit -S open,creat,openat -F exit=-EACCES -k access\n",
+			want: "-a always,exit -F arch=b64 -S openat -F exit=-EACCES -k access\n" +
+				"-a always,exit -F arch=b32 -S open,creat,openat -F exit=-EACCES -k access\n",
+			lines: []int{1},
+		},
+		{
+			name:    "existing arch mapped",
+			machine: "arm64",
+			text:    "-D\n-a always,exit -F arch=b64 -S rename,renameat -k rename\n",
+			want:    "-D\n-a always,exit -F arch=b64 -S renameat -k rename\n",
+			lines:   []int{2},
+		},
+		{
+			name:    "dropped",
+			machine: "amd64",
+			text:    "-a always,exit -S socketcall -k net\n",
+			want: "-a always,exit -F arch=b32 -S socketcall -k net\n" +
+				"# Left out for arch=b64. x86_64 has none of the syscalls of: -a always,exit -S socketcall -k net\n",
+			lines: []int{1},
+		},
+		{
+			name:    "pair already in the file",
+			machine: "amd64",
+			text:    "-a always,exit -F arch=b32 -S execve -k exec\n-a always,exit -S execve -k exec\n",
+			want:    "-a always,exit -F arch=b32 -S execve -k exec\n-a always,exit -F arch=b64 -S execve -k exec\n",
+			lines:   []int{2},
+		},
+		{
+			name:    "unchanged",
+			machine: "amd64",
+			text: "# Kept byte for byte\n-w  /etc/passwd -p wa\n-a always,exit -F arch=b64 -S open -k o\n" +
+				"-a always,exit -S all -F auid=0\n-a always,exit -S 59 -k n\n-a always,exit -F arch=x86_64 -S open\n" +
+				"-a always,exit -F arch!=b32 -S open\n-a always,task -F uid=0\n",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, expansions, err := ExpandArch("10-test.rules", test.text, test.machine)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := test.want
+			if want == "" {
+				want = test.text
+			}
+			if got != want {
+				t.Errorf("ExpandArch() =\n%s\nwant\n%s", got, want)
+			}
+			var lines []int
+			for _, expansion := range expansions {
+				lines = append(lines, expansion.Line)
+			}
+			if !reflect.DeepEqual(lines, test.lines) {
+				t.Errorf("expansions on lines %v, want %v", lines, test.lines)
+			}
+		})
+	}
+}
+
+func TestExpandArchErrors(t *testing.T) {
+	if _, _, err := ExpandArch("10-test.rules", "-a always,exit -S open\n", "riscv64"); err == nil {
+		t.Error("ExpandArch returned no error for an unsupported machine")
+	}
+	text := "-a always,exit -S open\n-a always,exit -S\n"
+	got, _, err := ExpandArch("10-test.rules", text, "amd64")
+	if err == nil || got != text {
+		t.Errorf("ExpandArch() = %q, %v, want the text and a parse error", got, err)
+	}
+}
+
+// The rules ExpandArch writes pass the arch-pair check, though the syscalls of a pair are named per arch.
+func TestLintExpanded(t *testing.T) {
+	text := "-D\n" +
+		"-a always,exit -S chown,lchown32,open -F auid>=1000 -k perm\n" +
+		"-a always,exit -S rename -k rename\n" +
+		"-a always,exit -S socketcall -k net\n" +
+		"-a always,exit -F arch=b64 -S open -k open\n" +
+		"-a always,exit -F arch=b32 -S open -k open\n"
+
+	for _, machine := range []string{"amd64", "arm64"} {
+		t.Run(machine, func(t *testing.T) {
+			expanded, _, err := ExpandArch("10-test.rules", text, machine)
+			if err != nil {
+				t.Fatal(err)
+			}
+			file, err := ParseString("10-test.rules", expanded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if findings := Lint([]*File{file}); len(findings) > 0 {
+				t.Errorf("Lint found %v in\n%s", findings, strings.TrimSpace(expanded))
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package auditrules
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Kinds of values a field compares against.
+type fieldKind int
+
+const (
+	numericField fieldKind = iota // A number, or a name auditctl resolves to one, such as a user or errno name
+	stringField                   // Compared with = and != only
+	archField                     // b32, b64, or a machine name such as x86_64
+	permField                     // Combination of r, w, x, and a
+	pathField                     // An absolute path
+)
+
+// Fields auditctl accepts with -F, from the field table of libaudit.
+var fieldKinds = map[string]fieldKind{
+	"a0": numericField, "a1": numericField, "a2": numericField, "a3": numericField,
+	"arch": archField, "auid": numericField, "devmajor": numericField, "devminor": numericField,
+	"dir": pathField, "egid": numericField, "euid": numericField, "exe": pathField, "exit": numericField,
+	"filetype": stringField, "fsgid": numericField, "fstype": stringField, "fsuid": numericField,
+	"gid": numericField, "inode": numericField, "key": stringField, "loginuid": numericField,
+	"msgtype": numericField, "obj_gid": numericField, "obj_lev_high": stringField, "obj_lev_low": stringField,
+	"obj_role": stringField, "obj_type": stringField, "obj_uid": numericField, "obj_user": stringField,
+	"path": pathField, "perm": permField, "pers": numericField, "pid": numericField, "ppid": numericField,
+	"saddr_fam": numericField, "sessionid": numericField, "sgid": numericField, "subj_clr": stringField,
+	"subj_role": stringField, "subj_sen": stringField, "subj_type": stringField, "subj_user": stringField,
+	"success": numericField, "suid": numericField, "uid": numericField,
+}
+
+// Fields that may be compared with each other with -C.
+var comparableFields = map[string]bool{
+	"auid": true, "egid": true, "euid": true, "fsgid": true, "fsuid": true, "gid": true, "obj_gid": true,
+	"obj_uid": true, "sgid": true, "suid": true, "uid": true,
+}
+
+// Fields allowed on the lists other than exit, where every field is allowed.
+var listFields = map[string]map[string]bool{
+	"exclude":    {"auid": true, "exe": true, "gid": true, "msgtype": true, "pid": true, "subj_clr": true, "subj_role": true, "subj_sen": true, "subj_type": true, "subj_user": true, "uid": true},
+	"filesystem": {"fstype": true},
+	"user":       {"auid": true, "exe": true, "gid": true, "msgtype": true, "pid": true, "subj_clr": true, "subj_role": true, "subj_sen": true, "subj_type": true, "subj_user": true, "uid": true},
+}
+
+// Operators in the order they are matched, so two character operators win over their first character.
+var operators = []string{"!=", "<=", ">=", "&=", "=", "<", ">", "&"}
+
+// Machine names auditctl accepts as arch values besides b32 and b64.
+var archNames = map[string]bool{
+	"b32": true, "b64": true, "i386": true, "i486": true, "i586": true, "i686": true, "x86_64": true,
+	"aarch64": true, "armeb": true, "armv7l": true, "ppc": true, "ppc64": true, "ppc64le": true,
+	"s390": true, "s390x": true,
+}
+
+// File types the filetype field accepts.
+var fileTypes = map[string]bool{
+	"file": true, "dir": true, "socket": true, "link": true, "character": true, "block": true, "fifo": true,
+}
+
+var (
+	numberPattern = regexp.MustCompile(`^-?(0x[0-9a-fA-F]+|[0-9]+)$`)
+	namePattern   = regexp.MustCompile(`^-?[A-Za-z_][A-Za-z0-9_.-]*$`)
+	syscallName   = regexp.MustCompile(`^([a-z_][a-z0-9_]*|[0-9]+)$`)
+)
+
+// splitField splits a field expression such as arch=b64 into its name, operator, and value.
+func splitField(expression string) (Field, error) {
+	i := strings.IndexAny(expression, "!=<>&")
+	if i <= 0 {
+		return Field{}, fmt.Errorf("expected field, operator, and value such as arch=b64, got %q", expression)
+	}
+	for _, op := range operators {
+		if strings.HasPrefix(expression[i:], op) {
+			value := expression[i+len(op):]
+			if value == "" {
+				return Field{}, fmt.Errorf("field %s has no value", expression[:i])
+			}
+			return Field{Name: expression[:i], Op: op, Value: value}, nil
+		}
+	}
+	return Field{}, fmt.Errorf("invalid operator in %q", expression)
+}
+
+// checkField validates the name, operator, and value of a -F field on the given list.
+func checkField(field Field, list string) error {
+	kind, known := fieldKinds[field.Name]
+	if !known {
+		return fmt.Errorf("unknown field %s", field.Name)
+	}
+	if allowed, restricted := listFields[list]; restricted && !allowed[field.Name] {
+		return fmt.Errorf("field %s is not allowed on the %s list", field.Name, list)
+	}
+	if field.Name == "perm" && list != "exit" {
+		return fmt.Errorf("field perm is only allowed on the exit list")
+	}
+
+	if kind != numericField && field.Op != "=" && field.Op != "!=" {
+		return fmt.Errorf("field %s only supports the = and != operators, got %s", field.Name, field.Op)
+	}
+
+	switch kind {
+	case numericField:
+		if !numberPattern.MatchString(field.Value) && !namePattern.MatchString(field.Value) {
+			return fmt.Errorf("field %s requires a number or a name, got %q", field.Name, field.Value)
+		}
+		if field.Name == "success" && field.Value != "0" && field.Value != "1" {
+			return fmt.Errorf("field success requires 0 or 1, got %q", field.Value)
+		}
+	case archField:
+		if !archNames[field.Value] {
+			return fmt.Errorf("unknown arch %q. Use b32, b64, or a machine name such as x86_64 or aarch64", field.Value)
+		}
+	case permField:
+		if field.Op != "=" {
+			return fmt.Errorf("field perm only supports the = operator")
+		}
+		if err := checkPerms(field.Value); err != nil {
+			return err
+		}
+	case pathField:
+		if !strings.HasPrefix(field.Value, "/") {
+			return fmt.Errorf("field %s requires an absolute path, got %q", field.Name, field.Value)
+		}
+	case stringField:
+		if field.Name == "filetype" && !fileTypes[field.Value] {
+			return fmt.Errorf("unknown file type %q", field.Value)
+		}
+	}
+
+	return nil
+}
+
+// checkCompare validates a -C comparison between two fields.
+func checkCompare(field Field) error {
+	if !comparableFields[field.Name] {
+		return fmt.Errorf("field %s cannot be compared with -C", field.Name)
+	}
+	if !comparableFields[field.Value] {
+		return fmt.Errorf("field %s cannot be compared with -C", field.Value)
+	}
+	if field.Op != "=" && field.Op != "!=" {
+		return fmt.Errorf("-C only supports the = and != operators, got %s", field.Op)
+	}
+	return nil
+}
+
+// checkPerms validates the permissions of a watch or a perm field.
+func checkPerms(perms string) error {
+	if perms == "" || strings.Trim(perms, "rwxa") != "" {
+		return fmt.Errorf("permissions must be a combination of r, w, x, and a, got %q", perms)
+	}
+	return nil
+}
+
+// checkUint validates the argument of an option that takes a non-negative number.
+func checkUint(option, value string) error {
+	if _, err := strconv.ParseUint(value, 10, 32); err != nil {
+		return fmt.Errorf("option %s requires a non-negative number, got %q", option, value)
+	}
+	return nil
+}
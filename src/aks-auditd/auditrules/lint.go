@@ -0,0 +1,313 @@
+package auditrules
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Lint checks. Every Finding names the check that produced it.
+const (
+	CheckDeleteFirst        = "delete-first"        // -D is missing or does not come first
+	CheckEnableLast         = "enable-last"         // Rules follow -e 2
+	CheckDuplicateWatch     = "duplicate-watch"     // Two watches on the same path
+	CheckShadowedWatch      = "shadowed-watch"      // A watch on a path a previous directory watch already covers
+	CheckDuplicateRule      = "duplicate-rule"      // Two identical rules
+	CheckArchPair           = "arch-pair"           // A syscall rule without arch, or without its b32 or b64 counterpart
+	CheckMissingKey         = "missing-key"         // A rule or watch without -k
+	CheckConflictingSetting = "conflicting-setting" // Files set -b, -f, -r, -e, or --backlog_wait_time to different values
+	CheckUnreachableRule    = "unreachable-rule"    // An exit rule after a never rule that matches every syscall
+)
+
+// Finding is a best-practice violation in a ruleset. Line is 0 when the finding concerns the whole ruleset.
+// RelatedFile and RelatedLine are the earlier line a conflicting setting conflicts with, and empty otherwise.
+type Finding struct {
+	File        string
+	Line        int
+	Check       string
+	Message     string
+	RelatedFile string
+	RelatedLine int
+}
+
+// String formats the finding as file:line: [check] message.
+func (f Finding) String() string {
+	return fmt.Sprintf("%s:%d: [%s] %s", f.File, f.Line, f.Check, f.Message)
+}
+
+// location is a line of a file in a ruleset.
+type location struct {
+	file string
+	line int
+}
+
+func (l location) String() string {
+	return fmt.Sprintf("%s:%d", l.file, l.line)
+}
+
+// locatedWatch is a watch and the line it is on.
+type locatedWatch struct {
+	at    location
+	watch *Watch
+}
+
+// locatedRule is a rule and the line it is on.
+type locatedRule struct {
+	at   location
+	rule *Rule
+}
+
+// excludeAllRule is a never rule on the exit list that matches every syscall of arch, or of every arch when arch is
+// empty.
+type excludeAllRule struct {
+	at   location
+	arch string
+}
+
+// Lint checks a ruleset, given as its files in the order augenrules loads them, and returns the findings in file and
+// line order.
+func Lint(files []*File) []Finding {
+	var findings []Finding
+	add := func(at location, check, format string, args ...interface{}) {
+		findings = append(findings, Finding{File: at.file, Line: at.line, Check: check, Message: fmt.Sprintf(format, args...)})
+	}
+
+	var (
+		deleteAt    *location // The first -D
+		firstRuleAt *location // The first line that is not -D
+		enableAt    *location // -e 2
+		settings    = make(map[string]location)
+		values      = make(map[string]string)
+		watches     = make(map[string]location)
+		dirWatches  []locatedWatch
+		rules       = make(map[string]location)
+		archRules   = make(map[string]bool)
+		syscalls    []locatedRule
+		excludeAll  []excludeAllRule
+	)
+
+	for _, file := range files {
+		for _, line := range file.Lines {
+			if line.IsBlank() || line.IsComment() {
+				continue
+			}
+			at := location{file: file.Name, line: line.Pos.Line}
+
+			if enableAt != nil {
+				add(*enableAt, CheckEnableLast, "-e 2 locks the audit configuration, but %s follows it. Put -e 2 last", at)
+				enableAt = nil
+			}
+
+			switch {
+			case line.Control != nil:
+				control := line.Control
+				if control.Option == "-D" {
+					if deleteAt != nil {
+						add(at, CheckDeleteFirst, "-D is given more than once. The first one is at %s", *deleteAt)
+					} else if firstRuleAt != nil {
+						add(at, CheckDeleteFirst, "-D comes after %s. Put -D first, so the rules loaded before are deleted before any rule is added", *firstRuleAt)
+					}
+					if deleteAt == nil {
+						deleteAt = &at
+					}
+					continue
+				}
+				if firstRuleAt == nil {
+					firstRuleAt = &at
+				}
+				if control.Value == "" {
+					continue
+				}
+				if control.Option == "-e" && control.Value == "2" {
+					enableAt = &at
+				}
+				if previous, set := settings[control.Option]; set && previous.file != at.file && values[control.Option] != control.Value {
+					add(at, CheckConflictingSetting, "%s is %s here and %s at %s. Only the value loaded last takes effect", control.Option, control.Value, values[control.Option], previous)
+					findings[len(findings)-1].RelatedFile, findings[len(findings)-1].RelatedLine = previous.file, previous.line
+				}
+				settings[control.Option] = at
+				values[control.Option] = control.Value
+
+			case line.Watch != nil:
+				if firstRuleAt == nil {
+					firstRuleAt = &at
+				}
+				watch := line.Watch
+				if watch.Remove {
+					continue
+				}
+				if len(watch.Keys) == 0 {
+					add(at, CheckMissingKey, "the watch on %s has no -k key, so its events cannot be searched by key", watch.Path)
+				}
+				watchPath := path.Clean(watch.Path)
+				if previous, exists := watches[watchPath]; exists {
+					add(at, CheckDuplicateWatch, "%s is already watched at %s", watch.Path, previous)
+				} else {
+					watches[watchPath] = at
+				}
+				for _, dir := range dirWatches {
+					dirPath := path.Clean(dir.watch.Path)
+					if strings.HasPrefix(watchPath, strings.TrimSuffix(dirPath, "/")+"/") && coversPerms(dir.watch.Perms, watch.Perms) {
+						add(at, CheckShadowedWatch, "the watch on %s at %s already covers %s with the same permissions, so events are recorded with its key instead", dir.watch.Path, dir.at, watch.Path)
+						break
+					}
+				}
+				dirWatches = append(dirWatches, locatedWatch{at, watch})
+				checkUnreachable(excludeAll, "", at, add)
+
+			case line.Rule != nil:
+				if firstRuleAt == nil {
+					firstRuleAt = &at
+				}
+				rule := line.Rule
+				if rule.Op == "-d" {
+					continue
+				}
+				normalized := rule.Canonical()
+				if previous, exists := rules[normalized]; exists {
+					add(at, CheckDuplicateRule, "the same rule is already at %s", previous)
+				} else {
+					rules[normalized] = at
+				}
+				if rule.Action == "always" && (rule.List == "exit" || rule.List == "task" || rule.List == "io_uring") && len(rule.Keys) == 0 {
+					add(at, CheckMissingKey, "the rule has no -k key, so its events cannot be searched by key")
+				}
+				if rule.List != "exit" {
+					continue
+				}
+
+				arch, _ := rule.Field("arch")
+				if rule.Action == "never" && matchesEverything(rule) {
+					excludeAll = append(excludeAll, excludeAllRule{at, arch})
+					continue
+				}
+				checkUnreachable(excludeAll, arch, at, add)
+
+				if len(rule.Syscalls) > 0 {
+					archRules[withoutArch(rule)+"|"+arch] = true
+					syscalls = append(syscalls, locatedRule{at, rule})
+				}
+			}
+		}
+	}
+
+	if deleteAt == nil && firstRuleAt != nil {
+		add(location{file: firstRuleAt.file}, CheckDeleteFirst, "the ruleset has no -D, so the rules loaded before stay in the kernel next to these")
+	}
+
+	for _, s := range syscalls {
+		arch, hasArch := s.rule.Field("arch")
+		counterpart := map[string]string{"b32": "b64", "b64": "b32"}[arch]
+		switch {
+		case !hasArch && matchesAllSyscalls(s.rule):
+			// -S all matches every syscall of every arch as it is
+		case !hasArch:
+			add(s.at, CheckArchPair, "the syscall rule has no -F arch, so syscall names are resolved for the node arch only. Add a pair of rules with arch=b32 and arch=b64")
+		case counterpart != "" && !archRules[withoutArch(s.rule)+"|"+counterpart] && existsInArch(s.rule, counterpart):
+			add(s.at, CheckArchPair, "the syscall rule has arch=%s but no matching rule with arch=%s, so %s-bit programs can bypass it", arch, counterpart, map[string]string{"b32": "64", "b64": "32"}[arch])
+		}
+	}
+
+	sort.SliceStable(findings, func(i, j int) bool {
+		if findings[i].File != findings[j].File {
+			return fileIndex(files, findings[i].File) < fileIndex(files, findings[j].File)
+		}
+		return findings[i].Line < findings[j].Line
+	})
+	return findings
+}
+
+// checkUnreachable reports an always rule with the given arch when a previous never rule matches every syscall of that
+// arch. The exit list stops at the first matching rule, so the rule never produces an event.
+func checkUnreachable(excludeAll []excludeAllRule, arch string, at location, add func(location, string, string, ...interface{})) {
+	for _, exclude := range excludeAll {
+		if exclude.arch == "" || exclude.arch == arch {
+			add(at, CheckUnreachableRule, "the rule is never reached. The never rule at %s matches every syscall first", exclude.at)
+			return
+		}
+	}
+}
+
+// matchesEverything returns true for a rule without syscalls other than all and without fields other than arch.
+func matchesEverything(rule *Rule) bool {
+	if !matchesAllSyscalls(rule) {
+		return false
+	}
+	for _, field := range rule.Fields {
+		if field.Name != "arch" || field.Compare {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesAllSyscalls returns true for a rule on -S all only.
+func matchesAllSyscalls(rule *Rule) bool {
+	for _, syscall := range rule.Syscalls {
+		if syscall != "all" {
+			return false
+		}
+	}
+	return true
+}
+
+// existsInArch returns true if any syscall of the rule exists in the ABI that arch, b32 or b64, selects on any of the
+// machines aks-auditd runs on. A rule without such a syscall, such as one on socketcall for b32, needs no counterpart,
+// and ExpandArch leaves the counterpart out.
+func existsInArch(rule *Rule, arch string) bool {
+	for _, abis := range machineABIs {
+		for _, syscall := range rule.Syscalls {
+			if syscall == "all" || numberPattern.MatchString(syscall) {
+				return true
+			}
+			if _, exists := resolveSyscall(abis[arch], syscall); exists {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// withoutArch returns the rule formatted without its arch field and its syscalls, so the b32 and b64 rules of a pair
+// compare equal. The syscalls are left out because the same rule names them differently per arch, such as lchown32
+// for b32 and lchown for b64, or open for b32 and openat for b64 on arm64, as ExpandArch writes them.
+func withoutArch(rule *Rule) string {
+	stripped := *rule
+	stripped.Fields = nil
+	for _, field := range rule.Fields {
+		if field.Name != "arch" || field.Compare {
+			stripped.Fields = append(stripped.Fields, field)
+		}
+	}
+	stripped.Syscalls = nil
+	stripped.SyscallIndex = 0
+	stripped.Options = nil
+	return stripped.String()
+}
+
+// coversPerms returns true when the permissions outer include all of inner. Empty permissions mean all of them.
+func coversPerms(outer, inner string) bool {
+	if outer == "" {
+		return true
+	}
+	if inner == "" {
+		inner = "rwxa"
+	}
+	for _, perm := range inner {
+		if !strings.ContainsRune(outer, perm) {
+			return false
+		}
+	}
+	return true
+}
+
+// fileIndex returns the position of the named file in the ruleset.
+func fileIndex(files []*File, name string) int {
+	for i, file := range files {
+		if file.Name == name {
+			return i
+		}
+	}
+	return len(files)
+}
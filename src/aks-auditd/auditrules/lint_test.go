@@ -0,0 +1,67 @@
+package auditrules
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLint(t *testing.T) {
+	for _, test := range []struct {
+		name, text string
+		want       []string // Checks found, in order
+	}{
+		{"clean", "-D\n-w /etc/passwd -p wa -k identity\n-e 2\n", nil},
+		{"no delete", "-w /etc/passwd -p wa -k identity\n", []string{CheckDeleteFirst}},
+		{"missing key", "-D\n-a always,exit -F arch=b64 -S execve\n-a always,exit -F arch=b32 -S execve\n", []string{CheckMissingKey, CheckMissingKey}},
+		{"duplicate watch", "-D\n-w /etc/passwd -p wa -k a\n-w /etc/passwd/ -p r -k b\n", []string{CheckDuplicateWatch}},
+		{"shadowed watch", "-D\n-w /etc/ -p wa -k etc\n-w /etc/passwd -p w -k identity\n", []string{CheckShadowedWatch}},
+		{
+			"duplicate rule written differently",
+			"-D\n-a always,exit -F arch=b64 -S open -S close -k f\n-a always,exit -F arch=b64 -F key=f -S open,close\n" +
+				"-a always,exit -F arch=b32 -S open,close -k f\n",
+			[]string{CheckDuplicateRule},
+		},
+		{"rules after enable", "-D\n-e 2\n-w /etc/passwd -p wa -k identity\n", []string{CheckEnableLast}},
+		{"arch missing", "-D\n-a always,exit -S execve -k exec\n", []string{CheckArchPair}},
+		{"all without arch", "-D\n-a always,exit -S all -F auid=0 -k root\n", nil},
+		{"counterpart missing", "-D\n-a always,exit -F arch=b64 -S execve -k exec\n", []string{CheckArchPair}},
+		{"counterpart with other fields", "-D\n-a always,exit -F arch=b64 -S execve -k exec\n-a always,exit -F arch=b32 -S execve -F uid=0 -k exec\n", []string{CheckArchPair, CheckArchPair}},
+		{"counterpart named per arch", "-D\n-a always,exit -F arch=b64 -S chown,fchown -k perm\n-a always,exit -F arch=b32 -S chown32,fchown32 -k perm\n", nil},
+		{"no counterpart syscall", "-D\n-a always,exit -F arch=b32 -S socketcall -k net\n", nil},
+		{"unreachable", "-D\n-a never,exit -S all\n-a always,exit -F arch=b64 -S execve -k exec\n-a always,exit -F arch=b32 -S execve -k exec\n", []string{CheckUnreachableRule, CheckUnreachableRule}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			file, err := ParseString("10-test.rules", test.text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, finding := range Lint([]*File{file}) {
+				got = append(got, finding.Check)
+			}
+			if strings.Join(got, ",") != strings.Join(test.want, ",") {
+				t.Errorf("Lint found %v, want %v", Lint([]*File{file}), test.want)
+			}
+		})
+	}
+}
+
+func TestLintConflictingSetting(t *testing.T) {
+	base, err := ParseString("10-base.rules", "-D\n-b 8192\n-f 1\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app, err := ParseString("20-app.rules", "-f 1\n-b 1024\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	findings := Lint([]*File{base, app})
+	if len(findings) != 1 {
+		t.Fatalf("Lint found %v, want one conflicting setting", findings)
+	}
+	got := findings[0]
+	if got.Check != CheckConflictingSetting || got.File != "20-app.rules" || got.Line != 2 || got.RelatedFile != "10-base.rules" || got.RelatedLine != 2 {
+		t.Errorf("Lint found %+v, want -b at 20-app.rules:2 conflicting with 10-base.rules:2", got)
+	}
+}
@@ -0,0 +1,51 @@
+package auditrules
+
+import (
+	"sort"
+	"strings"
+)
+
+// SortLoadOrder sorts rules file names in the order augenrules loads them, which is the natural order of ls -v. Runs
+// of digits compare by their numeric value, so 9-base.rules comes before 10-app.rules.
+func SortLoadOrder(names []string) {
+	sort.SliceStable(names, func(i, j int) bool { return versionLess(names[i], names[j]) })
+}
+
+// versionLess compares two names the way ls -v does.
+func versionLess(a, b string) bool {
+	for a != "" && b != "" {
+		aDigits, bDigits := isDigit(a[0]), isDigit(b[0])
+		if aDigits != bDigits {
+			return aDigits
+		}
+
+		aChunk, aRest := splitChunk(a, aDigits)
+		bChunk, bRest := splitChunk(b, bDigits)
+		if aDigits {
+			aNumber, bNumber := strings.TrimLeft(aChunk, "0"), strings.TrimLeft(bChunk, "0")
+			if len(aNumber) != len(bNumber) {
+				return len(aNumber) < len(bNumber)
+			}
+			if aNumber != bNumber {
+				return aNumber < bNumber
+			}
+		} else if aChunk != bChunk {
+			return aChunk < bChunk
+		}
+		a, b = aRest, bRest
+	}
+	return len(a) < len(b)
+}
+
+// splitChunk splits the leading run of digits, or of non-digits, from s.
+func splitChunk(s string, digits bool) (string, string) {
+	i := 0
+	for i < len(s) && isDigit(s[i]) == digits {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
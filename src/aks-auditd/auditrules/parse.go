@@ -0,0 +1,380 @@
+package auditrules
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Error is a syntax or validation error at a position in a rules file.
+type Error struct {
+	File string
+	Pos  Position
+	Msg  string
+}
+
+// Error formats the error as file:line:column: message.
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Pos.Line, e.Pos.Column, e.Msg)
+}
+
+// ErrorList is the list of errors found in a rules file, in the order of the lines they are on.
+type ErrorList []*Error
+
+// Error formats the first error and the number of others.
+func (l ErrorList) Error() string {
+	switch len(l) {
+	case 0:
+		return "no errors"
+	case 1:
+		return l[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more errors)", l[0].Error(), len(l)-1)
+}
+
+// Maximum length of all keys of a rule together, AUDIT_MAX_KEY_LEN in libaudit
+const maxKeyLength = 256
+
+// Control options, the number of arguments they take, and the values they accept. A nil value list accepts any
+// non-negative number.
+var controlOptions = map[string]struct {
+	args   int
+	values []string
+}{
+	"-D":                   {args: 0},
+	"-b":                   {args: 1},
+	"-f":                   {args: 1, values: []string{"0", "1", "2"}},
+	"-r":                   {args: 1},
+	"-e":                   {args: 1, values: []string{"0", "1", "2"}},
+	"--backlog_wait_time":  {args: 1},
+	"--loginuid-immutable": {args: 0},
+	"--reset-lost":         {args: 0},
+	"-c":                   {args: 0},
+	"-i":                   {args: 0},
+}
+
+// Lists that accept -S syscalls
+var syscallLists = map[string]bool{"exit": true, "io_uring": true}
+
+// token is a whitespace separated word of a line and the column it starts at.
+type token struct {
+	text   string
+	column int
+}
+
+// Parse reads a rules file and returns every line of it. It returns an ErrorList with every invalid line. Invalid
+// lines are left out of the returned File, which holds the lines that parsed.
+func Parse(name string, r io.Reader) (*File, error) {
+	file := &File{Name: name}
+	var errs ErrorList
+
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line, err := ParseLine(scanner.Text())
+		if err != nil {
+			err.File = name
+			err.Pos.Line = lineNumber
+			errs = append(errs, err)
+			continue
+		}
+		line.Pos = Position{Line: lineNumber, Column: 1}
+		file.Lines = append(file.Lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, &Error{File: name, Pos: Position{Line: len(file.Lines) + len(errs) + 1, Column: 1}, Msg: err.Error()})
+	}
+
+	if len(errs) > 0 {
+		return file, errs
+	}
+	return file, nil
+}
+
+// ParseString parses rules held in a string. See Parse.
+func ParseString(name, rules string) (*File, error) {
+	return Parse(name, strings.NewReader(rules))
+}
+
+// ParseLine parses a single line of a rules file. The returned error has the column of the offending token and no
+// file name or line number.
+func ParseLine(text string) (Line, *Error) {
+	tokens := tokenize(text)
+	if len(tokens) == 0 {
+		return Line{}, nil
+	}
+	if strings.HasPrefix(tokens[0].text, "#") {
+		return Line{Comment: strings.TrimSpace(text)}, nil
+	}
+
+	p := &parser{tokens: tokens}
+	_, isControl := controlOptions[tokens[0].text]
+	switch first := tokens[0].text; {
+	case isControl:
+		control, err := p.control()
+		return Line{Control: control}, err
+	case first == "-w" || first == "-W":
+		watch, err := p.watch()
+		return Line{Watch: watch}, err
+	case first == "-a" || first == "-A" || first == "-d":
+		rule, err := p.rule()
+		return Line{Rule: rule}, err
+	default:
+		return Line{}, p.errorAt(tokens[0], "expected a rule such as -a or -w, or a control option such as -b, got %q", first)
+	}
+}
+
+// tokenize splits a line on spaces and tabs and records the column every word starts at.
+func tokenize(text string) []token {
+	var tokens []token
+	start := -1
+	for i := 0; i <= len(text); i++ {
+		if i == len(text) || text[i] == ' ' || text[i] == '\t' || text[i] == '\r' {
+			if start >= 0 {
+				tokens = append(tokens, token{text: text[start:i], column: start + 1})
+				start = -1
+			}
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+	}
+	return tokens
+}
+
+// parser walks the tokens of a single line.
+type parser struct {
+	tokens []token
+	i      int
+}
+
+// next returns the next token and advances past it. The second return value is false at the end of the line.
+func (p *parser) next() (token, bool) {
+	if p.i >= len(p.tokens) {
+		return token{}, false
+	}
+	p.i++
+	return p.tokens[p.i-1], true
+}
+
+// argument returns the argument of option, or an error at option when the line ends.
+func (p *parser) argument(option token) (token, *Error) {
+	arg, ok := p.next()
+	if !ok || (strings.HasPrefix(arg.text, "-") && len(arg.text) > 1 && !numberPattern.MatchString(arg.text)) {
+		return token{}, p.errorAt(option, "option %s requires an argument", option.text)
+	}
+	return arg, nil
+}
+
+func (p *parser) errorAt(t token, format string, args ...interface{}) *Error {
+	return &Error{Pos: Position{Column: t.column}, Msg: fmt.Sprintf(format, args...)}
+}
+
+// control parses a control option such as -b 8192. -D may be followed by -k to delete only the rules with that key.
+func (p *parser) control() (*Control, *Error) {
+	option, _ := p.next()
+	spec := controlOptions[option.text]
+	control := &Control{Option: option.text}
+
+	if spec.args > 0 {
+		value, err := p.argument(option)
+		if err != nil {
+			return nil, err
+		}
+		if spec.values != nil {
+			valid := false
+			for _, v := range spec.values {
+				valid = valid || value.text == v
+			}
+			if !valid {
+				return nil, p.errorAt(value, "option %s requires one of %s, got %q", option.text, strings.Join(spec.values, ", "), value.text)
+			}
+		} else if err := checkUint(option.text, value.text); err != nil {
+			return nil, p.errorAt(value, "%v", err)
+		}
+		control.Value = value.text
+	}
+
+	if next, ok := p.next(); ok {
+		if option.text != "-D" || next.text != "-k" {
+			return nil, p.errorAt(next, "unexpected %q after %s. Put every control option on its own line", next.text, option.text)
+		}
+		key, err := p.argument(next)
+		if err != nil {
+			return nil, err
+		}
+		control.Key = key.text
+		if extra, ok := p.next(); ok {
+			return nil, p.errorAt(extra, "unexpected %q after -D -k %s", extra.text, key.text)
+		}
+	}
+
+	return control, nil
+}
+
+// watch parses a file system watch such as -w /etc/passwd -p wa -k identity.
+func (p *parser) watch() (*Watch, *Error) {
+	option, _ := p.next()
+	path, err := p.argument(option)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(path.text, "/") {
+		return nil, p.errorAt(path, "option %s requires an absolute path, got %q", option.text, path.text)
+	}
+	watch := &Watch{Remove: option.text == "-W", Path: path.text}
+
+	first := option
+	for {
+		t, ok := p.next()
+		if !ok {
+			break
+		}
+		switch t.text {
+		case "-p":
+			if watch.Perms != "" {
+				return nil, p.errorAt(t, "option -p is given more than once")
+			}
+			perms, err := p.argument(t)
+			if err != nil {
+				return nil, err
+			}
+			if err := checkPerms(perms.text); err != nil {
+				return nil, p.errorAt(perms, "%v", err)
+			}
+			watch.Perms = perms.text
+			watch.PermsIndex = len(watch.Keys)
+		case "-k":
+			key, err := p.argument(t)
+			if err != nil {
+				return nil, err
+			}
+			watch.Keys = append(watch.Keys, key.text)
+		default:
+			return nil, p.errorAt(t, "unexpected %q in a watch. Watches only take -p and -k", t.text)
+		}
+	}
+
+	if err := checkKeys(watch.Keys); err != nil {
+		return nil, p.errorAt(first, "%v", err)
+	}
+	return watch, nil
+}
+
+// rule parses a rule such as -a always,exit -F arch=b64 -S openat -k access.
+func (p *parser) rule() (*Rule, *Error) {
+	option, _ := p.next()
+	actionList, err := p.argument(option)
+	if err != nil {
+		return nil, err
+	}
+	action, list, ok := splitActionList(actionList.text)
+	if !ok {
+		return nil, p.errorAt(actionList, "invalid action,list %q. Actions are always and never. Lists are task, exit, user, exclude, filesystem, and io_uring", actionList.text)
+	}
+	rule := &Rule{Op: option.text, Action: action, List: list}
+
+	for {
+		t, ok := p.next()
+		if !ok {
+			break
+		}
+		switch t.text {
+		case "-S":
+			arg, err := p.argument(t)
+			if err != nil {
+				return nil, err
+			}
+			if !syscallLists[list] {
+				return nil, p.errorAt(t, "-S is not allowed on the %s list", list)
+			}
+			if len(rule.Syscalls) == 0 {
+				rule.SyscallIndex = len(rule.Fields)
+			}
+			for _, name := range strings.Split(arg.text, ",") {
+				if !syscallName.MatchString(name) {
+					return nil, p.errorAt(arg, "invalid syscall %q", name)
+				}
+				rule.Syscalls = append(rule.Syscalls, name)
+			}
+			rule.Options = append(rule.Options, Option{Flag: "-S", Syscalls: len(strings.Split(arg.text, ","))})
+		case "-F":
+			arg, err := p.argument(t)
+			if err != nil {
+				return nil, err
+			}
+			field, err2 := splitField(arg.text)
+			if err2 != nil {
+				return nil, p.errorAt(arg, "%v", err2)
+			}
+			if field.Name == "key" {
+				if field.Op != "=" {
+					return nil, p.errorAt(arg, "field key only supports the = operator")
+				}
+				rule.Keys = append(rule.Keys, field.Value)
+				rule.Options = append(rule.Options, Option{Flag: "-F", Key: true})
+				continue
+			}
+			if err := checkField(field, list); err != nil {
+				return nil, p.errorAt(arg, "%v", err)
+			}
+			rule.Fields = append(rule.Fields, field)
+			rule.Options = append(rule.Options, Option{Flag: "-F"})
+		case "-C":
+			arg, err := p.argument(t)
+			if err != nil {
+				return nil, err
+			}
+			field, err2 := splitField(arg.text)
+			if err2 != nil {
+				return nil, p.errorAt(arg, "%v", err2)
+			}
+			field.Compare = true
+			if err := checkCompare(field); err != nil {
+				return nil, p.errorAt(arg, "%v", err)
+			}
+			rule.Fields = append(rule.Fields, field)
+			rule.Options = append(rule.Options, Option{Flag: "-C"})
+		case "-k":
+			key, err := p.argument(t)
+			if err != nil {
+				return nil, err
+			}
+			rule.Keys = append(rule.Keys, key.text)
+			rule.Options = append(rule.Options, Option{Flag: "-k"})
+		default:
+			return nil, p.errorAt(t, "unexpected %q in a rule. Rules take -S, -F, -C, and -k", t.text)
+		}
+	}
+
+	if err := checkKeys(rule.Keys); err != nil {
+		return nil, p.errorAt(option, "%v", err)
+	}
+	return rule, nil
+}
+
+// splitActionList splits the argument of -a, -A, and -d into its action and list. auditctl accepts both orders.
+func splitActionList(s string) (action, list string, ok bool) {
+	actions := map[string]bool{"always": true, "never": true}
+	lists := map[string]bool{"task": true, "exit": true, "user": true, "exclude": true, "filesystem": true, "io_uring": true}
+
+	first, second, found := strings.Cut(s, ",")
+	switch {
+	case !found:
+		return "", "", false
+	case actions[first] && lists[second]:
+		return first, second, true
+	case lists[first] && actions[second]:
+		return second, first, true
+	}
+	return "", "", false
+}
+
+// checkKeys validates the combined length of the keys of a rule or watch.
+func checkKeys(keys []string) error {
+	if length := len(strings.Join(keys, "\x01")); length > maxKeyLength {
+		return fmt.Errorf("the keys are %d characters long together. The limit is %d", length, maxKeyLength)
+	}
+	return nil
+}
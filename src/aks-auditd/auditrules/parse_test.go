@@ -0,0 +1,241 @@
+package auditrules
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseLineRoundTrip(t *testing.T) {
+	for _, test := range []struct {
+		name, line, want string // want is empty when the line formats as written
+	}{
+		{"blank", "", ""},
+		{"comment", "# Identity changes", ""},
+		{"delete", "-D", ""},
+		{"delete key", "-D -k identity", ""},
+		{"backlog", "-b 8192", ""},
+		{"backlog wait time", "--backlog_wait_time 60000", ""},
+		{"failure", "-f 1", ""},
+		{"rate", "-r 100", ""},
+		{"enable", "-e 2", ""},
+		{"loginuid", "--loginuid-immutable", ""},
+		{"watch", "-w /etc/passwd", ""},
+		{"watch perms", "-w /etc/passwd -p wa", ""},
+		{"watch perms key", "-w /etc/passwd -p wa -k identity", ""},
+		{"watch key perms", "-w /etc/passwd -k identity -p wa", ""},
+		{"watch keys around perms", "-w /etc/sudoers -k a -p rw -k b", ""},
+		{"watch remove", "-W /etc/passwd -p wa -k identity", ""},
+		{"syscall", "-a always,exit -F arch=b64 -S openat -k access", ""},
+		{"syscall list", "-a always,exit -F arch=b64 -S open,openat,creat -k access", ""},
+		{"syscall options", "-a always,exit -F arch=b64 -S open -S openat -k access", ""},
+		{"syscall groups", "-a always,exit -F arch=b64 -S open,creat -S openat -k access", ""},
+		{"syscalls around a field", "-a always,exit -S open -F arch=b64 -S openat -k access", ""},
+		{"fields after syscalls", "-a always,exit -F arch=b32 -S openat -F exit=-EACCES -F auid>=1000 -F auid!=-1 -k access", ""},
+		{"field key", "-a always,exit -F arch=b64 -S execve -F key=exec", ""},
+		{"field key before fields", "-a always,exit -F key=exec -F arch=b64 -S execve", ""},
+		{"keys mixed", "-a always,exit -F arch=b64 -S execve -k exec -F key=proc", ""},
+		{"key before syscalls", "-a always,exit -k access -F arch=b64 -S openat", ""},
+		{"compare", "-a always,exit -F arch=b64 -S execve -C uid!=euid -F euid=0 -k setuid", ""},
+		{"compare auid", "-a always,exit -F arch=b64 -S all -C auid!=uid -k su", ""},
+		{"prepend", "-A never,exit -F arch=b64 -S all -F exe=/usr/bin/containerd", ""},
+		{"delete rule", "-d always,exit -F arch=b64 -S openat -k access", ""},
+		{"exclude", "-a always,exclude -F msgtype=CWD", ""},
+		{"list first", "-a exit,always -F arch=b64 -S openat", "-a always,exit -F arch=b64 -S openat"},
+		{"spacing", "  -w  /etc/passwd\t-p wa   -k identity  ", "-w /etc/passwd -p wa -k identity"},
+		{"comment spacing", "   # Identity changes  ", "# Identity changes"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			want := test.want
+			if want == "" {
+				want = strings.TrimSpace(test.line)
+			}
+
+			line, err := ParseLine(test.line)
+			if err != nil {
+				t.Fatalf("ParseLine(%q) returned %v", test.line, err)
+			}
+			if got := line.String(); got != want {
+				t.Fatalf("ParseLine(%q).String() = %q, want %q", test.line, got, want)
+			}
+
+			again, err := ParseLine(line.String())
+			if err != nil {
+				t.Fatalf("ParseLine(%q) returned %v", line.String(), err)
+			}
+			if !reflect.DeepEqual(again, line) && test.want == "" {
+				t.Errorf("ParseLine(%q) = %+v, want %+v", line.String(), again, line)
+			}
+		})
+	}
+}
+
+func TestParseLineStructure(t *testing.T) {
+	line, err := ParseLine("-a always,exit -S open -F arch=b64 -S openat,creat -F key=access -C uid!=euid -k files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Rule{
+		Op: "-a", Action: "always", List: "exit",
+		Syscalls: []string{"open", "openat", "creat"},
+		Fields:   []Field{{Name: "arch", Op: "=", Value: "b64"}, {Name: "uid", Op: "!=", Value: "euid", Compare: true}},
+		Keys:     []string{"access", "files"},
+		Options: []Option{
+			{Flag: "-S", Syscalls: 1}, {Flag: "-F"}, {Flag: "-S", Syscalls: 2}, {Flag: "-F", Key: true},
+			{Flag: "-C"}, {Flag: "-k"},
+		},
+	}
+	if !reflect.DeepEqual(line.Rule, want) {
+		t.Errorf("got %+v, want %+v", line.Rule, want)
+	}
+	if got, want := line.Rule.Canonical(), "-a always,exit -S open,openat,creat -F arch=b64 -C uid!=euid -k access -k files"; got != want {
+		t.Errorf("Canonical() = %q, want %q", got, want)
+	}
+
+	watch, err := ParseLine("-w /etc/shadow -k a -k b -p r")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (&Watch{Path: "/etc/shadow", Perms: "r", Keys: []string{"a", "b"}, PermsIndex: 2}); !reflect.DeepEqual(watch.Watch, want) {
+		t.Errorf("got %+v, want %+v", watch.Watch, want)
+	}
+}
+
+func TestCanonical(t *testing.T) {
+	for _, test := range []struct {
+		lines []string // Lines that add the same watch or rule
+		want  string
+	}{
+		{
+			[]string{"-w /etc/passwd -p wa -k identity", "-w /etc/passwd -k identity -p aw", "-w /etc/passwd/ -p wa -k identity"},
+			"-w /etc/passwd -p wa -k identity",
+		},
+		{[]string{"-w /etc/ssh", "-w /etc/ssh/ -p arwx"}, "-w /etc/ssh -p rwxa"},
+		{
+			[]string{
+				"-a always,exit -F arch=b64 -S open,openat -F exit=-EACCES -k access",
+				"-a exit,always -F arch=b64 -S open -S openat -F exit=-EACCES -F key=access",
+				"-a always,exit -k access -F arch=b64 -S open -F exit=-EACCES -S openat",
+			},
+			"-a always,exit -F arch=b64 -S open,openat -F exit=-EACCES -k access",
+		},
+	} {
+		for _, text := range test.lines {
+			line, err := ParseLine(text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got string
+			if line.Watch != nil {
+				got = line.Watch.Canonical()
+			} else {
+				got = line.Rule.Canonical()
+			}
+			if got != test.want {
+				t.Errorf("Canonical() of %q = %q, want %q", text, got, test.want)
+			}
+		}
+	}
+}
+
+func TestRuleStringWithoutOptions(t *testing.T) {
+	rule := Rule{
+		Op: "-a", Action: "always", List: "exit",
+		Syscalls:     []string{"openat"},
+		Fields:       []Field{{Name: "arch", Op: "=", Value: "b64"}, {Name: "exit", Op: "=", Value: "-EACCES"}},
+		Keys:         []string{"access"},
+		SyscallIndex: 1,
+	}
+	want := "-a always,exit -F arch=b64 -S openat -F exit=-EACCES -k access"
+	if got := rule.String(); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+
+	// Options that no longer match the syscalls, such as after a syscall is added, are ignored
+	rule.Options = []Option{{Flag: "-F"}, {Flag: "-S", Syscalls: 1}, {Flag: "-F"}, {Flag: "-k"}}
+	rule.Syscalls = append(rule.Syscalls, "open")
+	if got, want := rule.String(), "-a always,exit -F arch=b64 -S openat,open -F exit=-EACCES -k access"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestParseLineErrors(t *testing.T) {
+	for _, test := range []struct {
+		line   string
+		column int
+		msg    string
+	}{
+		{"-x", 1, "expected a rule"},
+		{"auditctl -w /etc/passwd", 1, "expected a rule"},
+		{"-b", 1, "option -b requires an argument"},
+		{"-b -1", 4, "requires a non-negative number"},
+		{"-b 8192 -e 1", 9, "Put every control option on its own line"},
+		{"-e 3", 4, "requires one of 0, 1, 2"},
+		{"-D -k", 4, "option -k requires an argument"},
+		{"-D -k a b", 9, `unexpected "b"`},
+		{"-w", 1, "option -w requires an argument"},
+		{"-w etc/passwd", 4, "requires an absolute path"},
+		{"-w /etc/passwd -p", 16, "option -p requires an argument"},
+		{"-w /etc/passwd -p wz", 19, "permissions must be a combination"},
+		{"-w /etc/passwd -p r -p w", 21, "more than once"},
+		{"-w /etc/passwd -S open", 16, "Watches only take -p and -k"},
+		{"-a always", 4, "invalid action,list"},
+		{"-a always,sometimes", 4, "invalid action,list"},
+		{"-a always,exit -S", 16, "option -S requires an argument"},
+		{"-a always,exit -S Open", 19, `invalid syscall "Open"`},
+		{"-a always,exit -S open,", 19, `invalid syscall ""`},
+		{"-a always,task -S open", 16, "-S is not allowed on the task list"},
+		{"-a always,exit -F arch", 19, "expected field, operator, and value"},
+		{"-a always,exit -F arch=", 19, "has no value"},
+		{"-a always,exit -F color=red", 19, "unknown field color"},
+		{"-a always,exit -F arch=b16", 19, `unknown arch "b16"`},
+		{"-a always,exit -F key!=x", 19, "field key only supports the = operator"},
+		{"-a always,exit -F path=etc", 19, "requires an absolute path"},
+		{"-a always,exit -F success=2", 19, "requires 0 or 1"},
+		{"-a always,exit -F perm>r", 19, "only supports the = and != operators"},
+		{"-a always,exclude -F path=/etc", 22, "not allowed on the exclude list"},
+		{"-a always,exit -C uid=path", 19, "field path cannot be compared with -C"},
+		{"-a always,exit -C uid<euid", 19, "-C only supports the = and != operators"},
+		{"-a always,exit -k", 16, "option -k requires an argument"},
+		{"-a always,exit -k " + strings.Repeat("k", maxKeyLength+1), 1, "The limit is 256"},
+		{"-a always,exit -p wa", 16, "Rules take -S, -F, -C, and -k"},
+	} {
+		t.Run(test.line, func(t *testing.T) {
+			_, err := ParseLine(test.line)
+			if err == nil {
+				t.Fatalf("ParseLine(%q) returned no error", test.line)
+			}
+			if err.Pos.Column != test.column || !strings.Contains(err.Msg, test.msg) {
+				t.Errorf("ParseLine(%q) returned %q at column %d, want %q at column %d", test.line, err.Msg, err.Pos.Column, test.msg, test.column)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	text := "# Identity\n-w /etc/passwd -p wa -k identity\n\n-a always,exit -S\n-b 8192\n-e 3\n"
+	file, err := ParseString("10-base.rules", text)
+
+	errs, ok := err.(ErrorList)
+	if !ok || len(errs) != 2 {
+		t.Fatalf("ParseString returned %v, want 2 errors", err)
+	}
+	if got, want := errs[0].Error(), "10-base.rules:4:16: option -S requires an argument"; got != want {
+		t.Errorf("first error = %q, want %q", got, want)
+	}
+	if got, want := errs[1].Pos, (Position{Line: 6, Column: 4}); got != want {
+		t.Errorf("second error at %+v, want %+v", got, want)
+	}
+
+	// The lines that parse are kept with their positions
+	if got, want := file.String(), "# Identity\n-w /etc/passwd -p wa -k identity\n\n-b 8192\n"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	var lines []int
+	for _, line := range file.Lines {
+		lines = append(lines, line.Pos.Line)
+	}
+	if want := []int{1, 2, 3, 5}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("lines %v, want %v", lines, want)
+	}
+}
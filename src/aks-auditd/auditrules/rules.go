@@ -0,0 +1,253 @@
+// Package auditrules parses, validates, and formats audit rules in the auditctl syntax used by the files in
+// /etc/audit/rules.d. It lets aks-auditd check rules without auditctl, which is not in the distroless image.
+package auditrules
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Position is the place of a token in a rules file. Line and Column start at 1. Column counts bytes.
+type Position struct {
+	Line   int
+	Column int
+}
+
+// File is a parsed rules file. Every line of the file is kept, including comments and blank lines, so formatting a
+// File reproduces the file.
+type File struct {
+	Name  string
+	Lines []Line
+}
+
+// Line is a line of a rules file. At most one of Control, Watch, and Rule is set. A line with none of them set is a
+// comment when Comment is not empty and a blank line otherwise.
+type Line struct {
+	Pos     Position `json:"-"`
+	Control *Control `json:"control,omitempty"`
+	Watch   *Watch   `json:"watch,omitempty"`
+	Rule    *Rule    `json:"rule,omitempty"`
+	Comment string   `json:"comment,omitempty"` // The comment including the leading #
+}
+
+// Control is an option that configures the kernel audit system rather than adding a rule, such as -D, -b, or -e.
+type Control struct {
+	Option string `json:"option"`          // The option as written, such as -b or --backlog_wait_time
+	Value  string `json:"value,omitempty"` // Argument of the option. Empty for options without one.
+	Key    string `json:"key,omitempty"`   // Only rules with this key are deleted by -D -k key
+}
+
+// Watch is a file system watch added with -w or removed with -W.
+type Watch struct {
+	Remove bool     `json:"remove,omitempty"` // Set for -W
+	Path   string   `json:"path"`
+	Perms  string   `json:"perms,omitempty"` // Combination of r, w, x, and a. Empty means all.
+	Keys   []string `json:"keys,omitempty"`
+
+	// Number of keys that come before -p, so formatting the watch keeps the order it is written in.
+	PermsIndex int `json:"permsIndex,omitempty"`
+}
+
+// Rule is a syscall, task, user, exclude, or filesystem rule added with -a or -A, or deleted with -d.
+type Rule struct {
+	Op       string   `json:"op"`     // -a appends, -A prepends, and -d deletes
+	Action   string   `json:"action"` // always or never
+	List     string   `json:"list"`   // exit, task, user, exclude, filesystem, or io_uring
+	Syscalls []string `json:"syscalls,omitempty"`
+	Fields   []Field  `json:"fields,omitempty"`
+	Keys     []string `json:"keys,omitempty"`
+
+	// Number of fields that come before the -S options. auditctl resolves syscall names for the arch field given
+	// before them, so the order is kept.
+	SyscallIndex int `json:"syscallIndex,omitempty"`
+
+	// Options of a parsed rule in the order they are written. Formatting the rule keeps their order and grouping, so
+	// the compiled audit.rules has the rule as augenrules copies it. A rule built or changed in code has no options
+	// and is formatted with its syscalls at SyscallIndex and its keys last.
+	Options []Option `json:"options,omitempty"`
+}
+
+// Option is a -S, -F, -C, or -k option of a rule as it is written.
+type Option struct {
+	Flag     string `json:"flag"`               // -S, -F, -C, or -k
+	Syscalls int    `json:"syscalls,omitempty"` // Number of syscalls listed by a -S
+	Key      bool   `json:"key,omitempty"`      // Set for -F key=value, which adds a key like -k
+}
+
+// Field is a -F field comparison, or a -C comparison between two fields.
+type Field struct {
+	Name    string `json:"name"`
+	Op      string `json:"op"` // =, !=, <, >, <=, >=, &, or &=
+	Value   string `json:"value"`
+	Compare bool   `json:"compare,omitempty"` // Set for -C, where Value is the name of the other field
+}
+
+// IsBlank returns true for an empty line.
+func (l Line) IsBlank() bool {
+	return l.Control == nil && l.Watch == nil && l.Rule == nil && l.Comment == ""
+}
+
+// IsComment returns true for a comment line.
+func (l Line) IsComment() bool {
+	return l.Control == nil && l.Watch == nil && l.Rule == nil && l.Comment != ""
+}
+
+// String formats the line in the auditctl syntax with single spaces between its words, keeping the order of its
+// options. Parsing the result returns the same line.
+func (l Line) String() string {
+	switch {
+	case l.Control != nil:
+		return l.Control.String()
+	case l.Watch != nil:
+		return l.Watch.String()
+	case l.Rule != nil:
+		return l.Rule.String()
+	}
+	return l.Comment
+}
+
+// String formats the control option, such as -b 8192.
+func (c Control) String() string {
+	s := c.Option
+	if c.Value != "" {
+		s += " " + c.Value
+	}
+	if c.Key != "" {
+		s += " -k " + c.Key
+	}
+	return s
+}
+
+// String formats the watch, such as -w /etc/passwd -p wa -k identity.
+func (w Watch) String() string {
+	var b strings.Builder
+	if w.Remove {
+		b.WriteString("-W ")
+	} else {
+		b.WriteString("-w ")
+	}
+	b.WriteString(w.Path)
+	for i, key := range w.Keys {
+		if i == w.PermsIndex && w.Perms != "" {
+			b.WriteString(" -p " + w.Perms)
+		}
+		b.WriteString(" -k " + key)
+	}
+	if w.PermsIndex >= len(w.Keys) && w.Perms != "" {
+		b.WriteString(" -p " + w.Perms)
+	}
+	return b.String()
+}
+
+// String formats the rule, such as -a always,exit -F arch=b64 -S openat -F exit=-EACCES -k access. A parsed rule
+// keeps the order and grouping of its options.
+func (r Rule) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s,%s", r.Op, r.Action, r.List)
+	if r.writeOptions(&b) {
+		return b.String()
+	}
+
+	for i, field := range r.Fields {
+		if i == r.SyscallIndex && len(r.Syscalls) > 0 {
+			b.WriteString(" -S " + strings.Join(r.Syscalls, ","))
+		}
+		b.WriteString(" " + field.String())
+	}
+	if r.SyscallIndex >= len(r.Fields) && len(r.Syscalls) > 0 {
+		b.WriteString(" -S " + strings.Join(r.Syscalls, ","))
+	}
+	for _, key := range r.Keys {
+		b.WriteString(" -k " + key)
+	}
+	return b.String()
+}
+
+// writeOptions writes the syscalls, fields, and keys of the rule in the order of its options. It returns false,
+// having written nothing, when the options do not account for exactly the syscalls, fields, and keys of the rule.
+func (r Rule) writeOptions(b *strings.Builder) bool {
+	if len(r.Options) == 0 {
+		return false
+	}
+
+	var options []string
+	syscalls, fields, keys := 0, 0, 0
+	for _, option := range r.Options {
+		switch {
+		case option.Flag == "-S" && option.Syscalls > 0 && syscalls+option.Syscalls <= len(r.Syscalls):
+			options = append(options, "-S "+strings.Join(r.Syscalls[syscalls:syscalls+option.Syscalls], ","))
+			syscalls += option.Syscalls
+		case (option.Flag == "-k" || option.Key && option.Flag == "-F") && keys < len(r.Keys):
+			if option.Key {
+				options = append(options, "-F key="+r.Keys[keys])
+			} else {
+				options = append(options, "-k "+r.Keys[keys])
+			}
+			keys++
+		case (option.Flag == "-F" && !option.Key || option.Flag == "-C") && fields < len(r.Fields) && r.Fields[fields].Compare == (option.Flag == "-C"):
+			options = append(options, r.Fields[fields].String())
+			fields++
+		default:
+			return false
+		}
+	}
+	if syscalls != len(r.Syscalls) || fields != len(r.Fields) || keys != len(r.Keys) {
+		return false
+	}
+
+	for _, option := range options {
+		b.WriteString(" " + option)
+	}
+	return true
+}
+
+// Canonical formats the rule with its syscalls at SyscallIndex and its keys last, whatever order and grouping its
+// options are written in, so two lines that add the same rule to the kernel format the same.
+func (r Rule) Canonical() string {
+	r.Options = nil
+	return r.String()
+}
+
+// Canonical formats the watch with a clean path and its permissions first, in the order rwxa, so two lines that add
+// the same watch to the kernel format the same. A watch without -p watches all permissions.
+func (w Watch) Canonical() string {
+	w.Path = path.Clean(w.Path)
+	perms := ""
+	for _, perm := range "rwxa" {
+		if w.Perms == "" || strings.ContainsRune(w.Perms, perm) {
+			perms += string(perm)
+		}
+	}
+	w.Perms, w.PermsIndex = perms, 0
+	return w.String()
+}
+
+// String formats the field as -F name=value or -C name=other.
+func (f Field) String() string {
+	if f.Compare {
+		return "-C " + f.Name + f.Op + f.Value
+	}
+	return "-F " + f.Name + f.Op + f.Value
+}
+
+// Field returns the value of the first field with the given name and true, or an empty string and false when the rule
+// has no such field.
+func (r Rule) Field(name string) (string, bool) {
+	for _, field := range r.Fields {
+		if field.Name == name && !field.Compare {
+			return field.Value, true
+		}
+	}
+	return "", false
+}
+
+// String formats the file, one line per line.
+func (f File) String() string {
+	var b strings.Builder
+	for _, line := range f.Lines {
+		b.WriteString(line.String())
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
@@ -0,0 +1,99 @@
+package auditrules
+
+// ABIs of the b64 and b32 arch values on every machine, in Go naming, that aks-auditd runs on. auditctl resolves
+// syscall names in the table of the ABI the arch field selects.
+var machineABIs = map[string]map[string]string{
+	"amd64": {"b64": "x86_64", "b32": "i386"},
+	"arm64": {"b64": "aarch64", "b32": "arm"},
+}
+
+// Syscall names of the other ABIs that an ABI lacks, and the syscall of the ABI that does the same. An empty
+// replacement means the ABI has no such syscall, so the name is left out of the rule. Names that are not listed are
+// kept as they are. The tables only hold names auditctl rejects for the ABI, so a rule written for one machine loads on
+// the other.
+var missingSyscalls = map[string]map[string]string{
+	"x86_64": merge(
+		legacy32Syscalls,
+		map[string]string{
+			"arm_fadvise64_64": "fadvise64", "arm_sync_file_range": "sync_file_range", "bdflush": "", "break": "",
+			"ftime": "", "gtty": "", "idle": "", "ipc": "", "lock": "", "mpx": "", "nice": "", "oldfstat": "",
+			"oldlstat": "", "oldolduname": "", "oldstat": "", "olduname": "", "prof": "", "profil": "", "readdir": "",
+			"sgetmask": "", "signal": "", "socketcall": "", "ssetmask": "", "stime": "", "stty": "", "ulimit": "",
+			"vm86": "", "vm86old": "",
+		},
+	),
+	"i386": {
+		"accept": "accept4", "arm_fadvise64_64": "fadvise64_64", "arm_sync_file_range": "sync_file_range",
+		"epoll_ctl_old": "", "epoll_wait_old": "", "kexec_file_load": "", "newfstatat": "fstatat64", "security": "",
+		"tuxcall": "",
+	},
+	"aarch64": merge(
+		legacy32Syscalls,
+		map[string]string{
+			"_newselect": "pselect6", "access": "faccessat", "afs_syscall": "", "alarm": "", "arch_prctl": "",
+			"arm_fadvise64_64": "fadvise64", "arm_sync_file_range": "sync_file_range", "chmod": "fchmodat",
+			"chown": "fchownat", "chown32": "fchownat", "creat": "openat", "create_module": "", "dup2": "dup3",
+			"epoll_create": "epoll_create1", "epoll_ctl_old": "", "epoll_wait": "epoll_pwait", "epoll_wait_old": "",
+			"eventfd": "eventfd2", "fork": "clone", "futimesat": "utimensat", "get_kernel_syms": "",
+			"get_thread_area": "", "getdents": "getdents64", "getpgrp": "getpgid", "getpmsg": "",
+			"inotify_init": "inotify_init1", "ioperm": "", "iopl": "", "ipc": "", "lchown": "fchownat",
+			"lchown32": "fchownat", "link": "linkat", "lstat": "newfstatat", "lstat64": "newfstatat",
+			"mkdir": "mkdirat", "mknod": "mknodat", "modify_ldt": "", "nfsservctl": "", "open": "openat", "pause": "",
+			"pipe": "pipe2", "poll": "ppoll", "putpmsg": "", "query_module": "", "readlink": "readlinkat",
+			"rename": "renameat", "rmdir": "unlinkat", "security": "", "select": "pselect6", "set_thread_area": "",
+			"signalfd": "signalfd4", "socketcall": "", "stat": "newfstatat", "stat64": "newfstatat", "stime": "",
+			"symlink": "symlinkat", "sysfs": "", "_sysctl": "", "time": "", "tuxcall": "", "unlink": "unlinkat",
+			"uselib": "", "ustat": "", "utime": "utimensat", "utimes": "utimensat", "vfork": "clone", "vserver": "",
+		},
+	),
+	"arm": {
+		"arch_prctl": "", "epoll_ctl_old": "", "epoll_wait_old": "", "fadvise64": "arm_fadvise64_64",
+		"get_thread_area": "", "getpmsg": "", "ioperm": "", "iopl": "", "modify_ldt": "", "newfstatat": "fstatat64",
+		"putpmsg": "", "security": "", "set_thread_area": "", "sync_file_range": "arm_sync_file_range", "tuxcall": "",
+	},
+}
+
+// Syscalls of the 32-bit ABIs that the 64-bit ABIs replaced with one syscall for 32-bit IDs, 64-bit offsets, and the
+// real-time signal calls.
+var legacy32Syscalls = map[string]string{
+	"_llseek": "lseek", "clock_adjtime64": "clock_adjtime", "clock_gettime64": "clock_gettime",
+	"clock_settime64": "clock_settime", "fadvise64_64": "fadvise64", "fchown32": "fchown", "fcntl64": "fcntl",
+	"fstat64": "fstat", "fstatat64": "newfstatat", "fstatfs64": "fstatfs", "ftruncate64": "ftruncate",
+	"getegid32": "getegid", "geteuid32": "geteuid", "getgid32": "getgid", "getgroups32": "getgroups",
+	"getresgid32": "getresgid", "getresuid32": "getresuid", "getuid32": "getuid", "mmap2": "mmap",
+	"sendfile64": "sendfile", "setfsgid32": "setfsgid", "setfsuid32": "setfsuid", "setgid32": "setgid",
+	"setgroups32": "setgroups", "setregid32": "setregid", "setresgid32": "setresgid", "setresuid32": "setresuid",
+	"setreuid32": "setreuid", "setuid32": "setuid", "sigaction": "rt_sigaction", "sigpending": "rt_sigpending",
+	"sigprocmask": "rt_sigprocmask", "sigreturn": "rt_sigreturn", "sigsuspend": "rt_sigsuspend",
+	"statfs64": "statfs", "truncate64": "truncate", "ugetrlimit": "getrlimit", "umount": "umount2",
+	"utimensat_time64": "utimensat", "waitpid": "wait4", "chown32": "chown", "lchown32": "lchown", "stat64": "stat",
+	"lstat64": "lstat",
+}
+
+// merge returns the entries of both maps. Entries of override replace those of base.
+func merge(base, override map[string]string) map[string]string {
+	merged := make(map[string]string, len(base)+len(override))
+	for name, replacement := range base {
+		merged[name] = replacement
+	}
+	for name, replacement := range override {
+		merged[name] = replacement
+	}
+	return merged
+}
+
+// SupportedMachine returns true if syscall rules can be expanded for the machine, in Go naming such as amd64.
+func SupportedMachine(machine string) bool {
+	_, supported := machineABIs[machine]
+	return supported
+}
+
+// resolveSyscall returns the name of the syscall of abi that does what name does. The second return value is false
+// when abi has no such syscall.
+func resolveSyscall(abi, name string) (string, bool) {
+	replacement, missing := missingSyscalls[abi][name]
+	if !missing {
+		return name, true
+	}
+	return replacement, replacement != ""
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// FileChange records a single file in a change set along with its digest in the target directory before the sync
+// (OldDigest) and in the source directory (NewDigest). A digest is empty when the file does not exist on that side.
+// Source is the name of the source the file is written from, if any.
+type FileChange struct {
+	Name      string
+	OldDigest string
+	NewDigest string
+	Source    string
+}
+
+// String formats the file change as name(old->new) for logging, followed by @source when the file has a source.
+func (f FileChange) String() string {
+	if f.Source != "" {
+		return fmt.Sprintf("%s(%s->%s)@%s", f.Name, shortDigest(f.OldDigest), shortDigest(f.NewDigest), f.Source)
+	}
+	return fmt.Sprintf("%s(%s->%s)", f.Name, shortDigest(f.OldDigest), shortDigest(f.NewDigest))
+}
+
+// ChangeSet is the set of operations required to make a target directory match its source directory. Foreign files
+// are target files aks-auditd did not write. Skipped files are source files that are not written because a foreign
+// file already has the same name. Drifted files were changed on the node by someone else and are left as they are
+// under the report drift policy. Their NewDigest is the digest aks-auditd last wrote. Quarantined files failed
+// validation and are left as they are under the skip-bad-files validation policy. Their NewDigest is the digest of
+// the invalid source file.
+type ChangeSet struct {
+	Added       []FileChange
+	Modified    []FileChange
+	Removed     []FileChange
+	Unchanged   []FileChange
+	Foreign     []FileChange
+	Skipped     []FileChange
+	Drifted     []FileChange
+	Quarantined []FileChange
+}
+
+// IsEmpty returns true when the target directory already matches the source directory.
+func (c ChangeSet) IsEmpty() bool {
+	return len(c.Added) == 0 && len(c.Modified) == 0 && len(c.Removed) == 0
+}
+
+// sort orders every list in the change set by file name so the log record and the sync order are deterministic.
+func (c *ChangeSet) sort() {
+	for _, changes := range [][]FileChange{c.Added, c.Modified, c.Removed, c.Unchanged, c.Foreign, c.Skipped, c.Drifted, c.Quarantined} {
+		sort.Slice(changes, func(i, j int) bool { return changes[i].Name < changes[j].Name })
+	}
+}
+
+// log writes the change set as a single structured log record. Records with changes are logged at info level so every
+// change made to the node is visible with the default log level.
+func (c ChangeSet) log(sourceDir, targetDir string) {
+	entry := log.WithFields(log.Fields{
+		"sourceDirectory": sourceDir,
+		"targetDirectory": targetDir,
+		"added":           c.Added,
+		"modified":        c.Modified,
+		"removed":         c.Removed,
+		"unchanged":       c.Unchanged,
+		"foreign":         c.Foreign,
+		"skipped":         c.Skipped,
+		"drifted":         c.Drifted,
+		"quarantined":     c.Quarantined,
+	})
+
+	for _, skipped := range c.Skipped {
+		log.Warnf("Not writing %s to %s. A file with the same name exists that aks-auditd did not create.", skipped.Name, targetDir)
+	}
+
+	if c.IsEmpty() {
+		entry.Debug("Change set")
+	} else {
+		entry.Info("Change set")
+	}
+}
+
+// manifest returns the manifest describing the target directory once the change set has been applied. Drifted files
+// keep the digest aks-auditd last wrote, so they are still owned and still reported as drift on the next sync.
+// Quarantined files that aks-auditd wrote before keep the digest of the file left on the node.
+func (c ChangeSet) manifest() Manifest {
+	manifest := Manifest{Files: make(map[string]string), Sources: make(map[string]string)}
+	for _, change := range append(append(append(c.Added, c.Modified...), c.Unchanged...), c.Drifted...) {
+		manifest.Files[change.Name] = change.NewDigest
+		if change.Source != "" {
+			manifest.Sources[change.Name] = change.Source
+		}
+	}
+	for _, change := range c.Quarantined {
+		if change.OldDigest != "" {
+			manifest.Files[change.Name] = change.OldDigest
+		}
+	}
+	return manifest
+}
+
+// keepDrift removes the drifted files from the added, modified, and removed files, so the sync leaves them as they
+// are on the node, and lists them as drifted instead.
+func (c *ChangeSet) keepDrift(drifts []Drift) {
+	drifted := make(map[string]bool)
+	for _, drift := range drifts {
+		drifted[drift.File] = true
+		c.Drifted = append(c.Drifted, FileChange{Name: drift.File, OldDigest: drift.ActualDigest, NewDigest: drift.ExpectedDigest})
+	}
+
+	keep := func(changes []FileChange) []FileChange {
+		var kept []FileChange
+		for _, change := range changes {
+			if !drifted[change.Name] {
+				kept = append(kept, change)
+			}
+		}
+		return kept
+	}
+	c.Added = keep(c.Added)
+	c.Modified = keep(c.Modified)
+	c.Removed = keep(c.Removed)
+	c.sort()
+}
+
+// keepQuarantined removes the quarantined files from the added and modified files, so the sync leaves them as they
+// are on the node, and lists them as quarantined instead.
+func (c *ChangeSet) keepQuarantined(quarantine map[string][]ValidationError) {
+	keep := func(changes []FileChange) []FileChange {
+		var kept []FileChange
+		for _, change := range changes {
+			if _, quarantined := quarantine[change.Name]; quarantined {
+				c.Quarantined = append(c.Quarantined, change)
+				continue
+			}
+			kept = append(kept, change)
+		}
+		return kept
+	}
+	c.Added = keep(c.Added)
+	c.Modified = keep(c.Modified)
+	c.sort()
+}
+
+// digest returns the hex encoded form of a SHA-256 hash.
+func digest(hash [32]byte) string {
+	return hex.EncodeToString(hash[:])
+}
+
+// shortDigest truncates a hex digest to 12 characters for logging. Missing digests are shown as "-".
+func shortDigest(d string) string {
+	if d == "" {
+		return "-"
+	}
+	if len(d) > 12 {
+		return d[:12]
+	}
+	return d
+}
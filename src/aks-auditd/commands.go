@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"text/tabwriter"
+)
+
+// usage describes the commands aks-auditd accepts in addition to running the sync loop. The commands are meant to be
+// run by on-call with kubectl exec in the aks-auditd container of the node to recover.
+const usage = `Usage: aks-auditd [command] [flags]
+
+Without a command, aks-auditd runs the sync loop.
+
+Commands:
+  history    List the rulesets recorded on this node
+  rollback   Restore an earlier ruleset and hold back the current ConfigMap ruleset
+  resume     Remove the hold so the ConfigMap ruleset is applied again
+  resync     Make the running aks-auditd start a new sync cycle right away
+  lint       Check rules files for audit best practices. Lints the given files and directories, or the rules in the
+             target directory when none are given
+  compile    Print the audit.rules augenrules generates from the given files and directories, or from the rules in
+             the target directory when none are given, and its digest
+  packs      List the built-in rule packs, or the rules of the given pack
+`
+
+// runCommand runs one of the on-call commands and returns the process exit code.
+func runCommand(args []string) int {
+	// The sync loop runs as PID 1 of the container and starts a new sync cycle on SIGHUP
+	if args[0] == "resync" {
+		if err := syscall.Kill(1, syscall.SIGHUP); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+
+	// The rule packs are built into the binary and listed without a configuration
+	if args[0] == "packs" {
+		if err := packsCommand(args[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	target := flags.String("target", "", "target directory of the ruleset (default: the first configured directory)")
+	to := flags.String("to", "", "rollback only: ID of the ruleset to restore (default: the newest earlier ruleset that did not fail)")
+	reason := flags.String("reason", "manual rollback", "rollback only: reason recorded with the hold")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	// Linting and compiling files given on the command line works without a configuration, for example in CI
+	if (args[0] == "lint" || args[0] == "compile") && flags.NArg() > 0 {
+		command := lintCommand
+		if args[0] == "compile" {
+			command = compileCommand
+		}
+		if err := command("", flags.Args()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+
+	if err := initConfig(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	config, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	applyConfig(config)
+
+	pair, err := findPair(config, *target)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if args[0] == "lint" {
+		if err := lintCommand(pair.TargetDirectory, nil); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+	if args[0] == "compile" {
+		if err := compileCommand(pair.TargetDirectory, nil); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+	if pair.HistorySize == 0 {
+		fmt.Fprintln(os.Stderr, "The history is disabled. Set historySize to a value greater than 0.")
+		return 1
+	}
+
+	switch args[0] {
+	case "history":
+		err = printHistory(pair)
+	case "rollback":
+		err = rollbackCommand(pair, *to, *reason)
+	case "resume":
+		err = resumeCommand(pair)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// findPair returns the configured pair with the given target directory, or the first pair if target is empty.
+func findPair(config Config, target string) (DirectoryPair, error) {
+	for _, pair := range config.Directories {
+		if target == "" || filepath.Clean(pair.TargetDirectory) == filepath.Clean(target) {
+			return pair.resolveSnapshots(), nil
+		}
+	}
+	return DirectoryPair{}, fmt.Errorf("no configured directory has the target %s", target)
+}
+
+// printHistory writes the rulesets recorded for the pair as a table and marks the one currently in place.
+func printHistory(pair DirectoryPair) error {
+	rulesets, err := readHistory(pair.TargetDirectory)
+	if err != nil {
+		return err
+	}
+	manifest, _, err := readManifest(pair.TargetDirectory)
+	if err != nil {
+		return err
+	}
+	current := currentRuleset(rulesets, rulesetDigest(manifest.Files))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "\tID\tDIGEST\tEFFECTIVE\tRESOURCE VERSION\tSTATUS\tFILES")
+	for i, ruleset := range rulesets {
+		marker := ""
+		if i == current {
+			marker = "*"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\n", marker, ruleset.ID, shortDigest(ruleset.Digest), shortDigest(ruleset.EffectiveDigest), valueOrDefault(ruleset.ResourceVersion, "-"), ruleset.Status, len(ruleset.Files))
+	}
+	w.Flush()
+
+	hold, held, err := readHold(pair.TargetDirectory)
+	if err != nil {
+		return err
+	}
+	if held {
+		fmt.Printf("\nThe ConfigMap ruleset %s is held back since %v after a rollback to %s: %s\n", shortDigest(hold.Digest), hold.Timestamp, hold.RolledBackTo, hold.Reason)
+	}
+
+	reboot, required, err := readRebootRequired(pair.TargetDirectory)
+	if err != nil {
+		return err
+	}
+	if required {
+		fmt.Printf("\nThe audit configuration is immutable (-e 2). Reboot required since %v to apply ruleset %s.\n", reboot.Timestamp, rebootRulesetName(pair.TargetDirectory, reboot.Digest))
+	}
+
+	return nil
+}
+
+// rollbackCommand restores the ruleset with the given ID, or the newest earlier ruleset that did not fail, and holds
+// back the current ConfigMap ruleset until the ConfigMap changes or resume is run.
+func rollbackCommand(pair DirectoryPair, id, reason string) error {
+	unlock, err := lockHistory(pair.TargetDirectory)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	rulesets, err := readHistory(pair.TargetDirectory)
+	if err != nil {
+		return err
+	}
+	manifest, _, err := readManifest(pair.TargetDirectory)
+	if err != nil {
+		return err
+	}
+	current := currentRuleset(rulesets, rulesetDigest(manifest.Files))
+
+	target := -1
+	for i := len(rulesets) - 1; i >= 0; i-- {
+		if id != "" && rulesets[i].ID == id {
+			target = i
+			break
+		}
+		if id == "" && i < current && rulesets[i].Status != rulesetFailed && rulesets[i].Digest != rulesets[current].Digest {
+			target = i
+			break
+		}
+	}
+	if target < 0 {
+		return errors.New("no ruleset to roll back to. Run the history command to list the recorded rulesets")
+	}
+
+	desiredDigest, err := sourceDigest(pair)
+	if err != nil {
+		return err
+	}
+	if err := rollback(pair, rulesets[target], desiredDigest, reason); err != nil {
+		return err
+	}
+
+	fmt.Printf("Restored ruleset %s in %s. aks-auditd-monitor reloads auditd shortly.\n", rulesets[target].ID, pair.TargetDirectory)
+	return nil
+}
+
+// resumeCommand removes the hold on the pair so the next sync applies the ConfigMap ruleset again.
+func resumeCommand(pair DirectoryPair) error {
+	unlock, err := lockHistory(pair.TargetDirectory)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := removeHold(pair.TargetDirectory); err != nil {
+		return err
+	}
+
+	fmt.Printf("Removed the hold on %s. The ConfigMap ruleset is applied on the next sync.\n", pair.TargetDirectory)
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"aksauditd/auditrules"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Name of the file with the effective ruleset aks-auditd keeps in a target directory with rules files.
+// aks-auditd-monitor reads it to load a rules change into the kernel without restarting auditd. The leading dot and
+// .json extension keep augenrules and auditd from reading it.
+const compiledFileName = stagingPrefix + "compiled.json"
+
+// CompiledRuleset is the effective ruleset of a target directory: the audit.rules augenrules generates from the rules
+// files, along with the digests of the files it was compiled from. aks-auditd-monitor only loads it while the rules
+// files on the node still have these digests.
+type CompiledRuleset struct {
+	Digest  string            `json:"digest"`            // Hex SHA-256 digest of the compiled audit.rules
+	Files   map[string]string `json:"files"`             // Rules file name to the hex SHA-256 digest of its content
+	Lines   []auditrules.Line `json:"lines"`             // Control options, watches, and rules of the audit.rules in order
+	History string            `json:"history,omitempty"` // History directory in the target directory, where load failures go
+}
+
+// compileFiles compiles the rules files, keyed by the name they have in the target directory, into the audit.rules
+// augenrules generates from them and returns it along with its hex SHA-256 digest. augenrules copies a line that does
+// not parse into audit.rules as it is, where auditctl rejects it, so the files must parse.
+func compileFiles(root string, byName map[string]string) (*auditrules.File, string, error) {
+	files, findings, err := parseRulesFiles(root, byName)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(findings) > 0 {
+		return nil, "", fmt.Errorf("cannot compile the rules: %s", findings[0])
+	}
+
+	compiled := auditrules.Compile(files)
+	return compiled, digest(sha256.Sum256([]byte(compiled.String()))), nil
+}
+
+// effectivePaths returns the rules files augenrules loads from the target directory once the changes are synced,
+// keyed by their names in the target directory. Added and modified files are read from the source, and every other
+// file in the target directory, except the removed ones, from the target directory.
+func effectivePaths(targetDir string, hashesTarget map[string][32]byte, sourceFiles map[string]SourceFile, changes ChangeSet) map[string]string {
+	paths := make(map[string]string)
+	for fileName := range hashesTarget {
+		paths[fileName] = filepath.Join(targetDir, fileName)
+	}
+	for _, change := range changes.Removed {
+		delete(paths, change.Name)
+	}
+	for _, change := range append(changes.Added, changes.Modified...) {
+		paths[change.Name] = sourceFiles[change.Name].Path
+	}
+
+	for fileName := range paths {
+		if !strings.HasSuffix(fileName, ".rules") || strings.HasPrefix(fileName, ".") {
+			delete(paths, fileName)
+		}
+	}
+	return paths
+}
+
+// reportEffectiveRuleset compiles the rules files, which are the files of the target directory of the pair after the
+// sync, and logs the digest of the audit.rules augenrules generates from them whenever it changes. The rules
+// themselves are logged at debug level. The compiled ruleset is written to the target directory for
+// aks-auditd-monitor. A target directory without rules files, such as plugins.d, has no effective ruleset.
+func reportEffectiveRuleset(pair DirectoryPair, byName map[string]string) {
+	if len(byName) == 0 {
+		return
+	}
+	compiled, compiledDigest, err := compileFiles(pair.TargetDirectory, byName)
+	if err != nil {
+		log.Warnf("Unable to compile the effective ruleset of %s: %v", pair.TargetDirectory, err)
+		return
+	}
+
+	// Only log the effective ruleset when it changes and not on every poll
+	if reports.changed(pair.TargetDirectory, kindEffective, "", compiledDigest) {
+		log.WithFields(log.Fields{
+			"targetDirectory": pair.TargetDirectory,
+			"files":           len(byName),
+			"lines":           len(compiled.Lines) - 1,
+			"digest":          compiledDigest,
+		}).Info("Effective ruleset compiled")
+		log.Debugf("Effective ruleset of %s:\n%s", pair.TargetDirectory, compiled)
+	}
+
+	// aks-auditd-monitor reports a load failure to the history of the pair, so it is named in the compiled ruleset
+	history := ""
+	if pair.HistorySize > 0 {
+		history = historyDirectoryName
+	}
+	if err := writeCompiled(pair.TargetDirectory, history, compiled, compiledDigest, byName); err != nil {
+		log.Warnf("Unable to write the effective ruleset of %s: %v", pair.TargetDirectory, err)
+	}
+}
+
+// writeCompiled writes the compiled ruleset to targetDir with the name of its history directory, unless the one there
+// already has the same digests and history.
+func writeCompiled(targetDir, history string, compiled *auditrules.File, compiledDigest string, byName map[string]string) error {
+	ruleset := CompiledRuleset{Digest: compiledDigest, Files: make(map[string]string), History: history}
+	for fileName, path := range byName {
+		data, err := hostReadFile(targetDir, path)
+		if err != nil {
+			return err
+		}
+		ruleset.Files[fileName] = digest(sha256.Sum256(data))
+	}
+	for _, line := range compiled.Lines {
+		if !line.IsComment() {
+			ruleset.Lines = append(ruleset.Lines, line)
+		}
+	}
+
+	var current CompiledRuleset
+	data, err := hostReadFile(targetDir, filepath.Join(targetDir, compiledFileName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil && json.Unmarshal(data, &current) == nil && current.Digest == ruleset.Digest && current.History == ruleset.History && reflect.DeepEqual(current.Files, ruleset.Files) {
+		return nil
+	}
+
+	log.Debugf("Writing the effective ruleset %s to %s", shortDigest(compiledDigest), targetDir)
+	return writeJSON(targetDir, targetDir, compiledFileName, ruleset)
+}
+
+// effectiveDigest returns the digest of the audit.rules compiled from the rules files in dir, or an empty string when
+// dir has no rules files or they do not compile.
+func effectiveDigest(dir string) string {
+	paths, err := rulesFilePaths(dir)
+	if err != nil || len(paths) == 0 {
+		return ""
+	}
+	_, compiledDigest, err := compileFiles(dir, pathsByName(paths))
+	if err != nil {
+		log.Debugf("Unable to compile the effective ruleset of %s: %v", dir, err)
+		return ""
+	}
+	return compiledDigest
+}
+
+// compileCommand compiles the given rules files and directories, or the rules in dir when none are given, into the
+// audit.rules augenrules generates from them. It prints the audit.rules to stdout and its digest to stderr, so the
+// output can be compared with /etc/audit/audit.rules on the node.
+func compileCommand(dir string, args []string) error {
+	files, err := collectRulesFiles(dir, args)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no rules files to compile")
+	}
+
+	compiled, compiledDigest, err := compileFiles(dir, pathsByName(files))
+	if err != nil {
+		return err
+	}
+	fmt.Print(compiled)
+	fmt.Fprintf(os.Stderr, "Digest: %s\n", compiledDigest)
+	return nil
+}
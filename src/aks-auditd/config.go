@@ -0,0 +1,415 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/mitchellh/mapstructure"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Audit configuration directory of the node. aks-auditd writes to its rules.d and plugins.d through container mounts.
+const nodeAuditDirectory = "/etc/audit"
+
+// Directory the configuration file is read from. The file name is config.yaml.
+const configDirectory = "/etc/aks-auditd"
+
+// The configuration currently in effect. It is replaced as a whole when the config file changes and the new file is valid.
+var (
+	configMu      sync.RWMutex
+	currentConfig Config
+)
+
+// configReloaded receives a value whenever a new configuration has been applied, so the main loop can start a new sync
+// cycle without waiting out the previous poll interval.
+var configReloaded = make(chan struct{}, 1)
+
+// Config holds the aks-auditd settings after the environment variables, config file, and defaults have been merged.
+type Config struct {
+	LogLevel         string          `mapstructure:"logLevel"`
+	PollInterval     time.Duration   `mapstructure:"pollInterval"`
+	RulesDirectory   string          `mapstructure:"rulesDirectory"`   // Target directory of the default rules pair
+	PluginsDirectory string          `mapstructure:"pluginsDirectory"` // Target directory of the default plugins pair
+	Directories      []DirectoryPair `mapstructure:"directories"`      // Replaces the default pairs when set
+	FilePrefix       string          `mapstructure:"filePrefix"`       // Default file name prefix for every pair
+	HistorySize      int             `mapstructure:"historySize"`      // Number of applied rulesets kept per pair
+	DriftPolicy      string          `mapstructure:"driftPolicy"`      // Default drift policy for every pair
+	ValidationPolicy string          `mapstructure:"validationPolicy"` // Default validation policy for every pair
+	SigningKeys      []string        `mapstructure:"signingKeys"`      // Default signing keys for every pair
+	ArchExpansion    bool            `mapstructure:"archExpansion"`    // Expand syscall rules for b64 and b32 and the node arch
+	Packs            []PackSelection `mapstructure:"packs"`            // Built-in rule packs of the default rules pair
+}
+
+// initConfig sets the defaults, binds the environment variables, and reads the config file. The order of precedence is
+// environment variable, config file value, and then default value. A missing config file is not an error.
+func initConfig() error {
+
+	// Set default config values
+	viper.SetDefault("pollInterval", "30s")
+	viper.SetDefault("logLevel", "info")
+	viper.SetDefault("historySize", 5)
+	viper.SetDefault("driftPolicy", driftRemediate)
+	viper.SetDefault("validationPolicy", validationAllOrNothing)
+	viper.SetDefault("archExpansion", true)
+
+	// Environment variable settings
+	// NOTE: When using BindEnv with multiple, SetEnvPrefix does not apply and we must set it explicitly
+	viper.SetEnvPrefix("AA")
+	viper.BindEnv("logLevel", "AA_LOG_LEVEL")
+	viper.BindEnv("pollInterval", "AA_POLL_INTERVAL")
+	viper.BindEnv("rulesDirectory", "AA_RULES_DIRECTORY")
+	viper.BindEnv("pluginsDirectory", "AA_PLUGINS_DIRECTORY")
+	viper.BindEnv("filePrefix", "AA_FILE_PREFIX")
+	viper.BindEnv("historySize", "AA_HISTORY_SIZE")
+	viper.BindEnv("driftPolicy", "AA_DRIFT_POLICY")
+	viper.BindEnv("validationPolicy", "AA_VALIDATION_POLICY")
+	viper.BindEnv("archExpansion", "AA_ARCH_EXPANSION")
+
+	// Set the file name of the configuration file without the extension
+	viper.SetConfigName("config")
+	viper.AddConfigPath(configDirectory)
+	viper.SetConfigType("yaml")
+	if err := viper.ReadInConfig(); err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
+			log.Debug("Config file not found. Using default values.")
+		} else {
+			return fmt.Errorf("error reading config file: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// loadConfig decodes the current viper settings into a Config and validates it. Keys that aks-auditd does not know
+// are reported as errors rather than ignored, so a typo in the config file does not silently fall back to a default.
+func loadConfig() (Config, error) {
+	var config Config
+
+	decodeHook := viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
+		mapstructure.StringToTimeDurationHookFunc(),
+		stringToFileModeHookFunc(),
+	))
+	if err := viper.UnmarshalExact(&config, decodeHook); err != nil {
+		return Config{}, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	// Files written to a declared directory default to the rules file permissions
+	for i := range config.Directories {
+		if config.Directories[i].FileMode == 0 {
+			config.Directories[i].FileMode = rulesFileMode
+		}
+	}
+
+	// Earlier versions took the paths of the audit directories on the node. They are mapped to the paths the DaemonSet
+	// mounts the node directories at, so a config written for them keeps working.
+	config.RulesDirectory = containerPath("rulesDirectory", config.RulesDirectory, chrootRulesMount)
+	config.PluginsDirectory = containerPath("pluginsDirectory", config.PluginsDirectory, chrootPluginsMount)
+	for i := range config.Directories {
+		key := fmt.Sprintf("directories[%d].targetDirectory", i)
+		config.Directories[i].TargetDirectory = containerPath(key, config.Directories[i].TargetDirectory, "")
+	}
+
+	if len(config.Directories) > 0 && (config.RulesDirectory != "" || config.PluginsDirectory != "") {
+		return Config{}, errors.New("invalid configuration: directories cannot be combined with rulesDirectory or pluginsDirectory")
+	}
+	if len(config.Directories) > 0 && len(config.Packs) > 0 {
+		return Config{}, errors.New("invalid configuration: packs cannot be combined with directories. Set packs on the directory instead")
+	}
+
+	// Without an explicit list of directories, sync the rules and plugins directories
+	if len(config.Directories) == 0 {
+		config.Directories = []DirectoryPair{
+			{
+				SourceDirectory: rulesMount,
+				TargetDirectory: valueOrDefault(config.RulesDirectory, chrootRulesMount),
+				FileMode:        rulesFileMode,
+				ConfigMap:       rulesConfigMap,
+				Packs:           config.Packs,
+			},
+			{
+				SourceDirectory: pluginsMount,
+				TargetDirectory: valueOrDefault(config.PluginsDirectory, chrootPluginsMount),
+				FileMode:        pluginsFileMode,
+				ConfigMap:       pluginsConfigMap,
+			},
+		}
+	}
+
+	// Pairs without their own file name prefix, drift policy, validation policy, or signing keys use the global ones.
+	// Every pair keeps the same number of rulesets and expands syscall rules the same way.
+	for i := range config.Directories {
+		if config.Directories[i].FilePrefix == "" {
+			config.Directories[i].FilePrefix = config.FilePrefix
+		}
+		if config.Directories[i].DriftPolicy == "" {
+			config.Directories[i].DriftPolicy = config.DriftPolicy
+		}
+		if config.Directories[i].ValidationPolicy == "" {
+			config.Directories[i].ValidationPolicy = config.ValidationPolicy
+		}
+		if len(config.Directories[i].SigningKeys) == 0 {
+			config.Directories[i].SigningKeys = config.SigningKeys
+		}
+		config.Directories[i].HistorySize = config.HistorySize
+		config.Directories[i].ArchExpansion = config.ArchExpansion
+	}
+
+	if err := config.validate(); err != nil {
+		return Config{}, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	return config, nil
+}
+
+// getConfig returns the configuration currently in effect.
+func getConfig() Config {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return currentConfig
+}
+
+// applyConfig makes config the configuration in effect and sets the log level it specifies.
+func applyConfig(config Config) {
+	configMu.Lock()
+	currentConfig = config
+	configMu.Unlock()
+
+	log.SetLevel(levelMap[strings.ToLower(config.LogLevel)])
+}
+
+// watchConfig reloads the configuration whenever the config file changes, including the symlink swap kubelet performs
+// when a mounted ConfigMap is updated. An invalid new configuration is rejected and the last good one stays in effect.
+// Nothing is watched when aks-auditd runs without a config file.
+func watchConfig() {
+	if viper.ConfigFileUsed() == "" {
+		log.Debug("No config file in use. Configuration changes require a restart.")
+		return
+	}
+
+	viper.OnConfigChange(func(e fsnotify.Event) {
+		log.Info("Config file changed: ", e.Name)
+		reloadConfig()
+	})
+	viper.WatchConfig()
+}
+
+// reloadConfig applies the settings viper read from the changed config file. An invalid configuration is rejected and
+// the last good one stays in effect. It returns true when the new configuration was applied.
+func reloadConfig() bool {
+	config, err := loadConfig()
+	if err != nil {
+		log.Errorf("Rejected the new configuration. Keeping the last good configuration. %v", err)
+		return false
+	}
+
+	applyConfig(config)
+	config.logConfig()
+
+	// Wake up the main loop. If a wake up is already pending, it will pick up this configuration as well.
+	select {
+	case configReloaded <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// validate checks the values of the configuration and returns all problems found, one per line.
+func (c Config) validate() error {
+	var errs []error
+
+	if _, ok := levelMap[strings.ToLower(c.LogLevel)]; !ok {
+		errs = append(errs, fmt.Errorf("logLevel: invalid log level %q. Valid values are panic, fatal, error, warn, info, debug, trace", c.LogLevel))
+	}
+
+	if c.PollInterval <= 0 {
+		errs = append(errs, fmt.Errorf("pollInterval: must be greater than 0, got %v", c.PollInterval))
+	}
+
+	if c.HistorySize < 0 {
+		errs = append(errs, fmt.Errorf("historySize: must be 0 or greater, got %d", c.HistorySize))
+	}
+
+	targets := make(map[string]int)
+	for i, pair := range c.Directories {
+		if len(pair.Sources) > 0 {
+			errs = append(errs, pair.validateSources(i)...)
+		} else {
+			if !filepath.IsAbs(pair.SourceDirectory) {
+				errs = append(errs, fmt.Errorf("directories[%d].sourceDirectory: must be an absolute path, got %q", i, pair.SourceDirectory))
+			}
+			if filepath.Clean(pair.SourceDirectory) == filepath.Clean(pair.TargetDirectory) {
+				errs = append(errs, fmt.Errorf("directories[%d]: sourceDirectory and targetDirectory must differ", i))
+			}
+		}
+		if !filepath.IsAbs(pair.TargetDirectory) {
+			errs = append(errs, fmt.Errorf("directories[%d].targetDirectory: must be an absolute path, got %q", i, pair.TargetDirectory))
+		}
+		if j, exists := targets[filepath.Clean(pair.TargetDirectory)]; exists {
+			errs = append(errs, fmt.Errorf("directories[%d].targetDirectory: %q is already the target of directories[%d]", i, pair.TargetDirectory, j))
+		}
+		targets[filepath.Clean(pair.TargetDirectory)] = i
+		if strings.Contains(pair.FilePrefix, "/") || strings.HasPrefix(pair.FilePrefix, ".") {
+			errs = append(errs, fmt.Errorf("directories[%d].filePrefix: must not contain '/' or start with '.', got %q", i, pair.FilePrefix))
+		}
+		switch pair.DriftPolicy {
+		case driftRemediate, driftReport, driftAlertAndRemediate:
+		default:
+			errs = append(errs, fmt.Errorf("directories[%d].driftPolicy: invalid drift policy %q. Valid values are remediate, report, alert-and-remediate", i, pair.DriftPolicy))
+		}
+		switch pair.ValidationPolicy {
+		case validationAllOrNothing, validationSkipBadFiles:
+		default:
+			errs = append(errs, fmt.Errorf("directories[%d].validationPolicy: invalid validation policy %q. Valid values are all-or-nothing, skip-bad-files", i, pair.ValidationPolicy))
+		}
+		if _, err := parsePublicKeys(pair.SigningKeys); err != nil {
+			errs = append(errs, fmt.Errorf("directories[%d].signingKeys: %w", i, err))
+		}
+		errs = append(errs, pair.validatePacks(i)...)
+		if pair.FileMode&^os.ModePerm != 0 {
+			errs = append(errs, fmt.Errorf("directories[%d].fileMode: must be a permission value no greater than 0777, got %#o", i, uint32(pair.FileMode)))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// isNodeAuditPath returns true if path is the audit configuration directory of the node, /etc/audit, or a path in it.
+// aks-auditd only reaches these directories through the mounts of its container.
+func isNodeAuditPath(path string) bool {
+	path = filepath.Clean(path)
+	return path == nodeAuditDirectory || strings.HasPrefix(path, nodeAuditDirectory+"/")
+}
+
+// Audit directories of the node mapped to the paths the DaemonSet mounts them at in the aks-auditd container
+var nodeMounts = map[string]string{
+	nodeAuditDirectory + "/rules.d":   chrootRulesMount,
+	nodeAuditDirectory + "/plugins.d": chrootPluginsMount,
+}
+
+// containerPath returns the path in the aks-auditd container that the setting key, set to path, refers to. A path on
+// the node in /etc/audit is replaced by the mount path of its node directory, or by fallback when it is not one of the
+// mounted directories, and a warning tells how to migrate the setting. Any other path is returned as it is.
+func containerPath(key, path, fallback string) string {
+	if !isNodeAuditPath(path) {
+		return path
+	}
+	mount, exists := nodeMounts[filepath.Clean(path)]
+	if !exists {
+		mount = fallback
+	}
+	if mount == "" {
+		log.Warnf("%s: %q is a path on the node, but aks-auditd only reaches the node through the mounts of its container. Set it to the mountPath of the node directory in the DaemonSet.", key, path)
+		return path
+	}
+	log.Warnf("%s: %q is a path on the node. Using %s, the path in the aks-auditd container where the DaemonSet mounts the node directory. Set %s to %s or remove it to silence this warning.", key, path, mount, key, mount)
+	return mount
+}
+
+// validateSources checks the layered sources of the pair at index i of the directories.
+func (p DirectoryPair) validateSources(i int) []error {
+	var errs []error
+
+	if p.SourceDirectory != "" || p.ConfigMap != "" {
+		errs = append(errs, fmt.Errorf("directories[%d]: sources cannot be combined with sourceDirectory or configMap", i))
+	}
+
+	priorities := make(map[int]int)
+	directories := make(map[string]int)
+	for j, source := range p.Sources {
+		if source.OCI != nil {
+			if source.Directory != "" || source.ConfigMap != "" {
+				errs = append(errs, fmt.Errorf("directories[%d].sources[%d]: oci cannot be combined with directory or configMap", i, j))
+			}
+			if _, err := parseOCIReference(source.OCI.Reference); err != nil {
+				errs = append(errs, fmt.Errorf("directories[%d].sources[%d].oci.reference: %w", i, j, err))
+			}
+			if source.OCI.PollInterval < 0 {
+				errs = append(errs, fmt.Errorf("directories[%d].sources[%d].oci.pollInterval: must be 0 or greater, got %v", i, j, source.OCI.PollInterval))
+			}
+			// The credentials belong to the registry in reference and are only ever sent to it over HTTPS
+			if source.OCI.Username != "" && source.OCI.Insecure {
+				errs = append(errs, fmt.Errorf("directories[%d].sources[%d].oci: username cannot be combined with insecure, as the credentials would be sent over plain HTTP", i, j))
+			}
+			if source.OCI.Username != "" && source.OCI.Mirror != "" {
+				errs = append(errs, fmt.Errorf("directories[%d].sources[%d].oci: username cannot be combined with mirror, as the credentials of %s would be sent to %s", i, j, source.OCI.Reference, source.OCI.Mirror))
+			}
+			if k, exists := priorities[source.Priority]; exists {
+				errs = append(errs, fmt.Errorf("directories[%d].sources[%d].priority: %d is already the priority of sources[%d]", i, j, source.Priority, k))
+			}
+			priorities[source.Priority] = j
+			continue
+		}
+		if !filepath.IsAbs(source.Directory) {
+			errs = append(errs, fmt.Errorf("directories[%d].sources[%d].directory: must be an absolute path, got %q", i, j, source.Directory))
+		}
+		if filepath.Clean(source.Directory) == filepath.Clean(p.TargetDirectory) {
+			errs = append(errs, fmt.Errorf("directories[%d].sources[%d]: directory and targetDirectory must differ", i, j))
+		}
+		if k, exists := directories[filepath.Clean(source.Directory)]; exists {
+			errs = append(errs, fmt.Errorf("directories[%d].sources[%d].directory: %q is already the directory of sources[%d]", i, j, source.Directory, k))
+		}
+		directories[filepath.Clean(source.Directory)] = j
+		if k, exists := priorities[source.Priority]; exists {
+			errs = append(errs, fmt.Errorf("directories[%d].sources[%d].priority: %d is already the priority of sources[%d]", i, j, source.Priority, k))
+		}
+		priorities[source.Priority] = j
+	}
+
+	return errs
+}
+
+// logConfig writes the effective configuration to the log.
+func (c Config) logConfig() {
+	if viper.ConfigFileUsed() != "" {
+		log.Info("Config file: ", viper.ConfigFileUsed())
+	}
+	log.Info("Polling interval: ", c.PollInterval)
+	log.Info("Log Level: ", c.LogLevel)
+	log.Info("History size: ", c.HistorySize)
+	log.Info("Syscall rule arch expansion: ", c.ArchExpansion)
+	for _, pair := range c.Directories {
+		log.Infof("Syncing %s to %s with file mode %#o, file prefix %q, drift policy %s, and validation policy %s", strings.Join(pair.sourceDirectories(), ", "), pair.TargetDirectory, uint32(pair.FileMode), pair.FilePrefix, pair.DriftPolicy, pair.ValidationPolicy)
+		for _, selection := range pair.Packs {
+			if len(selection.Exclude) > 0 {
+				log.Infof("Rendering the rule pack %s into %s without the rules %s", selection.Name, pair.TargetDirectory, strings.Join(selection.Exclude, ", "))
+			} else {
+				log.Infof("Rendering the rule pack %s into %s", selection.Name, pair.TargetDirectory)
+			}
+		}
+		if len(pair.SigningKeys) > 0 {
+			log.Infof("Requiring a signature by one of %d signing keys on every source of %s", len(pair.SigningKeys), pair.TargetDirectory)
+		}
+	}
+}
+
+// stringToFileModeHookFunc decodes file modes written in the config file. YAML already decodes an unquoted 0640 as an
+// octal number, so only quoted values such as "0640" need to be parsed.
+func stringToFileModeHookFunc() mapstructure.DecodeHookFuncType {
+	return func(f reflect.Type, t reflect.Type, data interface{}) (interface{}, error) {
+		if t != reflect.TypeOf(os.FileMode(0)) || f.Kind() != reflect.String {
+			return data, nil
+		}
+		mode, err := strconv.ParseUint(data.(string), 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid file mode %q: must be an octal value such as 0640", data)
+		}
+		return os.FileMode(mode), nil
+	}
+}
+
+// valueOrDefault returns value, or defaultValue when value is empty.
+func valueOrDefault(value, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// loadTestConfig loads the configuration from the defaults and settings, keyed by config file key.
+func loadTestConfig(t *testing.T, settings map[string]any) (Config, error) {
+	t.Helper()
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	if err := initConfig(); err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range settings {
+		viper.Set(key, value)
+	}
+	return loadConfig()
+}
+
+func TestLoadConfigNodePaths(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		settings map[string]any
+		want     []string // Target directories of the pairs
+	}{
+		{"defaults", nil, []string{chrootRulesMount, chrootPluginsMount}},
+		{"container paths", map[string]any{"rulesDirectory": "/rules", "pluginsDirectory": "/plugins"}, []string{"/rules", "/plugins"}},
+		{"node rules directory", map[string]any{"rulesDirectory": "/etc/audit/rules.d/"}, []string{chrootRulesMount, chrootPluginsMount}},
+		{"node plugins directory", map[string]any{"pluginsDirectory": "/etc/audit/plugins.d"}, []string{chrootRulesMount, chrootPluginsMount}},
+		{"node audit directory", map[string]any{"rulesDirectory": "/etc/audit"}, []string{chrootRulesMount, chrootPluginsMount}},
+		{"similar container path", map[string]any{"rulesDirectory": "/etc/auditd-rules"}, []string{"/etc/auditd-rules", chrootPluginsMount}},
+		{"node target directory", map[string]any{"directories": []map[string]any{
+			{"sourceDirectory": "/auditd-rules", "targetDirectory": "/etc/audit/rules.d"},
+			{"sourceDirectory": "/audispd-plugins", "targetDirectory": "/etc/audit/plugins.d/"},
+		}}, []string{chrootRulesMount, chrootPluginsMount}},
+		{"unmounted node target directory", map[string]any{"directories": []map[string]any{
+			{"sourceDirectory": "/auditd-rules", "targetDirectory": "/etc/audit/other.d"},
+		}}, []string{"/etc/audit/other.d"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			// A config written for the node paths of earlier versions still loads
+			config, err := loadTestConfig(t, test.settings)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var got []string
+			for _, pair := range config.Directories {
+				got = append(got, pair.TargetDirectory)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("target directories are %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	t.Cleanup(func() { applyConfig(Config{LogLevel: "info"}) })
+
+	// writeConfig replaces the config file and reads it the way the viper watch does on a change
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := viper.ReadInConfig(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := initConfig(); err != nil {
+		t.Fatal(err)
+	}
+	viper.SetConfigFile(file)
+	writeConfig("pollInterval: 10s\n")
+	config, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	applyConfig(config)
+
+	// Drain a wake up left by another test
+	select {
+	case <-configReloaded:
+	default:
+	}
+
+	// An invalid value or an unknown key is rejected, and the last good configuration stays in effect
+	for _, content := range []string{
+		"pollInterval: 10s\ndriftPolicy: ignore\n",
+		"pollInterval: 10s\npollIntervall: 20s\n",
+		"pollInterval: -1s\n",
+	} {
+		writeConfig(content)
+		if reloadConfig() {
+			t.Errorf("the configuration %q was applied", content)
+		}
+		if got := getConfig().PollInterval; got != 10*time.Second {
+			t.Errorf("after rejecting %q, the poll interval in effect is %v, want 10s", content, got)
+		}
+		select {
+		case <-configReloaded:
+			t.Errorf("rejecting %q woke up the main loop", content)
+		default:
+		}
+	}
+
+	// A valid change is applied and wakes up the main loop
+	writeConfig("pollInterval: 20s\n")
+	if !reloadConfig() {
+		t.Fatal("the valid configuration was rejected")
+	}
+	if got := getConfig().PollInterval; got != 20*time.Second {
+		t.Errorf("the poll interval in effect is %v, want 20s", got)
+	}
+	select {
+	case <-configReloaded:
+	default:
+		t.Error("applying the configuration did not wake up the main loop")
+	}
+}
+
+func TestLoadConfigOCICredentials(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		oci     map[string]any
+		wantErr string
+	}{
+		{"credentials", map[string]any{"username": "puller", "passwordFile": "/etc/aks-auditd/registry/password"}, ""},
+		{"mirror", map[string]any{"mirror": "localhost:5000", "insecure": true}, ""},
+		{"credentials over plain HTTP", map[string]any{"username": "puller", "insecure": true}, "plain HTTP"},
+		{"credentials sent to the mirror", map[string]any{"username": "puller", "mirror": "mirror.example.com"}, "would be sent to mirror.example.com"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.oci["reference"] = "myregistry.azurecr.io/audit/rules:v1"
+			_, err := loadTestConfig(t, map[string]any{"directories": []map[string]any{{
+				"targetDirectory": "/auditd-rules-target",
+				"sources":         []map[string]any{{"oci": test.oci, "priority": 100}},
+			}}})
+			switch {
+			case test.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)):
+				t.Fatalf("error = %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
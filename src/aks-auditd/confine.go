@@ -0,0 +1,379 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// Every file aks-auditd writes on the node is beneath one of the configured target directories, which are hostPath
+// mounts. Anyone with write access to such a directory on the node could plant a symlink, such as
+// rules.d/.aks-auditd-history -> /etc, to make aks-auditd write elsewhere on the node. The functions in this file are
+// the only way aks-auditd creates, renames, or removes files in a target directory. Every function takes the target
+// directory, root, the path is confined to. They resolve paths with openat2 and RESOLVE_BENEATH|RESOLVE_NO_SYMLINKS, or
+// with an O_NOFOLLOW walk where openat2 is missing or blocked, and refuse any path that leaves root or passes through a
+// symlink.
+
+// errEscape is returned when a path leaves its target directory or passes through a symlink.
+var errEscape = errors.New("path escapes the target directory")
+
+// openat2 is the openat2 system call. Tests replace it to exercise the fallback for when it is missing or blocked.
+var openat2 = unix.Openat2
+
+// isBeneath returns true if path is root or a path in it. An empty root contains nothing.
+func isBeneath(root, path string) bool {
+	if root == "" {
+		return false
+	}
+	root, path = filepath.Clean(root), filepath.Clean(path)
+	return path == root || strings.HasPrefix(path, root+"/")
+}
+
+// reportEscape logs a refused file operation as a security event and emits a Warning event on the aks-auditd pod the
+// first time it happens for the path, so a planted symlink raises one event and not one on every poll.
+func reportEscape(root, operation, path string, reason error) {
+	log.WithFields(log.Fields{
+		"securityEvent": "pathEscape",
+		"operation":     operation,
+		"path":          path,
+	}).Errorf("Refused a file operation that escapes the target directory. Check the node for a planted symlink. Error: %v", reason)
+
+	if !reports.changed(root, kindEscape, path, "") {
+		return
+	}
+
+	message := fmt.Sprintf("Refused to %s %s: %v. Check the node for a planted symlink.", operation, path, reason)
+	if err := createPodEvent("Warning", "PathEscapeRefused", message); err != nil {
+		log.Debugf("Unable to emit the path escape event: %v", err)
+	}
+}
+
+// openBeneath opens path with the given flags without leaving root or following a symlink. It returns the file
+// descriptor. Paths outside of root are refused.
+func openBeneath(root, operation, path string, flags int, mode uint32) (int, error) {
+	if !isBeneath(root, path) {
+		reportEscape(root, operation, path, fmt.Errorf("not in the target directory %q", root))
+		return -1, fmt.Errorf("%s %s: %w", operation, path, errEscape)
+	}
+	rel, err := filepath.Rel(filepath.Clean(root), filepath.Clean(path))
+	if err != nil {
+		return -1, err
+	}
+
+	rootFd, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, &os.PathError{Op: operation, Path: root, Err: err}
+	}
+	defer unix.Close(rootFd)
+
+	fd, err := openat2(rootFd, rel, &unix.OpenHow{
+		Flags:   uint64(flags | unix.O_CLOEXEC),
+		Mode:    uint64(mode),
+		Resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_SYMLINKS | unix.RESOLVE_NO_MAGICLINKS,
+	})
+	// Kernels before 5.6 lack openat2, and container runtimes with an older seccomp profile block it with EPERM
+	if errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EPERM) {
+		fd, err = walkBeneath(rootFd, rel, flags, mode)
+	}
+	if errors.Is(err, unix.EXDEV) || errors.Is(err, unix.ELOOP) {
+		reportEscape(root, operation, path, err)
+		return -1, fmt.Errorf("%s %s: %w", operation, path, errEscape)
+	}
+	if err != nil {
+		return -1, &os.PathError{Op: operation, Path: path, Err: err}
+	}
+
+	return fd, nil
+}
+
+// walkBeneath opens rel beneath the directory rootFd one component at a time with O_NOFOLLOW, for when openat2 is
+// missing or blocked. rel is clean and relative, so it has no .. components.
+func walkBeneath(rootFd int, rel string, flags int, mode uint32) (int, error) {
+	fd, err := unix.Dup(rootFd)
+	if err != nil {
+		return -1, err
+	}
+	if rel == "." {
+		defer unix.Close(fd)
+		return unix.Openat(fd, ".", flags|unix.O_CLOEXEC, mode)
+	}
+
+	components := strings.Split(rel, "/")
+	for _, component := range components[:len(components)-1] {
+		next, err := unix.Openat(fd, component, unix.O_PATH|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		unix.Close(fd)
+		if errors.Is(err, unix.ENOTDIR) {
+			err = unix.ELOOP // A symlink opened with O_NOFOLLOW|O_DIRECTORY fails with ENOTDIR
+		}
+		if err != nil {
+			return -1, err
+		}
+		fd = next
+	}
+	defer unix.Close(fd)
+
+	last := components[len(components)-1]
+	file, err := unix.Openat(fd, last, flags|unix.O_NOFOLLOW|unix.O_CLOEXEC, mode)
+	if errors.Is(err, unix.ENOTDIR) && flags&unix.O_DIRECTORY != 0 {
+		// A symlink opened with O_NOFOLLOW|O_DIRECTORY fails with ENOTDIR, like a regular file
+		var stat unix.Stat_t
+		if unix.Fstatat(fd, last, &stat, unix.AT_SYMLINK_NOFOLLOW) == nil && stat.Mode&unix.S_IFMT == unix.S_IFLNK {
+			err = unix.ELOOP
+		}
+	}
+	return file, err
+}
+
+// openParent opens the directory that contains path and returns its file descriptor and the base name of path.
+func openParent(root, operation, path string) (int, string, error) {
+	fd, err := openBeneath(root, operation, filepath.Dir(filepath.Clean(path)), unix.O_PATH|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return -1, "", err
+	}
+	return fd, filepath.Base(path), nil
+}
+
+// hostOpenFile is os.OpenFile for a path in root.
+func hostOpenFile(root, path string, flags int, mode os.FileMode) (*os.File, error) {
+	fd, err := openBeneath(root, "open", path, flags, uint32(mode.Perm()))
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), path), nil
+}
+
+// hostOpen opens a file for reading. Files in root are opened with hostOpenFile. Any other file, such as a file in a
+// ConfigMap mount, is opened with os.Open.
+func hostOpen(root, path string) (*os.File, error) {
+	if !isBeneath(root, path) {
+		return os.Open(path)
+	}
+	return hostOpenFile(root, path, os.O_RDONLY, 0)
+}
+
+// hostCreateTemp is os.CreateTemp for a directory in root. The last * in pattern is replaced by a random string.
+func hostCreateTemp(root, dir, pattern string) (*os.File, error) {
+	dirFd, err := openBeneath(root, "create", dir, unix.O_PATH|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(dirFd)
+
+	for i := 0; i < 100; i++ {
+		name := randomName(pattern)
+		fd, err := unix.Openat(dirFd, name, unix.O_RDWR|unix.O_CREAT|unix.O_EXCL|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0600)
+		if errors.Is(err, unix.EEXIST) {
+			continue
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "create", Path: filepath.Join(dir, name), Err: err}
+		}
+		return os.NewFile(uintptr(fd), filepath.Join(dir, name)), nil
+	}
+	return nil, &os.PathError{Op: "create", Path: filepath.Join(dir, pattern), Err: os.ErrExist}
+}
+
+// hostMkdirTemp is os.MkdirTemp for a directory in root.
+func hostMkdirTemp(root, dir, pattern string) (string, error) {
+	dirFd, err := openBeneath(root, "mkdir", dir, unix.O_PATH|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return "", err
+	}
+	defer unix.Close(dirFd)
+
+	for i := 0; i < 100; i++ {
+		name := randomName(pattern + "*")
+		err := unix.Mkdirat(dirFd, name, 0750)
+		if errors.Is(err, unix.EEXIST) {
+			continue
+		}
+		if err != nil {
+			return "", &os.PathError{Op: "mkdir", Path: filepath.Join(dir, name), Err: err}
+		}
+		return filepath.Join(dir, name), nil
+	}
+	return "", &os.PathError{Op: "mkdir", Path: filepath.Join(dir, pattern), Err: os.ErrExist}
+}
+
+// hostMkdirAll is os.MkdirAll for a path in root. root itself must exist. An existing component that is a symlink is
+// refused.
+func hostMkdirAll(root, path string, mode os.FileMode) error {
+	if !isBeneath(root, path) {
+		reportEscape(root, "mkdir", path, fmt.Errorf("not in the target directory %q", root))
+		return fmt.Errorf("mkdir %s: %w", path, errEscape)
+	}
+	rel, err := filepath.Rel(filepath.Clean(root), filepath.Clean(path))
+	if err != nil || rel == "." {
+		return err
+	}
+
+	current := filepath.Clean(root)
+	for _, component := range strings.Split(rel, "/") {
+		parentFd, err := openBeneath(root, "mkdir", current, unix.O_PATH|unix.O_DIRECTORY, 0)
+		if err != nil {
+			return err
+		}
+		err = unix.Mkdirat(parentFd, component, uint32(mode.Perm()))
+		unix.Close(parentFd)
+		if err != nil && !errors.Is(err, unix.EEXIST) {
+			return &os.PathError{Op: "mkdir", Path: filepath.Join(current, component), Err: err}
+		}
+		current = filepath.Join(current, component)
+	}
+
+	// Opening the full path refuses an existing component that is a symlink
+	fd, err := openBeneath(root, "mkdir", path, unix.O_PATH|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return err
+	}
+	return unix.Close(fd)
+}
+
+// hostRename is os.Rename for paths in root. Like rename(2), it replaces a symlink at newPath rather than following it.
+func hostRename(root, oldPath, newPath string) error {
+	oldFd, oldName, err := openParent(root, "rename", oldPath)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(oldFd)
+	newFd, newName, err := openParent(root, "rename", newPath)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(newFd)
+
+	if err := unix.Renameat(oldFd, oldName, newFd, newName); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: err}
+	}
+	return nil
+}
+
+// hostRemove is os.Remove for a path in root. A symlink is removed, not the file it points at.
+func hostRemove(root, path string) error {
+	dirFd, name, err := openParent(root, "remove", path)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dirFd)
+
+	err = unix.Unlinkat(dirFd, name, 0)
+	if errors.Is(err, unix.EISDIR) {
+		err = unix.Unlinkat(dirFd, name, unix.AT_REMOVEDIR)
+	}
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: path, Err: err}
+	}
+	return nil
+}
+
+// hostRemoveAll is os.RemoveAll for a path in root. Symlinks in the tree are removed, not followed.
+func hostRemoveAll(root, path string) error {
+	dir, err := hostOpenFile(root, path, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if errors.Is(err, unix.ENOTDIR) {
+		return hostRemove(root, path)
+	}
+	if err != nil {
+		return err
+	}
+	entries, err := dir.ReadDir(-1)
+	dir.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		child := filepath.Join(path, entry.Name())
+		if entry.IsDir() {
+			err = hostRemoveAll(root, child)
+		} else {
+			err = hostRemove(root, child)
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	err = hostRemove(root, path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// hostReadDir is os.ReadDir for a directory in root. Any other directory is read with os.ReadDir.
+func hostReadDir(root, dir string) ([]os.DirEntry, error) {
+	if !isBeneath(root, dir) {
+		return os.ReadDir(dir)
+	}
+	d, err := hostOpenFile(root, dir, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	return d.ReadDir(-1)
+}
+
+// hostReadFile is os.ReadFile for a file in root. Any other file is read with os.ReadFile.
+func hostReadFile(root, path string) ([]byte, error) {
+	if !isBeneath(root, path) {
+		return os.ReadFile(path)
+	}
+	file, err := hostOpenFile(root, path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return io.ReadAll(file)
+}
+
+// hostReadlink returns the destination of the symlink at path in root without following it.
+func hostReadlink(root, path string) (string, error) {
+	dirFd, name, err := openParent(root, "readlink", path)
+	if err != nil {
+		return "", err
+	}
+	defer unix.Close(dirFd)
+
+	buf := make([]byte, unix.PathMax)
+	n, err := unix.Readlinkat(dirFd, name, buf)
+	if err != nil {
+		return "", &os.PathError{Op: "readlink", Path: path, Err: err}
+	}
+	return string(buf[:n]), nil
+}
+
+// hostLstat is os.Lstat for a path in root. A symlink is described, not the file it points at. Any other path is
+// described with os.Lstat.
+func hostLstat(root, path string) (os.FileInfo, error) {
+	if !isBeneath(root, path) {
+		return os.Lstat(path)
+	}
+	fd, err := openBeneath(root, "lstat", path, unix.O_PATH|unix.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	file := os.NewFile(uintptr(fd), path)
+	defer file.Close()
+	return file.Stat()
+}
+
+// randomName replaces the last * in pattern with a random number, or appends it when pattern has no *.
+func randomName(pattern string) string {
+	random := strconv.FormatUint(uint64(rand.Uint32()), 10)
+	if i := strings.LastIndex(pattern, "*"); i >= 0 {
+		return pattern[:i] + random + pattern[i+1:]
+	}
+	return pattern + random
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestIsBeneath(t *testing.T) {
+	for _, test := range []struct {
+		root, path string
+		want       bool
+	}{
+		{"/rules", "/rules", true},
+		{"/rules/", "/rules/10-base.rules", true},
+		{"/rules", "/rules/.aks-auditd-history/x", true},
+		{"/rules", "/rules/../etc/passwd", false},
+		{"/rules", "/rules-other/10-base.rules", false},
+		{"/rules", "/plugins", false},
+		{"", "/rules", false},
+	} {
+		if got := isBeneath(test.root, test.path); got != test.want {
+			t.Errorf("isBeneath(%q, %q) = %v, want %v", test.root, test.path, got, test.want)
+		}
+	}
+}
+
+// testConfinement checks that file operations stay in root, with openat2 or with the fallback walk.
+func testConfinement(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	writeFiles(t, outside, map[string]string{"passwd": "root::0:0\n"})
+	writeFiles(t, root, map[string]string{"10-base.rules": "-D\n"})
+
+	// A directory planted as a symlink out of the target directory
+	if err := os.Symlink(outside, filepath.Join(root, historyDirectoryName)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "passwd"), filepath.Join(root, "20-link.rules")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := hostReadFile(root, filepath.Join(root, historyDirectoryName, "passwd")); !errors.Is(err, errEscape) {
+		t.Errorf("reading through a symlinked directory returned %v, want %v", err, errEscape)
+	}
+	if _, err := hostReadFile(root, filepath.Join(root, "20-link.rules")); !errors.Is(err, errEscape) {
+		t.Errorf("reading a symlink returned %v, want %v", err, errEscape)
+	}
+	if err := hostMkdirAll(root, filepath.Join(root, historyDirectoryName, "entry"), 0750); !errors.Is(err, errEscape) {
+		t.Errorf("creating a directory through a symlink returned %v, want %v", err, errEscape)
+	}
+	if err := writeJSON(root, filepath.Join(root, historyDirectoryName), holdFileName, Hold{}); !errors.Is(err, errEscape) {
+		t.Errorf("writing through a symlinked directory returned %v, want %v", err, errEscape)
+	}
+	if err := hostRemove(root, filepath.Join(outside, "passwd")); !errors.Is(err, errEscape) {
+		t.Errorf("removing a file outside of root returned %v, want %v", err, errEscape)
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) != 1 {
+		t.Errorf("the directory outside of root holds %d entries, want 1", len(entries))
+	}
+
+	// Files in root are read and written, and a symlink is described rather than followed
+	if data, err := hostReadFile(root, filepath.Join(root, "10-base.rules")); err != nil || string(data) != "-D\n" {
+		t.Errorf("reading a file in root returned %q, %v", data, err)
+	}
+	if err := writeJSON(root, root, holdFileName, Hold{}); err != nil {
+		t.Errorf("writing a file in root: %v", err)
+	}
+	info, err := hostLstat(root, filepath.Join(root, "20-link.rules"))
+	if err != nil || info.Mode()&os.ModeSymlink == 0 || info.Name() != "20-link.rules" {
+		t.Errorf("hostLstat of a symlink returned %v, %v, want the symlink", info, err)
+	}
+	if info, err := hostLstat(root, filepath.Join(root, "10-base.rules")); err != nil || !info.Mode().IsRegular() || info.Size() != 3 {
+		t.Errorf("hostLstat of a file returned %v, %v, want the file", info, err)
+	}
+	if _, err := hostLstat(root, filepath.Join(root, "missing.rules")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("hostLstat of a missing file returned %v, want %v", err, os.ErrNotExist)
+	}
+	if _, err := hostLstat(root, filepath.Join(root, historyDirectoryName, "passwd")); !errors.Is(err, errEscape) {
+		t.Errorf("hostLstat through a symlinked directory returned %v, want %v", err, errEscape)
+	}
+}
+
+func TestConfinement(t *testing.T) {
+	testConfinement(t)
+}
+
+func TestConfinementWithoutOpenat2(t *testing.T) {
+	for _, errno := range []unix.Errno{unix.ENOSYS, unix.EPERM} {
+		t.Run(errno.Error(), func(t *testing.T) {
+			previous := openat2
+			openat2 = func(int, string, *unix.OpenHow) (int, error) { return -1, errno }
+			t.Cleanup(func() { openat2 = previous })
+			testConfinement(t)
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Drift policies. They decide what aks-auditd does when a file it wrote to the node was changed or deleted by someone
+// else since the last sync.
+const (
+	driftRemediate         = "remediate"           // Overwrite the file with the ConfigMap content
+	driftReport            = "report"              // Log the drift and emit an event, but leave the file as it is
+	driftAlertAndRemediate = "alert-and-remediate" // Log the drift, emit an event, and overwrite the file
+)
+
+// Drift describes a file aks-auditd wrote whose content on the node no longer matches the manifest. ActualDigest is
+// empty when the file was deleted. ModTime, UID, and GID describe the file as found on the node, so security can work
+// out who changed it.
+type Drift struct {
+	File           string    `json:"file"`
+	ExpectedDigest string    `json:"expectedDigest"`
+	ActualDigest   string    `json:"actualDigest"`
+	ModTime        time.Time `json:"modTime,omitempty"`
+	UID            int       `json:"uid"`
+	GID            int       `json:"gid"`
+}
+
+// detectDrift returns the files in the manifest whose content in the target directory differs from the digest
+// aks-auditd wrote. A file that already matches the desired source content is not drift, even if the manifest is out
+// of date.
+func detectDrift(targetDir string, hashesDesired, hashesTarget map[string][32]byte, manifest Manifest) []Drift {
+	var drifts []Drift
+
+	for fileName, expected := range manifest.Files {
+		actual := ""
+		if hash, exists := hashesTarget[fileName]; exists {
+			actual = digest(hash)
+		}
+		desired := ""
+		if hash, exists := hashesDesired[fileName]; exists {
+			desired = digest(hash)
+		}
+		if actual == expected || actual == desired {
+			continue
+		}
+
+		drift := Drift{File: fileName, ExpectedDigest: expected, ActualDigest: actual, UID: -1, GID: -1}
+		if info, err := hostLstat(targetDir, filepath.Join(targetDir, fileName)); err == nil {
+			drift.ModTime = info.ModTime().UTC()
+			if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+				drift.UID = int(stat.Uid)
+				drift.GID = int(stat.Gid)
+			}
+		}
+		drifts = append(drifts, drift)
+	}
+
+	sort.Slice(drifts, func(i, j int) bool { return drifts[i].File < drifts[j].File })
+	return drifts
+}
+
+// reportDrift logs a record for every drifted file in the target directory of the pair. Under the report and
+// alert-and-remediate policies, new drift is logged as a warning and emitted as a Kubernetes Event on the aks-auditd
+// pod. Drift that is remediated right away is logged at info level.
+func reportDrift(pair DirectoryPair, drifts []Drift) {
+	targetDir := pair.TargetDirectory
+
+	current := make(map[string]bool)
+	for _, drift := range drifts {
+		path := filepath.Join(targetDir, drift.File)
+		current[path] = true
+
+		entry := log.WithFields(log.Fields{
+			"targetDirectory": targetDir,
+			"file":            drift.File,
+			"expectedDigest":  drift.ExpectedDigest,
+			"actualDigest":    valueOrDefault(drift.ActualDigest, "deleted"),
+			"modTime":         drift.ModTime,
+			"uid":             drift.UID,
+			"gid":             drift.GID,
+			"driftPolicy":     pair.DriftPolicy,
+		})
+
+		if pair.DriftPolicy == driftRemediate {
+			entry.Info("Drift detected. Remediating.")
+			continue
+		}
+
+		// Under the report policy the file stays drifted, so only report it again when it changes once more
+		if !reports.changed(targetDir, kindDrift, path, drift.ActualDigest) {
+			entry.Debug("Drift detected. Already reported.")
+			continue
+		}
+		entry.Warn("Drift detected")
+
+		message := fmt.Sprintf("%s was changed outside of aks-auditd: expected digest %s, actual digest %s, modified %v by uid %d gid %d. Policy: %s.",
+			path, shortDigest(drift.ExpectedDigest), shortDigest(drift.ActualDigest), drift.ModTime, drift.UID, drift.GID, pair.DriftPolicy)
+		if drift.ActualDigest == "" {
+			message = fmt.Sprintf("%s was deleted outside of aks-auditd: expected digest %s. Policy: %s.", path, shortDigest(drift.ExpectedDigest), pair.DriftPolicy)
+		}
+		if err := createPodEvent("Warning", "DriftDetected", message); err != nil {
+			log.Debugf("Unable to emit the drift event: %v", err)
+		}
+	}
+
+	// Forget drift that has been resolved so it is reported again if it comes back
+	reports.retain(targetDir, kindDrift, func(path string) bool { return current[path] })
+}
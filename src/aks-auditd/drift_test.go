@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDetectDrift(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"changed.rules": "-D\n"})
+	hash := func(content string) [32]byte { return sha256.Sum256([]byte(content)) }
+
+	manifest := Manifest{Files: map[string]string{
+		"unchanged.rules": digest(hash("written")),
+		"updated.rules":   digest(hash("written")),
+		"changed.rules":   digest(hash("written")),
+		"deleted.rules":   digest(hash("written")),
+	}}
+	hashesDesired := map[string][32]byte{
+		"unchanged.rules": hash("written"),
+		"updated.rules":   hash("source"),
+		"changed.rules":   hash("source"),
+		"deleted.rules":   hash("written"),
+	}
+	hashesTarget := map[string][32]byte{
+		"unchanged.rules": hash("written"),
+		"updated.rules":   hash("source"), // Already the desired content, so not drift
+		"changed.rules":   hash("-D\n"),
+	}
+
+	drifts := detectDrift(dir, hashesDesired, hashesTarget, manifest)
+	if len(drifts) != 2 {
+		t.Fatalf("detectDrift() = %+v, want changed.rules and deleted.rules", drifts)
+	}
+
+	changed, deleted := drifts[0], drifts[1]
+	if changed.File != "changed.rules" || changed.ExpectedDigest != digest(hash("written")) || changed.ActualDigest != digest(hash("-D\n")) {
+		t.Errorf("drift of the changed file = %+v", changed)
+	}
+	if changed.ModTime.IsZero() || changed.UID != os.Getuid() || changed.GID != os.Getgid() {
+		t.Errorf("drift of the changed file does not describe the file on the node: %+v", changed)
+	}
+	if deleted.File != "deleted.rules" || deleted.ActualDigest != "" || deleted.UID != -1 || deleted.GID != -1 {
+		t.Errorf("drift of the deleted file = %+v", deleted)
+	}
+}
+
+func TestChangeSetKeepDrift(t *testing.T) {
+	changes := ChangeSet{
+		Added:    []FileChange{{Name: "deleted.rules", NewDigest: "d1"}, {Name: "new.rules", NewDigest: "d2"}},
+		Modified: []FileChange{{Name: "changed.rules", OldDigest: "d3", NewDigest: "d4"}, {Name: "updated.rules", OldDigest: "d5", NewDigest: "d6"}},
+		Removed:  []FileChange{{Name: "old.rules", OldDigest: "d7"}},
+	}
+	changes.keepDrift([]Drift{
+		{File: "changed.rules", ExpectedDigest: "d8", ActualDigest: "d3"},
+		{File: "deleted.rules", ExpectedDigest: "d1"},
+	})
+
+	if got := names(changes.Added); !reflect.DeepEqual(got, []string{"new.rules"}) {
+		t.Errorf("Added = %v, want [new.rules]", got)
+	}
+	if got := names(changes.Modified); !reflect.DeepEqual(got, []string{"updated.rules"}) {
+		t.Errorf("Modified = %v, want [updated.rules]", got)
+	}
+	if got := names(changes.Removed); !reflect.DeepEqual(got, []string{"old.rules"}) {
+		t.Errorf("Removed = %v, want [old.rules]", got)
+	}
+	want := []FileChange{{Name: "changed.rules", OldDigest: "d3", NewDigest: "d8"}, {Name: "deleted.rules", NewDigest: "d1"}}
+	if !reflect.DeepEqual(changes.Drifted, want) {
+		t.Errorf("Drifted = %v, want %v", changes.Drifted, want)
+	}
+
+	// Drifted files keep the digest aks-auditd last wrote, so they are reported again on the next sync
+	manifest := changes.manifest()
+	if manifest.Files["changed.rules"] != "d8" || manifest.Files["deleted.rules"] != "d1" {
+		t.Errorf("manifest = %v, want the drifted files with the digests aks-auditd wrote", manifest.Files)
+	}
+}
+
+func TestSyncFromSourceDriftPolicies(t *testing.T) {
+	source := map[string]string{
+		"10-base.rules":  "-w /etc/passwd -p wa -k identity\n",
+		"20-extra.rules": "-w /etc/shadow -p wa -k identity\n",
+		"30-net.rules":   "-w /etc/hosts -p wa -k network\n",
+	}
+
+	for _, test := range []struct {
+		policy string
+		want   map[string]string
+	}{
+		{driftRemediate, map[string]string{
+			"10-base.rules":  "-w /etc/passwd -p wa -k identity\n",
+			"20-extra.rules": "-w /etc/shadow -p wa -k identity\n",
+			"30-net.rules":   "-w /etc/hosts -p wa -k network-changes\n",
+		}},
+		{driftAlertAndRemediate, map[string]string{
+			"10-base.rules":  "-w /etc/passwd -p wa -k identity\n",
+			"20-extra.rules": "-w /etc/shadow -p wa -k identity\n",
+			"30-net.rules":   "-w /etc/hosts -p wa -k network-changes\n",
+		}},
+		// The changed file and the deleted file are left as they are on the node, the source change is still written
+		{driftReport, map[string]string{
+			"10-base.rules": "-w /etc/passwd -p r -k tampered\n",
+			"30-net.rules":  "-w /etc/hosts -p wa -k network-changes\n",
+		}},
+	} {
+		t.Run(test.policy, func(t *testing.T) {
+			pair := testPair(t)
+			pair.DriftPolicy = test.policy
+			writeFiles(t, pair.SourceDirectory, source)
+			if _, err := syncFromSource(pair); err != nil {
+				t.Fatal(err)
+			}
+
+			writeFiles(t, pair.TargetDirectory, map[string]string{"10-base.rules": "-w /etc/passwd -p r -k tampered\n"})
+			if err := os.Remove(filepath.Join(pair.TargetDirectory, "20-extra.rules")); err != nil {
+				t.Fatal(err)
+			}
+			writeFiles(t, pair.SourceDirectory, map[string]string{"30-net.rules": "-w /etc/hosts -p wa -k network-changes\n"})
+
+			// Under the report policy the drift is kept on every sync, not only the first one after it appeared
+			for i := 0; i < 2; i++ {
+				if _, err := syncFromSource(pair); err != nil {
+					t.Fatal(err)
+				}
+				got := readFiles(t, pair.TargetDirectory)
+				delete(got, compiledFileName)
+				if !reflect.DeepEqual(got, test.want) {
+					t.Errorf("sync %d: target = %v, want %v", i+1, got, test.want)
+				}
+			}
+
+			manifest, _, err := readManifest(pair.TargetDirectory)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, owned := manifest.Files["20-extra.rules"]; !owned {
+				t.Errorf("manifest = %v, want the deleted file still owned", manifest.Files)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"runtime"
+	"strings"
+
+	"aksauditd/auditrules"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// nodeMachine is the machine of the node in Go naming, such as amd64 or arm64. The image is built for each arch and the
+// node pulls the one of its own, so this is the arch of the binary.
+var nodeMachine = runtime.GOARCH
+
+// expandArch expands the syscall rules of the rules file at path for b64 and b32 and the arch of the node, and writes
+// the result to the rendered cache of targetDir. The third return value is false when the file has no rule to expand,
+// or does not parse, which validation reports.
+func expandArch(targetDir, fileName, path string) (string, [32]byte, bool, error) {
+	if !auditrules.SupportedMachine(nodeMachine) {
+		return "", [32]byte{}, false, nil
+	}
+	data, err := hostReadFile(targetDir, path)
+	if err != nil {
+		return "", [32]byte{}, false, err
+	}
+	text, expansions, err := auditrules.ExpandArch(fileName, string(data), nodeMachine)
+	if err != nil || len(expansions) == 0 {
+		return "", [32]byte{}, false, nil
+	}
+
+	for _, expansion := range expansions {
+		log.WithFields(log.Fields{
+			"file":    fileName,
+			"line":    expansion.Line,
+			"dropped": strings.Join(expansion.Dropped, ","),
+		}).Debugf("Expanded a syscall rule into: %s", strings.Join(expansion.Rules, " | "))
+	}
+	renderedPath, hash, err := cacheRendered(targetDir, fileName, []byte(text))
+	return renderedPath, hash, err == nil, err
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"aksauditd/auditrules"
+)
+
+func TestSyncFromSourceArchExpansion(t *testing.T) {
+	if !auditrules.SupportedMachine(nodeMachine) {
+		t.Skipf("syscall rules are not expanded on %s", nodeMachine)
+	}
+
+	pair := testPair(t)
+	pair.ArchExpansion = true
+	source := map[string]string{
+		"10-base.rules": "-D\n-w /etc/passwd -p wa -k identity\n",
+		"20-exec.rules": "-a always,exit -S execve -k exec\n",
+	}
+	writeFiles(t, pair.SourceDirectory, source)
+	if _, err := syncFromSource(pair); err != nil {
+		t.Fatal(err)
+	}
+
+	got := readFiles(t, pair.TargetDirectory)
+	if got["10-base.rules"] != source["10-base.rules"] {
+		t.Errorf("10-base.rules has no syscall rules but was synced as %q", got["10-base.rules"])
+	}
+	want := "-a always,exit -F arch=b64 -S execve -k exec\n-a always,exit -F arch=b32 -S execve -k exec\n"
+	if got["20-exec.rules"] != want {
+		t.Errorf("20-exec.rules was synced as %q, want %q", got["20-exec.rules"], want)
+	}
+	if data := readFiles(t, pair.SourceDirectory)["20-exec.rules"]; data != source["20-exec.rules"] {
+		t.Errorf("the source file was changed to %q", data)
+	}
+
+	// The expanded ruleset has no arch-pair findings
+	files, findings, err := parseRulesFiles(pair.TargetDirectory, map[string]string{
+		"10-base.rules": filepath.Join(pair.TargetDirectory, "10-base.rules"),
+		"20-exec.rules": filepath.Join(pair.TargetDirectory, "20-exec.rules"),
+	})
+	if err != nil || len(findings) > 0 {
+		t.Fatalf("parseRulesFiles returned %v, %v", findings, err)
+	}
+	if lint := auditrules.Lint(files); len(lint) > 0 {
+		t.Errorf("Lint found %v", lint)
+	}
+}
+
+func TestSyncFromSourceArchExpansionArm64(t *testing.T) {
+	previous := nodeMachine
+	nodeMachine = "arm64"
+	t.Cleanup(func() { nodeMachine = previous })
+
+	// aarch64 has no open, so b64 keeps openat only
+	pair := testPair(t)
+	pair.ArchExpansion = true
+	writeFiles(t, pair.SourceDirectory, map[string]string{
+		"20-open.rules": "-a always,exit -S open,openat -F exit=-EACCES -k access\n",
+	})
+	if _, err := syncFromSource(pair); err != nil {
+		t.Fatal(err)
+	}
+
+	got := readFiles(t, pair.TargetDirectory)
+	want := "-a always,exit -F arch=b64 -S openat -F exit=-EACCES -k access\n" +
+		"-a always,exit -F arch=b32 -S open,openat -F exit=-EACCES -k access\n"
+	if got["20-open.rules"] != want {
+		t.Errorf("20-open.rules was synced as %q, want %q", got["20-open.rules"], want)
+	}
+}
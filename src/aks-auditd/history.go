@@ -0,0 +1,412 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// Name of the directory in a target directory that holds the last applied rulesets. The leading dot keeps augenrules
+// and aks-auditd-monitor from reading it. Each ruleset is a subdirectory with a copy of its files.
+const historyDirectoryName = stagingPrefix + "history"
+
+// Name of the file in a history entry that describes the ruleset. The prefix keeps getFileHashes from treating it as
+// part of the ruleset when the entry is restored.
+const rulesetFileName = stagingPrefix + "ruleset.json"
+
+// Name of the file in the history directory that holds back a ConfigMap ruleset after a rollback.
+const holdFileName = "hold.json"
+
+// Name of the file aks-auditd-monitor writes to the history directory when auditd fails to load the rules.
+const loadFailureFileName = "load-failed.json"
+
+// Status values of a ruleset in the history
+const (
+	rulesetApplied = "applied"
+	rulesetFailed  = "failed"
+)
+
+// Ruleset describes one set of files aks-auditd applied to a target directory.
+type Ruleset struct {
+	ID              string            `json:"id"`
+	Digest          string            `json:"digest"`
+	Timestamp       time.Time         `json:"timestamp"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"` // resourceVersion of the source ConfigMap when it was applied
+	Source          string            `json:"source"`                    // ConfigMap snapshot directory the files were read from
+	Layers          []Layer           `json:"layers,omitempty"`          // Sources of a pair with layered sources
+	Status          string            `json:"status"`
+	Files           map[string]string `json:"files"`                     // Target file name to hex SHA-256 digest
+	FileSources     map[string]string `json:"sources,omitempty"`         // Target file name to the name of the source it was read from
+	EffectiveDigest string            `json:"effectiveDigest,omitempty"` // Digest of the audit.rules augenrules generates from the files
+}
+
+// Layer describes one of the sources a ruleset of a pair with layered sources was merged from.
+type Layer struct {
+	Name            string `json:"name"`
+	Priority        int    `json:"priority"`
+	Source          string `json:"source"` // ConfigMap snapshot directory the files were read from
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+// Hold keeps aks-auditd from applying the ConfigMap ruleset with the given digest after a rollback. It is removed as
+// soon as the ConfigMap content changes or an operator resumes syncing.
+type Hold struct {
+	Digest       string    `json:"digest"`
+	RolledBackTo string    `json:"rolledBackTo"`
+	Reason       string    `json:"reason"`
+	Timestamp    time.Time `json:"timestamp"`
+}
+
+// LoadFailure is written by aks-auditd-monitor when auditd fails to load the rules after a restart.
+type LoadFailure struct {
+	Timestamp time.Time `json:"timestamp"`
+	Error     string    `json:"error"`
+}
+
+// historyDir returns the history directory of targetDir.
+func historyDir(targetDir string) string {
+	return filepath.Join(targetDir, historyDirectoryName)
+}
+
+// lockHistory takes an exclusive lock on the history directory of targetDir, creating the directory if needed. The
+// lock serializes the sync loop with the rollback command, which runs as a separate process.
+func lockHistory(targetDir string) (func(), error) {
+	dir := historyDir(targetDir)
+	if err := hostMkdirAll(targetDir, dir, 0750); err != nil {
+		return nil, err
+	}
+
+	d, err := hostOpen(targetDir, dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(d.Fd()), unix.LOCK_EX); err != nil {
+		d.Close()
+		return nil, err
+	}
+
+	return func() {
+		unix.Flock(int(d.Fd()), unix.LOCK_UN)
+		d.Close()
+	}, nil
+}
+
+// rulesetDigest returns the digest of a set of files. It is the SHA-256 of the sha256sum style listing of the files
+// sorted by name, so the same files always produce the same digest.
+func rulesetDigest(files map[string]string) string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var listing strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&listing, "%s  %s\n", files[name], name)
+	}
+
+	return digest(sha256.Sum256([]byte(listing.String())))
+}
+
+// readHistory returns the rulesets in the history of targetDir, oldest first.
+func readHistory(targetDir string) ([]Ruleset, error) {
+	entries, err := hostReadDir(targetDir, historyDir(targetDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var rulesets []Ruleset
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		var ruleset Ruleset
+		if err := readJSON(targetDir, filepath.Join(historyDir(targetDir), entry.Name(), rulesetFileName), &ruleset); err != nil {
+			log.Warnf("Ignoring unreadable ruleset %s in the history of %s: %v", entry.Name(), targetDir, err)
+			continue
+		}
+		rulesets = append(rulesets, ruleset)
+	}
+
+	sort.Slice(rulesets, func(i, j int) bool { return rulesets[i].ID < rulesets[j].ID })
+	return rulesets, nil
+}
+
+// currentRuleset returns the index of the newest ruleset in the history with the given digest, or -1 if there is none.
+func currentRuleset(rulesets []Ruleset, rulesetDigest string) int {
+	for i := len(rulesets) - 1; i >= 0; i-- {
+		if rulesets[i].Digest == rulesetDigest {
+			return i
+		}
+	}
+	return -1
+}
+
+// recordRuleset copies the files aks-auditd owns in the target directory into a new history entry and removes the
+// oldest entries beyond the configured history size. The entry is written to a hidden directory first and renamed into
+// place, so the history never contains a partial entry.
+func recordRuleset(pair DirectoryPair, manifest Manifest) error {
+	targetDir := pair.TargetDirectory
+	files := manifest.Files
+	ruleset := Ruleset{
+		Digest:      rulesetDigest(files),
+		Timestamp:   time.Now().UTC(),
+		Status:      rulesetApplied,
+		Files:       files,
+		FileSources: manifest.Sources,
+	}
+	ruleset.EffectiveDigest = effectiveDigest(targetDir)
+	ruleset.ID = ruleset.Timestamp.Format("20060102T150405.000Z") + "-" + shortDigest(ruleset.Digest)
+
+	if len(pair.Sources) == 0 {
+		ruleset.Source = filepath.Base(pair.SourceDirectory)
+		ruleset.ResourceVersion = configMapResourceVersion(pair.ConfigMap)
+	}
+	for _, source := range pair.Sources {
+		ruleset.Layers = append(ruleset.Layers, Layer{
+			Name:            source.name(),
+			Priority:        source.Priority,
+			Source:          filepath.Base(source.Directory),
+			ResourceVersion: configMapResourceVersion(source.ConfigMap),
+		})
+	}
+
+	entryDir := filepath.Join(historyDir(targetDir), ruleset.ID)
+	tmpDir, err := hostMkdirTemp(targetDir, historyDir(targetDir), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer hostRemoveAll(targetDir, tmpDir)
+
+	for name := range files {
+		stagedPath, err := stageFile(targetDir, filepath.Join(targetDir, name), tmpDir, name, pair.FileMode)
+		if err != nil {
+			return err
+		}
+		if err := hostRename(targetDir, stagedPath, filepath.Join(tmpDir, name)); err != nil {
+			return err
+		}
+	}
+	if err := writeJSON(targetDir, tmpDir, rulesetFileName, ruleset); err != nil {
+		return err
+	}
+	if err := hostRename(targetDir, tmpDir, entryDir); err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"targetDirectory": targetDir,
+		"id":              ruleset.ID,
+		"digest":          ruleset.Digest,
+		"resourceVersion": ruleset.ResourceVersion,
+	}).Info("Recorded ruleset in history")
+
+	return pruneHistory(targetDir, pair.HistorySize)
+}
+
+// configMapResourceVersion returns the resourceVersion of the named ConfigMap, or an empty string when there is no
+// ConfigMap or its resourceVersion cannot be read.
+func configMapResourceVersion(name string) string {
+	if name == "" {
+		return ""
+	}
+	resourceVersion, err := getConfigMapResourceVersion(name)
+	if err != nil {
+		log.Debugf("Unable to read the resourceVersion of ConfigMap %s: %v", name, err)
+	}
+	return resourceVersion
+}
+
+// pruneHistory removes the oldest rulesets until at most size remain.
+func pruneHistory(targetDir string, size int) error {
+	rulesets, err := readHistory(targetDir)
+	if err != nil {
+		return err
+	}
+
+	for len(rulesets) > size {
+		if err := hostRemoveAll(targetDir, filepath.Join(historyDir(targetDir), rulesets[0].ID)); err != nil {
+			return err
+		}
+		log.Debugf("Removed ruleset %s from the history of %s", rulesets[0].ID, targetDir)
+		rulesets = rulesets[1:]
+	}
+
+	return nil
+}
+
+// setRulesetStatus updates the status of a ruleset in the history.
+func setRulesetStatus(targetDir string, ruleset Ruleset, status string) error {
+	ruleset.Status = status
+	return writeJSON(targetDir, filepath.Join(historyDir(targetDir), ruleset.ID), rulesetFileName, ruleset)
+}
+
+// rollback restores ruleset to the target directory of the pair and holds back the ConfigMap ruleset with
+// heldDigest, so the next sync does not immediately undo the rollback. The files are restored exactly as they were
+// recorded. They do not go through the selectors, templates, and packs of the pair again, and files changed on the
+// node since are replaced whatever the drift policy of the pair.
+func rollback(pair DirectoryPair, ruleset Ruleset, heldDigest, reason string) error {
+	sourceFiles, err := historyFiles(pair.TargetDirectory, ruleset)
+	if err != nil {
+		return fmt.Errorf("failed to restore ruleset %s: %w", ruleset.ID, err)
+	}
+
+	restore := pair
+	restore.DriftPolicy = driftRemediate
+	if err := replayJournal(restore.TargetDirectory); err != nil {
+		return fmt.Errorf("failed to restore ruleset %s: %w", ruleset.ID, err)
+	}
+	entryDir := filepath.Join(historyDir(pair.TargetDirectory), ruleset.ID)
+	if _, err := syncFiles(restore, entryDir, sourceFiles, nil); err != nil {
+		return fmt.Errorf("failed to restore ruleset %s: %w", ruleset.ID, err)
+	}
+
+	// Restoring the ruleset the ConfigMap already describes needs no hold
+	if ruleset.Digest != heldDigest {
+		hold := Hold{
+			Digest:       heldDigest,
+			RolledBackTo: ruleset.ID,
+			Reason:       reason,
+			Timestamp:    time.Now().UTC(),
+		}
+		if err := writeJSON(pair.TargetDirectory, historyDir(pair.TargetDirectory), holdFileName, hold); err != nil {
+			return err
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"targetDirectory": pair.TargetDirectory,
+		"rolledBackTo":    ruleset.ID,
+		"digest":          ruleset.Digest,
+		"heldDigest":      heldDigest,
+		"reason":          reason,
+	}).Warn("Rolled back ruleset")
+
+	return nil
+}
+
+// historyFiles returns the files of a ruleset in the history of targetDir, keyed by the names they were written under
+// and attributed to the sources they were read from. Every file must still have the digest it was recorded with.
+func historyFiles(targetDir string, ruleset Ruleset) (map[string]SourceFile, error) {
+	entryDir := filepath.Join(historyDir(targetDir), ruleset.ID)
+	files := make(map[string]SourceFile)
+	for name, fileDigest := range ruleset.Files {
+		if name != filepath.Base(name) || strings.HasPrefix(name, stagingPrefix) {
+			return nil, fmt.Errorf("invalid file name %q", name)
+		}
+		path := filepath.Join(entryDir, name)
+		hash, err := getFileHash(targetDir, path)
+		if err != nil {
+			return nil, err
+		}
+		if digest(hash) != fileDigest {
+			return nil, fmt.Errorf("%s has digest %s, but was recorded with %s", path, digest(hash), fileDigest)
+		}
+		files[name] = SourceFile{Path: path, Hash: hash, Source: ruleset.FileSources[name]}
+	}
+	return files, nil
+}
+
+// handleLoadFailure rolls the target directory back to the newest earlier ruleset that did not fail when
+// aks-auditd-monitor reported that auditd could not load the current rules. It returns true if a rollback happened.
+func handleLoadFailure(pair DirectoryPair, desiredDigest string, currentDigest string) (bool, error) {
+	targetDir := pair.TargetDirectory
+
+	var failure LoadFailure
+	failurePath := filepath.Join(historyDir(targetDir), loadFailureFileName)
+	if err := readJSON(targetDir, failurePath, &failure); errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer hostRemove(targetDir, failurePath)
+
+	log.Errorf("auditd failed to load the rules in %s at %v: %s", targetDir, failure.Timestamp, failure.Error)
+
+	rulesets, err := readHistory(targetDir)
+	if err != nil {
+		return false, err
+	}
+
+	current := currentRuleset(rulesets, currentDigest)
+	if current < 0 {
+		log.Error("The failed ruleset is not in the history. Unable to roll back.")
+		return false, nil
+	}
+	if err := setRulesetStatus(targetDir, rulesets[current], rulesetFailed); err != nil {
+		return false, err
+	}
+
+	for i := current - 1; i >= 0; i-- {
+		if rulesets[i].Status == rulesetFailed || rulesets[i].Digest == rulesets[current].Digest {
+			continue
+		}
+		reason := fmt.Sprintf("auditd failed to load ruleset %s: %s", rulesets[current].ID, failure.Error)
+		if err := rollback(pair, rulesets[i], desiredDigest, reason); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	log.Error("No earlier ruleset that loaded successfully is in the history. Unable to roll back.")
+	return false, nil
+}
+
+// readHold returns the hold on the target directory. The second return value is false when there is no hold.
+func readHold(targetDir string) (Hold, bool, error) {
+	var hold Hold
+	err := readJSON(targetDir, filepath.Join(historyDir(targetDir), holdFileName), &hold)
+	if errors.Is(err, os.ErrNotExist) {
+		return hold, false, nil
+	}
+	return hold, err == nil, err
+}
+
+// removeHold removes the hold on the target directory, so the ConfigMap ruleset is applied on the next sync.
+func removeHold(targetDir string) error {
+	err := hostRemove(targetDir, filepath.Join(historyDir(targetDir), holdFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// readJSON decodes the JSON file at path in root into v.
+func readJSON(root, path string, v interface{}) error {
+	data, err := hostReadFile(root, path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// writeJSON atomically replaces the file name in dir in root with v encoded as JSON.
+func writeJSON(root, dir, name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	stagedPath, err := stageContent(root, strings.NewReader(string(data)), dir, name, manifestFileMode)
+	if err != nil {
+		return err
+	}
+	if err := hostRename(root, stagedPath, filepath.Join(dir, name)); err != nil {
+		hostRemove(root, stagedPath)
+		return err
+	}
+
+	return syncDir(root, dir)
+}
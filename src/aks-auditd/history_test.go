@@ -0,0 +1,159 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// syncAndRecord syncs the pair and records the ruleset it applied in the history. It returns the files in the target
+// directory and the recorded ruleset.
+func syncAndRecord(t *testing.T, pair DirectoryPair) (map[string]string, Ruleset) {
+	t.Helper()
+	if _, err := syncFromSource(pair); err != nil {
+		t.Fatal(err)
+	}
+	manifest, _, err := readManifest(pair.TargetDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock, err := lockHistory(pair.TargetDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	if err := recordRuleset(pair, manifest); err != nil {
+		t.Fatal(err)
+	}
+	rulesets, err := readHistory(pair.TargetDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return readFiles(t, pair.TargetDirectory), rulesets[len(rulesets)-1]
+}
+
+func TestRollback(t *testing.T) {
+	pair := testPair(t)
+	pair.HistorySize = 5
+	pair.Packs = []PackSelection{{Name: "k8s-node"}}
+	writeFiles(t, pair.SourceDirectory, map[string]string{"10-base.rules": "-D\n-b 8192\n"})
+	first, recorded := syncAndRecord(t, pair)
+
+	// Change the source and the pack selection, so restoring through the sync pipeline would render other files
+	packs, _ := rulePacks()
+	pair.Packs = []PackSelection{{Name: "k8s-node", Exclude: []string{packs["k8s-node"].Rules[0].ID}}}
+	writeFiles(t, pair.SourceDirectory, map[string]string{"10-base.rules": "-D\n-b 16384\n", "20-new.rules": "-w /etc/hosts -p wa\n"})
+	second, current := syncAndRecord(t, pair)
+	if len(second) == len(first) && second["10-base.rules"] == first["10-base.rules"] {
+		t.Fatal("second sync did not change the target directory")
+	}
+
+	if err := rollback(pair, recorded, current.Digest, "test"); err != nil {
+		t.Fatal(err)
+	}
+	restored := readFiles(t, pair.TargetDirectory)
+	if len(restored) != len(first) {
+		t.Errorf("restored %d files, want %d", len(restored), len(first))
+	}
+	for name, content := range first {
+		if restored[name] != content {
+			t.Errorf("%s was restored as %q, want %q", name, restored[name], content)
+		}
+	}
+	manifest, _, err := readManifest(pair.TargetDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rulesetDigest(manifest.Files) != recorded.Digest {
+		t.Errorf("manifest digest is %s after the rollback, want %s", rulesetDigest(manifest.Files), recorded.Digest)
+	}
+	for name, source := range recorded.FileSources {
+		if manifest.Sources[name] != source {
+			t.Errorf("%s is attributed to %q after the rollback, want %q", name, manifest.Sources[name], source)
+		}
+	}
+	hold, exists, err := readHold(pair.TargetDirectory)
+	if err != nil || !exists || hold.Digest != current.Digest || hold.RolledBackTo != recorded.ID {
+		t.Errorf("hold is %+v, %v, %v, want the digest %s held back", hold, exists, err, current.Digest)
+	}
+}
+
+func TestRollbackChangedHistory(t *testing.T) {
+	pair := testPair(t)
+	pair.HistorySize = 5
+	writeFiles(t, pair.SourceDirectory, map[string]string{"10-base.rules": "-D\n-b 8192\n"})
+	before, recorded := syncAndRecord(t, pair)
+
+	// A history entry whose file no longer has its recorded digest is not restored
+	entryFile := filepath.Join(historyDir(pair.TargetDirectory), recorded.ID, "10-base.rules")
+	if err := os.WriteFile(entryFile, []byte("-e 0\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	err := rollback(pair, recorded, "", "test")
+	if err == nil || !strings.Contains(err.Error(), "was recorded with") {
+		t.Fatalf("got error %v, want a digest mismatch", err)
+	}
+	if after := readFiles(t, pair.TargetDirectory); after["10-base.rules"] != before["10-base.rules"] {
+		t.Errorf("target directory changed to %v", after)
+	}
+}
+
+func TestRulesetIDShortDigest(t *testing.T) {
+	for digest, want := range map[string]string{"": "-", "abc": "abc", strings.Repeat("a", 64): strings.Repeat("a", 12)} {
+		if got := shortDigest(digest); got != want {
+			t.Errorf("shortDigest(%q) = %q, want %q", digest, got, want)
+		}
+	}
+}
+
+func TestCompareAndSyncHistory(t *testing.T) {
+	readCompiled := func(t *testing.T, dir string) CompiledRuleset {
+		t.Helper()
+		var compiled CompiledRuleset
+		if err := readJSON(dir, filepath.Join(dir, compiledFileName), &compiled); err != nil {
+			t.Fatal(err)
+		}
+		return compiled
+	}
+
+	// A rules pair keeps a history and names it in the compiled ruleset for aks-auditd-monitor
+	rules := testPair(t)
+	rules.HistorySize = 5
+	writeFiles(t, rules.SourceDirectory, map[string]string{"10-base.rules": "-D\n-b 8192\n"})
+	if _, err := compareAndSyncDirectories(rules); err != nil {
+		t.Fatal(err)
+	}
+	if rulesets, err := readHistory(rules.TargetDirectory); err != nil || len(rulesets) != 1 {
+		t.Errorf("the history of the rules holds %d rulesets, %v", len(rulesets), err)
+	}
+	if got := readCompiled(t, rules.TargetDirectory).History; got != historyDirectoryName {
+		t.Errorf("the compiled ruleset names the history %q, want %q", got, historyDirectoryName)
+	}
+
+	// Without a history, the compiled ruleset names none, so aks-auditd-monitor does not report load failures
+	rules.HistorySize = 0
+	writeFiles(t, rules.SourceDirectory, map[string]string{"10-base.rules": "-D\n-b 16384\n"})
+	if _, err := compareAndSyncDirectories(rules); err != nil {
+		t.Fatal(err)
+	}
+	if got := readCompiled(t, rules.TargetDirectory).History; got != "" {
+		t.Errorf("the compiled ruleset of a pair without history names the history %q", got)
+	}
+
+	// Plugins cannot fail to load the way rules do, so a pair without rules files keeps no history
+	plugins := testPair(t)
+	plugins.HistorySize = 5
+	writeFiles(t, plugins.SourceDirectory, map[string]string{
+		"af_unix.conf": "active = yes\ndirection = out\npath = builtin_af_unix\ntype = builtin\nformat = string\n",
+	})
+	if _, err := compareAndSyncDirectories(plugins); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(historyDir(plugins.TargetDirectory)); !os.IsNotExist(err) {
+		t.Errorf("the plugins pair has a history: %v", err)
+	}
+	if got := readFiles(t, plugins.TargetDirectory)["af_unix.conf"]; got == "" {
+		t.Error("the plugin file was not synced")
+	}
+}
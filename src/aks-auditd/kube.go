@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Directory where Kubernetes mounts the service account token, CA certificate, and namespace of the pod.
+var serviceAccountDirectory = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubeGet reads a resource from the Kubernetes API server with the pod's service account and decodes the JSON response
+// into v.
+func kubeGet(path string, v interface{}) error {
+	return kubeRequest(http.MethodGet, path, nil, v)
+}
+
+// kubePost creates the resource in body on the Kubernetes API server with the pod's service account.
+func kubePost(path string, body interface{}) error {
+	return kubeRequest(http.MethodPost, path, body, nil)
+}
+
+// kubePatch applies the JSON merge patch in body to a resource on the Kubernetes API server with the pod's service
+// account.
+func kubePatch(path string, body interface{}) error {
+	return kubeRequest(http.MethodPatch, path, body, nil)
+}
+
+// kubeRequest sends a request to the Kubernetes API server with the pod's service account. body is encoded as JSON when
+// not nil, and the JSON response is decoded into v when not nil. Only the few calls aks-auditd needs are made, so this
+// avoids pulling in client-go.
+func kubeRequest(method, path string, body, v interface{}) error {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return errors.New("not running in a Kubernetes pod")
+	}
+
+	token, err := os.ReadFile(filepath.Join(serviceAccountDirectory, "token"))
+	if err != nil {
+		return err
+	}
+	caCert, err := os.ReadFile(filepath.Join(serviceAccountDirectory, "ca.crt"))
+	if err != nil {
+		return err
+	}
+	caPool := x509.NewCertPool()
+	if !caPool.AppendCertsFromPEM(caCert) {
+		return errors.New("invalid service account CA certificate")
+	}
+
+	client := &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: caPool, MinVersion: tls.VersionTLS12}},
+	}
+	var requestBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&requestBody).Encode(body); err != nil {
+			return err
+		}
+	}
+	request, err := http.NewRequest(method, "https://"+net.JoinHostPort(host, port)+path, &requestBody)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	request.Header.Set("Accept", "application/json")
+	if method == http.MethodPatch {
+		request.Header.Set("Content-Type", "application/merge-patch+json")
+	} else if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("%s %s: %s", method, path, response.Status)
+	}
+
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(response.Body).Decode(v)
+}
+
+// podNamespace returns the namespace the pod runs in.
+func podNamespace() (string, error) {
+	namespace, err := os.ReadFile(filepath.Join(serviceAccountDirectory, "namespace"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(namespace)), nil
+}
+
+// getConfigMapResourceVersion returns the resourceVersion of the named ConfigMap in the pod's namespace.
+func getConfigMapResourceVersion(name string) (string, error) {
+	namespace, err := podNamespace()
+	if err != nil {
+		return "", err
+	}
+
+	var configMap struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+	}
+	if err := kubeGet("/api/v1/namespaces/"+namespace+"/configmaps/"+name, &configMap); err != nil {
+		return "", err
+	}
+
+	return configMap.Metadata.ResourceVersion, nil
+}
+
+// createPodEvent records a Kubernetes Event of the given type (Normal or Warning) on the aks-auditd pod, so it shows up
+// in kubectl describe and in cluster event pipelines. The pod name is set through the downward API in POD_NAME.
+func createPodEvent(eventType, reason, message string) error {
+	namespace, err := podNamespace()
+	if err != nil {
+		return err
+	}
+	podName := os.Getenv("POD_NAME")
+	if podName == "" {
+		return errors.New("POD_NAME is not set")
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	event := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"generateName": podName + ".",
+			"namespace":    namespace,
+		},
+		"involvedObject": map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Pod",
+			"name":       podName,
+			"namespace":  namespace,
+		},
+		"type":           eventType,
+		"reason":         reason,
+		"message":        message,
+		"source":         map[string]interface{}{"component": "aks-auditd", "host": os.Getenv("NODE_NAME")},
+		"firstTimestamp": now,
+		"lastTimestamp":  now,
+		"count":          1,
+	}
+
+	return kubePost("/api/v1/namespaces/"+namespace+"/events", event)
+}
+
+// Node is the part of a Kubernetes Node object aks-auditd reads.
+type Node struct {
+	Metadata struct {
+		Labels map[string]string `json:"labels"`
+	} `json:"metadata"`
+	Status struct {
+		NodeInfo struct {
+			Architecture  string `json:"architecture"`
+			KernelVersion string `json:"kernelVersion"`
+			OSImage       string `json:"osImage"`
+		} `json:"nodeInfo"`
+	} `json:"status"`
+}
+
+// getNode returns the node aks-auditd runs on. The node name is set through the downward API in NODE_NAME.
+func getNode() (Node, error) {
+	var node Node
+	nodeName := os.Getenv("NODE_NAME")
+	if nodeName == "" {
+		return node, errors.New("NODE_NAME is not set")
+	}
+	err := kubeGet("/api/v1/nodes/"+nodeName, &node)
+	return node, err
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"aksauditd/auditrules"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Source is one directory, usually a ConfigMap mount, that contributes files to a target directory. A platform team
+// can own a baseline source while app teams add their own sources with a different priority.
+type Source struct {
+	Directory string     `mapstructure:"directory"`
+	OCI       *OCISource `mapstructure:"oci"`       // Pulls the files from an OCI artifact instead of Directory
+	Priority  int        `mapstructure:"priority"`  // A file replaces the same-named files of sources with a lower priority
+	ConfigMap string     `mapstructure:"configMap"` // Name of the ConfigMap mounted at Directory, recorded in the history
+}
+
+// name returns the name the source is referred to by in logs, the manifest, and the history.
+func (s Source) name() string {
+	if s.OCI != nil {
+		return s.OCI.Reference
+	}
+	return valueOrDefault(s.ConfigMap, s.Directory)
+}
+
+// SourceFile is a file of the merged sources of a pair.
+type SourceFile struct {
+	Path   string   // Path of the file in the source directory it is read from
+	Hash   [32]byte // SHA-256 hash of the file
+	Source string   // Name of the source the file is read from
+	Origin string   // Path of the template or file as written in the source, when Path holds it rendered or expanded
+}
+
+// sources returns the sources of the pair, highest priority first. A pair with a single sourceDirectory has one source.
+func (p DirectoryPair) sources() []Source {
+	if len(p.Sources) == 0 {
+		return []Source{{Directory: p.SourceDirectory, ConfigMap: p.ConfigMap}}
+	}
+
+	sources := append([]Source(nil), p.Sources...)
+	sort.SliceStable(sources, func(i, j int) bool { return sources[i].Priority > sources[j].Priority })
+	return sources
+}
+
+// sourceDirectories returns the directories of the sources of the pair, highest priority first. OCI sources are
+// listed by their reference.
+func (p DirectoryPair) sourceDirectories() []string {
+	var dirs []string
+	for _, source := range p.sources() {
+		if source.OCI != nil {
+			dirs = append(dirs, source.OCI.Reference)
+			continue
+		}
+		dirs = append(dirs, source.Directory)
+	}
+	return dirs
+}
+
+// mountedDirectories returns the source directories of the pair that are mounted in the container, leaving out OCI
+// sources.
+func (p DirectoryPair) mountedDirectories() []string {
+	var dirs []string
+	for _, source := range p.sources() {
+		if source.OCI == nil {
+			dirs = append(dirs, source.Directory)
+		}
+	}
+	return dirs
+}
+
+// resolveSnapshots returns a copy of the pair that reads every source from the ConfigMap snapshot currently in place,
+// and every OCI source from the last good bundle cached on the node.
+func (p DirectoryPair) resolveSnapshots() DirectoryPair {
+	p.SourceDirectory = resolveSnapshot(p.SourceDirectory)
+
+	sources := make([]Source, len(p.Sources))
+	for i, source := range p.Sources {
+		if source.OCI != nil {
+			source.Directory = cachedOCIBundle(p.TargetDirectory, *source.OCI)
+		} else {
+			source.Directory = resolveSnapshot(source.Directory)
+		}
+		sources[i] = source
+	}
+	if len(sources) > 0 {
+		p.Sources = sources
+	}
+
+	return p
+}
+
+// mergeSources returns the files of all sources of the pair and of the rule packs it enables, keyed by the name they
+// are written under in the target directory. A file in a source with a higher priority replaces the same-named file of
+// every lower priority source.
+func mergeSources(pair DirectoryPair) (map[string]SourceFile, error) {
+	merged := make(map[string]SourceFile)
+	archives := make(map[string]bool)
+	rendered := make(map[string]bool)
+
+	for _, source := range pair.sources() {
+		files, err := readSource(pair, source, archives, rendered)
+		if err != nil {
+			return nil, err
+		}
+
+		for fileName, file := range files {
+			name := targetFileName(pair.FilePrefix, fileName)
+			if winner, exists := merged[name]; exists {
+				log.Debugf("%s from %s overrides the same file from %s", name, winner.Source, source.name())
+				continue
+			}
+			merged[name] = file
+		}
+	}
+
+	// The built-in rule packs come after every source
+	if err := renderPacks(pair, merged, rendered); err != nil {
+		return nil, err
+	}
+
+	pruneCache(pair.TargetDirectory, archiveCacheDir(pair.TargetDirectory), archives)
+	pruneCache(pair.TargetDirectory, renderedCacheDir(pair.TargetDirectory), rendered)
+	return merged, nil
+}
+
+// readSource returns the files of a single source keyed by their source file name. Files whose node selector does not
+// match this node are left out. Archives in the source are expanded
+// into the archive cache of the target directory and replaced by their files. Templates, in the source or in an
+// archive, are rendered with the facts of the node and keyed by their name without the template suffix. Syscall rules
+// are expanded for the arch of the node. The digest of every expanded archive is added to archives, and the cache key
+// of every rendered template or expanded rules file to rendered.
+func readSource(pair DirectoryPair, source Source, archives, rendered map[string]bool) (map[string]SourceFile, error) {
+	if source.OCI != nil && source.Directory == "" {
+		return nil, fmt.Errorf("no bundle of %s has been pulled yet", source.OCI.Reference)
+	}
+	hashes, err := getFileHashes(pair.TargetDirectory, source.Directory)
+	if err != nil {
+		return nil, fmt.Errorf("error getting file hashes for %s: %w", source.Directory, err)
+	}
+
+	files := make(map[string]SourceFile)
+	add := func(fileName, path string, hash [32]byte) error {
+		origin := path
+		// A file whose node selector does not match this node is left out, as if it were not in the source
+		matches, err := matchesNode(pair.TargetDirectory, path)
+		if err != nil {
+			return fmt.Errorf("unable to match the node selector of %s in %s: %w", fileName, source.name(), err)
+		}
+		if !matches {
+			return nil
+		}
+		if isTemplate(fileName) {
+			templateName := fileName
+			fileName = strings.TrimSuffix(fileName, templateSuffix)
+			renderedPath, renderedHash, err := renderTemplate(pair.TargetDirectory, path, fileName)
+			if err != nil {
+				reportRenderError(pair, source, templateName, err)
+				return fmt.Errorf("failed to render template %s in %s: %w", templateName, source.name(), err)
+			}
+			rendered[renderedKey(fileName, renderedHash)] = true
+			path, hash = renderedPath, renderedHash
+		}
+		if pair.ArchExpansion && strings.HasSuffix(fileName, ".rules") {
+			expandedPath, expandedHash, expanded, err := expandArch(pair.TargetDirectory, fileName, path)
+			if err != nil {
+				return fmt.Errorf("failed to expand the syscall rules of %s in %s: %w", fileName, source.name(), err)
+			}
+			if expanded {
+				rendered[renderedKey(fileName, expandedHash)] = true
+				path, hash = expandedPath, expandedHash
+			}
+		}
+		if _, exists := files[fileName]; exists {
+			return fmt.Errorf("%s is in %s more than once, as a file, a template, or in an archive", fileName, source.name())
+		}
+		file := SourceFile{Path: path, Hash: hash, Source: source.name()}
+		if path != origin {
+			file.Origin = origin
+		}
+		files[fileName] = file
+		return nil
+	}
+
+	for fileName, hash := range hashes {
+		if !isArchive(fileName) {
+			if err := add(fileName, filepath.Join(source.Directory, fileName), hash); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		expandedDir, err := expandArchive(pair.TargetDirectory, filepath.Join(source.Directory, fileName), hash)
+		if err != nil {
+			return nil, fmt.Errorf("rejected archive %s in %s: %w", fileName, source.name(), err)
+		}
+		archives[filepath.Base(expandedDir)] = true
+
+		entries, err := getFileHashes(pair.TargetDirectory, expandedDir)
+		if err != nil {
+			return nil, err
+		}
+		for entryName, entryHash := range entries {
+			if err := add(entryName, filepath.Join(expandedDir, entryName), entryHash); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return files, nil
+}
+
+// detectConflicts returns a description of every control setting, such as -b or -e, that a rules file sets to a
+// different value than a file from another source before it, as found by the conflicting-setting lint check. The
+// result is empty for a pair with a single source. Files cached in the target directory root are read confined to it.
+func detectConflicts(root string, files map[string]SourceFile) []string {
+	byName := make(map[string]string)
+	for name, file := range files {
+		if strings.HasSuffix(name, ".rules") {
+			byName[name] = file.Path
+		}
+	}
+
+	// Lines that do not parse are reported by the validation, and the lines that parse are still checked
+	parsed, _, err := parseRulesFiles(root, byName)
+	if err != nil {
+		log.Warnf("Unable to check the rules files for conflicting settings: %v", err)
+		return nil
+	}
+
+	var conflicts []string
+	for _, finding := range auditrules.Lint(parsed) {
+		if finding.Check != auditrules.CheckConflictingSetting {
+			continue
+		}
+		source, relatedSource := files[finding.File].Source, files[finding.RelatedFile].Source
+		if source == relatedSource {
+			continue
+		}
+		conflicts = append(conflicts, fmt.Sprintf("%s:%d: %s (%s is from %s, %s from %s)", finding.File, finding.Line,
+			finding.Message, finding.File, source, finding.RelatedFile, relatedSource))
+	}
+
+	return conflicts
+}
+
+// reportConflicts logs the conflicts between the sources of the pair as a warning whenever they change, so the same
+// conflicts are only logged once and not on every poll.
+func reportConflicts(pair DirectoryPair, conflicts []string) {
+	fingerprint := strings.Join(conflicts, "\n")
+	if !reports.changed(pair.TargetDirectory, kindConflicts, "", fingerprint) {
+		return
+	}
+
+	for _, conflict := range conflicts {
+		log.WithFields(log.Fields{
+			"targetDirectory": pair.TargetDirectory,
+		}).Warnf("Conflicting setting in the rule sources: %s", conflict)
+	}
+}
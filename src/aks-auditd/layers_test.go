@@ -0,0 +1,132 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testLayeredPair returns a pair merging a baseline source with priority 100 and an app source with priority 10.
+func testLayeredPair(t *testing.T) DirectoryPair {
+	t.Helper()
+	pair := testPair(t)
+	pair.SourceDirectory = ""
+	pair.Sources = []Source{
+		{Directory: t.TempDir(), Priority: 10, ConfigMap: "auditd-rules-app"},
+		{Directory: t.TempDir(), Priority: 100, ConfigMap: "auditd-rules"},
+	}
+	return pair
+}
+
+func TestMergeSources(t *testing.T) {
+	pair := testLayeredPair(t)
+	app, baseline := pair.Sources[0].Directory, pair.Sources[1].Directory
+	writeFiles(t, baseline, map[string]string{
+		"10-base.rules":   "-D\n-b 8192\n",
+		"30-shared.rules": "-w /etc/passwd -p wa -k identity\n",
+	})
+	writeFiles(t, app, map[string]string{
+		"20-app.rules":    "-w /opt/app -p wa -k app\n",
+		"30-shared.rules": "-w /etc/passwd -p r -k app-identity\n",
+	})
+
+	merged, err := mergeSources(pair)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"10-base.rules":   "auditd-rules",
+		"20-app.rules":    "auditd-rules-app",
+		"30-shared.rules": "auditd-rules", // The lower priority app source loses
+	}
+	got := make(map[string]string)
+	for name, file := range merged {
+		got[name] = file.Source
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("mergeSources() sources = %v, want %v", got, want)
+	}
+	if data, err := os.ReadFile(merged["30-shared.rules"].Path); err != nil || string(data) != "-w /etc/passwd -p wa -k identity\n" {
+		t.Errorf("30-shared.rules is read from %s: %q, %v", merged["30-shared.rules"].Path, data, err)
+	}
+
+	// The sync writes the winning file
+	if _, err := syncFromSource(pair); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFiles(t, pair.TargetDirectory)["30-shared.rules"]; got != "-w /etc/passwd -p wa -k identity\n" {
+		t.Errorf("30-shared.rules on the node = %q, want the file of the higher priority source", got)
+	}
+}
+
+func TestDetectConflicts(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		baseline map[string]string
+		app      map[string]string
+		want     []string // Files with a conflict, as file:line
+	}{
+		{
+			"different values",
+			map[string]string{"10-base.rules": "-D\n-b 8192\n-f 1\n"},
+			map[string]string{"20-app.rules": "-b 1024\n"},
+			[]string{"20-app.rules:1"},
+		},
+		{
+			"same value",
+			map[string]string{"10-base.rules": "-D\n-b 8192\n"},
+			map[string]string{"20-app.rules": "-b 8192\n"},
+			nil,
+		},
+		{
+			"one source",
+			map[string]string{"10-base.rules": "-D\n-b 8192\n", "20-more.rules": "-b 1024\n"},
+			nil,
+			nil,
+		},
+		{
+			// A value in a comment or after a key is not a setting, unlike for a scan of the first two words
+			"not a setting",
+			map[string]string{"10-base.rules": "-D\n-b 8192\n"},
+			map[string]string{"20-app.rules": "# -b 1024\n-w /etc/hosts -p wa -k net\n"},
+			nil,
+		},
+		{
+			"enable",
+			map[string]string{"10-base.rules": "-D\n-e 1\n"},
+			map[string]string{"99-finalize.rules": "-e 2\n"},
+			[]string{"99-finalize.rules:1"},
+		},
+		{
+			"plugin files are not checked",
+			map[string]string{"10-base.rules": "-D\n-b 8192\n", "syslog.conf": "-b 1\n"},
+			map[string]string{"au-remote.conf": "-b 2\n"},
+			nil,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			pair := testLayeredPair(t)
+			writeFiles(t, pair.Sources[1].Directory, test.baseline)
+			writeFiles(t, pair.Sources[0].Directory, test.app)
+
+			merged, err := mergeSources(pair)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conflicts := detectConflicts(pair.TargetDirectory, merged)
+
+			var got []string
+			for _, conflict := range conflicts {
+				got = append(got, strings.Join(strings.SplitN(conflict, ":", 3)[:2], ":"))
+				if !strings.Contains(conflict, "from auditd-rules-app") || !strings.Contains(conflict, "from auditd-rules)") {
+					t.Errorf("conflict %q does not name both sources", conflict)
+				}
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("detectConflicts() = %q, want conflicts at %v", conflicts, test.want)
+			}
+		})
+	}
+}
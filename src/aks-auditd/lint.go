@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"aksauditd/auditrules"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Check name of the findings for files that do not parse. A file on the node that aks-auditd did not write, or that
+// was quarantined under the skip-bad-files policy earlier, may not parse.
+const checkSyntax = "syntax"
+
+// lintDirectory lints the .rules files in dir as one ruleset, in the order augenrules loads them.
+func lintDirectory(dir string) ([]auditrules.Finding, error) {
+	paths, err := rulesFilePaths(dir)
+	if err != nil {
+		return nil, err
+	}
+	return lintFiles(dir, paths)
+}
+
+// rulesFilePaths returns the paths of the .rules files in dir that augenrules loads.
+func rulesFilePaths(dir string) ([]string, error) {
+	entries, err := hostReadDir(dir, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && strings.HasSuffix(entry.Name(), ".rules") && !strings.HasPrefix(entry.Name(), ".") {
+			paths = append(paths, filepath.Join(dir, entry.Name()))
+		}
+	}
+	return paths, nil
+}
+
+// parseRulesFiles parses the rules files, keyed by the name they have in the target directory and holding the path
+// to read them from. It returns them in the order augenrules loads them, along with a syntax finding for every line
+// that does not parse. The lines that parse are kept. Files in root are read confined to it.
+func parseRulesFiles(root string, byName map[string]string) ([]*auditrules.File, []auditrules.Finding, error) {
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	auditrules.SortLoadOrder(names)
+
+	var findings []auditrules.Finding
+	var files []*auditrules.File
+	for _, name := range names {
+		data, err := hostReadFile(root, byName[name])
+		if err != nil {
+			return nil, nil, err
+		}
+		file, err := auditrules.Parse(name, bytes.NewReader(data))
+		if errs, ok := err.(auditrules.ErrorList); ok {
+			for _, e := range errs {
+				findings = append(findings, auditrules.Finding{File: name, Line: e.Pos.Line, Check: checkSyntax, Message: e.Msg})
+			}
+		}
+		files = append(files, file)
+	}
+	return files, findings, nil
+}
+
+// lintFiles lints the rules files at paths as one ruleset. The files are sorted in the order augenrules loads them.
+// Files in root are read confined to it.
+func lintFiles(root string, paths []string) ([]auditrules.Finding, error) {
+	files, findings, err := parseRulesFiles(root, pathsByName(paths))
+	if err != nil {
+		return nil, err
+	}
+
+	// Syntax findings go in between the lint findings of the same file
+	order := make(map[string]int)
+	for i, file := range files {
+		order[file.Name] = i
+	}
+	findings = append(findings, auditrules.Lint(files)...)
+	sort.SliceStable(findings, func(i, j int) bool {
+		if findings[i].File != findings[j].File {
+			return order[findings[i].File] < order[findings[j].File]
+		}
+		return findings[i].Line < findings[j].Line
+	})
+	return findings, nil
+}
+
+// reportLint lints the rules in the target directory of the pair and logs the findings as warnings whenever they
+// change. A target directory without rules files, such as plugins.d, has no findings.
+func reportLint(pair DirectoryPair) {
+	findings, err := lintDirectory(pair.TargetDirectory)
+	if err != nil {
+		log.Warnf("Unable to lint the rules in %s: %v", pair.TargetDirectory, err)
+		return
+	}
+
+	var fingerprint strings.Builder
+	for _, finding := range findings {
+		fingerprint.WriteString(finding.String() + "\n")
+	}
+	// The same findings are only logged as warnings once and not on every poll
+	if !reports.changed(pair.TargetDirectory, kindLint, "", fingerprint.String()) {
+		return
+	}
+
+	for _, finding := range findings {
+		log.WithFields(log.Fields{
+			"targetDirectory": pair.TargetDirectory,
+			"file":            finding.File,
+			"line":            finding.Line,
+			"check":           finding.Check,
+		}).Warnf("Lint: %s", finding.Message)
+	}
+	if len(findings) > 0 {
+		log.Warnf("The rules in %s have %d lint findings. Run aks-auditd lint for details.", pair.TargetDirectory, len(findings))
+	}
+}
+
+// lintCommand lints the given rules files and directories, or the rules in dir when none are given. It prints one
+// finding per line and returns an error when there are findings.
+func lintCommand(dir string, args []string) error {
+	files, err := collectRulesFiles(dir, args)
+	if err != nil {
+		return err
+	}
+
+	findings, err := lintFiles(dir, files)
+	if err != nil {
+		return err
+	}
+	for _, finding := range findings {
+		fmt.Println(finding)
+	}
+	if len(findings) > 0 {
+		return fmt.Errorf("the rules have %d lint findings", len(findings))
+	}
+	return nil
+}
+
+// pathsByName keys the paths by their file names.
+func pathsByName(paths []string) map[string]string {
+	byName := make(map[string]string, len(paths))
+	for _, path := range paths {
+		byName[filepath.Base(path)] = path
+	}
+	return byName
+}
+
+// collectRulesFiles returns the given rules files and the .rules files in the given directories, or the .rules files
+// in dir when none are given.
+func collectRulesFiles(dir string, args []string) ([]string, error) {
+	paths := args
+	if len(args) == 0 {
+		paths = []string{dir}
+	}
+
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(path, "*.rules"))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	return files, nil
+}
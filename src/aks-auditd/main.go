@@ -1,16 +1,19 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sort"
 	"strings"
+	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
-	"github.com/spf13/viper"
 	"golang.org/x/sys/unix"
 )
 
@@ -33,54 +36,119 @@ const chrootRulesMount = "/auditd-rules-target"
 // Container mount point where auditd rules are stored.
 const rulesMount = "/auditd-rules"
 
+// Container mount point where the host audit plugins.d directory is mounted.
+const chrootPluginsMount = "/audispd-plugins-target"
+
+// Container mount point where audispd plugin configuration files are stored.
+const pluginsMount = "/audispd-plugins"
+
+// Names of the ConfigMaps mounted at rulesMount and pluginsMount
+const rulesConfigMap = "auditd-rules"
+const pluginsConfigMap = "audispd-plugins"
+
+// Prefix and suffix of the hidden temporary files used to stage a new set of files in a target directory.
+const stagingPrefix = ".aks-auditd-"
+const stagingSuffix = ".tmp"
+
+// Permissions of rules files written to the host. augenrules has no requirements on these.
+const rulesFileMode = 0644
+
+// Permissions of plugin configuration files written to the host. auditd skips plugin files that are not 0600 or 0640
+// and not owned by root. aks-auditd cannot change file ownership, so aks-auditd-monitor sets the root owner on the node.
+const pluginsFileMode = 0640
+
 // Map of source to target directories for copying files
 type DirectoryPair struct {
-	SourceDirectory string
-	TargetDirectory string
+	SourceDirectory  string          `mapstructure:"sourceDirectory"`
+	Sources          []Source        `mapstructure:"sources"` // Layered sources merged by priority. Replaces SourceDirectory when set.
+	TargetDirectory  string          `mapstructure:"targetDirectory"`
+	FileMode         os.FileMode     `mapstructure:"fileMode"`         // Permissions of the files written to TargetDirectory
+	FilePrefix       string          `mapstructure:"filePrefix"`       // Prepended to the name of every file written to TargetDirectory
+	ConfigMap        string          `mapstructure:"configMap"`        // Name of the ConfigMap mounted at SourceDirectory, recorded in the history
+	DriftPolicy      string          `mapstructure:"driftPolicy"`      // What to do with files changed on the node by someone else
+	ValidationPolicy string          `mapstructure:"validationPolicy"` // What to do with the valid files when some source files are invalid
+	SigningKeys      []string        `mapstructure:"signingKeys"`      // Public keys, PEM or file path, one of which must sign every source
+	Packs            []PackSelection `mapstructure:"packs"`            // Built-in rule packs rendered next to the source files
+	HistorySize      int             `mapstructure:"-"`                // Number of applied rulesets kept in the history. 0 disables the history.
+	ArchExpansion    bool            `mapstructure:"-"`                // Expand syscall rules for b64 and b32 and the node arch
 }
 
 func main() {
 
-	// Set default config values
-	viper.SetDefault("pollInterval", "30s")
-	viper.SetDefault("logLevel", "info")
+	// Run an on-call command, such as rollback, instead of the sync loop
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
 
-	// Environment variable settings
-	// NOTE: When using BindEnv with multiple, SetEnvPrefix does not apply and we must set it explicitly
-	viper.SetEnvPrefix("AA")
-	viper.BindEnv("logLevel", "AA_LOG_LEVEL")
-	viper.BindEnv("pollInterval", "AA_POLL_INTERVAL")
+	ctx, stop, resync := notifySignals()
+	defer stop()
 
-	// Output the configuration settings
-	duration, err := time.ParseDuration(viper.GetString("pollInterval"))
+	// Read the config file and environment variables
+	if err := initConfig(); err != nil {
+		log.Fatal(err)
+	}
+	config, err := loadConfig()
 	if err != nil {
-		fmt.Println("Error parsing duration:", err)
-		return
+		log.Fatal(err)
 	}
-	log.Info("Polling interval: ", duration)
 
-	level, ok := levelMap[strings.ToLower(viper.GetString("logLevel"))]
-	if !ok {
-		log.Warn(fmt.Sprintf("Invalid log level: %s. Falling back to 'info' level logging.", viper.GetString("logLevel")))
-		level = log.InfoLevel
-	}
-	log.Info("Log Level: ", viper.GetString("logLevel"))
-	log.SetLevel(level)
+	// Output the configuration settings
+	config.logConfig()
+	applyConfig(config)
 
-	// Compare and sync the rules and plugins directories
-	directories := []DirectoryPair{
-		{
-			SourceDirectory: rulesMount,
-			TargetDirectory: chrootRulesMount,
-		},
+	// Apply changes to the config file while running
+	watchConfig()
+
+	// Sync as soon as kubelet updates a mounted ConfigMap. Polling continues as a safety net.
+	watcher, err := newSourceWatcher()
+	if err != nil {
+		log.Warnf("Failed to watch the source directories. Falling back to polling. Error: %v", err)
 	}
 
-	// Run the main loop
+	syncLoop(ctx, resync, watcher)
+}
+
+// notifySignals returns a context that is cancelled by SIGTERM or SIGINT, and a channel that receives SIGHUP. SIGTERM
+// and SIGINT stop the main loop once the sync in progress completes, so a target directory is never left partially
+// written. SIGHUP starts a new sync cycle right away. stop releases both.
+func notifySignals() (context.Context, context.CancelFunc, chan os.Signal) {
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	resync := make(chan os.Signal, 1)
+	signal.Notify(resync, syscall.SIGHUP)
+	return ctx, func() {
+		signal.Stop(resync)
+		cancel()
+	}, resync
+}
+
+// syncLoop runs the main loop until ctx is cancelled. The configuration is read at the start of every cycle, so a
+// reloaded directory list, log level, or poll interval takes effect on the next cycle. A new cycle starts after the
+// poll interval, or earlier on SIGHUP, a configuration reload, or a source directory update. watcher may be nil.
+func syncLoop(ctx context.Context, resync <-chan os.Signal, watcher *sourceWatcher) {
 	for {
-		for _, pair := range directories {
-			sourceDir := pair.SourceDirectory
-			targetDir := pair.TargetDirectory
-			requiresReload, err := compareAndSyncDirectories(sourceDir, targetDir)
+		config := getConfig()
+
+		// Forget what was reported about target directories that were removed from the configuration
+		reports.retainTargets(config.Directories)
+
+		if watcher != nil {
+			sourceDirs := make([]string, 0, len(config.Directories))
+			for _, pair := range config.Directories {
+				sourceDirs = append(sourceDirs, pair.mountedDirectories()...)
+			}
+			watcher.update(sourceDirs)
+		}
+
+		// Expose a ruleset that waits for a reboot because the audit configuration is immutable
+		reportRebootRequired(config.Directories)
+
+		// Compare and sync the rules and plugins directories
+		for _, pair := range config.Directories {
+			if ctx.Err() != nil {
+				break
+			}
+
+			requiresReload, err := compareAndSyncDirectories(pair)
 			if err != nil {
 				log.Errorf("Error syncing directories: %v", err)
 			}
@@ -89,7 +157,19 @@ func main() {
 				log.Info("Differences found. Auditd rules/plugins require reload.")
 			}
 		}
-		time.Sleep(viper.GetDuration("pollInterval"))
+
+		select {
+		case <-ctx.Done():
+			log.Info("Received a shutdown signal. Exiting.")
+			return
+		case <-resync:
+			log.Info("Received SIGHUP. Starting a new sync cycle.")
+		case <-time.After(config.PollInterval):
+		case <-configReloaded:
+			log.Debug("Configuration reloaded. Starting a new sync cycle.")
+		case <-sourceChanged:
+			log.Debug("Source directory updated. Starting a new sync cycle.")
+		}
 	}
 }
 
@@ -114,62 +194,276 @@ func Chroot(path string) (func() error, error) {
 	}, nil
 }
 
-func compareAndSyncDirectories(sourceDir, targetDir string) (bool, error) {
+// compareAndSyncDirectories syncs the target directory of the pair with its source directory. It returns true when the
+// target directory was modified and auditd needs to reload its rules/plugins.
+//
+// When the pair keeps a history, every applied ruleset is recorded in it. If aks-auditd-monitor reported that auditd
+// failed to load the current ruleset, the previous ruleset is restored instead, and the failed ConfigMap ruleset is
+// held back until the ConfigMap changes.
+func compareAndSyncDirectories(pair DirectoryPair) (bool, error) {
+
+	// Complete a switch of files an earlier sync was interrupted in, before the target directory is read
+	if err := replayJournal(pair.TargetDirectory); err != nil {
+		return false, err
+	}
+
+	// Check the OCI sources for a new bundle. Polling a tag is throttled to its own poll interval.
+	pullOCISources(pair)
+
+	// Read every source from the ConfigMap snapshot currently in place. Both the hashes and the copied files come from
+	// the same snapshot, even if kubelet swaps in a new one while the sync runs.
+	pair = pair.resolveSnapshots()
+
+	// Refuse unsigned or tampered sources before anything on the node is touched, so the last verified ruleset stays
+	if err := verifySources(pair); err != nil {
+		return false, err
+	}
+
+	// Only rules can fail to load and be rolled back, so a pair without rules files, such as plugins.d, keeps no history
+	if pair.HistorySize == 0 || !holdsRules(pair) {
+		return syncFromSource(pair)
+	}
+
+	unlock, err := lockHistory(pair.TargetDirectory)
+	if err != nil {
+		return false, fmt.Errorf("failed to lock the history of %s: %w", pair.TargetDirectory, err)
+	}
+	defer unlock()
+
+	desiredDigest, err := sourceDigest(pair)
+	if err != nil {
+		return false, err
+	}
+	manifest, _, err := readManifest(pair.TargetDirectory)
+	if err != nil {
+		return false, err
+	}
+
+	rolledBack, err := handleLoadFailure(pair, desiredDigest, rulesetDigest(manifest.Files))
+	if err != nil || rolledBack {
+		return rolledBack, err
+	}
+
+	hold, held, err := readHold(pair.TargetDirectory)
+	if err != nil {
+		return false, err
+	}
+	if held && hold.Digest == desiredDigest {
+		log.Warnf("Not syncing %s. The ConfigMap ruleset %s is held back after a rollback to %s: %s", pair.TargetDirectory, shortDigest(desiredDigest), hold.RolledBackTo, hold.Reason)
+		return false, nil
+	}
+	if held {
+		log.Infof("The ConfigMap for %s changed since the rollback to %s. Resuming sync.", pair.TargetDirectory, hold.RolledBackTo)
+		if err := removeHold(pair.TargetDirectory); err != nil {
+			return false, err
+		}
+	}
+
+	requiresReload, err := syncFromSource(pair)
+	if err != nil {
+		return false, err
+	}
+
+	// Record the ruleset in place unless the history already has it as its current entry
+	manifest, _, err = readManifest(pair.TargetDirectory)
+	if err != nil {
+		return requiresReload, err
+	}
+	rulesets, err := readHistory(pair.TargetDirectory)
+	if err != nil {
+		return requiresReload, err
+	}
+	if requiresReload || currentRuleset(rulesets, rulesetDigest(manifest.Files)) < 0 {
+		if err := recordRuleset(pair, manifest); err != nil {
+			log.Errorf("Failed to record the ruleset of %s in the history: %v", pair.TargetDirectory, err)
+		}
+	}
+
+	return requiresReload, nil
+}
+
+// holdsRules returns true if the merged sources of the pair have a rules file.
+func holdsRules(pair DirectoryPair) bool {
+	sourceFiles, err := mergeSources(pair)
+	if err != nil {
+		// The sync reports the error
+		return false
+	}
+	for fileName := range sourceFiles {
+		if strings.HasSuffix(fileName, ".rules") {
+			return true
+		}
+	}
+	return false
+}
+
+// sourceDigest returns the ruleset digest of the merged source files under the names they are written as in the
+// target directory.
+func sourceDigest(pair DirectoryPair) (string, error) {
+	sourceFiles, err := mergeSources(pair)
+	if err != nil {
+		return "", err
+	}
+
+	desired := make(map[string]string)
+	for fileName, sourceFile := range sourceFiles {
+		desired[fileName] = digest(sourceFile.Hash)
+	}
+
+	return rulesetDigest(desired), nil
+}
+
+// syncFromSource computes the change set between the merged sources and the target directory of the pair, logs it,
+// and applies it to the target directory. It returns true when the target directory was modified.
+func syncFromSource(pair DirectoryPair) (bool, error) {
+
+	sourceDir := strings.Join(pair.sourceDirectories(), ",")
+	targetDir := pair.TargetDirectory
 
 	log.Debug("Comparing directories: ", sourceDir, " and ", targetDir)
-	requiresReload := false
-	hashesSource, err := getFileHashes(sourceDir)
+	sourceFiles, err := mergeSources(pair)
 	if err != nil {
-		log.Warn(fmt.Sprintf("Error getting file hashes for %s: %v", sourceDir, err))
+		log.Warn(err)
 		return false, err
 	}
+	if len(pair.Sources) > 1 {
+		reportConflicts(pair, detectConflicts(pair.TargetDirectory, sourceFiles))
+	}
 
-	// Iterating through the fileHashes map
-	for fileName, hashValue := range hashesSource {
-		log.Debug(fmt.Sprintf("Source Dir File: %s, Hash: %x", fileName, hashValue))
+	// Quarantine the source files that fail validation, so a typo never reaches augenrules. Under the all-or-nothing
+	// policy, the target directory is left exactly as it is until every file is valid.
+	quarantine := validateSourceFiles(pair.TargetDirectory, sourceFiles)
+	reportQuarantine(pair, sourceFiles, quarantine)
+	if len(quarantine) > 0 && pair.ValidationPolicy != validationSkipBadFiles {
+		names := make([]string, 0, len(quarantine))
+		for name := range quarantine {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return false, fmt.Errorf("refusing the ruleset of %s: invalid files %s", sourceDir, strings.Join(names, ", "))
 	}
 
-	hashesTarget, err := getFileHashes(targetDir)
+	return syncFiles(pair, sourceDir, sourceFiles, quarantine)
+}
+
+// syncFiles computes the change set between sourceFiles, keyed by the names they are written under, and the target
+// directory of the pair, logs it, and applies it to the target directory. sourceDir names where the files were read
+// from in the logs. The quarantined files are left as they are on the node. It returns true when the target directory
+// was modified.
+func syncFiles(pair DirectoryPair, sourceDir string, sourceFiles map[string]SourceFile, quarantine map[string][]ValidationError) (bool, error) {
+
+	targetDir := pair.TargetDirectory
+
+	// The source hashes keyed by the names the files are written under in the target directory
+	hashesDesired := make(map[string][32]byte)
+	for fileName, sourceFile := range sourceFiles {
+		hashesDesired[fileName] = sourceFile.Hash
+	}
+
+	hashesTarget, err := getFileHashes(targetDir, targetDir)
 	if err != nil {
 		log.Warn(fmt.Sprintf("Error getting file hashes for %s: %v", targetDir, err))
 		return false, err
 	}
 
-	// Iterating through the fileHashes map
-	for fileName, hashValue := range hashesTarget {
-		log.Debug(fmt.Sprintf("Target Dir File: %s, Hash: %x", fileName, hashValue))
+	// Without a readable manifest, aks-auditd cannot tell its own files apart from foreign ones, so it does not touch
+	// the target directory at all.
+	manifest, manifestExists, err := readManifest(targetDir)
+	if err != nil {
+		return false, err
+	}
+	if !manifestExists {
+		manifest = adoptFiles(pair.FilePrefix, hashesDesired, hashesTarget)
+	}
+
+	changes := diffFileHashes(hashesDesired, hashesTarget, manifest)
+
+	// Attribute every file to the source it is written from
+	for _, fileChanges := range [][]FileChange{changes.Added, changes.Modified, changes.Unchanged, changes.Skipped} {
+		for i := range fileChanges {
+			fileChanges[i].Source = sourceFiles[fileChanges[i].Name].Source
+		}
 	}
 
-	if needSync(hashesSource, hashesTarget) {
-		log.Info("Directories differ. Syncing...")
-		if err := syncDirectories(sourceDir, targetDir); err != nil {
-			log.Error(fmt.Sprintf("Error syncing directories: %v", err))
-			return false, err
+	// Files aks-auditd wrote that someone else changed since the last sync. A pair without a policy remediates.
+	if drifts := detectDrift(targetDir, hashesDesired, hashesTarget, manifest); len(drifts) > 0 {
+		if pair.DriftPolicy == "" {
+			pair.DriftPolicy = driftRemediate
+		}
+		reportDrift(pair, drifts)
+		if pair.DriftPolicy == driftReport {
+			changes.keepDrift(drifts)
 		}
-		requiresReload = true
-	} else {
+	}
+
+	// Under the skip-bad-files policy, the quarantined files are left as they are on the node
+	if len(quarantine) > 0 {
+		changes.keepQuarantined(quarantine)
+	}
+
+	changes.log(sourceDir, targetDir)
+
+	if changes.IsEmpty() {
 		log.Debug("Directories are in sync.")
-		requiresReload = false
+		reportLint(pair)
+		reportEffectiveRuleset(pair, effectivePaths(targetDir, hashesTarget, sourceFiles, changes))
+		// A manifest written by an earlier version has no ruleset digest for aks-auditd-monitor yet
+		if !manifestExists || manifest.Digest == "" {
+			return false, writeManifest(targetDir, changes.manifest())
+		}
+		return false, nil
 	}
 
-	return requiresReload, nil
+	// Show the audit.rules the node is about to load before the files are switched in
+	reportEffectiveRuleset(pair, effectivePaths(targetDir, hashesTarget, sourceFiles, changes))
+
+	log.Info("Directories differ. Syncing...")
+	if err := syncDirectories(pair, sourceFiles, changes, manifest); err != nil {
+		log.Error(fmt.Sprintf("Error syncing directories: %v", err))
+		return false, err
+	}
+	reportLint(pair)
+
+	return true, nil
 }
 
-// getFileHashes reads the directory and returns a map of file names to their SHA-256 hashes
-func getFileHashes(dir string) (map[string][32]byte, error) {
-	files, err := os.ReadDir(dir)
+// getFileHashes reads the directory and returns a map of file names to their SHA-256 hashes. A directory in root is
+// read confined to it.
+func getFileHashes(root, dir string) (map[string][32]byte, error) {
+	files, err := hostReadDir(root, dir)
 	if err != nil {
 		return nil, err
 	}
 
 	fileHashes := make(map[string][32]byte)
 	for _, file := range files {
-		if file.Name() == "..data" {
+		if file.Name() == configMapDataLink {
+			continue
+		}
+		// Skip the manifest and staged files aks-auditd keeps in target directories
+		if strings.HasPrefix(file.Name(), stagingPrefix) {
+			continue
+		}
+		// A symlink in a target directory is never followed. It is hashed by its destination, so a symlink planted over
+		// a file aks-auditd owns shows up as drift and is replaced.
+		if file.Type()&os.ModeSymlink != 0 && isBeneath(root, dir) {
+			fullFilePath := filepath.Join(dir, file.Name())
+			destination, err := hostReadlink(root, fullFilePath)
+			if err != nil {
+				log.Warn(fmt.Sprintf("Failed reading symlink %s: %v", fullFilePath, err))
+				continue
+			}
+			log.WithFields(log.Fields{
+				"securityEvent": "symlink",
+				"path":          fullFilePath,
+				"destination":   destination,
+			}).Warn("Found a symlink in a target directory. It is not followed.")
+			fileHashes[file.Name()] = sha256.Sum256([]byte("symlink:" + destination))
 			continue
 		}
 		if !file.IsDir() {
 			fullFilePath := filepath.Join(dir, file.Name())
-			hash, err := getFileHash(fullFilePath)
+			hash, err := getFileHash(root, fullFilePath)
 			if err != nil {
 				log.Warn(fmt.Sprintf("Failed calculating hash for file %s: %v", fullFilePath, err))
 				continue
@@ -186,9 +480,9 @@ func getFileHashes(dir string) (map[string][32]byte, error) {
 	return fileHashes, nil
 }
 
-// getFileHash calculates the SHA-256 hash of a file
-func getFileHash(filePath string) ([32]byte, error) {
-	file, err := os.Open(filePath)
+// getFileHash calculates the SHA-256 hash of a file. A file in root is read confined to it.
+func getFileHash(root, filePath string) ([32]byte, error) {
+	file, err := hostOpen(root, filePath)
 	if err != nil {
 		return [32]byte{}, err
 	}
@@ -199,93 +493,182 @@ func getFileHash(filePath string) ([32]byte, error) {
 		return [32]byte{}, err
 	}
 
-	return sha256.Sum256(hasher.Sum(nil)), nil
+	var hash [32]byte
+	copy(hash[:], hasher.Sum(nil))
+	return hash, nil
 }
 
-// needSync determines if the directories need to be synchronized
-func needSync(hashesDir1, hashesDir2 map[string][32]byte) bool {
-	for file, hash1 := range hashesDir1 {
-		fileName := filepath.Base(file)
-		if hash2, exists := hashesDir2[fileName]; exists {
-			if hash1 != hash2 {
-				return true
-			}
-		} else {
-			return true
+// diffFileHashes compares the source and target file hashes and returns the operations required to make the target
+// match the source. Only files listed in the manifest are modified or removed. Any other target file is reported as
+// foreign, and a source file whose name is taken by a foreign file is skipped.
+func diffFileHashes(hashesSource, hashesTarget map[string][32]byte, manifest Manifest) ChangeSet {
+	var changes ChangeSet
+
+	for file, sourceHash := range hashesSource {
+		targetHash, exists := hashesTarget[file]
+		switch {
+		case !exists:
+			changes.Added = append(changes.Added, FileChange{Name: file, NewDigest: digest(sourceHash)})
+		case !manifest.owns(file):
+			changes.Skipped = append(changes.Skipped, FileChange{Name: file, OldDigest: digest(targetHash), NewDigest: digest(sourceHash)})
+		case sourceHash != targetHash:
+			changes.Modified = append(changes.Modified, FileChange{Name: file, OldDigest: digest(targetHash), NewDigest: digest(sourceHash)})
+		default:
+			changes.Unchanged = append(changes.Unchanged, FileChange{Name: file, OldDigest: digest(targetHash), NewDigest: digest(sourceHash)})
 		}
 	}
 
-	for file := range hashesDir2 {
-		if _, exists := hashesDir1[file]; !exists {
-			return true
+	for file, targetHash := range hashesTarget {
+		if _, exists := hashesSource[file]; exists {
+			continue
+		}
+		if manifest.owns(file) {
+			changes.Removed = append(changes.Removed, FileChange{Name: file, OldDigest: digest(targetHash)})
+		} else {
+			changes.Foreign = append(changes.Foreign, FileChange{Name: file, OldDigest: digest(targetHash)})
 		}
 	}
 
-	return false
+	changes.sort()
+	return changes
 }
 
-// // syncDirectories removes all files from dir2 and copies all files from dir1 to dir2
-func syncDirectories(sourceDir, destDir string) error {
-
-	// Remove all files from destDir
-	destFiles, err := os.ReadDir(destDir)
-	if err != nil {
-		return err
+// syncDirectories applies the change set to destDir. Every added or modified file is first staged in destDir as a
+// hidden temporary file and flushed to disk. Only when all of them have been staged are the temporary files renamed
+// over their final names and the removed files deleted. If any file fails to stage, the staged files are discarded
+// and destDir is left exactly as it was. Unchanged and foreign files are not touched.
+//
+// The manifest is written twice. Before the switch it lists both the old and the new files, so an interrupted sync
+// never leaves a file aks-auditd wrote without an owner. After the switch it lists exactly the new set. The switch is
+// recorded in a journal first, and a switch that is interrupted partway through is completed from the journal by the
+// next sync, including the first one after a restart.
+func syncDirectories(pair DirectoryPair, sourceFiles map[string]SourceFile, changes ChangeSet, manifest Manifest) error {
+
+	destDir := pair.TargetDirectory
+
+	// Stage the added and modified files in destDir. The map key is the final file name and the value is the staged file path.
+	staged := make(map[string]string)
+	discard := func() {
+		for _, stagedPath := range staged {
+			if err := hostRemove(destDir, stagedPath); err != nil {
+				log.Warn(fmt.Sprintf("Failed to remove staged file: %s Error: %v", stagedPath, err))
+			}
+		}
 	}
 
-	// Iterate through files and delete each one
-	for _, file := range destFiles {
-		filePath := filepath.Join(destDir, file.Name())
-		err := os.Remove(filePath)
+	for _, change := range append(changes.Added, changes.Modified...) {
+		srcPath := sourceFiles[change.Name].Path
+		stagedPath, err := stageFile(destDir, srcPath, destDir, change.Name, pair.FileMode)
 		if err != nil {
-			log.Warn(fmt.Sprintf("Failed to delete file: %s Error: %v", filePath, err))
-			continue
+			discard()
+			return fmt.Errorf("failed to stage file %s in %s: %w", srcPath, destDir, err)
 		}
-		log.Debug(fmt.Sprintf("Deleted file: %s", filePath))
+		staged[change.Name] = stagedPath
+
+		log.Debug(fmt.Sprintf("Staged file %s as %s", srcPath, stagedPath))
 	}
 
-	// Copy all files from srcDir to destDir
-	files, err := os.ReadDir(sourceDir)
-	if err != nil {
-		return err
+	// Record ownership of the staged files before they are switched in. This also flushes the staged directory entries.
+	intent := Manifest{Files: make(map[string]string)}
+	for fileName, fileDigest := range manifest.Files {
+		intent.Files[fileName] = fileDigest
+	}
+	for _, change := range append(changes.Added, changes.Modified...) {
+		intent.Files[change.Name] = change.NewDigest
+	}
+	if err := writeManifest(destDir, intent); err != nil {
+		discard()
+		return fmt.Errorf("failed to write manifest in %s: %w", destDir, err)
 	}
 
-	for _, file := range files {
-		if file.Name() == "..data" {
-			continue
-		}
+	// Record the switch before it starts, so a crash or failed rename partway through is completed by the next sync
+	journal := Journal{Staged: staged, Manifest: changes.manifest()}
+	for _, change := range changes.Removed {
+		journal.Removed = append(journal.Removed, change.Name)
+	}
+	if err := writeJSON(destDir, destDir, journalFileName, journal); err != nil {
+		discard()
+		return fmt.Errorf("failed to write the journal in %s: %w", destDir, err)
+	}
+
+	// Switch in the new set. Each rename atomically replaces the old file, so readers see either the old or the new
+	// content, but the set as a whole is only complete once every rename is done. aks-auditd-monitor does not load
+	// anything from destDir until the journal is removed.
+	if err := applyJournal(destDir, journal); err != nil {
+		return err
+	}
 
-		if file.IsDir() {
+	// Remove staged files left behind by a sync that failed before it wrote its journal
+	entries, err := hostReadDir(destDir, destDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), stagingPrefix) || !strings.HasSuffix(entry.Name(), stagingSuffix) {
 			continue
 		}
-
-		srcPath := filepath.Join(sourceDir, file.Name())
-		destPath := filepath.Join(destDir, file.Name())
-
-		if err := copyFile(srcPath, destPath); err != nil {
-			log.Warn(fmt.Sprintf("Failed to copy file: %s to %s, error: %v", srcPath, destPath, err))
+		leftover := filepath.Join(destDir, entry.Name())
+		if err := hostRemove(destDir, leftover); err != nil && !os.IsNotExist(err) {
+			log.Warn(fmt.Sprintf("Failed to remove staged file: %s Error: %v", leftover, err))
 		}
-
-		log.Debug(fmt.Sprintf("Copied file %s to %s", srcPath, destPath))
 	}
 
 	return nil
 }
 
-// copyFile copies a file from src to dst
-func copyFile(sourcePath, targetPath string) error {
-	srcFile, err := os.Open(sourcePath)
+// stageFile copies sourcePath into a hidden temporary file in dir in root with the given permissions and flushes it to
+// disk. It returns the path of the staged file.
+func stageFile(root, sourcePath, dir, fileName string, mode os.FileMode) (string, error) {
+	srcFile, err := hostOpen(root, sourcePath)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer srcFile.Close()
 
-	targetFile, err := os.Create(targetPath)
+	return stageContent(root, srcFile, dir, fileName, mode)
+}
+
+// stageContent writes content into a hidden temporary file in dir in root with the given permissions and flushes it to
+// disk. The temporary file name does not end in .rules or .conf, so neither augenrules, auditd, nor aks-auditd-monitor
+// act on it. It returns the path of the staged file.
+func stageContent(root string, content io.Reader, dir, fileName string, mode os.FileMode) (string, error) {
+	stagedFile, err := hostCreateTemp(root, dir, stagingPrefix+fileName+".*"+stagingSuffix)
+	if err != nil {
+		return "", err
+	}
+	stagedPath := stagedFile.Name()
+
+	// Remove the staged file if anything below fails
+	fail := func(err error) (string, error) {
+		stagedFile.Close()
+		hostRemove(root, stagedPath)
+		return "", err
+	}
+
+	if _, err := io.Copy(stagedFile, content); err != nil {
+		return fail(err)
+	}
+	if err := stagedFile.Chmod(mode); err != nil {
+		return fail(err)
+	}
+	if err := stagedFile.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := stagedFile.Close(); err != nil {
+		hostRemove(root, stagedPath)
+		return "", err
+	}
+
+	return stagedPath, nil
+}
+
+// syncDir flushes the directory entries of dir in root to disk so renames and removals survive a node crash.
+func syncDir(root, dir string) error {
+	d, err := hostOpen(root, dir)
 	if err != nil {
 		return err
 	}
-	defer targetFile.Close()
+	defer d.Close()
 
-	_, err = io.Copy(targetFile, srcFile)
-	return err
+	return d.Sync()
 }
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testPair returns a pair from a new source directory to a new target directory.
+func testPair(t *testing.T) DirectoryPair {
+	t.Helper()
+	return DirectoryPair{
+		SourceDirectory:  t.TempDir(),
+		TargetDirectory:  t.TempDir(),
+		FileMode:         0640,
+		DriftPolicy:      driftRemediate,
+		ValidationPolicy: validationAllOrNothing,
+	}
+}
+
+// writeFiles writes the files, keyed by name, to dir.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readFiles returns the content of the files in dir keyed by name, without the manifest and the history.
+func readFiles(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, entry := range entries {
+		if entry.IsDir() || entry.Name() == manifestFileName {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[entry.Name()] = string(data)
+	}
+	return files
+}
+
+func TestSyncFromSource(t *testing.T) {
+	pair := testPair(t)
+	writeFiles(t, pair.SourceDirectory, map[string]string{
+		"10-base.rules": "-D\n-b 8192\n",
+		"20-exec.rules": "-a always,exit -F arch=b64 -S execve -k exec\n",
+	})
+	writeFiles(t, pair.TargetDirectory, map[string]string{"99-node.rules": "-w /etc/hosts -p wa\n"})
+
+	if _, err := syncFromSource(pair); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(filepath.Join(pair.SourceDirectory, "20-exec.rules"))
+	writeFiles(t, pair.SourceDirectory, map[string]string{"10-base.rules": "-D\n-b 16384\n"})
+	if _, err := syncFromSource(pair); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file aks-auditd did not write is left alone
+	want := map[string]string{"10-base.rules": "-D\n-b 16384\n", "99-node.rules": "-w /etc/hosts -p wa\n"}
+	got := readFiles(t, pair.TargetDirectory)
+	for name := range got {
+		if name != "10-base.rules" && name != "99-node.rules" {
+			delete(got, name)
+		}
+	}
+	if len(got) != len(want) || got["10-base.rules"] != want["10-base.rules"] || got["99-node.rules"] != want["99-node.rules"] {
+		t.Errorf("target directory holds %v, want %v", got, want)
+	}
+}
+
+// names returns the names of the file changes.
+func names(changes []FileChange) []string {
+	names := []string{}
+	for _, change := range changes {
+		names = append(names, change.Name)
+	}
+	return names
+}
+
+func TestDiffFileHashes(t *testing.T) {
+	hash := func(content string) [32]byte { return sha256.Sum256([]byte(content)) }
+	source := map[string][32]byte{
+		"10-added.rules":     hash("added"),
+		"20-modified.rules":  hash("new"),
+		"30-unchanged.rules": hash("same"),
+		"40-skipped.rules":   hash("ours"),
+	}
+	target := map[string][32]byte{
+		"20-modified.rules":  hash("old"),
+		"30-unchanged.rules": hash("same"),
+		"40-skipped.rules":   hash("theirs"),
+		"50-removed.rules":   hash("removed"),
+		"60-foreign.rules":   hash("foreign"),
+	}
+	manifest := Manifest{Files: map[string]string{
+		"20-modified.rules":  digest(hash("old")),
+		"30-unchanged.rules": digest(hash("same")),
+		"50-removed.rules":   digest(hash("removed")),
+	}}
+
+	changes := diffFileHashes(source, target, manifest)
+	for _, category := range []struct {
+		name    string
+		changes []FileChange
+		want    []string
+	}{
+		{"added", changes.Added, []string{"10-added.rules"}},
+		{"modified", changes.Modified, []string{"20-modified.rules"}},
+		{"unchanged", changes.Unchanged, []string{"30-unchanged.rules"}},
+		{"skipped", changes.Skipped, []string{"40-skipped.rules"}},
+		{"removed", changes.Removed, []string{"50-removed.rules"}},
+		{"foreign", changes.Foreign, []string{"60-foreign.rules"}},
+	} {
+		if got := names(category.changes); !reflect.DeepEqual(got, category.want) {
+			t.Errorf("%s files are %v, want %v", category.name, got, category.want)
+		}
+	}
+
+	// Every change records the digest on each side it exists on
+	if change := changes.Added[0]; change.OldDigest != "" || change.NewDigest != digest(hash("added")) {
+		t.Errorf("added file has digests %s, want -> %s", change, shortDigest(digest(hash("added"))))
+	}
+	if change := changes.Modified[0]; change.OldDigest != digest(hash("old")) || change.NewDigest != digest(hash("new")) {
+		t.Errorf("modified file has digests %s", change)
+	}
+	if change := changes.Removed[0]; change.OldDigest != digest(hash("removed")) || change.NewDigest != "" {
+		t.Errorf("removed file has digests %s", change)
+	}
+	if changes.IsEmpty() {
+		t.Error("a change set with added, modified, and removed files is empty")
+	}
+
+	// Once applied, aks-auditd owns the added, modified, and unchanged files, but not the skipped and foreign ones
+	want := map[string]string{
+		"10-added.rules":     digest(hash("added")),
+		"20-modified.rules":  digest(hash("new")),
+		"30-unchanged.rules": digest(hash("same")),
+	}
+	if got := changes.manifest().Files; !reflect.DeepEqual(got, want) {
+		t.Errorf("manifest after the change set is %v, want %v", got, want)
+	}
+
+	// A target that matches the source has nothing to change
+	changes = diffFileHashes(map[string][32]byte{"30-unchanged.rules": hash("same")}, map[string][32]byte{"30-unchanged.rules": hash("same")}, manifest)
+	if !changes.IsEmpty() || len(changes.Unchanged) != 1 {
+		t.Errorf("change set of a directory in sync is %+v", changes)
+	}
+}
+
+// waitForFile returns true if the file exists with the content within timeout.
+func waitForFile(path, content string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if data, err := os.ReadFile(path); err == nil && string(data) == content {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestSyncLoopSignals(t *testing.T) {
+	pair := testPair(t)
+	pair.HistorySize = 0
+	writeFiles(t, pair.SourceDirectory, map[string]string{"10-base.rules": "-w /etc/passwd -p wa -k identity\n"})
+	applyConfig(Config{LogLevel: "info", PollInterval: time.Hour, Directories: []DirectoryPair{pair}})
+	t.Cleanup(func() { applyConfig(Config{LogLevel: "info"}) })
+
+	ctx, stop, resync := notifySignals()
+	defer stop()
+	done := make(chan struct{})
+	go func() {
+		syncLoop(ctx, resync, nil)
+		close(done)
+	}()
+
+	// The first cycle starts right away
+	target := filepath.Join(pair.TargetDirectory, "10-base.rules")
+	if !waitForFile(target, "-w /etc/passwd -p wa -k identity\n", 5*time.Second) {
+		t.Fatal("the first sync cycle did not write the rules file")
+	}
+
+	// SIGHUP starts a new cycle long before the poll interval
+	writeFiles(t, pair.SourceDirectory, map[string]string{"10-base.rules": "-w /etc/shadow -p wa -k identity\n"})
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	if !waitForFile(target, "-w /etc/shadow -p wa -k identity\n", 5*time.Second) {
+		t.Fatal("SIGHUP did not start a new sync cycle")
+	}
+
+	// SIGTERM stops the loop
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("SIGTERM did not stop the sync loop")
+	}
+	if ctx.Err() == nil {
+		t.Error("SIGTERM did not cancel the context")
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Name of the manifest file aks-auditd keeps in every target directory. The leading dot and .json extension keep
+// augenrules, auditd, and aks-auditd-monitor from reading it.
+const manifestFileName = stagingPrefix + "manifest.json"
+
+// Permissions of the manifest file. Only aks-auditd and members of the audit-admins group need to read it.
+const manifestFileMode = 0640
+
+// Manifest records the files aks-auditd wrote to a target directory. Only files listed in the manifest are ever
+// overwritten or removed by aks-auditd. Every other file in the target directory belongs to someone else, such as
+// Defender for Cloud or a vendor EDR agent, and is left alone.
+type Manifest struct {
+	Files   map[string]string `json:"files"`             // Target file name to the hex SHA-256 digest aks-auditd wrote
+	Sources map[string]string `json:"sources,omitempty"` // Target file name to the name of the source it was written from
+	Digest  string            `json:"digest,omitempty"`  // Ruleset digest of Files, read by aks-auditd-monitor
+}
+
+// owns returns true if aks-auditd wrote the file.
+func (m Manifest) owns(fileName string) bool {
+	_, exists := m.Files[fileName]
+	return exists
+}
+
+// readManifest reads the manifest of targetDir. The second return value is false when targetDir has no manifest yet.
+func readManifest(targetDir string) (Manifest, bool, error) {
+	manifest := Manifest{Files: make(map[string]string)}
+
+	data, err := hostReadFile(targetDir, filepath.Join(targetDir, manifestFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return manifest, false, nil
+	}
+	if err != nil {
+		return manifest, false, err
+	}
+
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, false, fmt.Errorf("invalid manifest %s: %w", filepath.Join(targetDir, manifestFileName), err)
+	}
+	if manifest.Files == nil {
+		manifest.Files = make(map[string]string)
+	}
+
+	return manifest, true, nil
+}
+
+// writeManifest atomically replaces the manifest of targetDir. The ruleset digest of the files is recorded with them,
+// so aks-auditd-monitor names the ruleset the way the history does without computing the digest itself.
+func writeManifest(targetDir string, manifest Manifest) error {
+	manifest.Digest = rulesetDigest(manifest.Files)
+	return writeJSON(targetDir, targetDir, manifestFileName, manifest)
+}
+
+// adoptFiles builds the first manifest for a target directory written by a version of aks-auditd that did not keep
+// one. Those versions owned the whole directory, so every file with the name of a source file was written by
+// aks-auditd and is adopted. hashesSource is keyed by the names the files are written under, with prefix. A copy
+// written under the name without prefix, before filePrefix was set, is adopted as well, so the sync removes it rather
+// than leaving augenrules to load its rules twice. All other files are treated as foreign.
+func adoptFiles(prefix string, hashesSource, hashesTarget map[string][32]byte) Manifest {
+	manifest := Manifest{Files: make(map[string]string)}
+	for fileName := range hashesSource {
+		for _, name := range []string{fileName, strings.TrimPrefix(fileName, prefix)} {
+			if targetHash, exists := hashesTarget[name]; exists && !manifest.owns(name) {
+				manifest.Files[name] = digest(targetHash)
+				log.Infof("Adopting %s written by a previous version of aks-auditd.", name)
+			}
+		}
+	}
+	return manifest
+}
+
+// targetFileName returns the name a source file is written under in the target directory.
+func targetFileName(prefix, sourceFileName string) string {
+	return prefix + sourceFileName
+}
+
+// Name of the journal of a switch in progress. It is written once every new file is staged and removed once the
+// switch is complete, so a switch that was interrupted by a crash or a failed rename is completed by the next sync.
+const journalFileName = stagingPrefix + "journal.json"
+
+// Journal records a switch of staged files into a target directory.
+type Journal struct {
+	Staged   map[string]string `json:"staged"`            // Target file name to the path of its staged file
+	Removed  []string          `json:"removed,omitempty"` // Target file names to remove
+	Manifest Manifest          `json:"manifest"`          // Manifest of the target directory once the switch is complete
+}
+
+// applyJournal switches the staged files of the journal into targetDir, removes the removed files, and writes the
+// manifest. A staged file that no longer exists was already switched in, and a removed file that no longer exists was
+// already removed, so applying a journal a second time completes the switch. The journal is removed at the end.
+func applyJournal(targetDir string, journal Journal) error {
+	names := make([]string, 0, len(journal.Staged))
+	for fileName := range journal.Staged {
+		names = append(names, fileName)
+	}
+	sort.Strings(names)
+
+	for _, fileName := range names {
+		stagedPath := journal.Staged[fileName]
+		destPath := filepath.Join(targetDir, fileName)
+		if err := hostRename(targetDir, stagedPath, destPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to move staged file %s to %s: %w", stagedPath, destPath, err)
+		}
+		log.Debugf("Switched in %s", destPath)
+	}
+
+	for _, fileName := range journal.Removed {
+		filePath := filepath.Join(targetDir, fileName)
+		if err := hostRemove(targetDir, filePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to delete file %s: %w", filePath, err)
+		}
+		log.Debugf("Deleted file: %s", filePath)
+	}
+
+	if err := writeManifest(targetDir, journal.Manifest); err != nil {
+		return fmt.Errorf("failed to write manifest in %s: %w", targetDir, err)
+	}
+	if err := hostRemove(targetDir, filepath.Join(targetDir, journalFileName)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return syncDir(targetDir, targetDir)
+}
+
+// replayJournal completes a switch into targetDir that an earlier sync did not finish. Until it is complete,
+// targetDir holds a mix of old and new files.
+func replayJournal(targetDir string) error {
+	data, err := hostReadFile(targetDir, filepath.Join(targetDir, journalFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var journal Journal
+	if err := json.Unmarshal(data, &journal); err != nil {
+		return fmt.Errorf("invalid journal %s: %w", filepath.Join(targetDir, journalFileName), err)
+	}
+	log.Warnf("Completing the switch of %d files into %s that an earlier sync did not finish.", len(journal.Staged), targetDir)
+	return applyJournal(targetDir, journal)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReplayJournal(t *testing.T) {
+	pair := testPair(t)
+	dir := pair.TargetDirectory
+	writeFiles(t, dir, map[string]string{
+		"10-base.rules": "-b 8192\n",
+		"20-old.rules":  "-w /etc/passwd -p wa\n",
+		"30-exec.rules": "-a always,exit -F arch=b64 -S execve\n",
+	})
+
+	// A switch of two modified files and a removal that was interrupted after the first rename
+	staged := make(map[string]string)
+	for name, content := range map[string]string{"10-base.rules": "-b 16384\n", "30-exec.rules": "-a always,exit -F arch=b64 -S execveat\n"} {
+		path, err := stageContent(dir, strings.NewReader(content), dir, name, 0640)
+		if err != nil {
+			t.Fatal(err)
+		}
+		staged[name] = path
+	}
+	journal := Journal{
+		Staged:   staged,
+		Removed:  []string{"20-old.rules"},
+		Manifest: Manifest{Files: map[string]string{"10-base.rules": "a", "30-exec.rules": "b"}},
+	}
+	if err := writeJSON(dir, dir, journalFileName, journal); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(staged["10-base.rules"], filepath.Join(dir, "10-base.rules")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := replayJournal(dir); err != nil {
+		t.Fatal(err)
+	}
+	got := readFiles(t, dir)
+	want := map[string]string{"10-base.rules": "-b 16384\n", "30-exec.rules": "-a always,exit -F arch=b64 -S execveat\n"}
+	if len(got) != len(want) || got["10-base.rules"] != want["10-base.rules"] || got["30-exec.rules"] != want["30-exec.rules"] {
+		t.Errorf("target directory holds %v, want %v", got, want)
+	}
+	manifest, exists, err := readManifest(dir)
+	if err != nil || !exists || len(manifest.Files) != 2 {
+		t.Errorf("manifest is %v, %v, %v, want the manifest of the journal", manifest, exists, err)
+	}
+
+	// Once complete, there is nothing to replay
+	if err := replayJournal(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAdoptFiles(t *testing.T) {
+	pair := testPair(t)
+	pair.FilePrefix = "aks-auditd-"
+	writeFiles(t, pair.SourceDirectory, map[string]string{
+		"10-base.rules": "-D\n-b 8192\n",
+		"20-exec.rules": "-a always,exit -F arch=b64 -S execve -k exec\n",
+	})
+
+	// A version without a manifest wrote 10-base.rules without prefix, and 20-exec.rules with it. 99-node.rules belongs
+	// to someone else.
+	writeFiles(t, pair.TargetDirectory, map[string]string{
+		"10-base.rules":            "-D\n-b 4096\n",
+		"aks-auditd-20-exec.rules": "-a always,exit -F arch=b64 -S execve -k exec\n",
+		"99-node.rules":            "-w /etc/hosts -p wa\n",
+	})
+
+	if _, err := syncFromSource(pair); err != nil {
+		t.Fatal(err)
+	}
+
+	// The copy without prefix is adopted and removed, so augenrules does not load its rules twice
+	want := map[string]string{
+		"aks-auditd-10-base.rules": "-D\n-b 8192\n",
+		"aks-auditd-20-exec.rules": "-a always,exit -F arch=b64 -S execve -k exec\n",
+		"99-node.rules":            "-w /etc/hosts -p wa\n",
+	}
+	got := readFiles(t, pair.TargetDirectory)
+	for name := range got {
+		if strings.HasPrefix(name, stagingPrefix) {
+			delete(got, name)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("target directory holds %v, want %v", got, want)
+	}
+	manifest, _, err := readManifest(pair.TargetDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.owns("10-base.rules") || manifest.owns("99-node.rules") || !manifest.owns("aks-auditd-10-base.rules") {
+		t.Errorf("manifest owns %v", manifest.Files)
+	}
+
+	// Without a prefix, only files with the name of a source file are adopted
+	hash := func(content string) [32]byte { return sha256.Sum256([]byte(content)) }
+	manifest = adoptFiles("", map[string][32]byte{"10-base.rules": hash("new")}, map[string][32]byte{
+		"10-base.rules": hash("old"),
+		"99-node.rules": hash("node"),
+	})
+	if !reflect.DeepEqual(manifest.Files, map[string]string{"10-base.rules": digest(hash("old"))}) {
+		t.Errorf("adoptFiles without prefix adopted %v", manifest.Files)
+	}
+}
+
+func TestManifestDigest(t *testing.T) {
+	pair := testPair(t)
+	writeFiles(t, pair.SourceDirectory, map[string]string{"10-base.rules": "-D\n"})
+	if _, err := syncFromSource(pair); err != nil {
+		t.Fatal(err)
+	}
+	manifest, _, err := readManifest(pair.TargetDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Digest != rulesetDigest(manifest.Files) {
+		t.Fatalf("manifest digest = %q, want the ruleset digest %s", manifest.Digest, rulesetDigest(manifest.Files))
+	}
+
+	// A manifest written by an earlier version gets the digest on the next sync, even when nothing changed
+	manifest.Digest = ""
+	if err := writeJSON(pair.TargetDirectory, pair.TargetDirectory, manifestFileName, manifest); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := syncFromSource(pair); err != nil {
+		t.Fatal(err)
+	}
+	if manifest, _, _ = readManifest(pair.TargetDirectory); manifest.Digest != rulesetDigest(manifest.Files) {
+		t.Errorf("manifest digest after the sync = %q, want the ruleset digest", manifest.Digest)
+	}
+}
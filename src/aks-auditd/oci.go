@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Name of the directory in a target directory that caches the rules bundles pulled from OCI registries. The leading
+// dot keeps augenrules and aks-auditd-monitor from reading it.
+const ociCacheDirectoryName = stagingPrefix + "oci"
+
+// Name of the file in the cache directory of a reference that points at the last good bundle.
+const ociCurrentFileName = "current.json"
+
+// Default interval at which a tag is checked for a new bundle. Digest references are only pulled once.
+const defaultOCIPollInterval = 5 * time.Minute
+
+// Size limits that keep a broken or hostile registry from filling the node disk or the aks-auditd memory
+const (
+	maxOCIManifestSize = 4 << 20
+	maxOCIBlobSize     = 16 << 20
+)
+
+// Media types of the manifests aks-auditd accepts
+var ociManifestMediaTypes = []string{
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// Media types of layers that hold a tar archive of rules files. Any other layer must carry a file name in the
+// org.opencontainers.image.title annotation and is written as a single file, which is how oras push stores files.
+var ociTarMediaTypes = map[string]bool{
+	"application/vnd.oci.image.layer.v1.tar":            true,
+	"application/vnd.oci.image.layer.v1.tar+gzip":       true,
+	"application/vnd.docker.image.rootfs.diff.tar.gzip": true,
+}
+
+// Splits an OCI reference into registry, repository, tag, and digest
+var ociReferencePattern = regexp.MustCompile(`^([a-zA-Z0-9.-]+(?::[0-9]+)?)/([a-z0-9]+(?:[._/-][a-z0-9]+)*)(?::([A-Za-z0-9_][A-Za-z0-9_.-]{0,127}))?(?:@(sha256:[a-f0-9]{64}))?$`)
+
+// OCISource pulls a rules bundle from an OCI registry artifact instead of reading a ConfigMap mount. The bundle is
+// cached in the target directory on the node, so the last good bundle is still synced while the registry is down.
+type OCISource struct {
+	Reference    string        `mapstructure:"reference"`    // registry/repository:tag or registry/repository@sha256:digest
+	Mirror       string        `mapstructure:"mirror"`       // Registry host, such as localhost:5000, to pull from instead of the registry in Reference
+	Insecure     bool          `mapstructure:"insecure"`     // Pull over plain HTTP. Only meant for a local registry.
+	PollInterval time.Duration `mapstructure:"pollInterval"` // Interval at which a tag is checked for a new bundle
+	Username     string        `mapstructure:"username"`     // Username for registries that require authentication
+	PasswordFile string        `mapstructure:"passwordFile"` // File with the password or token, such as a mounted Secret
+}
+
+// ociReference is a parsed OCI reference.
+type ociReference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// ociBundle is the content of the current file in the cache directory of a reference.
+type ociBundle struct {
+	Reference string    `json:"reference"`
+	Digest    string    `json:"digest"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// ociManifest holds the parts of an OCI image manifest aks-auditd uses.
+type ociManifest struct {
+	MediaType string `json:"mediaType"`
+	Layers    []struct {
+		MediaType   string            `json:"mediaType"`
+		Digest      string            `json:"digest"`
+		Size        int64             `json:"size"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"layers"`
+}
+
+// lastOCIPull holds the time every cache directory was last checked against its registry.
+var lastOCIPull = make(map[string]time.Time)
+
+// parseOCIReference splits reference into its parts. A reference without a tag or digest refers to the latest tag.
+func parseOCIReference(reference string) (ociReference, error) {
+	match := ociReferencePattern.FindStringSubmatch(reference)
+	if match == nil || !strings.ContainsAny(match[1], ".:") && match[1] != "localhost" {
+		return ociReference{}, fmt.Errorf("invalid OCI reference %q: must be registry/repository:tag or registry/repository@sha256:digest", reference)
+	}
+
+	ref := ociReference{Registry: match[1], Repository: match[2], Tag: match[3], Digest: match[4]}
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = "latest"
+	}
+	return ref, nil
+}
+
+// ociCacheDir returns the directory in targetDir that caches the bundles of reference.
+func ociCacheDir(targetDir, reference string) string {
+	return filepath.Join(targetDir, ociCacheDirectoryName, digest(sha256.Sum256([]byte(reference)))[:16])
+}
+
+// cachedOCIBundle returns the directory of the last good bundle of the source, or an empty string when no bundle has
+// been pulled yet.
+func cachedOCIBundle(targetDir string, source OCISource) string {
+	var bundle ociBundle
+	if err := readJSON(targetDir, filepath.Join(ociCacheDir(targetDir, source.Reference), ociCurrentFileName), &bundle); err != nil {
+		return ""
+	}
+	return filepath.Join(ociCacheDir(targetDir, source.Reference), strings.Replace(bundle.Digest, ":", "-", 1))
+}
+
+// pullOCISources checks the OCI sources of the pair whose poll interval has passed for a new bundle. A failed pull is
+// logged, the last good bundle stays in place, and the pull is tried again once the poll interval has passed.
+func pullOCISources(pair DirectoryPair) {
+	for _, source := range pair.Sources {
+		if source.OCI == nil {
+			continue
+		}
+
+		cacheDir := ociCacheDir(pair.TargetDirectory, source.OCI.Reference)
+		interval := source.OCI.PollInterval
+		if interval == 0 {
+			interval = defaultOCIPollInterval
+		}
+		if time.Since(lastOCIPull[cacheDir]) < interval {
+			continue
+		}
+
+		// A failed pull is retried after the poll interval as well, so an unreachable or failing registry is not
+		// requested again on every sync cycle
+		lastOCIPull[cacheDir] = time.Now()
+		if err := pullOCIBundle(pair.TargetDirectory, *source.OCI); err != nil {
+			if cachedOCIBundle(pair.TargetDirectory, *source.OCI) != "" {
+				log.Errorf("Failed to pull %s. Keeping the last good bundle. Error: %v", source.OCI.Reference, err)
+			} else {
+				log.Errorf("Failed to pull %s. No bundle has been pulled yet. Error: %v", source.OCI.Reference, err)
+			}
+		}
+	}
+}
+
+// pullOCIBundle pulls the bundle of the source into the OCI cache of targetDir unless the cached bundle already has the
+// digest the registry reports. The new bundle is written to a hidden directory and renamed into place before the current file is
+// switched to it, so a failed pull never replaces the last good bundle.
+func pullOCIBundle(targetDir string, source OCISource) error {
+	ref, err := parseOCIReference(source.Reference)
+	if err != nil {
+		return err
+	}
+	client := &ociClient{ref: ref, source: source, http: &http.Client{Timeout: 60 * time.Second}, root: targetDir}
+	cacheDir := ociCacheDir(targetDir, source.Reference)
+
+	var current ociBundle
+	if err := readJSON(targetDir, filepath.Join(cacheDir, ociCurrentFileName), &current); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Warnf("Ignoring unreadable OCI cache %s: %v", cacheDir, err)
+	}
+
+	// A digest reference never changes, and a tag only needs a pull when it moved to a new digest
+	manifestDigest := ref.Digest
+	if manifestDigest == "" {
+		manifestDigest, err = client.resolveTag()
+		if err != nil {
+			return err
+		}
+	}
+	if manifestDigest == current.Digest {
+		log.Debugf("Bundle %s is up to date at %s", source.Reference, manifestDigest)
+		return nil
+	}
+
+	if err := hostMkdirAll(targetDir, cacheDir, 0750); err != nil {
+		return err
+	}
+	tmpDir, err := hostMkdirTemp(targetDir, cacheDir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer hostRemoveAll(targetDir, tmpDir)
+
+	manifest, err := client.fetchManifest(manifestDigest)
+	if err != nil {
+		return err
+	}
+	for _, layer := range manifest.Layers {
+		if err := client.extractLayer(layer.MediaType, layer.Digest, layer.Annotations["org.opencontainers.image.title"], tmpDir); err != nil {
+			return fmt.Errorf("layer %s: %w", layer.Digest, err)
+		}
+	}
+
+	bundleDir := filepath.Join(cacheDir, strings.Replace(manifestDigest, ":", "-", 1))
+	if err := hostRemoveAll(targetDir, bundleDir); err != nil {
+		return err
+	}
+	if err := hostRename(targetDir, tmpDir, bundleDir); err != nil {
+		return err
+	}
+	bundle := ociBundle{Reference: source.Reference, Digest: manifestDigest, Timestamp: time.Now().UTC()}
+	if err := writeJSON(targetDir, cacheDir, ociCurrentFileName, bundle); err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"reference":      source.Reference,
+		"digest":         manifestDigest,
+		"previousDigest": current.Digest,
+	}).Info("Pulled rules bundle")
+
+	// Only the current bundle is kept. The ruleset history keeps earlier rulesets.
+	entries, err := hostReadDir(targetDir, cacheDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && entry.Name() != filepath.Base(bundleDir) && !strings.HasPrefix(entry.Name(), ".") {
+			hostRemoveAll(targetDir, filepath.Join(cacheDir, entry.Name()))
+		}
+	}
+
+	return nil
+}
+
+// ociClient makes the few OCI distribution API calls needed to pull a bundle. Like the Kubernetes API client, it
+// avoids a full registry client library.
+type ociClient struct {
+	ref    ociReference
+	source OCISource
+	http   *http.Client
+	token  string
+	root   string // Target directory the bundle is cached in
+}
+
+// url returns the URL of an API path on the registry, or on the mirror when one is configured.
+func (c *ociClient) url(apiPath string) string {
+	scheme := "https"
+	if c.source.Insecure {
+		scheme = "http"
+	}
+	return scheme + "://" + valueOrDefault(c.source.Mirror, c.ref.Registry) + "/v2/" + c.ref.Repository + apiPath
+}
+
+// do sends a request to the registry. When the registry asks for a bearer token, a token for pulling the repository is
+// requested and the request is sent again.
+func (c *ociClient) do(method, apiPath string, accept []string) (*http.Response, error) {
+	send := func() (*http.Response, error) {
+		request, err := http.NewRequest(method, c.url(apiPath), nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, mediaType := range accept {
+			request.Header.Add("Accept", mediaType)
+		}
+		if c.token != "" {
+			request.Header.Set("Authorization", "Bearer "+c.token)
+		} else if c.source.Username != "" {
+			password, err := c.password()
+			if err != nil {
+				return nil, err
+			}
+			request.SetBasicAuth(c.source.Username, password)
+		}
+		return c.http.Do(request)
+	}
+
+	response, err := send()
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode == http.StatusUnauthorized && c.token == "" {
+		challenge := response.Header.Get("WWW-Authenticate")
+		response.Body.Close()
+		if err := c.authenticate(challenge); err != nil {
+			return nil, err
+		}
+		if response, err = send(); err != nil {
+			return nil, err
+		}
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s", method, c.url(apiPath), response.Status)
+	}
+
+	return response, nil
+}
+
+// authenticate gets a bearer token from the token service named in the WWW-Authenticate challenge of the registry.
+func (c *ociClient) authenticate(challenge string) error {
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return fmt.Errorf("unsupported registry authentication challenge %q", challenge)
+	}
+
+	params := make(map[string]string)
+	for _, match := range regexp.MustCompile(`(\w+)="([^"]*)"`).FindAllStringSubmatch(challenge, -1) {
+		params[match[1]] = match[2]
+	}
+	if params["realm"] == "" {
+		return fmt.Errorf("registry authentication challenge %q has no realm", challenge)
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil {
+		return fmt.Errorf("registry authentication challenge %q has an invalid realm: %w", challenge, err)
+	}
+	if c.source.Username != "" && realm.Scheme != "https" {
+		return fmt.Errorf("not sending the registry credentials to %s over plain HTTP", params["realm"])
+	}
+
+	query := url.Values{}
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	query.Set("scope", valueOrDefault(params["scope"], "repository:"+c.ref.Repository+":pull"))
+	request, err := http.NewRequest(http.MethodGet, params["realm"]+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if c.source.Username != "" {
+		password, err := c.password()
+		if err != nil {
+			return err
+		}
+		request.SetBasicAuth(c.source.Username, password)
+	}
+
+	response, err := c.http.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("registry token request: %s", response.Status)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(response.Body, maxOCIManifestSize)).Decode(&token); err != nil {
+		return err
+	}
+	c.token = valueOrDefault(token.Token, token.AccessToken)
+	if c.token == "" {
+		return errors.New("registry token response has no token")
+	}
+
+	return nil
+}
+
+// password reads the registry password from the password file of the source.
+func (c *ociClient) password() (string, error) {
+	if c.source.PasswordFile == "" {
+		return "", nil
+	}
+	password, err := os.ReadFile(c.source.PasswordFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(password)), nil
+}
+
+// resolveTag returns the digest of the manifest the tag currently points at.
+func (c *ociClient) resolveTag() (string, error) {
+	response, err := c.do(http.MethodHead, "/manifests/"+c.ref.Tag, ociManifestMediaTypes)
+	if err != nil {
+		return "", err
+	}
+	response.Body.Close()
+
+	manifestDigest := response.Header.Get("Docker-Content-Digest")
+	if !strings.HasPrefix(manifestDigest, "sha256:") {
+		return "", fmt.Errorf("registry did not return the digest of %s:%s", c.ref.Repository, c.ref.Tag)
+	}
+	return manifestDigest, nil
+}
+
+// fetchManifest downloads the manifest with the given digest and verifies its content against the digest.
+func (c *ociClient) fetchManifest(manifestDigest string) (ociManifest, error) {
+	var manifest ociManifest
+
+	response, err := c.do(http.MethodGet, "/manifests/"+manifestDigest, ociManifestMediaTypes)
+	if err != nil {
+		return manifest, err
+	}
+	defer response.Body.Close()
+
+	data, err := readVerified(response.Body, manifestDigest, maxOCIManifestSize)
+	if err != nil {
+		return manifest, fmt.Errorf("manifest %s: %w", manifestDigest, err)
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, fmt.Errorf("invalid manifest %s: %w", manifestDigest, err)
+	}
+	if len(manifest.Layers) == 0 {
+		return manifest, fmt.Errorf("manifest %s has no layers", manifestDigest)
+	}
+
+	return manifest, nil
+}
+
+// extractLayer downloads the layer with the given digest, verifies it, and writes its files to dir in the target
+// directory of the client. Tar layers are unpacked. Any other layer is written as a single file named title.
+func (c *ociClient) extractLayer(mediaType, layerDigest, title, dir string) error {
+	response, err := c.do(http.MethodGet, "/blobs/"+layerDigest, nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	data, err := readVerified(response.Body, layerDigest, maxOCIBlobSize)
+	if err != nil {
+		return err
+	}
+
+	if !ociTarMediaTypes[mediaType] {
+		name, err := archiveEntryName(title)
+		if err != nil {
+			return err
+		}
+		file, err := hostOpenFile(c.root, filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+		if err != nil {
+			return err
+		}
+		_, err = file.Write(data)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}
+
+	var content io.Reader = bytes.NewReader(data)
+	if strings.HasSuffix(mediaType, "gzip") {
+		gzipReader, err := gzip.NewReader(content)
+		if err != nil {
+			return err
+		}
+		defer gzipReader.Close()
+		content = gzipReader
+	}
+
+	return extractTar(content, c.root, dir)
+}
+
+// readVerified reads at most limit bytes from r and checks that their SHA-256 digest matches expected, given as
+// sha256:<hex>.
+func readVerified(r io.Reader, expected string, limit int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("larger than %d bytes", limit)
+	}
+	if actual := "sha256:" + digest(sha256.Sum256(data)); actual != expected {
+		return nil, fmt.Errorf("digest mismatch: expected %s, got %s", expected, actual)
+	}
+	return data, nil
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blobDigest returns the digest of data as sha256:<hex>.
+func blobDigest(data []byte) string {
+	return "sha256:" + digest(sha256.Sum256(data))
+}
+
+// gzipData returns data compressed with gzip.
+func gzipData(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// ociLayer is a layer of a test bundle.
+type ociLayer struct {
+	mediaType string
+	title     string
+	data      []byte
+}
+
+// fakeRegistry serves the manifests and blobs of the audit/rules repository. Tags maps a tag to a manifest digest.
+// Blobs in failing return an internal server error.
+type fakeRegistry struct {
+	mu        sync.Mutex
+	manifests map[string][]byte
+	blobs     map[string][]byte
+	tags      map[string]string
+	failing   map[string]bool
+	requests  int
+}
+
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{manifests: make(map[string][]byte), blobs: make(map[string][]byte), tags: make(map[string]string), failing: make(map[string]bool)}
+}
+
+// push stores a manifest of the layers, tags it, and returns its digest.
+func (r *fakeRegistry) push(t *testing.T, tag string, layers ...ociLayer) string {
+	t.Helper()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var manifest ociManifest
+	manifest.MediaType = ociManifestMediaTypes[0]
+	for _, layer := range layers {
+		layerDigest := blobDigest(layer.data)
+		r.blobs[layerDigest] = layer.data
+		manifest.Layers = append(manifest.Layers, struct {
+			MediaType   string            `json:"mediaType"`
+			Digest      string            `json:"digest"`
+			Size        int64             `json:"size"`
+			Annotations map[string]string `json:"annotations"`
+		}{layer.mediaType, layerDigest, int64(len(layer.data)), map[string]string{"org.opencontainers.image.title": layer.title}})
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestDigest := blobDigest(data)
+	r.manifests[manifestDigest] = data
+	r.tags[tag] = manifestDigest
+	return manifestDigest
+}
+
+func (r *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests++
+
+	switch name := req.URL.Path; {
+	case strings.HasPrefix(name, "/v2/audit/rules/manifests/"):
+		reference := strings.TrimPrefix(name, "/v2/audit/rules/manifests/")
+		manifestDigest := valueOrDefault(r.tags[reference], reference)
+		data, exists := r.manifests[manifestDigest]
+		if !exists {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", ociManifestMediaTypes[0])
+		w.Header().Set("Docker-Content-Digest", manifestDigest)
+		w.Write(data)
+	case strings.HasPrefix(name, "/v2/audit/rules/blobs/"):
+		blobDigest := strings.TrimPrefix(name, "/v2/audit/rules/blobs/")
+		data, exists := r.blobs[blobDigest]
+		if !exists || r.failing[blobDigest] {
+			http.Error(w, "unavailable", http.StatusInternalServerError)
+			return
+		}
+		w.Write(data)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// mirrorSource returns an OCI source that pulls the reference from the registry served by server over plain HTTP.
+func mirrorSource(server *httptest.Server, tag string) OCISource {
+	return OCISource{Reference: "myregistry.azurecr.io/audit/rules:" + tag, Mirror: server.Listener.Addr().String(), Insecure: true}
+}
+
+func TestParseOCIReference(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+
+	for _, test := range []struct {
+		reference string
+		want      ociReference
+		wantErr   bool
+	}{
+		{reference: "myregistry.azurecr.io/audit/rules:v1", want: ociReference{Registry: "myregistry.azurecr.io", Repository: "audit/rules", Tag: "v1"}},
+		{reference: "myregistry.azurecr.io/audit/rules", want: ociReference{Registry: "myregistry.azurecr.io", Repository: "audit/rules", Tag: "latest"}},
+		{reference: "myregistry.azurecr.io/audit/rules@" + digest, want: ociReference{Registry: "myregistry.azurecr.io", Repository: "audit/rules", Digest: digest}},
+		{reference: "myregistry.azurecr.io/audit/rules:v1@" + digest, want: ociReference{Registry: "myregistry.azurecr.io", Repository: "audit/rules", Tag: "v1", Digest: digest}},
+		{reference: "localhost/audit-rules:v1", want: ociReference{Registry: "localhost", Repository: "audit-rules", Tag: "v1"}},
+		{reference: "localhost:5000/audit-rules", want: ociReference{Registry: "localhost:5000", Repository: "audit-rules", Tag: "latest"}},
+		{reference: "registry:5000/audit/rules:v1", want: ociReference{Registry: "registry:5000", Repository: "audit/rules", Tag: "v1"}},
+		// Without a dot or port, the first component is a Docker Hub namespace, not a registry
+		{reference: "audit/rules:v1", wantErr: true},
+		{reference: "rules", wantErr: true},
+		{reference: "myregistry.azurecr.io/Audit/rules:v1", wantErr: true},
+		{reference: "myregistry.azurecr.io/audit/rules@sha256:abc", wantErr: true},
+		{reference: "myregistry.azurecr.io/audit/rules:" + strings.Repeat("v", 129), wantErr: true},
+	} {
+		t.Run(test.reference, func(t *testing.T) {
+			got, err := parseOCIReference(test.reference)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseOCIReference(%q) error = %v, want error %v", test.reference, err, test.wantErr)
+			}
+			if !test.wantErr && got != test.want {
+				t.Errorf("parseOCIReference(%q) = %+v, want %+v", test.reference, got, test.want)
+			}
+		})
+	}
+}
+
+func TestOCIClientAuthenticate(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(passwordFile, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name          string
+		challenge     string // %s is replaced by the URL of the test server
+		tokenResponse string
+		wantErr       string
+	}{
+		{name: "token", challenge: `Bearer realm="%s/token",service="registry"`, tokenResponse: `{"token":"t0ken"}`},
+		{name: "access_token", challenge: `Bearer realm="%s/token",service="registry"`, tokenResponse: `{"access_token":"t0ken"}`},
+		{name: "no token", challenge: `Bearer realm="%s/token"`, tokenResponse: `{}`, wantErr: "has no token"},
+		{name: "missing realm", challenge: `Bearer service="registry"`, wantErr: "has no realm"},
+		{name: "basic challenge", challenge: `Basic realm="registry"`, wantErr: "unsupported"},
+		{name: "plain HTTP realm", challenge: `Bearer realm="http://auth.example.com/token"`, wantErr: "over plain HTTP"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var tokenQuery string
+			var server *httptest.Server
+			server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.URL.Path == "/token" {
+					if user, password, ok := req.BasicAuth(); !ok || user != "puller" || password != "s3cret" {
+						http.Error(w, "bad credentials", http.StatusUnauthorized)
+						return
+					}
+					tokenQuery = req.URL.RawQuery
+					w.Write([]byte(test.tokenResponse))
+					return
+				}
+				if req.Header.Get("Authorization") != "Bearer t0ken" {
+					w.Header().Set("WWW-Authenticate", strings.ReplaceAll(test.challenge, "%s", server.URL))
+					http.Error(w, "unauthorized", http.StatusUnauthorized)
+					return
+				}
+				w.Header().Set("Docker-Content-Digest", "sha256:"+strings.Repeat("b", 64))
+			}))
+			defer server.Close()
+
+			reference := server.Listener.Addr().String() + "/audit/rules:v1"
+			ref, err := parseOCIReference(reference)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := &ociClient{
+				ref:    ref,
+				source: OCISource{Reference: reference, Username: "puller", PasswordFile: passwordFile},
+				http:   server.Client(),
+				root:   t.TempDir(),
+			}
+
+			got, err := client.resolveTag()
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("resolveTag() error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != "sha256:"+strings.Repeat("b", 64) {
+				t.Errorf("resolveTag() = %s", got)
+			}
+			if tokenQuery != "scope=repository%3Aaudit%2Frules%3Apull&service=registry" {
+				t.Errorf("token requested with %q, want the pull scope of the repository", tokenQuery)
+			}
+		})
+	}
+}
+
+func TestOCIClientResolveTagWithoutDigest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+
+	source := mirrorSource(server, "v1")
+	ref, err := parseOCIReference(source.Reference)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &ociClient{ref: ref, source: source, http: server.Client(), root: t.TempDir()}
+	if _, err := client.resolveTag(); err == nil || !strings.Contains(err.Error(), "did not return the digest") {
+		t.Errorf("resolveTag() error = %v, want a missing digest error", err)
+	}
+}
+
+func TestReadVerified(t *testing.T) {
+	data := []byte("-w /etc/passwd -p wa -k identity\n")
+
+	if got, err := readVerified(bytes.NewReader(data), blobDigest(data), int64(len(data))); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("readVerified() = %q, %v, want the data", got, err)
+	}
+	if _, err := readVerified(bytes.NewReader(data), blobDigest([]byte("other")), 1024); err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+		t.Errorf("readVerified() error = %v, want a digest mismatch", err)
+	}
+	if _, err := readVerified(bytes.NewReader(data), blobDigest(data), int64(len(data))-1); err == nil || !strings.Contains(err.Error(), "larger than") {
+		t.Errorf("readVerified() error = %v, want a size limit error", err)
+	}
+}
+
+func TestOCIClientExtractLayer(t *testing.T) {
+	archive := buildTar(t, file("10-base.rules", "-D\n"), file("20-exec.rules", "-a always,exit -F arch=b64 -S execve -k exec\n"))
+
+	for _, test := range []struct {
+		name    string
+		layer   ociLayer
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name:  "tar+gzip",
+			layer: ociLayer{mediaType: "application/vnd.oci.image.layer.v1.tar+gzip", data: gzipData(t, archive)},
+			want:  map[string]string{"10-base.rules": "-D\n", "20-exec.rules": "-a always,exit -F arch=b64 -S execve -k exec\n"},
+		},
+		{
+			name:  "tar",
+			layer: ociLayer{mediaType: "application/vnd.oci.image.layer.v1.tar", data: archive},
+			want:  map[string]string{"10-base.rules": "-D\n", "20-exec.rules": "-a always,exit -F arch=b64 -S execve -k exec\n"},
+		},
+		{
+			name:  "oras title",
+			layer: ociLayer{mediaType: "application/vnd.oras.file", title: "30-net.rules", data: []byte("-w /etc/hosts -p wa -k net\n")},
+			want:  map[string]string{"30-net.rules": "-w /etc/hosts -p wa -k net\n"},
+		},
+		{
+			name:    "title escaping the bundle",
+			layer:   ociLayer{mediaType: "application/vnd.oras.file", title: "../../etc/audit/rules.d/99-evil.rules", data: []byte("-e 0\n")},
+			wantErr: "must be a plain file name",
+		},
+		{
+			name:    "hidden title",
+			layer:   ociLayer{mediaType: "application/vnd.oras.file", title: manifestFileName, data: []byte("{}")},
+			wantErr: "must be a plain file name",
+		},
+		{
+			name:    "missing title",
+			layer:   ociLayer{mediaType: "application/vnd.oras.file", data: []byte("-D\n")},
+			wantErr: "must be a plain file name",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			registry := newFakeRegistry()
+			registry.push(t, "v1", test.layer)
+			server := httptest.NewServer(registry)
+			defer server.Close()
+
+			source := mirrorSource(server, "v1")
+			ref, err := parseOCIReference(source.Reference)
+			if err != nil {
+				t.Fatal(err)
+			}
+			root := t.TempDir()
+			dir := filepath.Join(root, "bundle")
+			if err := os.Mkdir(dir, 0750); err != nil {
+				t.Fatal(err)
+			}
+			client := &ociClient{ref: ref, source: source, http: server.Client(), root: root}
+
+			err = client.extractLayer(test.layer.mediaType, blobDigest(test.layer.data), test.layer.title, dir)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("extractLayer() error = %v, want %q", err, test.wantErr)
+				}
+				if entries, _ := os.ReadDir(root); len(entries) != 1 {
+					t.Errorf("extractLayer() wrote outside the bundle directory: %v", entries)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := readFiles(t, dir); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("extractLayer() wrote %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPullOCIBundle(t *testing.T) {
+	registry := newFakeRegistry()
+	server := httptest.NewServer(registry)
+	defer server.Close()
+
+	targetDir := t.TempDir()
+	source := mirrorSource(server, "v1")
+	base := ociLayer{mediaType: "application/vnd.oras.file", title: "10-base.rules", data: []byte("-D\n")}
+	firstDigest := registry.push(t, "v1", base)
+
+	if err := pullOCIBundle(targetDir, source); err != nil {
+		t.Fatal(err)
+	}
+	bundleDir := cachedOCIBundle(targetDir, source)
+	if filepath.Base(bundleDir) != strings.Replace(firstDigest, ":", "-", 1) {
+		t.Fatalf("cached bundle = %s, want the bundle of %s", bundleDir, firstDigest)
+	}
+	if got := readFiles(t, bundleDir); !reflect.DeepEqual(got, map[string]string{"10-base.rules": "-D\n"}) {
+		t.Fatalf("cached bundle holds %v", got)
+	}
+
+	// The tag moves to a bundle with a layer that fails to download. The previous bundle stays current and in place.
+	broken := ociLayer{mediaType: "application/vnd.oras.file", title: "20-exec.rules", data: []byte("-a always,exit -S execve -k exec\n")}
+	registry.push(t, "v1", base, broken)
+	registry.failing[blobDigest(broken.data)] = true
+
+	if err := pullOCIBundle(targetDir, source); err == nil || !strings.Contains(err.Error(), "layer "+blobDigest(broken.data)) {
+		t.Fatalf("pullOCIBundle() error = %v, want the failed layer", err)
+	}
+	if got := cachedOCIBundle(targetDir, source); got != bundleDir {
+		t.Errorf("cached bundle after the failed pull = %s, want %s", got, bundleDir)
+	}
+	if got := readFiles(t, bundleDir); !reflect.DeepEqual(got, map[string]string{"10-base.rules": "-D\n"}) {
+		t.Errorf("previous bundle holds %v after the failed pull", got)
+	}
+	entries, err := os.ReadDir(filepath.Dir(bundleDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.Name() != ociCurrentFileName && entry.Name() != filepath.Base(bundleDir) {
+			t.Errorf("the failed pull left %s in the cache", entry.Name())
+		}
+	}
+}
+
+func TestPullOCISourcesThrottlesFailures(t *testing.T) {
+	registry := newFakeRegistry()
+	server := httptest.NewServer(registry)
+	defer server.Close()
+
+	source := mirrorSource(server, "missing")
+	source.PollInterval = time.Hour
+	pair := DirectoryPair{TargetDirectory: t.TempDir(), Sources: []Source{{OCI: &source, Priority: 100}}}
+	t.Cleanup(func() { delete(lastOCIPull, ociCacheDir(pair.TargetDirectory, source.Reference)) })
+
+	// The tag does not exist, so every pull fails. A failed pull is not tried again before the poll interval passed.
+	pullOCISources(pair)
+	pullOCISources(pair)
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if registry.requests != 1 {
+		t.Errorf("the registry received %d requests, want 1", registry.requests)
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"embed"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"aksauditd/auditrules"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// packFiles holds the built-in rule packs. They are versioned with the binary, so a new image is the only way a pack
+// changes on a node.
+//
+//go:embed packs/*.rules
+var packFiles embed.FS
+
+// Comment lines of a pack file that hold its metadata and start a rule
+const (
+	packNameHeader    = "## Pack:"
+	packTitleHeader   = "## Title:"
+	packVersionHeader = "## Version:"
+	packRuleHeader    = "## Rule:"
+)
+
+// Prefix of the name of the rules file a pack is rendered into. augenrules loads it after rules files with a lower
+// number, such as the 10-audit.rules that sets -D and the buffers.
+const packFilePrefix = "50-pack-"
+
+// RulePack is a curated set of audit rules built into aks-auditd, such as the rules of a compliance benchmark.
+type RulePack struct {
+	Name    string
+	Title   string
+	Version string
+	Rules   []PackRule
+}
+
+// PackRule is a rule of a pack. It is one or more lines of audit rules that together implement a control of the
+// benchmark the pack follows, and can only be excluded as a whole.
+type PackRule struct {
+	ID    string // Control the rule implements, such as 4.1.3.1, unique in the pack
+	Title string
+	Lines []string // Watches, rules, and comments
+}
+
+// PackSelection enables a built-in rule pack for a pair.
+type PackSelection struct {
+	Name    string   `mapstructure:"name"`
+	Exclude []string `mapstructure:"exclude"` // IDs of the rules of the pack to leave out
+}
+
+// rulePacks returns the built-in rule packs keyed by name. The packs are parsed once.
+var rulePacks = sync.OnceValues(func() (map[string]RulePack, error) {
+	entries, err := packFiles.ReadDir("packs")
+	if err != nil {
+		return nil, err
+	}
+
+	packs := make(map[string]RulePack)
+	for _, entry := range entries {
+		data, err := packFiles.ReadFile(path.Join("packs", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		pack, err := parsePack(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("built-in rule pack %s: %w", entry.Name(), err)
+		}
+		if pack.Name+".rules" != entry.Name() {
+			return nil, fmt.Errorf("built-in rule pack %s: named %q", entry.Name(), pack.Name)
+		}
+		packs[pack.Name] = pack
+	}
+	return packs, nil
+})
+
+// packNames returns the names of the built-in rule packs in alphabetical order.
+func packNames() []string {
+	packs, _ := rulePacks()
+	names := make([]string, 0, len(packs))
+	for name := range packs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parsePack parses a pack file. The metadata comes first in ## Pack:, ## Title:, and ## Version: comments. Every rule
+// starts with a ## Rule: comment that holds its ID and title. Other comments before the first rule describe the pack
+// and are dropped.
+func parsePack(text string) (RulePack, error) {
+	var pack RulePack
+	ids := make(map[string]bool)
+
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, packNameHeader):
+			pack.Name = strings.TrimSpace(strings.TrimPrefix(line, packNameHeader))
+		case strings.HasPrefix(line, packTitleHeader):
+			pack.Title = strings.TrimSpace(strings.TrimPrefix(line, packTitleHeader))
+		case strings.HasPrefix(line, packVersionHeader):
+			pack.Version = strings.TrimSpace(strings.TrimPrefix(line, packVersionHeader))
+		case strings.HasPrefix(line, packRuleHeader):
+			id, title, _ := strings.Cut(strings.TrimSpace(strings.TrimPrefix(line, packRuleHeader)), " ")
+			if id == "" || ids[id] {
+				return pack, fmt.Errorf("line %d: missing or duplicate rule ID %q", lineNumber, id)
+			}
+			ids[id] = true
+			pack.Rules = append(pack.Rules, PackRule{ID: id, Title: strings.TrimSpace(title)})
+		case len(pack.Rules) > 0:
+			rule := &pack.Rules[len(pack.Rules)-1]
+			rule.Lines = append(rule.Lines, line)
+		case !strings.HasPrefix(line, "#"):
+			return pack, fmt.Errorf("line %d: rule outside of a ## Rule: section", lineNumber)
+		}
+	}
+
+	if pack.Name == "" || pack.Version == "" {
+		return pack, fmt.Errorf("missing %s or %s", packNameHeader, packVersionHeader)
+	}
+	return pack, nil
+}
+
+// validatePacks checks the packs enabled for the pair at index i of the directories. Every pack and every excluded
+// rule must exist, so a typo does not silently load a rule that was meant to be left out.
+func (p DirectoryPair) validatePacks(i int) []error {
+	packs, err := rulePacks()
+	if err != nil {
+		return []error{err}
+	}
+
+	var errs []error
+	enabled := make(map[string]int)
+	for j, selection := range p.Packs {
+		pack, exists := packs[selection.Name]
+		if !exists {
+			errs = append(errs, fmt.Errorf("directories[%d].packs[%d].name: unknown rule pack %q. Valid values are %s", i, j, selection.Name, strings.Join(packNames(), ", ")))
+			continue
+		}
+		if k, exists := enabled[selection.Name]; exists {
+			errs = append(errs, fmt.Errorf("directories[%d].packs[%d].name: %s is already enabled by packs[%d]", i, j, selection.Name, k))
+		}
+		enabled[selection.Name] = j
+
+		for _, id := range selection.Exclude {
+			if !pack.hasRule(id) {
+				errs = append(errs, fmt.Errorf("directories[%d].packs[%d].exclude: %s has no rule %q", i, j, selection.Name, id))
+			}
+		}
+	}
+	return errs
+}
+
+// hasRule returns true if the pack has a rule with the ID.
+func (p RulePack) hasRule(id string) bool {
+	for _, rule := range p.Rules {
+		if rule.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// sourceName returns the name the files rendered from the pack are attributed to in logs, the manifest, and the
+// history.
+func (p RulePack) sourceName() string {
+	return "pack:" + p.Name + "@" + p.Version
+}
+
+// renderPacks renders the packs enabled for the pair into the rendered cache of the target directory and adds them to
+// merged, keyed by the name they are written under. Packs come after every source, so a source file with the same name
+// replaces a pack. A watch or rule that a merged rules file or an earlier pack already has is left out, as auditctl
+// refuses to load the same rule twice. The cache key of every rendered file is added to rendered.
+//
+// The syscall rules of a pack are always expanded for the arch of the node, as the packs use the syscall names of x86_64.
+func renderPacks(pair DirectoryPair, merged map[string]SourceFile, rendered map[string]bool) error {
+	if len(pair.Packs) == 0 {
+		return nil
+	}
+	packs, err := rulePacks()
+	if err != nil {
+		return err
+	}
+
+	// Watches and rules already loaded, in the form the pack lines are compared in, mapped to the first file that has
+	// them in name order, so the rendered packs do not change between syncs
+	names := make([]string, 0, len(merged))
+	for name := range merged {
+		if strings.HasSuffix(name, ".rules") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	loaded := make(map[string]string)
+	for _, name := range names {
+		data, err := hostReadFile(pair.TargetDirectory, merged[name].Path)
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if normalized := normalizeRuleLine(line); normalized != "" && loaded[normalized] == "" {
+				loaded[normalized] = name
+			}
+		}
+	}
+
+	for _, selection := range pair.Packs {
+		pack := packs[selection.Name]
+		fileName := packFilePrefix + pack.Name + ".rules"
+		name := targetFileName(pair.FilePrefix, fileName)
+		if winner, exists := merged[name]; exists {
+			log.Debugf("%s from %s overrides the rule pack %s", name, winner.Source, pack.Name)
+			continue
+		}
+
+		content := pack.render(name, selection.Exclude, loaded)
+		packPath, hash, err := cacheRendered(pair.TargetDirectory, fileName, []byte(content))
+		if err != nil {
+			return fmt.Errorf("failed to render the rule pack %s: %w", pack.Name, err)
+		}
+		rendered[renderedKey(fileName, hash)] = true
+
+		expandedPath, expandedHash, expanded, err := expandArch(pair.TargetDirectory, fileName, packPath)
+		if err != nil {
+			return fmt.Errorf("failed to expand the syscall rules of the rule pack %s: %w", pack.Name, err)
+		}
+		if expanded {
+			rendered[renderedKey(fileName, expandedHash)] = true
+			packPath, hash = expandedPath, expandedHash
+		}
+		merged[name] = SourceFile{Path: packPath, Hash: hash, Source: pack.sourceName()}
+	}
+	return nil
+}
+
+// render returns the rules file of the pack, written as name, without the excluded rules. A watch or rule in loaded,
+// which maps it to the file that has it, is left out and replaced by a comment. The watches and rules of the pack are
+// added to loaded.
+func (p RulePack) render(name string, exclude []string, loaded map[string]string) string {
+	excluded := make(map[string]bool)
+	for _, id := range exclude {
+		excluded[id] = true
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "## Rule pack %s version %s, rendered by aks-auditd. Changes to this file are overwritten.\n", p.Name, p.Version)
+	fmt.Fprintf(&b, "## %s\n", p.Title)
+	if len(exclude) > 0 {
+		fmt.Fprintf(&b, "## Excluded rules: %s\n", strings.Join(exclude, ", "))
+	}
+
+	for _, rule := range p.Rules {
+		if excluded[rule.ID] {
+			continue
+		}
+		fmt.Fprintf(&b, "\n%s %s %s\n", packRuleHeader, rule.ID, rule.Title)
+		for _, line := range rule.Lines {
+			normalized := normalizeRuleLine(line)
+			if loadedBy, exists := loaded[normalized]; exists && normalized != "" {
+				fmt.Fprintf(&b, "# Already loaded by %s: %s\n", loadedBy, line)
+				continue
+			}
+			if normalized != "" {
+				loaded[normalized] = name
+			}
+			fmt.Fprintln(&b, line)
+		}
+	}
+	return b.String()
+}
+
+// normalizeRuleLine returns the watch or rule a line of a rules file adds in the canonical form of the auditrules
+// parser, so the same watch or rule written with its options in another order compares equal. It returns an empty
+// string for a comment, control option, blank line, -W, -d, or a line that does not parse, which validation reports.
+func normalizeRuleLine(line string) string {
+	parsed, err := auditrules.ParseLine(line)
+	switch {
+	case err != nil:
+		return ""
+	case parsed.Watch != nil && !parsed.Watch.Remove:
+		return parsed.Watch.Canonical()
+	case parsed.Rule != nil && parsed.Rule.Op != "-d":
+		return parsed.Rule.Canonical()
+	}
+	return ""
+}
+
+// packsCommand prints the built-in rule packs with their versions, or the IDs and titles of the rules of the pack
+// named in args, which are the values packs[].exclude takes.
+func packsCommand(args []string) error {
+	packs, err := rulePacks()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if len(args) == 0 {
+		fmt.Fprintln(w, "NAME\tVERSION\tRULES\tTITLE")
+		for _, name := range packNames() {
+			pack := packs[name]
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", pack.Name, pack.Version, len(pack.Rules), pack.Title)
+		}
+		return w.Flush()
+	}
+
+	pack, exists := packs[args[0]]
+	if !exists {
+		return fmt.Errorf("unknown rule pack %q. Valid values are %s", args[0], strings.Join(packNames(), ", "))
+	}
+	fmt.Fprintf(w, "%s version %s: %s\n\n", pack.Name, pack.Version, pack.Title)
+	fmt.Fprintln(w, "ID\tLINES\tTITLE")
+	for _, rule := range pack.Rules {
+		lines := 0
+		for _, line := range rule.Lines {
+			if normalizeRuleLine(line) != "" {
+				lines++
+			}
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\n", rule.ID, lines, rule.Title)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"aksauditd/auditrules"
+)
+
+func TestParsePack(t *testing.T) {
+	pack, err := parsePack(`## Pack: test
+## Title: Test pack
+## Version: 1.2.3
+##
+## A description that is dropped.
+
+## Rule: 1.1 Audit the identity files
+-w /etc/passwd -p wa -k identity
+# A comment of the rule
+-w /etc/group -p wa -k identity
+
+## Rule: 1.2
+-a always,exit -S execve -k exec
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := RulePack{
+		Name:    "test",
+		Title:   "Test pack",
+		Version: "1.2.3",
+		Rules: []PackRule{
+			{ID: "1.1", Title: "Audit the identity files", Lines: []string{
+				"-w /etc/passwd -p wa -k identity",
+				"# A comment of the rule",
+				"-w /etc/group -p wa -k identity",
+			}},
+			{ID: "1.2", Lines: []string{"-a always,exit -S execve -k exec"}},
+		},
+	}
+	if !reflect.DeepEqual(pack, want) {
+		t.Errorf("parsePack returned %+v, want %+v", pack, want)
+	}
+	if pack.sourceName() != "pack:test@1.2.3" {
+		t.Errorf("sourceName returned %q", pack.sourceName())
+	}
+	if !pack.hasRule("1.2") || pack.hasRule("1.3") {
+		t.Error("hasRule does not match the IDs of the rules")
+	}
+}
+
+func TestParsePackErrors(t *testing.T) {
+	header := "## Pack: test\n## Version: 1.0.0\n"
+	tests := map[string]struct {
+		text string
+		want string
+	}{
+		"duplicate ID": {
+			text: header + "## Rule: 1.1 First\n-w /etc/passwd\n## Rule: 1.1 Second\n-w /etc/group\n",
+			want: `line 5: missing or duplicate rule ID "1.1"`,
+		},
+		"missing ID": {
+			text: header + "## Rule:\n-w /etc/passwd\n",
+			want: `line 3: missing or duplicate rule ID ""`,
+		},
+		"rule outside of a section": {
+			text: header + "-w /etc/passwd\n",
+			want: "line 3: rule outside of a ## Rule: section",
+		},
+		"missing name": {
+			text: "## Version: 1.0.0\n## Rule: 1.1\n-w /etc/passwd\n",
+			want: "missing ## Pack: or ## Version:",
+		},
+		"missing version": {
+			text: "## Pack: test\n## Rule: 1.1\n-w /etc/passwd\n",
+			want: "missing ## Pack: or ## Version:",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := parsePack(test.text)
+			if err == nil || err.Error() != test.want {
+				t.Errorf("parsePack returned %v, want %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestBuiltinPacks(t *testing.T) {
+	packs, err := rulePacks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"cis-level1", "cis-level2", "k8s-node", "pci-dss", "stig"} {
+		pack, exists := packs[name]
+		if !exists {
+			t.Errorf("the built-in pack %s is missing", name)
+			continue
+		}
+		if pack.Title == "" || len(pack.Rules) == 0 {
+			t.Errorf("the pack %s has no title or no rules", name)
+		}
+
+		// Every line of the pack parses, so none of them is dropped when rules are compared
+		content := pack.render(packFilePrefix+name+".rules", nil, make(map[string]string))
+		if _, err := auditrules.ParseString(name, content); err != nil {
+			t.Errorf("the pack %s does not parse: %v", name, err)
+		}
+	}
+}
+
+func TestNormalizeRuleLine(t *testing.T) {
+	equal := [][]string{
+		{
+			"-w /etc/passwd -p wa -k identity",
+			"  -w /etc/passwd   -k identity -p aw",
+			"-w /etc/passwd/ -p wa -k identity",
+		},
+		{
+			"-w /etc/shadow -k identity",
+			"-w /etc/shadow -p rwxa -k identity",
+			"-w /etc/shadow -k identity -p arwx",
+		},
+		{
+			"-a always,exit -F arch=b64 -S open,openat -F exit=-EACCES -k access",
+			"-a exit,always -F arch=b64 -S open -S openat -F exit=-EACCES -k access",
+			"-a always,exit -k access -F arch=b64 -S open -F exit=-EACCES -S openat",
+		},
+	}
+	for _, lines := range equal {
+		want := normalizeRuleLine(lines[0])
+		if want == "" {
+			t.Errorf("normalizeRuleLine(%q) returned an empty string", lines[0])
+			continue
+		}
+		for _, line := range lines[1:] {
+			if got := normalizeRuleLine(line); got != want {
+				t.Errorf("normalizeRuleLine(%q) = %q, want %q", line, got, want)
+			}
+		}
+	}
+
+	distinct := []string{
+		"-w /etc/passwd -p wa -k identity",
+		"-w /etc/passwd -p w -k identity",
+		"-w /etc/passwd -p wa -k passwd",
+		"-a always,exit -F arch=b64 -S open -k access",
+		"-a always,exit -F arch=b32 -S open -k access",
+		"-A always,exit -F arch=b64 -S open -k access",
+	}
+	seen := make(map[string]string)
+	for _, line := range distinct {
+		normalized := normalizeRuleLine(line)
+		if other, exists := seen[normalized]; exists {
+			t.Errorf("normalizeRuleLine formats %q and %q the same as %q", line, other, normalized)
+		}
+		seen[normalized] = line
+	}
+
+	for _, line := range []string{
+		"",
+		"   ",
+		"# -w /etc/passwd -p wa -k identity",
+		"-D",
+		"-b 8192",
+		"-e 2",
+		"-W /etc/passwd -p wa -k identity",
+		"-d always,exit -F arch=b64 -S open -k access",
+		"-w",
+		"-a always,bogus -S open",
+	} {
+		if got := normalizeRuleLine(line); got != "" {
+			t.Errorf("normalizeRuleLine(%q) = %q, want an empty string", line, got)
+		}
+	}
+}
+
+func TestRenderPack(t *testing.T) {
+	pack := RulePack{
+		Name:    "test",
+		Title:   "Test pack",
+		Version: "1.0.0",
+		Rules: []PackRule{
+			{ID: "1.1", Title: "Identity", Lines: []string{
+				"-w /etc/passwd -p wa -k identity",
+				"-w /etc/group -p wa -k identity",
+			}},
+			{ID: "1.2", Title: "Exec", Lines: []string{"-a always,exit -F arch=b64 -S execve -k exec"}},
+			{ID: "1.3", Title: "Sudoers", Lines: []string{"# Both files", "-w /etc/sudoers -p wa -k scope"}},
+		},
+	}
+
+	// The source has the passwd watch with its options in another order
+	loaded := map[string]string{normalizeRuleLine("-w /etc/passwd -k identity -p aw"): "10-base.rules"}
+	got := pack.render("50-pack-test.rules", []string{"1.2"}, loaded)
+	want := `## Rule pack test version 1.0.0, rendered by aks-auditd. Changes to this file are overwritten.
+## Test pack
+## Excluded rules: 1.2
+
+## Rule: 1.1 Identity
+# Already loaded by 10-base.rules: -w /etc/passwd -p wa -k identity
+-w /etc/group -p wa -k identity
+
+## Rule: 1.3 Sudoers
+# Both files
+-w /etc/sudoers -p wa -k scope
+`
+	if got != want {
+		t.Errorf("render returned\n%s\nwant\n%s", got, want)
+	}
+
+	// The rendered watches are added to loaded, the excluded rule is not
+	if loaded[normalizeRuleLine("-w /etc/group -p wa -k identity")] != "50-pack-test.rules" {
+		t.Errorf("the group watch was not added to loaded: %v", loaded)
+	}
+	if _, exists := loaded[normalizeRuleLine("-a always,exit -F arch=b64 -S execve -k exec")]; exists {
+		t.Error("the excluded rule was added to loaded")
+	}
+	if len(loaded) != 3 {
+		t.Errorf("loaded has %d entries, want 3: %v", len(loaded), loaded)
+	}
+}
+
+func TestSyncFromSourcePacks(t *testing.T) {
+	pair := testPair(t)
+	pair.Packs = []PackSelection{{Name: "k8s-node", Exclude: []string{"cni-config"}}}
+	writeFiles(t, pair.SourceDirectory, map[string]string{
+		"10-base.rules": "-w /etc/kubernetes -k kubernetes_config -p aw\n",
+	})
+	if _, err := syncFromSource(pair); err != nil {
+		t.Fatal(err)
+	}
+
+	got := readFiles(t, pair.TargetDirectory)
+	rendered, exists := got["50-pack-k8s-node.rules"]
+	if !exists {
+		t.Fatalf("the pack was not synced, the target has %v", got)
+	}
+	if !strings.Contains(rendered, "# Already loaded by 10-base.rules: -w /etc/kubernetes/ -p wa -k kubernetes_config\n") {
+		t.Errorf("the watch of the source is not commented out in the pack:\n%s", rendered)
+	}
+	if !strings.Contains(rendered, "\n-w /etc/containerd/ -p wa -k container_runtime\n") {
+		t.Errorf("the pack is missing its own watches:\n%s", rendered)
+	}
+	if strings.Contains(rendered, "/etc/cni/") {
+		t.Errorf("the excluded rule is in the pack:\n%s", rendered)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Name of the file aks-auditd-monitor writes to the rules target directory when -e 2 made the kernel audit
+// configuration immutable and the rules on the node cannot be applied until it reboots.
+const rebootRequiredFileName = stagingPrefix + "reboot-required.json"
+
+// Label and annotation aks-auditd sets on its node while a reboot is required, so the nodes to cordon and reboot can be
+// selected with kubectl get nodes -l aks-auditd/reboot-required=true.
+const (
+	rebootRequiredLabel      = "aks-auditd/reboot-required"
+	rebootRequiredAnnotation = "aks-auditd/reboot-required-ruleset"
+)
+
+// RebootRequired is written by aks-auditd-monitor when it skipped an auditd restart because the audit configuration is
+// immutable. Digest is the ruleset digest of the rules that wait for the reboot. The file is removed once the node
+// rebooted.
+type RebootRequired struct {
+	Timestamp time.Time `json:"timestamp"`
+	Digest    string    `json:"digest"`
+	BootID    string    `json:"bootID"`
+}
+
+// readRebootRequired returns the reboot required state of the target directory. The second return value is false when
+// no reboot is required.
+func readRebootRequired(targetDir string) (RebootRequired, bool, error) {
+	var state RebootRequired
+	err := readJSON(targetDir, filepath.Join(targetDir, rebootRequiredFileName), &state)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, false, nil
+	}
+	return state, err == nil, err
+}
+
+// rebootRulesetName returns the history ID of the ruleset with the given digest, followed by the short digest, or only
+// the short digest when the ruleset is not in the history.
+func rebootRulesetName(targetDir, rulesetDigest string) string {
+	rulesets, err := readHistory(targetDir)
+	if err != nil {
+		log.Debugf("Unable to read the history of %s: %v", targetDir, err)
+	}
+	if i := currentRuleset(rulesets, rulesetDigest); i >= 0 {
+		return fmt.Sprintf("%s (%s)", rulesets[i].ID, shortDigest(rulesetDigest))
+	}
+	return shortDigest(rulesetDigest)
+}
+
+// reportRebootRequired exposes the reboot required state aks-auditd-monitor recorded in a target directory. While a
+// reboot is required, a warning is logged, a RebootRequired event is recorded on the aks-auditd pod, and the node is
+// labeled. The label is removed once the node rebooted.
+func reportRebootRequired(pairs []DirectoryPair) {
+	var state RebootRequired
+	var targetDir string
+	for _, pair := range pairs {
+		pairState, required, err := readRebootRequired(pair.TargetDirectory)
+		if err != nil {
+			log.Warnf("Unable to read the reboot required state of %s: %v", pair.TargetDirectory, err)
+			return
+		}
+		if required {
+			state, targetDir = pairState, pair.TargetDirectory
+			break
+		}
+	}
+
+	key := ""
+	if targetDir != "" {
+		key = targetDir + "@" + state.Digest
+	}
+	// The target directory and digest of the ruleset waiting for a reboot, empty when no reboot is required, is only
+	// logged, recorded as an event, and set on the node when it changes. The first check always sets the node, so a
+	// label left over from before the node rebooted is removed when aks-auditd starts.
+	first := !reports.seen("", kindReboot, "")
+	if !reports.changed("", kindReboot, "", key) {
+		return
+	}
+
+	if targetDir == "" {
+		if !first {
+			log.Info("The node rebooted. The ruleset is applied.")
+		}
+		if err := labelNode(false, ""); err != nil {
+			log.Debugf("Failed to remove the %s label from the node: %v", rebootRequiredLabel, err)
+		}
+		return
+	}
+
+	name := rebootRulesetName(targetDir, state.Digest)
+	message := fmt.Sprintf("The audit configuration of the node is immutable (-e 2). Reboot required to apply ruleset %s in %s.", name, targetDir)
+	log.WithFields(log.Fields{
+		"targetDirectory": targetDir,
+		"digest":          state.Digest,
+		"since":           state.Timestamp,
+	}).Warn(message)
+
+	if err := createPodEvent("Warning", "RebootRequired", message); err != nil {
+		log.Debugf("Failed to record the reboot required event: %v", err)
+	}
+	if err := labelNode(true, state.Digest); err != nil {
+		log.Debugf("Failed to label the node with %s: %v", rebootRequiredLabel, err)
+	}
+}
+
+// labelNode sets the reboot required label on the node aks-auditd runs on, and the annotation to the digest of the
+// ruleset that waits for the reboot, or removes both when required is false. The node name is set through the
+// downward API in NODE_NAME.
+func labelNode(required bool, rulesetDigest string) error {
+	nodeName := os.Getenv("NODE_NAME")
+	if nodeName == "" {
+		return errors.New("NODE_NAME is not set")
+	}
+
+	// A null value removes the key in a JSON merge patch
+	var label, annotation interface{}
+	if required {
+		label, annotation = "true", valueOrDefault(rulesetDigest, "unknown")
+	}
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels":      map[string]interface{}{rebootRequiredLabel: label},
+			"annotations": map[string]interface{}{rebootRequiredAnnotation: annotation},
+		},
+	}
+
+	return kubePatch("/api/v1/nodes/"+nodeName, patch)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// apiRequest is a request received by the fake API server, with its JSON body decoded.
+type apiRequest struct {
+	Method string
+	Path   string
+	Body   map[string]interface{}
+}
+
+// fakeAPIServer starts a Kubernetes API server that accepts every request, and points the service account of the pod
+// at it until the test ends. It returns the requests received so far.
+func fakeAPIServer(t *testing.T) func() []apiRequest {
+	t.Helper()
+	var mu sync.Mutex
+	var requests []apiRequest
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer s3rvice-account-token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		request := apiRequest{Method: req.Method, Path: req.URL.Path}
+		if data, _ := io.ReadAll(req.Body); len(data) > 0 {
+			if err := json.Unmarshal(data, &request.Body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		mu.Lock()
+		requests = append(requests, request)
+		mu.Unlock()
+		w.Write([]byte("{}"))
+	}))
+	t.Cleanup(server.Close)
+
+	dir := t.TempDir()
+	caCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	writeFiles(t, dir, map[string]string{"token": "s3rvice-account-token\n", "ca.crt": string(caCert), "namespace": "kube-system"})
+	previous := serviceAccountDirectory
+	serviceAccountDirectory = dir
+	t.Cleanup(func() { serviceAccountDirectory = previous })
+
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KUBERNETES_SERVICE_HOST", host)
+	t.Setenv("KUBERNETES_SERVICE_PORT", port)
+	t.Setenv("NODE_NAME", "aks-nodepool1-0")
+	t.Setenv("POD_NAME", "aks-auditd-x7k2p")
+
+	return func() []apiRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		received := requests
+		requests = nil
+		return received
+	}
+}
+
+// nodeMetadata returns the label and annotation a node patch sets, or nil for those it removes.
+func nodeMetadata(t *testing.T, request apiRequest) (interface{}, interface{}) {
+	t.Helper()
+	if request.Method != http.MethodPatch || request.Path != "/api/v1/nodes/aks-nodepool1-0" {
+		t.Fatalf("request %s %s, want a patch of the node", request.Method, request.Path)
+	}
+	metadata := request.Body["metadata"].(map[string]interface{})
+	labels := metadata["labels"].(map[string]interface{})
+	annotations := metadata["annotations"].(map[string]interface{})
+	return labels[rebootRequiredLabel], annotations[rebootRequiredAnnotation]
+}
+
+func TestReportRebootRequired(t *testing.T) {
+	received := fakeAPIServer(t)
+	previous := reports
+	reports = newReporter()
+	t.Cleanup(func() { reports = previous })
+
+	rules, plugins := testPair(t), testPair(t)
+	pairs := []DirectoryPair{plugins, rules}
+
+	// The first check removes a label left over from before the node rebooted
+	reportRebootRequired(pairs)
+	requests := received()
+	if len(requests) != 1 {
+		t.Fatalf("received %v, want one node patch", requests)
+	}
+	if label, annotation := nodeMetadata(t, requests[0]); label != nil || annotation != nil {
+		t.Errorf("the node patch sets %v and %v, want both removed", label, annotation)
+	}
+
+	// aks-auditd-monitor recorded that the ruleset waits for a reboot
+	state, err := json.Marshal(RebootRequired{Digest: "9a1c2b3d4e5f", BootID: "boot-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, rules.TargetDirectory, map[string]string{rebootRequiredFileName: string(state)})
+	reportRebootRequired(pairs)
+	requests = received()
+	if len(requests) != 2 {
+		t.Fatalf("received %v, want an event and a node patch", requests)
+	}
+	if requests[0].Method != http.MethodPost || requests[0].Path != "/api/v1/namespaces/kube-system/events" || requests[0].Body["reason"] != "RebootRequired" {
+		t.Errorf("first request = %+v, want a RebootRequired event", requests[0])
+	}
+	if label, annotation := nodeMetadata(t, requests[1]); label != "true" || annotation != "9a1c2b3d4e5f" {
+		t.Errorf("the node patch sets %v and %v, want true and the digest", label, annotation)
+	}
+
+	// Nothing is sent again while the state does not change
+	reportRebootRequired(pairs)
+	if requests := received(); len(requests) != 0 {
+		t.Errorf("received %v for an unchanged state", requests)
+	}
+
+	// The node rebooted and aks-auditd-monitor removed the state
+	if err := os.Remove(filepath.Join(rules.TargetDirectory, rebootRequiredFileName)); err != nil {
+		t.Fatal(err)
+	}
+	reportRebootRequired(pairs)
+	requests = received()
+	if len(requests) != 1 {
+		t.Fatalf("received %v, want one node patch", requests)
+	}
+	if label, annotation := nodeMetadata(t, requests[0]); label != nil || annotation != nil {
+		t.Errorf("the node patch sets %v and %v, want both removed", label, annotation)
+	}
+}
+
+func TestLabelNode(t *testing.T) {
+	received := fakeAPIServer(t)
+
+	if err := labelNode(true, ""); err != nil {
+		t.Fatal(err)
+	}
+	if label, annotation := nodeMetadata(t, received()[0]); label != "true" || annotation != "unknown" {
+		t.Errorf("the node patch sets %v and %v, want true and unknown without a digest", label, annotation)
+	}
+
+	t.Setenv("NODE_NAME", "")
+	if err := labelNode(true, "9a1c"); err == nil {
+		t.Error("labelNode() without NODE_NAME did not fail")
+	}
+	if requests := received(); len(requests) != 0 {
+		t.Errorf("received %v without NODE_NAME", requests)
+	}
+}
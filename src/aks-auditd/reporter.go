@@ -0,0 +1,106 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+)
+
+// Kinds of conditions the reporter deduplicates. Every kind has its own keys within a target directory.
+const (
+	kindDrift       = "drift"       // Keyed by file path, the value is the actual digest
+	kindQuarantine  = "quarantine"  // Keyed by file name, the value is the digest of the quarantined content
+	kindConflicts   = "conflicts"   // One key, the value is the list of conflicts
+	kindRenderError = "renderError" // Keyed by source and file name, the value is the error
+	kindEscape      = "escape"      // Keyed by path
+	kindLint        = "lint"        // One key, the value is the list of findings
+	kindEffective   = "effective"   // One key, the value is the digest of the effective ruleset
+	kindReboot      = "reboot"      // One key of the node, the value is the ruleset waiting for a reboot
+	kindRejection   = "rejection"   // Keyed by source name, the value is the digest of the rejected listing
+)
+
+// reports holds what was last reported about every target directory.
+var reports = newReporter()
+
+// reporter remembers the value last reported for every condition of every target directory, so a condition that
+// persists is only logged or emitted as an event when it changes and not on every poll. Conditions that are not about
+// a target directory, such as a required reboot, use an empty target directory. It is safe for concurrent use.
+type reporter struct {
+	mu       sync.Mutex
+	reported map[string]map[reportKey]string // Target directory to condition to the value last reported
+}
+
+// reportKey identifies a condition within a target directory.
+type reportKey struct {
+	kind string
+	key  string
+}
+
+// newReporter returns a reporter that has not reported anything yet.
+func newReporter() *reporter {
+	return &reporter{reported: make(map[string]map[reportKey]string)}
+}
+
+// changed records value as reported for the condition and returns true if it was not reported before or was
+// reported with a different value.
+func (r *reporter) changed(targetDir, kind, key, value string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	targetDir = cleanTarget(targetDir)
+	previous, exists := r.reported[targetDir][reportKey{kind, key}]
+	if exists && previous == value {
+		return false
+	}
+	if r.reported[targetDir] == nil {
+		r.reported[targetDir] = make(map[reportKey]string)
+	}
+	r.reported[targetDir][reportKey{kind, key}] = value
+	return true
+}
+
+// seen returns true if the condition was reported before.
+func (r *reporter) seen(targetDir, kind, key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, exists := r.reported[cleanTarget(targetDir)][reportKey{kind, key}]
+	return exists
+}
+
+// retain forgets the conditions of the kind in targetDir whose key keep returns false for, so a resolved condition is
+// reported again if it comes back.
+func (r *reporter) retain(targetDir, kind string, keep func(key string) bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for condition := range r.reported[cleanTarget(targetDir)] {
+		if condition.kind == kind && !keep(condition.key) {
+			delete(r.reported[cleanTarget(targetDir)], condition)
+		}
+	}
+}
+
+// retainTargets forgets everything reported about target directories that are no longer configured, so a directory
+// that is configured again later starts with a clean slate.
+func (r *reporter) retainTargets(pairs []DirectoryPair) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	configured := map[string]bool{"": true}
+	for _, pair := range pairs {
+		configured[cleanTarget(pair.TargetDirectory)] = true
+	}
+	for targetDir := range r.reported {
+		if !configured[targetDir] {
+			delete(r.reported, targetDir)
+		}
+	}
+}
+
+// cleanTarget returns the clean form of a target directory, or an empty string for conditions of the node.
+func cleanTarget(targetDir string) string {
+	if targetDir == "" {
+		return ""
+	}
+	return filepath.Clean(targetDir)
+}
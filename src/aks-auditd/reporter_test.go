@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestReporter(t *testing.T) {
+	r := newReporter()
+
+	if !r.changed("/rules", kindDrift, "/rules/a.rules", "d1") {
+		t.Error("first report is not a change")
+	}
+	if r.changed("/rules/", kindDrift, "/rules/a.rules", "d1") {
+		t.Error("same report is a change")
+	}
+	if !r.changed("/rules", kindDrift, "/rules/a.rules", "d2") {
+		t.Error("new value is not a change")
+	}
+	if !r.changed("/rules", kindQuarantine, "/rules/a.rules", "d2") {
+		t.Error("kinds share their keys")
+	}
+	if !r.changed("/plugins", kindDrift, "/rules/a.rules", "d2") {
+		t.Error("target directories share their keys")
+	}
+
+	// A resolved condition is reported again when it comes back
+	r.changed("/rules", kindDrift, "/rules/b.rules", "d1")
+	r.retain("/rules", kindDrift, func(path string) bool { return path == "/rules/b.rules" })
+	if !r.changed("/rules", kindDrift, "/rules/a.rules", "d2") {
+		t.Error("forgotten condition is not a change")
+	}
+	if r.changed("/rules", kindDrift, "/rules/b.rules", "d1") || r.changed("/rules", kindQuarantine, "/rules/a.rules", "d2") {
+		t.Error("retain forgot a kept condition")
+	}
+
+	// A removed target directory starts over, and conditions of the node are kept
+	if r.seen("", kindReboot, "") || !r.changed("", kindReboot, "", "") || !r.seen("", kindReboot, "") {
+		t.Error("node condition is not recorded")
+	}
+	r.retainTargets([]DirectoryPair{{TargetDirectory: "/rules"}})
+	if !r.changed("/plugins", kindDrift, "/rules/a.rules", "d2") {
+		t.Error("condition of a removed target directory is not forgotten")
+	}
+	if r.changed("/rules", kindDrift, "/rules/b.rules", "d1") || r.changed("", kindReboot, "", "") {
+		t.Error("condition of a configured target directory or the node is forgotten")
+	}
+}
+
+func TestReporterConcurrent(t *testing.T) {
+	r := newReporter()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	changes := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if r.changed("/rules", kindLint, fmt.Sprint(j), "") {
+					mu.Lock()
+					changes++
+					mu.Unlock()
+				}
+				r.retainTargets([]DirectoryPair{{TargetDirectory: "/rules"}})
+			}
+		}(i)
+	}
+	wg.Wait()
+	if changes != 100 {
+		t.Errorf("got %d changes, want every key to change once", changes)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Directive in the header of a source file that limits the nodes it is synced to, for example
+// # aks-auditd-node-selector: kubernetes.azure.com/agentpool=ingress
+const nodeSelectorDirective = "aks-auditd-node-selector:"
+
+// requirement is one term of a node selector. A requirement without an operator only requires the label to exist.
+type requirement struct {
+	key      string
+	operator string // =, !=, exists, or !exists
+	value    string
+}
+
+// matches returns true if the labels meet the requirement.
+func (r requirement) matches(labels map[string]string) bool {
+	value, exists := labels[r.key]
+	switch r.operator {
+	case "=":
+		return exists && value == r.value
+	case "!=":
+		return !exists || value != r.value
+	case "exists":
+		return exists
+	default:
+		return !exists
+	}
+}
+
+// String formats the requirement in the selector syntax.
+func (r requirement) String() string {
+	switch r.operator {
+	case "exists":
+		return r.key
+	case "!exists":
+		return "!" + r.key
+	}
+	return r.key + r.operator + r.value
+}
+
+// parseSelector parses a comma separated equality based label selector, as kubectl get -l accepts it: key=value,
+// key==value, key!=value, key, and !key. All terms must match.
+func parseSelector(selector string) ([]requirement, error) {
+	var requirements []requirement
+	for _, term := range strings.Split(selector, ",") {
+		term = strings.TrimSpace(term)
+		var r requirement
+		switch {
+		case term == "":
+			return nil, fmt.Errorf("empty term in node selector %q", selector)
+		case strings.Contains(term, "!="):
+			key, value, _ := strings.Cut(term, "!=")
+			r = requirement{key: strings.TrimSpace(key), operator: "!=", value: strings.TrimSpace(value)}
+		case strings.Contains(term, "=="):
+			key, value, _ := strings.Cut(term, "==")
+			r = requirement{key: strings.TrimSpace(key), operator: "=", value: strings.TrimSpace(value)}
+		case strings.Contains(term, "="):
+			key, value, _ := strings.Cut(term, "=")
+			r = requirement{key: strings.TrimSpace(key), operator: "=", value: strings.TrimSpace(value)}
+		case strings.HasPrefix(term, "!"):
+			r = requirement{key: strings.TrimSpace(term[1:]), operator: "!exists"}
+		default:
+			r = requirement{key: term, operator: "exists"}
+		}
+		if r.key == "" || strings.ContainsAny(r.key, " \t!=") || strings.ContainsAny(r.value, " \t!=,") {
+			return nil, fmt.Errorf("invalid term %q in node selector %q", term, selector)
+		}
+		requirements = append(requirements, r)
+	}
+	return requirements, nil
+}
+
+// readNodeSelector returns the node selectors in the header of the file at path. The header is the comment and blank
+// lines before the first rule or setting. Every selector of a file must match. A file in root is read confined to it.
+func readNodeSelector(root, path string) ([]requirement, error) {
+	file, err := hostOpen(root, path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var requirements []requirement
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		comment, isComment := strings.CutPrefix(line, "#")
+		if !isComment {
+			break
+		}
+		selector, found := strings.CutPrefix(strings.TrimSpace(comment), nodeSelectorDirective)
+		if !found {
+			continue
+		}
+		terms, err := parseSelector(strings.TrimSpace(selector))
+		if err != nil {
+			return nil, err
+		}
+		requirements = append(requirements, terms...)
+	}
+	return requirements, scanner.Err()
+}
+
+// matchesNode returns true if the node selectors in the header of the file at path match the labels of this node. A
+// file without a node selector matches every node, and the labels are only read for files with one.
+func matchesNode(root, path string) (bool, error) {
+	requirements, err := readNodeSelector(root, path)
+	if err != nil || len(requirements) == 0 {
+		return err == nil, err
+	}
+
+	facts, err := nodeFacts()
+	if err != nil {
+		return false, err
+	}
+	for _, r := range requirements {
+		if !r.matches(facts.Labels) {
+			log.Debugf("Skipping %s. The node does not match its node selector term %s.", path, r)
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// setNodeFacts makes nodeFacts return facts until the test ends, instead of reading them from the node.
+func setNodeFacts(t *testing.T, facts NodeFacts) {
+	factsMu.Lock()
+	previous, previousAt := cachedFacts, cachedFactsAt
+	cachedFacts, cachedFactsAt = facts, time.Now()
+	factsMu.Unlock()
+
+	t.Cleanup(func() {
+		factsMu.Lock()
+		cachedFacts, cachedFactsAt = previous, previousAt
+		factsMu.Unlock()
+	})
+}
+
+func TestParseSelector(t *testing.T) {
+	for _, test := range []struct {
+		selector string
+		want     []requirement
+	}{
+		{"agentpool=ingress", []requirement{{"agentpool", "=", "ingress"}}},
+		{"agentpool==ingress", []requirement{{"agentpool", "=", "ingress"}}},
+		{"agentpool!=ingress", []requirement{{"agentpool", "!=", "ingress"}}},
+		{"gpu", []requirement{{"gpu", "exists", ""}}},
+		{"!gpu", []requirement{{"gpu", "!exists", ""}}},
+		{"kubernetes.azure.com/agentpool = ingress , !gpu", []requirement{
+			{"kubernetes.azure.com/agentpool", "=", "ingress"},
+			{"gpu", "!exists", ""},
+		}},
+		{"tier=", []requirement{{"tier", "=", ""}}},
+	} {
+		got, err := parseSelector(test.selector)
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseSelector(%q) = %v, %v, want %v", test.selector, got, err, test.want)
+		}
+	}
+
+	for _, selector := range []string{"", "a=b,", ",a=b", "=b", "a=b c", "a=b=c", "a==b!c", "!", "a b", "a!=b!=c", "!!a"} {
+		if got, err := parseSelector(selector); err == nil {
+			t.Errorf("parseSelector(%q) = %v, want an error", selector, got)
+		}
+	}
+}
+
+func TestRequirementMatches(t *testing.T) {
+	labels := map[string]string{"agentpool": "ingress", "gpu": ""}
+	for _, test := range []struct {
+		requirement requirement
+		want        bool
+	}{
+		{requirement{"agentpool", "=", "ingress"}, true},
+		{requirement{"agentpool", "=", "system"}, false},
+		{requirement{"zone", "=", ""}, false},
+		{requirement{"gpu", "=", ""}, true},
+		{requirement{"agentpool", "!=", "system"}, true},
+		{requirement{"agentpool", "!=", "ingress"}, false},
+		{requirement{"zone", "!=", "1"}, true},
+		{requirement{"gpu", "exists", ""}, true},
+		{requirement{"zone", "exists", ""}, false},
+		{requirement{"zone", "!exists", ""}, true},
+		{requirement{"gpu", "!exists", ""}, false},
+	} {
+		if got := test.requirement.matches(labels); got != test.want {
+			t.Errorf("%s matches %v = %v, want %v", test.requirement, labels, got, test.want)
+		}
+	}
+}
+
+func TestReadNodeSelector(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"10-none.rules": "# Base rules\n-w /etc/passwd -p wa -k identity\n",
+		"20-one.rules":  "# aks-auditd-node-selector: agentpool=ingress\n-w /etc/nginx -p wa -k nginx\n",
+		"30-two.rules": "# Ingress rules\n\n#aks-auditd-node-selector: agentpool=ingress\n" +
+			"  # aks-auditd-node-selector: !gpu\n-w /etc/nginx -p wa\n",
+		"40-late.rules":    "-D\n# aks-auditd-node-selector: agentpool=ingress\n",
+		"50-invalid.rules": "# aks-auditd-node-selector: agentpool=\"a b\"\n",
+	})
+
+	for _, test := range []struct {
+		fileName string
+		want     []requirement
+	}{
+		{"10-none.rules", nil},
+		{"20-one.rules", []requirement{{"agentpool", "=", "ingress"}}},
+		{"30-two.rules", []requirement{{"agentpool", "=", "ingress"}, {"gpu", "!exists", ""}}},
+		{"40-late.rules", nil}, // The selector is not in the header
+	} {
+		got, err := readNodeSelector(dir, filepath.Join(dir, test.fileName))
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("readNodeSelector(%s) = %v, %v, want %v", test.fileName, got, err, test.want)
+		}
+	}
+
+	if _, err := readNodeSelector(dir, filepath.Join(dir, "50-invalid.rules")); err == nil {
+		t.Error("readNodeSelector returned no error for an invalid selector")
+	}
+}
+
+func TestMatchesNode(t *testing.T) {
+	setNodeFacts(t, NodeFacts{Labels: map[string]string{"agentpool": "ingress"}})
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"10-none.rules":    "-w /etc/passwd -p wa -k identity\n",
+		"20-match.rules":   "# aks-auditd-node-selector: agentpool=ingress\n-w /etc/nginx -p wa\n",
+		"30-partial.rules": "# aks-auditd-node-selector: agentpool=ingress\n# aks-auditd-node-selector: gpu\n-D\n",
+		"40-other.rules":   "# aks-auditd-node-selector: agentpool in (system)\n-D\n",
+	})
+
+	for fileName, want := range map[string]bool{"10-none.rules": true, "20-match.rules": true, "30-partial.rules": false} {
+		if got, err := matchesNode(dir, filepath.Join(dir, fileName)); err != nil || got != want {
+			t.Errorf("matchesNode(%s) = %v, %v, want %v", fileName, got, err, want)
+		}
+	}
+	if _, err := matchesNode(dir, filepath.Join(dir, "40-other.rules")); err == nil {
+		t.Error("matchesNode returned no error for a set based selector")
+	}
+}
+
+func TestSyncFromSourceNodeSelector(t *testing.T) {
+	setNodeFacts(t, NodeFacts{Labels: map[string]string{"agentpool": "ingress"}})
+
+	pair := testPair(t)
+	writeFiles(t, pair.SourceDirectory, map[string]string{
+		"10-base.rules":    "-w /etc/passwd -p wa -k identity\n",
+		"20-ingress.rules": "# aks-auditd-node-selector: agentpool=ingress\n-w /etc/nginx -p wa -k nginx\n",
+		"30-system.rules":  "# aks-auditd-node-selector: agentpool=system\n-w /etc/coredns -p wa -k dns\n",
+	})
+	if _, err := syncFromSource(pair); err != nil {
+		t.Fatal(err)
+	}
+
+	got := readFiles(t, pair.TargetDirectory)
+	if _, exists := got["30-system.rules"]; exists {
+		t.Error("a file for other nodes was synced")
+	}
+	for _, fileName := range []string{"10-base.rules", "20-ingress.rules"} {
+		if _, exists := got[fileName]; !exists {
+			t.Errorf("%s was not synced", fileName)
+		}
+	}
+}
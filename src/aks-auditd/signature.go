@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Name of the file in a source directory that holds the detached signature of the source. The prefix keeps
+// getFileHashes from treating it as part of the ruleset, so the signature is never written to the node.
+const signatureFileName = stagingPrefix + "signature"
+
+// errUnsigned is returned when a source that must be signed has no signature file.
+var errUnsigned = errors.New("the source is not signed")
+
+// rulesetListing returns the ruleset manifest the signature of a source covers. It is the sha256sum output of the
+// files in the source directory sorted by name, as produced by LC_ALL=C sha256sum * in that directory.
+func rulesetListing(root, dir string) ([]byte, error) {
+	hashes, err := getFileHashes(root, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(hashes))
+	for name := range hashes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var listing strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&listing, "%s  %s\n", digest(hashes[name]), name)
+	}
+
+	return []byte(listing.String()), nil
+}
+
+// parsePublicKeys parses the signing keys of a pair. Every entry is either a PEM encoded public key or the path of a
+// file holding one. ECDSA keys, such as cosign.pub, verify cosign sign-blob signatures. Ed25519 keys verify plain
+// Ed25519 signatures.
+func parsePublicKeys(entries []string) ([]crypto.PublicKey, error) {
+	var keys []crypto.PublicKey
+
+	for _, entry := range entries {
+		data := []byte(entry)
+		if !strings.HasPrefix(strings.TrimSpace(entry), "-----BEGIN") {
+			var err error
+			if data, err = os.ReadFile(entry); err != nil {
+				return nil, fmt.Errorf("unable to read signing key: %w", err)
+			}
+		}
+
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("signing key %s is not PEM encoded", shortKeyName(entry))
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid signing key %s: %w", shortKeyName(entry), err)
+		}
+		switch key.(type) {
+		case *ecdsa.PublicKey, ed25519.PublicKey:
+			keys = append(keys, key)
+		default:
+			return nil, fmt.Errorf("signing key %s has type %T. Only ECDSA and Ed25519 keys are supported", shortKeyName(entry), key)
+		}
+	}
+
+	return keys, nil
+}
+
+// shortKeyName returns a key file path as is and shortens an inline PEM key for error messages.
+func shortKeyName(entry string) string {
+	if strings.HasPrefix(strings.TrimSpace(entry), "-----BEGIN") {
+		return "(inline PEM)"
+	}
+	return entry
+}
+
+// verifySource checks the detached signature in dir against the ruleset manifest of dir. The signature is base64
+// encoded, as written by cosign sign-blob or by openssl base64.
+func verifySource(root, dir string, keys []crypto.PublicKey) error {
+	encoded, err := hostReadFile(root, filepath.Join(dir, signatureFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return errUnsigned
+	}
+	if err != nil {
+		return err
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return fmt.Errorf("the signature is not base64 encoded: %w", err)
+	}
+
+	listing, err := rulesetListing(root, dir)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(listing)
+
+	for _, key := range keys {
+		switch key := key.(type) {
+		case *ecdsa.PublicKey:
+			if ecdsa.VerifyASN1(key, hash[:], signature) {
+				return nil
+			}
+		case ed25519.PublicKey:
+			if ed25519.Verify(key, listing, signature) {
+				return nil
+			}
+		}
+	}
+
+	return errors.New("the signature does not match the files. The files were changed after signing or were signed with an unknown key")
+}
+
+// verifySources checks the signature of every source of the pair. It returns an error naming the first source that is
+// unsigned or whose files do not match its signature. Pairs without signing keys are not checked.
+func verifySources(pair DirectoryPair) error {
+	if len(pair.SigningKeys) == 0 {
+		return nil
+	}
+
+	keys, err := parsePublicKeys(pair.SigningKeys)
+	if err != nil {
+		return err
+	}
+
+	for _, source := range pair.sources() {
+		if source.Directory == "" {
+			continue
+		}
+		if err := verifySource(pair.TargetDirectory, source.Directory, keys); err != nil {
+			reportRejection(pair, source, err)
+			return fmt.Errorf("refusing the ruleset of %s: %w", source.name(), err)
+		}
+		log.Debugf("Verified the signature of %s", source.name())
+	}
+
+	return nil
+}
+
+// reportRejection logs a rejected source as an error and emits a Warning event on the aks-auditd pod the first time
+// the rejected content is seen.
+func reportRejection(pair DirectoryPair, source Source, reason error) {
+	listing, _ := rulesetListing(pair.TargetDirectory, source.Directory)
+	listingDigest := digest(sha256.Sum256(listing))
+
+	log.WithFields(log.Fields{
+		"targetDirectory": pair.TargetDirectory,
+		"source":          source.name(),
+		"listingDigest":   listingDigest,
+	}).Errorf("Rejected an unverified ruleset. The last verified ruleset stays in place. Error: %v", reason)
+
+	// A rejected source only raises one event and not one on every poll. The error is logged on every poll.
+	if !reports.changed(pair.TargetDirectory, kindRejection, source.name(), listingDigest) {
+		return
+	}
+
+	message := fmt.Sprintf("Rejected the ruleset of %s for %s: %v. The last verified ruleset stays in place.", source.name(), pair.TargetDirectory, reason)
+	if err := createPodEvent("Warning", "RulesetRejected", message); err != nil {
+		log.Debugf("Unable to emit the rejection event: %v", err)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// publicKeyPEM returns the PEM encoded public key of a private key.
+func publicKeyPEM(t *testing.T, key crypto.PublicKey) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+// signSource writes the base64 encoded signature of the ruleset listing of dir, as cosign sign-blob or openssl
+// would, to the signature file of dir.
+func signSource(t *testing.T, dir string, key crypto.Signer) {
+	t.Helper()
+	listing, err := rulesetListing("", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var signature []byte
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		hash := sha256.Sum256(listing)
+		signature, err = ecdsa.SignASN1(rand.Reader, key, hash[:])
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, listing)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, dir, map[string]string{signatureFileName: base64.StdEncoding.EncodeToString(signature) + "\n"})
+}
+
+func TestRulesetListing(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"b.rules": "a\n", "a.rules": "", signatureFileName: "ignored"})
+
+	// LC_ALL=C sha256sum * output
+	want := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855  a.rules\n" +
+		"87428fc522803d31065e7bce3cf03fe475096631e5e07bbd7a0fde60c4cf25c7  b.rules\n"
+	listing, err := rulesetListing("", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(listing) != want {
+		t.Errorf("listing is\n%s\nwant\n%s", listing, want)
+	}
+}
+
+func TestVerifySource(t *testing.T) {
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name    string
+		signer  crypto.Signer
+		keys    []crypto.Signer
+		prepare func(dir string)
+		wantErr string
+	}{
+		{name: "ecdsa", signer: ecdsaKey, keys: []crypto.Signer{ecdsaKey}},
+		{name: "ed25519", signer: ed25519Key, keys: []crypto.Signer{ed25519Key}},
+		{name: "second key", signer: ed25519Key, keys: []crypto.Signer{otherKey, ed25519Key}},
+		{name: "unknown key", signer: otherKey, keys: []crypto.Signer{ecdsaKey, ed25519Key}, wantErr: "does not match"},
+		{name: "unsigned", keys: []crypto.Signer{ecdsaKey}, wantErr: errUnsigned.Error()},
+		{name: "changed file", signer: ecdsaKey, keys: []crypto.Signer{ecdsaKey}, wantErr: "does not match", prepare: func(dir string) {
+			writeFiles(t, dir, map[string]string{"10-base.rules": "-e 0\n"})
+		}},
+		{name: "added file", signer: ed25519Key, keys: []crypto.Signer{ed25519Key}, wantErr: "does not match", prepare: func(dir string) {
+			writeFiles(t, dir, map[string]string{"99-extra.rules": "-D\n"})
+		}},
+		{name: "removed file", signer: ecdsaKey, keys: []crypto.Signer{ecdsaKey}, wantErr: "does not match", prepare: func(dir string) {
+			os.Remove(filepath.Join(dir, "20-exec.rules"))
+		}},
+		{name: "not base64", signer: ecdsaKey, keys: []crypto.Signer{ecdsaKey}, wantErr: "not base64", prepare: func(dir string) {
+			writeFiles(t, dir, map[string]string{signatureFileName: "not a signature!"})
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFiles(t, dir, map[string]string{
+				"10-base.rules": "-D\n-b 8192\n",
+				"20-exec.rules": "-a always,exit -F arch=b64 -S execve -k exec\n",
+			})
+			if test.signer != nil {
+				signSource(t, dir, test.signer)
+			}
+			if test.prepare != nil {
+				test.prepare(dir)
+			}
+
+			var entries []string
+			for _, key := range test.keys {
+				entries = append(entries, publicKeyPEM(t, key.Public()))
+			}
+			keys, err := parsePublicKeys(entries)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = verifySource("", dir, keys)
+			switch {
+			case test.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)):
+				t.Fatalf("got error %v, want one containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestParsePublicKeys(t *testing.T) {
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "cosign.pub")
+	if err := os.WriteFile(keyFile, []byte(publicKeyPEM(t, ecdsaKey.Public())), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name    string
+		entry   string
+		wantErr string
+	}{
+		{"inline", publicKeyPEM(t, ecdsaKey.Public()), ""},
+		{"file", keyFile, ""},
+		{"missing file", keyFile + ".missing", "unable to read signing key"},
+		{"not pem", "-----BEGIN PUBLIC KEY-----\nnot a key", "not PEM encoded"},
+		{"rsa", publicKeyPEM(t, rsaKey.Public()), "Only ECDSA and Ed25519 keys are supported"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			keys, err := parsePublicKeys([]string{test.entry})
+			switch {
+			case test.wantErr == "" && (err != nil || len(keys) != 1):
+				t.Fatalf("got %d keys and error %v, want one key", len(keys), err)
+			case test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)):
+				t.Fatalf("got error %v, want one containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifySources(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair := testPair(t)
+	writeFiles(t, pair.SourceDirectory, map[string]string{"10-base.rules": "-D\n"})
+
+	// Without signing keys nothing is checked
+	if err := verifySources(pair); err != nil {
+		t.Fatalf("unexpected error without signing keys: %v", err)
+	}
+
+	pair.SigningKeys = []string{publicKeyPEM(t, key.Public())}
+	if err := verifySources(pair); !errors.Is(err, errUnsigned) {
+		t.Fatalf("got error %v for an unsigned source, want %v", err, errUnsigned)
+	}
+	signSource(t, pair.SourceDirectory, key)
+	if err := verifySources(pair); err != nil {
+		t.Fatalf("unexpected error for a signed source: %v", err)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// Suffix of the source files that are Go templates. A template is rendered with the facts of the node and written to
+// the node under its name without the suffix, so 30-gpu.rules.tmpl becomes 30-gpu.rules.
+const templateSuffix = ".tmpl"
+
+// Name of the directory in a target directory that holds the rendered templates. Each rendered file is kept in a
+// subdirectory named after the digest of its name and content, like the expanded archives.
+const renderedCacheDirectoryName = stagingPrefix + "rendered"
+
+// Path of the os-release file of the node, mounted from the host. The os-release file of the container describes the
+// container image instead.
+const nodeOSReleasePath = "/node-os-release"
+
+// Label AKS sets on every node to the name of its node pool
+const nodepoolLabel = "kubernetes.azure.com/agentpool"
+
+// How long the facts of the node are reused before they are read again. Node labels rarely change, so this keeps
+// aks-auditd from reading the Node object on every poll.
+const nodeFactsInterval = 5 * time.Minute
+
+// NodeFacts are the facts of the node a template is rendered with, for example {{ .Nodepool }} or
+// {{ index .Labels "kubernetes.azure.com/accelerator" }}.
+type NodeFacts struct {
+	Hostname      string            // Name of the node
+	Arch          string            // Architecture in Go naming, such as amd64 or arm64
+	KernelVersion string            // Kernel release as printed by uname -r
+	OSImage       string            // OS of the node as reported by kubelet, such as Ubuntu 22.04.5 LTS
+	OSRelease     map[string]string // Variables of /etc/os-release of the node, such as ID and VERSION_ID
+	Labels        map[string]string // Labels of the Node object
+	Nodepool      string            // Name of the AKS node pool
+}
+
+// Facts of the node last read and when they were read
+var (
+	factsMu       sync.Mutex
+	cachedFacts   NodeFacts
+	cachedFactsAt time.Time
+)
+
+// isTemplate returns true if the source file is a Go template rendered per node.
+func isTemplate(fileName string) bool {
+	return strings.HasSuffix(fileName, templateSuffix)
+}
+
+// renderedCacheDir returns the directory in targetDir that holds the rendered templates.
+func renderedCacheDir(targetDir string) string {
+	return filepath.Join(targetDir, renderedCacheDirectoryName)
+}
+
+// templateFuncs are the functions templates can use in addition to the Go template builtins.
+var templateFuncs = template.FuncMap{
+	"hasPrefix": strings.HasPrefix,
+	"hasSuffix": strings.HasSuffix,
+	"contains":  strings.Contains,
+	"lower":     strings.ToLower,
+	"upper":     strings.ToUpper,
+	"join":      strings.Join,
+	"split":     strings.Split,
+}
+
+// nodeFacts returns the facts of the node. Hostname, architecture, and kernel are read locally. The labels and node
+// pool come from the Node object, and an error is returned when it cannot be read, so a template is never rendered
+// with missing labels.
+func nodeFacts() (NodeFacts, error) {
+	factsMu.Lock()
+	defer factsMu.Unlock()
+	if !cachedFactsAt.IsZero() && time.Since(cachedFactsAt) < nodeFactsInterval {
+		return cachedFacts, nil
+	}
+
+	facts := NodeFacts{
+		Hostname:  os.Getenv("NODE_NAME"),
+		Arch:      nodeMachine,
+		OSRelease: readOSRelease(nodeOSReleasePath),
+	}
+
+	// The container shares the kernel of the node
+	var uname unix.Utsname
+	if err := unix.Uname(&uname); err != nil {
+		return NodeFacts{}, fmt.Errorf("unable to read the kernel version: %w", err)
+	}
+	facts.KernelVersion = unix.ByteSliceToString(uname.Release[:])
+
+	node, err := getNode()
+	if err != nil {
+		return NodeFacts{}, fmt.Errorf("unable to read the labels of the node: %w", err)
+	}
+	facts.Labels = node.Metadata.Labels
+	if facts.Labels == nil {
+		facts.Labels = make(map[string]string)
+	}
+	facts.Nodepool = facts.Labels[nodepoolLabel]
+	facts.OSImage = node.Status.NodeInfo.OSImage
+
+	cachedFacts, cachedFactsAt = facts, time.Now()
+	log.WithFields(log.Fields{
+		"hostname":      facts.Hostname,
+		"arch":          facts.Arch,
+		"kernelVersion": facts.KernelVersion,
+		"osImage":       facts.OSImage,
+		"nodepool":      facts.Nodepool,
+	}).Debug("Read the facts of the node")
+
+	return facts, nil
+}
+
+// readOSRelease parses an os-release file into its variables. A missing file results in no variables.
+func readOSRelease(path string) map[string]string {
+	release := make(map[string]string)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Debugf("Unable to read the os-release file of the node: %v", err)
+		return release
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		name, value, found := strings.Cut(line, "=")
+		if !found || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		} else {
+			value = strings.Trim(value, `'"`)
+		}
+		release[name] = value
+	}
+	return release
+}
+
+// KernelAtLeast returns true when the kernel release, such as 5.15.0-1064-azure, is at least version, such as 5.15.
+// Templates call it as {{ if .KernelAtLeast "5.15" }}.
+func (f NodeFacts) KernelAtLeast(version string) bool {
+	releaseParts := strings.FieldsFunc(f.KernelVersion, func(r rune) bool { return r == '.' || r == '-' })
+	for i, part := range strings.Split(version, ".") {
+		want, _ := strconv.Atoi(part)
+		have := 0
+		if i < len(releaseParts) {
+			have, _ = strconv.Atoi(releaseParts[i])
+		}
+		if have != want {
+			return have > want
+		}
+	}
+	return true
+}
+
+// renderTemplate renders the template at templatePath with the facts of the node into the rendered cache of
+// targetDir. It returns the path of the rendered file, which is named fileName, and the hash of its content. A missing
+// map key, such as a misspelled fact, is an error.
+func renderTemplate(targetDir, templatePath, fileName string) (string, [32]byte, error) {
+	facts, err := nodeFacts()
+	if err != nil {
+		return "", [32]byte{}, err
+	}
+
+	data, err := hostReadFile(targetDir, templatePath)
+	if err != nil {
+		return "", [32]byte{}, err
+	}
+	tmpl, err := template.New(filepath.Base(templatePath)).Option("missingkey=error").Funcs(templateFuncs).Parse(string(data))
+	if err != nil {
+		return "", [32]byte{}, err
+	}
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, facts); err != nil {
+		return "", [32]byte{}, err
+	}
+
+	return cacheRendered(targetDir, fileName, rendered.Bytes())
+}
+
+// cacheRendered writes content, the rendered form of a source file, to the rendered cache of targetDir. It returns the
+// path of the rendered file, which is named fileName, and the hash of its content.
+func cacheRendered(targetDir, fileName string, content []byte) (string, [32]byte, error) {
+	hash := sha256.Sum256(content)
+	renderedDir := filepath.Join(renderedCacheDir(targetDir), renderedKey(fileName, hash))
+	renderedPath := filepath.Join(renderedDir, fileName)
+	if info, err := hostLstat(targetDir, renderedPath); err == nil && info.Mode().IsRegular() {
+		return renderedPath, hash, nil
+	}
+
+	// Write the file into a hidden directory first and rename it into place, so the cache never holds a partial file
+	if err := hostMkdirAll(targetDir, renderedCacheDir(targetDir), 0750); err != nil {
+		return "", [32]byte{}, err
+	}
+	tmpDir, err := hostMkdirTemp(targetDir, renderedCacheDir(targetDir), ".tmp-")
+	if err != nil {
+		return "", [32]byte{}, err
+	}
+	defer hostRemoveAll(targetDir, tmpDir)
+
+	stagedPath, err := stageContent(targetDir, bytes.NewReader(content), tmpDir, fileName, 0640)
+	if err != nil {
+		return "", [32]byte{}, err
+	}
+	if err := hostRename(targetDir, stagedPath, filepath.Join(tmpDir, fileName)); err != nil {
+		return "", [32]byte{}, err
+	}
+	if err := hostRename(targetDir, tmpDir, renderedDir); err != nil {
+		return "", [32]byte{}, err
+	}
+	log.Debugf("Rendered %s into %s", fileName, renderedPath)
+
+	return renderedPath, hash, nil
+}
+
+// renderedKey returns the name of the directory in the rendered cache that holds the rendered file with the given name
+// and content hash. Two templates that render to the same content get a directory each.
+func renderedKey(fileName string, hash [32]byte) string {
+	return digest(sha256.Sum256([]byte(fileName + "\x00" + digest(hash))))
+}
+
+// reportRenderError logs a template that failed to render and emits a Warning event on the aks-auditd pod the first
+// time the error is seen.
+func reportRenderError(pair DirectoryPair, source Source, fileName string, reason error) {
+	log.WithFields(log.Fields{
+		"targetDirectory": pair.TargetDirectory,
+		"source":          source.name(),
+		"file":            fileName,
+	}).Errorf("Failed to render the template. The ruleset of this node stays in place. Error: %v", reason)
+
+	// A template that keeps failing only raises one event
+	if !reports.changed(pair.TargetDirectory, kindRenderError, source.name()+"|"+fileName, reason.Error()) {
+		return
+	}
+
+	message := fmt.Sprintf("Failed to render the template %s of %s for %s: %v. The ruleset of this node stays in place.", fileName, source.name(), pair.TargetDirectory, reason)
+	if err := createPodEvent("Warning", "TemplateRenderFailed", message); err != nil {
+		log.Debugf("Unable to emit the render failure event: %v", err)
+	}
+}
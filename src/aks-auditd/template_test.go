@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testFacts are the facts of an Ubuntu node in the ingress node pool.
+var testFacts = NodeFacts{
+	Hostname:      "aks-ingress-0",
+	Arch:          "amd64",
+	KernelVersion: "5.15.0-1064-azure",
+	OSImage:       "Ubuntu 22.04.5 LTS",
+	OSRelease:     map[string]string{"ID": "ubuntu", "VERSION_ID": "22.04"},
+	Labels:        map[string]string{nodepoolLabel: "ingress", "tier": "web"},
+	Nodepool:      "ingress",
+}
+
+func TestKernelAtLeast(t *testing.T) {
+	for _, test := range []struct {
+		kernel  string
+		version string
+		want    bool
+	}{
+		{"5.15.0-1064-azure", "5.15", true},
+		{"5.15.0-1064-azure", "5.15.0", true},
+		{"5.15.0-1064-azure", "5.4", true},
+		{"5.15.0-1064-azure", "5.16", false},
+		{"5.15.0-1064-azure", "6", false},
+		{"5.15.0-1064-azure", "4.19.200", true},
+		{"6.8.0-1015-azure", "5.15", true},
+		{"5.4.0-1109-azure", "5.15", false},
+		{"5.15", "5.15.1", false},
+	} {
+		if got := (NodeFacts{KernelVersion: test.kernel}).KernelAtLeast(test.version); got != test.want {
+			t.Errorf("KernelAtLeast(%q) on %s = %v, want %v", test.version, test.kernel, got, test.want)
+		}
+	}
+}
+
+func TestReadOSRelease(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "os-release")
+	writeFiles(t, filepath.Dir(path), map[string]string{"os-release": "# Ubuntu\n" +
+		"PRETTY_NAME=\"Ubuntu 22.04.5 LTS\"\n" +
+		"ID=ubuntu\n" +
+		"VERSION_ID='22.04'\n" +
+		"HOME_URL=\"https://www.ubuntu.com/\"\n" +
+		"\n" +
+		"not a variable\n"})
+
+	want := map[string]string{
+		"PRETTY_NAME": "Ubuntu 22.04.5 LTS",
+		"ID":          "ubuntu",
+		"VERSION_ID":  "22.04",
+		"HOME_URL":    "https://www.ubuntu.com/",
+	}
+	if got := readOSRelease(path); !reflect.DeepEqual(got, want) {
+		t.Errorf("readOSRelease() = %v, want %v", got, want)
+	}
+	if got := readOSRelease(filepath.Join(t.TempDir(), "missing")); len(got) != 0 {
+		t.Errorf("readOSRelease() of a missing file = %v, want no variables", got)
+	}
+}
+
+func TestRenderTemplate(t *testing.T) {
+	setNodeFacts(t, testFacts)
+
+	for _, test := range []struct {
+		name     string
+		template string
+		want     string
+		wantErr  string
+	}{
+		{
+			name: "facts",
+			template: "# {{ .Hostname }} in {{ .Nodepool }} on {{ .Arch }}\n" +
+				"{{ if eq (index .Labels \"tier\") \"web\" }}-w /var/www -p wa -k web\n{{ end }}" +
+				"{{ if and (eq .OSRelease.ID \"ubuntu\") (.KernelAtLeast \"5.15\") }}-w /etc/apt -p wa -k apt\n{{ end }}" +
+				"{{ if hasPrefix .OSImage \"Ubuntu\" }}-w /etc/netplan -p wa -k {{ lower \"NET\" }}\n{{ end }}",
+			want: "# aks-ingress-0 in ingress on amd64\n-w /var/www -p wa -k web\n-w /etc/apt -p wa -k apt\n-w /etc/netplan -p wa -k net\n",
+		},
+		{name: "missing label", template: "-w /var/www -p wa -k {{ .Labels.team }}\n", wantErr: "map has no entry for key"},
+		{name: "missing os-release variable", template: "# {{ .OSRelease.VARIANT_ID }}\n", wantErr: "map has no entry for key"},
+		{name: "misspelled fact", template: "# {{ .Nodpool }}\n", wantErr: "can't evaluate field Nodpool"},
+		{name: "syntax error", template: "{{ if .Nodepool }}\n", wantErr: "unexpected EOF"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			targetDir := t.TempDir()
+			writeFiles(t, targetDir, map[string]string{"30-web.rules.tmpl": test.template})
+
+			path, hash, err := renderTemplate(targetDir, filepath.Join(targetDir, "30-web.rules.tmpl"), "30-web.rules")
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("renderTemplate() error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != test.want {
+				t.Errorf("renderTemplate() = %q, want %q", data, test.want)
+			}
+			if filepath.Base(path) != "30-web.rules" || hash != sha256.Sum256(data) {
+				t.Errorf("renderTemplate() = %s with hash %s, want 30-web.rules with the hash of its content", path, digest(hash))
+			}
+		})
+	}
+}
+
+func TestRenderTemplateWithoutNode(t *testing.T) {
+	factsMu.Lock()
+	previous, previousAt := cachedFacts, cachedFactsAt
+	cachedFacts, cachedFactsAt = NodeFacts{}, time.Time{}
+	factsMu.Unlock()
+	t.Cleanup(func() {
+		factsMu.Lock()
+		cachedFacts, cachedFactsAt = previous, previousAt
+		factsMu.Unlock()
+	})
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+
+	// The labels cannot be read, so nothing is rendered rather than rendering without them
+	targetDir := t.TempDir()
+	writeFiles(t, targetDir, map[string]string{"30-web.rules.tmpl": "# {{ .Hostname }}\n"})
+	if _, _, err := renderTemplate(targetDir, filepath.Join(targetDir, "30-web.rules.tmpl"), "30-web.rules"); err == nil || !strings.Contains(err.Error(), "labels of the node") {
+		t.Errorf("renderTemplate() error = %v, want the node labels unreadable", err)
+	}
+}
+
+func TestSyncFromSourceRenderError(t *testing.T) {
+	pair := testPair(t)
+	writeFiles(t, pair.SourceDirectory, map[string]string{
+		"10-base.rules":     "-w /etc/passwd -p wa -k identity\n",
+		"30-web.rules.tmpl": "-w /var/www -p wa -k {{ .Labels.tier }}\n",
+	})
+
+	// A node with the label renders the template
+	setNodeFacts(t, testFacts)
+	if _, err := syncFromSource(pair); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"10-base.rules": "-w /etc/passwd -p wa -k identity\n", "30-web.rules": "-w /var/www -p wa -k web\n"}
+	got := readFiles(t, pair.TargetDirectory)
+	delete(got, compiledFileName)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("target = %v, want %v", got, want)
+	}
+
+	// On a node without the label the template does not render. The sync of the node is refused, including the
+	// change of the other file, and the files in place stay as they are.
+	writeFiles(t, pair.SourceDirectory, map[string]string{"10-base.rules": "-w /etc/shadow -p wa -k identity\n"})
+	setNodeFacts(t, NodeFacts{Hostname: "aks-system-0", Labels: map[string]string{nodepoolLabel: "system"}, Nodepool: "system"})
+	if _, err := syncFromSource(pair); err == nil || !strings.Contains(err.Error(), "failed to render template 30-web.rules.tmpl") {
+		t.Fatalf("syncFromSource() error = %v, want the render error", err)
+	}
+	got = readFiles(t, pair.TargetDirectory)
+	delete(got, compiledFileName)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("target after the render error = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"aksauditd/auditrules"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Validation policies. They decide what aks-auditd does when some source files fail validation.
+const (
+	validationAllOrNothing = "all-or-nothing" // Sync nothing until every file is valid
+	validationSkipBadFiles = "skip-bad-files" // Sync the valid files and leave the invalid ones as they are on the node
+)
+
+// ValidationError is a problem found in a source file, with the line and column it is at. Column is 0 when the
+// problem concerns the whole line, and Line is 0 when it concerns the whole file or cannot be traced back to a line of
+// the file in the source.
+type ValidationError struct {
+	File    string
+	Line    int
+	Column  int
+	Message string
+}
+
+// Error formats the validation error as file:line:column: message, or without the column or line when they are 0.
+func (e ValidationError) Error() string {
+	switch {
+	case e.Line == 0:
+		return fmt.Sprintf("%s: %s", e.File, e.Message)
+	case e.Column > 0:
+		return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Column, e.Message)
+	}
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Message)
+}
+
+// validateSourceFiles validates every merged source file and returns the errors of the invalid ones, keyed by the
+// name the file is written under in the target directory. Files ending in .rules are parsed as audit rules and files
+// ending in .conf are checked as audisp plugin configuration. Other files are not read by auditd and are not checked.
+// Files cached in the target directory root are read confined to it.
+func validateSourceFiles(root string, files map[string]SourceFile) map[string][]ValidationError {
+	quarantine := make(map[string][]ValidationError)
+
+	for name, file := range files {
+		if !strings.HasSuffix(name, ".rules") && !strings.HasSuffix(name, ".conf") {
+			continue
+		}
+
+		data, err := hostReadFile(root, file.Path)
+		if err != nil {
+			quarantine[name] = []ValidationError{{File: name, Message: err.Error()}}
+			continue
+		}
+
+		var errs []ValidationError
+		if strings.HasSuffix(name, ".rules") {
+			errs = validateRules(name, data)
+		} else {
+			errs = validatePluginConf(name, data)
+		}
+		if len(errs) == 0 {
+			continue
+		}
+		if file.Origin != "" {
+			errs = traceToOrigin(root, file.Origin, data, errs)
+		}
+		quarantine[name] = errs
+	}
+
+	return quarantine
+}
+
+// traceToOrigin maps the errors found in a file rendered from a template, or with its syscall rules expanded, back to
+// the file as written in the source at origin, so they name a line of the ConfigMap. A rendered line is traced to the
+// line of the source with the same text. A line that has no such line, or more than one, is quoted in the message
+// instead.
+func traceToOrigin(root, origin string, rendered []byte, errs []ValidationError) []ValidationError {
+	originData, err := hostReadFile(root, origin)
+	if err != nil {
+		log.Debugf("Unable to read %s to trace the validation errors to it: %v", origin, err)
+	}
+	originLines := strings.Split(string(originData), "\n")
+	renderedLines := strings.Split(string(rendered), "\n")
+
+	traced := make([]ValidationError, 0, len(errs))
+	for _, e := range errs {
+		e.File = filepath.Base(origin)
+		if e.Line < 1 || e.Line > len(renderedLines) {
+			e.Line, e.Column = 0, 0
+			traced = append(traced, e)
+			continue
+		}
+
+		text := renderedLines[e.Line-1]
+		match := 0
+		for i, line := range originLines {
+			if strings.TrimSpace(line) == strings.TrimSpace(text) {
+				if match != 0 {
+					match = -1
+					break
+				}
+				match = i + 1
+			}
+		}
+		switch {
+		case match > 0 && originLines[match-1] == text:
+			e.Line = match
+		case match > 0:
+			e.Line, e.Column = match, 0
+		default:
+			e.Message = fmt.Sprintf("%s, in line %d as rendered: %q", e.Message, e.Line, strings.TrimSpace(text))
+			e.Line, e.Column = 0, 0
+		}
+		traced = append(traced, e)
+	}
+	return traced
+}
+
+// validateRules parses an audit rules file and returns its syntax errors.
+func validateRules(name string, data []byte) []ValidationError {
+	_, err := auditrules.Parse(name, bytes.NewReader(data))
+	if err == nil {
+		return nil
+	}
+
+	var errs []ValidationError
+	for _, e := range err.(auditrules.ErrorList) {
+		errs = append(errs, ValidationError{File: name, Line: e.Pos.Line, Column: e.Pos.Column, Message: e.Msg})
+	}
+	return errs
+}
+
+// validatePluginConf checks every line of an audisp plugin configuration file and returns the problems found.
+func validatePluginConf(name string, data []byte) []ValidationError {
+	var errs []ValidationError
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if message := validatePluginLine(line); message != "" {
+			errs = append(errs, ValidationError{File: name, Line: lineNumber, Message: message})
+		}
+	}
+
+	return errs
+}
+
+// Keys an audisp plugin configuration file may set.
+var pluginKeys = map[string]bool{"active": true, "direction": true, "path": true, "type": true, "args": true, "format": true}
+
+// validatePluginLine checks a line of an audisp plugin configuration file, and returns a description of the problem
+// found, or an empty string for a valid line.
+func validatePluginLine(line string) string {
+	key, value, found := strings.Cut(line, "=")
+	key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+	if !found || key == "" {
+		return fmt.Sprintf("expected key = value, got %q", line)
+	}
+	if !pluginKeys[key] {
+		return fmt.Sprintf("unknown key %s", key)
+	}
+
+	switch key {
+	case "active":
+		if value != "yes" && value != "no" {
+			return fmt.Sprintf("active must be yes or no, got %q", value)
+		}
+	case "format":
+		if value != "binary" && value != "string" {
+			return fmt.Sprintf("format must be binary or string, got %q", value)
+		}
+	case "type":
+		if value != "always" && value != "builtin" {
+			return fmt.Sprintf("type must be always or builtin, got %q", value)
+		}
+	case "path":
+		if value == "" {
+			return "path must not be empty"
+		}
+	}
+
+	return ""
+}
+
+// reportQuarantine logs every error of the quarantined files and emits a Warning event on the aks-auditd pod the
+// first time a file content is quarantined. It is called on every sync, so files that became valid are forgotten.
+func reportQuarantine(pair DirectoryPair, files map[string]SourceFile, quarantine map[string][]ValidationError) {
+	names := make([]string, 0, len(quarantine))
+	for name := range quarantine {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		errs := quarantine[name]
+		for _, err := range errs {
+			log.WithFields(log.Fields{
+				"targetDirectory":  pair.TargetDirectory,
+				"source":           files[name].Source,
+				"file":             err.File,
+				"line":             err.Line,
+				"validationPolicy": pair.ValidationPolicy,
+			}).Errorf("Quarantined an invalid file. It is not written to the node. Error: %v", err)
+		}
+
+		// A bad file only raises one event and not one on every poll
+		if !reports.changed(pair.TargetDirectory, kindQuarantine, name, digest(files[name].Hash)) {
+			continue
+		}
+
+		message := fmt.Sprintf("Quarantined %s from %s for %s: %v", name, files[name].Source, pair.TargetDirectory, errs[0])
+		if len(errs) > 1 {
+			message += fmt.Sprintf(" and %d more errors", len(errs)-1)
+		}
+		if err := createPodEvent("Warning", "RuleFileQuarantined", message); err != nil {
+			log.Debugf("Unable to emit the quarantine event: %v", err)
+		}
+	}
+
+	// Forget files that are valid again, so they are reported if they break a second time with the same content
+	reports.retain(pair.TargetDirectory, kindQuarantine, func(name string) bool {
+		_, quarantined := quarantine[name]
+		return quarantined
+	})
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// errorStrings returns the formatted validation errors.
+func errorStrings(errs []ValidationError) []string {
+	var got []string
+	for _, err := range errs {
+		got = append(got, err.Error())
+	}
+	return got
+}
+
+func TestValidatePluginConf(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		conf string
+		want []string
+	}{
+		{
+			"valid",
+			"# syslog plugin\n\nactive = yes\ndirection = out\npath = /sbin/audisp-syslog\ntype = always\nargs = LOG_INFO\nformat = string\n",
+			nil,
+		},
+		{"unknown key", "active = yes\nactiv = no\n", []string{"syslog.conf:2: unknown key activ"}},
+		{"missing value separator", "active yes\n", []string{`syslog.conf:1: expected key = value, got "active yes"`}},
+		{"missing key", " = yes\n", []string{`syslog.conf:1: expected key = value, got "= yes"`}},
+		{"active", "active = true\n", []string{`syslog.conf:1: active must be yes or no, got "true"`}},
+		{"format", "format = json\n", []string{`syslog.conf:1: format must be binary or string, got "json"`}},
+		{"type", "type = sometimes\n", []string{`syslog.conf:1: type must be always or builtin, got "sometimes"`}},
+		{"empty path", "path =\n", []string{"syslog.conf:1: path must not be empty"}},
+		{
+			"every bad line",
+			"active = yes\n# comment\nformat = xml\n\ntype = never\n",
+			[]string{`syslog.conf:3: format must be binary or string, got "xml"`, `syslog.conf:5: type must be always or builtin, got "never"`},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := errorStrings(validatePluginConf("syslog.conf", []byte(test.conf))); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("validatePluginConf() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestValidateRules(t *testing.T) {
+	errs := validateRules("10-base.rules", []byte("-D\n-w /etc/passwd -p wa -k identity\n-a always,exit -F arch=b64 -S execve -F bogus=1\n-q\n"))
+	if len(errs) != 2 {
+		t.Fatalf("validateRules() = %v, want errors on lines 3 and 4", errs)
+	}
+	if errs[0].File != "10-base.rules" || errs[0].Line != 3 || errs[0].Column == 0 {
+		t.Errorf("first error = %+v, want line 3 with a column", errs[0])
+	}
+	if errs[1].Line != 4 {
+		t.Errorf("second error = %+v, want line 4", errs[1])
+	}
+}
+
+func TestValidateSourceFilesTemplate(t *testing.T) {
+	setNodeFacts(t, NodeFacts{Hostname: "aks-nodepool1-0", Labels: map[string]string{"tier": "web"}})
+	pair := testPair(t)
+	writeFiles(t, pair.SourceDirectory, map[string]string{
+		// The rendered file has fewer lines than the template, so its line numbers are not the ones of the ConfigMap
+		"30-web.rules" + templateSuffix: "{{- if eq .Labels.tier \"web\" }}\n" +
+			"{{- /* Web tier */ -}}\n" +
+			"-w /var/www -p wa -k web\n" +
+			"-a always,exit -F arch=b64 -S execve -F bogus=1 -k web-exec\n" +
+			"-w /etc/{{ .Hostname }} -p q -k host\n" +
+			"{{- end }}\n",
+	})
+
+	files, err := mergeSources(pair)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files["30-web.rules"].Origin != filepath.Join(pair.SourceDirectory, "30-web.rules"+templateSuffix) {
+		t.Fatalf("origin of the rendered file = %q, want the template", files["30-web.rules"].Origin)
+	}
+
+	errs := validateSourceFiles(pair.TargetDirectory, files)["30-web.rules"]
+	if len(errs) != 2 {
+		t.Fatalf("validateSourceFiles() = %v, want two errors", errs)
+	}
+
+	// A line the template writes as it is names the line of the template
+	if errs[0].File != "30-web.rules.tmpl" || errs[0].Line != 4 || errs[0].Column == 0 {
+		t.Errorf("error in a plain line = %+v, want 30-web.rules.tmpl line 4 with a column", errs[0])
+	}
+	// A line with a template action is quoted as rendered
+	got := errs[1].Error()
+	if !strings.HasPrefix(got, "30-web.rules.tmpl: ") || !strings.Contains(got, `"-w /etc/aks-nodepool1-0 -p q -k host"`) {
+		t.Errorf("error in a rendered line = %q, want the template and the rendered line", got)
+	}
+}
+
+func TestSyncFromSourceValidationPolicies(t *testing.T) {
+	valid := map[string]string{
+		"10-base.rules": "-D\n-b 8192\n",
+		"20-exec.rules": "-a always,exit -F arch=b64 -S execve -k exec\n",
+	}
+	update := map[string]string{
+		"10-base.rules": "-D\n-b 16384\n",
+		"20-exec.rules": "-a always,exit -F arch=b64 -S execve -F bogus=1 -k exec\n",
+	}
+
+	for _, test := range []struct {
+		policy  string
+		wantErr bool
+		want    map[string]string
+	}{
+		// Nothing is written while a file is invalid
+		{validationAllOrNothing, true, valid},
+		// The valid file is written, and the invalid file is left as it is on the node
+		{validationSkipBadFiles, false, map[string]string{"10-base.rules": "-D\n-b 16384\n", "20-exec.rules": valid["20-exec.rules"]}},
+	} {
+		t.Run(test.policy, func(t *testing.T) {
+			pair := testPair(t)
+			pair.ValidationPolicy = test.policy
+			writeFiles(t, pair.SourceDirectory, valid)
+			if _, err := syncFromSource(pair); err != nil {
+				t.Fatal(err)
+			}
+
+			writeFiles(t, pair.SourceDirectory, update)
+			_, err := syncFromSource(pair)
+			if test.wantErr != (err != nil) {
+				t.Fatalf("syncFromSource() error = %v, want error %v", err, test.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), "invalid files 20-exec.rules") {
+				t.Errorf("syncFromSource() error = %v, want the invalid file named", err)
+			}
+
+			got := readFiles(t, pair.TargetDirectory)
+			delete(got, compiledFileName)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("target = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+// Name of the symlink kubelet swaps when it updates a mounted ConfigMap. It points at a timestamped directory, such as
+// ..2024_10_17_11_29_10.123456789, that holds the actual files. The file names in the mount point are symlinks through
+// ..data into that directory.
+const configMapDataLink = "..data"
+
+// sourceChanged receives a value when kubelet swaps the ..data symlink of a watched source directory, so the main loop
+// can sync right away instead of waiting out the poll interval.
+var sourceChanged = make(chan struct{}, 1)
+
+// sourceWatcher watches the source directories for ConfigMap updates. The poll loop keeps running as a safety net, so
+// a missed or dropped event only delays a sync until the next poll.
+type sourceWatcher struct {
+	watcher *fsnotify.Watcher
+	watched map[string]bool
+}
+
+// newSourceWatcher creates the inotify watcher and starts processing its events.
+func newSourceWatcher() (*sourceWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &sourceWatcher{
+		watcher: watcher,
+		watched: make(map[string]bool),
+	}
+	go s.run()
+
+	return s, nil
+}
+
+// update watches exactly the given source directories. It is called at the start of every sync cycle so directories
+// added or removed by a configuration reload are picked up.
+func (s *sourceWatcher) update(dirs []string) {
+	wanted := make(map[string]bool)
+	for _, dir := range dirs {
+		wanted[dir] = true
+		if s.watched[dir] {
+			continue
+		}
+		if err := s.watcher.Add(dir); err != nil {
+			log.Warnf("Failed to watch %s for ConfigMap updates. Falling back to polling for this directory. Error: %v", dir, err)
+			continue
+		}
+		s.watched[dir] = true
+		log.Debug("Watching for ConfigMap updates: ", dir)
+	}
+
+	for dir := range s.watched {
+		if wanted[dir] {
+			continue
+		}
+		if err := s.watcher.Remove(dir); err != nil {
+			log.Debugf("Failed to stop watching %s: %v", dir, err)
+		}
+		delete(s.watched, dir)
+	}
+}
+
+// run signals sourceChanged whenever kubelet moves a new ..data symlink into place. Every other event in the source
+// directory, such as the creation of the new timestamped directory or the removal of the old one, is part of the same
+// update and is ignored.
+func (s *sourceWatcher) run() {
+	for {
+		select {
+		case err, ok := <-s.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Error(err)
+		case event, ok := <-s.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&fsnotify.Create == 0 || filepath.Base(event.Name) != configMapDataLink {
+				continue
+			}
+
+			log.Infof("ConfigMap update detected in %s", filepath.Dir(event.Name))
+			select {
+			case sourceChanged <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// resolveSnapshot returns the timestamped directory the ..data symlink in dir currently points at. Reading from that
+// directory instead of through the symlinks in dir gives a consistent view of the files even if kubelet swaps in a new
+// version halfway through a sync. When dir is not a ConfigMap mount, dir itself is returned.
+func resolveSnapshot(dir string) string {
+	target, err := os.Readlink(filepath.Join(dir, configMapDataLink))
+	if err != nil {
+		return dir
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(dir, target)
+	}
+
+	return target
+}
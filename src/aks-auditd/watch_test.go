@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeSnapshot writes the files to a new timestamped directory in dir and swaps the ..data symlink to it the way
+// kubelet updates a mounted ConfigMap: a new ..data_tmp symlink is renamed over ..data.
+func writeSnapshot(t *testing.T, dir, timestamp string, files map[string]string) {
+	t.Helper()
+	snapshot := filepath.Join(dir, "..2024_10_17_"+timestamp)
+	if err := os.Mkdir(snapshot, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, snapshot, files)
+	if err := os.Symlink(filepath.Base(snapshot), filepath.Join(dir, "..data_tmp")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, configMapDataLink)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitForSourceChanged returns true if sourceChanged receives a value within timeout.
+func waitForSourceChanged(timeout time.Duration) bool {
+	select {
+	case <-sourceChanged:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func TestSourceWatcher(t *testing.T) {
+	dir := t.TempDir()
+	writeSnapshot(t, dir, "11_29_10.1", map[string]string{"10-base.rules": "-D\n"})
+	if err := os.Symlink(filepath.Join(configMapDataLink, "10-base.rules"), filepath.Join(dir, "10-base.rules")); err != nil {
+		t.Fatal(err)
+	}
+
+	watcher, err := newSourceWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { watcher.watcher.Close() })
+	watcher.update([]string{dir})
+	waitForSourceChanged(0) // Drain a value left by another test
+
+	// Other changes in the source directory do not start a sync
+	writeFiles(t, dir, map[string]string{"notes.txt": "not a ConfigMap update"})
+	if err := os.Mkdir(filepath.Join(dir, "..2024_10_17_11_30_00.2"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if waitForSourceChanged(200 * time.Millisecond) {
+		t.Error("a change other than the ..data swap started a sync")
+	}
+
+	// The ..data swap starts a sync, and the files are read from the new snapshot
+	writeSnapshot(t, dir, "11_31_00.3", map[string]string{"10-base.rules": "-D\n-b 8192\n"})
+	if !waitForSourceChanged(5 * time.Second) {
+		t.Fatal("the ..data swap did not start a sync")
+	}
+	if got := resolveSnapshot(dir); got != filepath.Join(dir, "..2024_10_17_11_31_00.3") {
+		t.Errorf("resolveSnapshot returned %s", got)
+	}
+
+	// A directory that is no longer watched does not start a sync
+	watcher.update(nil)
+	writeSnapshot(t, dir, "11_32_00.4", map[string]string{"10-base.rules": "-D\n"})
+	if waitForSourceChanged(200 * time.Millisecond) {
+		t.Error("a ..data swap in a directory no longer watched started a sync")
+	}
+
+	// A directory that is not a ConfigMap mount is read as it is
+	plain := t.TempDir()
+	if got := resolveSnapshot(plain); got != plain {
+		t.Errorf("resolveSnapshot of a plain directory returned %s", got)
+	}
+}